@@ -0,0 +1,705 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fzzy/radix/redis"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+type AlarmKind string
+
+const (
+	HiHiAlarm      AlarmKind = "HIHI"
+	HiAlarm        AlarmKind = "HI"
+	LoAlarm        AlarmKind = "LO"
+	LoLoAlarm      AlarmKind = "LOLO"
+	RateAlarm      AlarmKind = "ROC"
+	DeviationAlarm AlarmKind = "DEV"
+	DigitalAlarm   AlarmKind = "DIGITAL"
+)
+
+// AlarmState follows ISA-18.2: an alarm stays unacknowledged until an operator
+// acknowledges it, even if its condition returns to normal first.
+type AlarmState string
+
+const (
+	AlarmNormal        AlarmState = "NORMAL"
+	AlarmUnackActive   AlarmState = "UNACK_ACTIVE"
+	AlarmAckActive     AlarmState = "ACK_ACTIVE"
+	AlarmUnackReturned AlarmState = "UNACK_RETURNED"
+)
+
+// activeAlarms is the hash, shared by every tag, holding the alarms not in
+// the normal state.
+const activeAlarms = "alarms:active"
+
+// Limits configures the alarms of a tag. Nil limits are disabled. Rate is in
+// value units per second, and Digital raises an alarm when the tag, read as a
+// bool, equals it. Deadband is the distance a value must move back past a
+// limit to clear its alarm.
+type Limits struct {
+	HiHi      *int     `json:"hihi,omitempty"`
+	Hi        *int     `json:"hi,omitempty"`
+	Lo        *int     `json:"lo,omitempty"`
+	LoLo      *int     `json:"lolo,omitempty"`
+	Rate      *float64 `json:"rate,omitempty"`
+	Setpoint  *int     `json:"setpoint,omitempty"`
+	Deviation *int     `json:"deviation,omitempty"`
+	Digital   *bool    `json:"digital,omitempty"`
+	Deadband  int      `json:"deadband,omitempty"`
+	OnDelay   Duration `json:"on_delay,omitempty"`
+	OffDelay  Duration `json:"off_delay,omitempty"`
+	Suppress  string   `json:"suppress,omitempty"`
+}
+
+func (l *Limits) String() string {
+	b, _ := json.Marshal(l)
+	return fmt.Sprintf("Limits%s", b)
+}
+
+func (l *Limits) Validate() error {
+	order := []*int{l.LoLo, l.Lo, l.Hi, l.HiHi}
+	prev := math.MinInt64
+	for _, v := range order {
+		if v == nil {
+			continue
+		}
+		if *v < prev {
+			return fmt.Errorf("limits must be ordered as LOLO <= LO <= HI <= HIHI")
+		}
+		prev = *v
+	}
+	if (l.Setpoint == nil) != (l.Deviation == nil) {
+		return fmt.Errorf("deviation alarm needs both setpoint and deviation")
+	}
+	if l.Deadband < 0 || l.OnDelay < 0 || l.OffDelay < 0 {
+		return fmt.Errorf("deadband and delays can't be negative")
+	}
+	if l.Suppress != "" {
+		if _, _, err := parseExpr(l.Suppress); err != nil {
+			return fmt.Errorf("invalid suppress condition: %s", err)
+		}
+	}
+	return nil
+}
+
+// Alarm is the state of one alarm of a tag, as stored in redis. Active is the
+// alarm condition, State its lifecycle. Shelved holds the unix time until
+// which operators shelved the alarm.
+type Alarm struct {
+	Tag        string     `json:"tag"`
+	Kind       AlarmKind  `json:"kind"`
+	Active     bool       `json:"active"`
+	State      AlarmState `json:"state"`
+	Value      int        `json:"value"`
+	Limit      float64    `json:"limit"`
+	Since      int64      `json:"since"`
+	Shelved    int64      `json:"shelved,omitempty"`
+	Suppressed bool       `json:"suppressed,omitempty"`
+	AckedBy    string     `json:"acked_by,omitempty"`
+	AckComment string     `json:"ack_comment,omitempty"`
+}
+
+func (a *Alarm) String() string {
+	return fmt.Sprintf(
+		"Alarm{Tag: %s, Kind: %s, Active: %t, State: %s, Value: %d, Limit: %g, Since: %d}",
+		a.Tag,
+		a.Kind,
+		a.Active,
+		a.State,
+		a.Value,
+		a.Limit,
+		a.Since,
+	)
+}
+
+// IsShelved tells whether the alarm is shelved at the unix time now.
+func (a *Alarm) IsShelved(now int64) bool {
+	return a.Shelved > now
+}
+
+func (a *Alarm) id() string {
+	return fmt.Sprintf("%s|%s", a.Tag, a.Kind)
+}
+
+// alarm engine ----------------------------------------------------------------
+
+// rateHold is how long a tag in rate alarm may go without a new value before
+// its rate is evaluated again, as held steady since the last one.
+const rateHold = 5 * time.Second
+
+// AlarmEngine evaluates the alarms of the configured tags whenever their value
+// changes, storing each alarm in the tag:alarms hash and the active ones in
+// alarms:active. It writes from timers for delayed alarms, so it must have a
+// connection of its own. A rate alarm is also evaluated once its tag goes
+// RateHold without changing, so it returns when the tag stops updating.
+// The journal keeps the JournalLen newest events, or every event when
+// JournalLen is 0.
+type AlarmEngine struct {
+	conn       *Client
+	RateHold   time.Duration
+	JournalLen int
+	limits     map[string]*Limits
+	alarms     map[string]*alarmState
+	last       map[string]*sample
+	suppress   map[string]*condition
+	holds      map[string]*time.Timer
+	seq        int64
+	mu         sync.Mutex
+}
+
+type alarmState struct {
+	Alarm
+	timer   *time.Timer
+	unshelf *time.Timer
+}
+
+type condition struct {
+	expr expr
+	refs []string
+}
+
+type sample struct {
+	value int
+	at    time.Time
+}
+
+func (e *AlarmEngine) String() string {
+	return fmt.Sprintf("AlarmEngine{Tags#len: %d}", len(e.limits))
+}
+
+// Configure sets the limits of tag, replacing previous ones, and loads the
+// alarms stored for it so their state survives restarts.
+func (e *AlarmEngine) Configure(tag string, l *Limits) error {
+	if err := l.Validate(); err != nil {
+		return fmt.Errorf("invalid limits for %s: %s", tag, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r, err := e.conn.Hgetall(alarmsKey(tag))
+	if err != nil {
+		return err
+	}
+	stored, err := decodeAlarms(r.Elems)
+	if err != nil {
+		return err
+	}
+	for _, a := range stored {
+		if _, ok := e.alarms[a.id()]; !ok {
+			e.alarms[a.id()] = &alarmState{Alarm: *a}
+		}
+	}
+
+	delete(e.suppress, tag)
+	if l.Suppress != "" {
+		x, refs, _ := parseExpr(l.Suppress)
+		e.suppress[tag] = &condition{x, refs}
+	}
+
+	e.limits[tag] = l
+	return nil
+}
+
+// Unconfigure drops the limits of tag and clears its alarms, so none stays
+// active once the tag has no limits or is gone.
+func (e *AlarmEngine) Unconfigure(tag string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r, err := e.conn.Hgetall(alarmsKey(tag))
+	if err != nil {
+		return err
+	}
+	stored, err := decodeAlarms(r.Elems)
+	if err != nil {
+		return err
+	}
+	ids := []string{}
+	for _, a := range stored {
+		ids = append(ids, a.id())
+	}
+	for id, s := range e.alarms {
+		if s.Tag != tag {
+			continue
+		}
+		if s.timer != nil {
+			s.timer.Stop()
+		}
+		if s.unshelf != nil {
+			s.unshelf.Stop()
+		}
+		delete(e.alarms, id)
+		if !containsString(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	if t := e.holds[tag]; t != nil {
+		t.Stop()
+		delete(e.holds, tag)
+	}
+	delete(e.limits, tag)
+	delete(e.last, tag)
+	delete(e.suppress, tag)
+
+	e.conn.Multi()
+	e.conn.Add("del", alarmsKey(tag))
+	for _, id := range ids {
+		e.conn.Add("hdel", activeAlarms, id)
+	}
+	_, err = e.conn.Exec()
+	return err
+}
+
+// Limits returns the limits configured for tag, or nil.
+func (e *AlarmEngine) Limits(tag string) *Limits {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.limits[tag]
+}
+
+// Ack acknowledges the alarm kind of tag on behalf of user.
+func (e *AlarmEngine) Ack(tag string, kind AlarmKind, user string, comment string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, err := e.alarm(tag, kind)
+	if err != nil {
+		return err
+	}
+
+	switch s.State {
+	case AlarmUnackActive:
+		s.State = AlarmAckActive
+	case AlarmUnackReturned:
+		s.State = AlarmNormal
+	default:
+		return fmt.Errorf("alarm %s is not unacknowledged", s.id())
+	}
+	s.AckedBy = user
+	s.AckComment = comment
+	return e.store(&s.Alarm, "ACK", user, comment)
+}
+
+// Shelve hides the alarm kind of tag from operators for d. Shelved alarms
+// are still evaluated, and are shown again with their current state once
+// unshelved.
+func (e *AlarmEngine) Shelve(tag string, kind AlarmKind, d time.Duration, user string, comment string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, err := e.alarm(tag, kind)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return fmt.Errorf("shelving needs a positive duration")
+	}
+
+	if s.unshelf != nil {
+		s.unshelf.Stop()
+	}
+	s.Shelved = time.Now().Add(d).Unix()
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if s.unshelf != t {
+			return
+		}
+		s.unshelf = nil
+		s.Shelved = 0
+		if err := e.store(&s.Alarm, "UNSHELVE", "", "shelving expired"); err != nil {
+			log.Printf("could not unshelve %s: %s\n", &s.Alarm, err)
+		}
+	})
+	s.unshelf = t
+	return e.store(&s.Alarm, "SHELVE", user, comment)
+}
+
+// Unshelve shows the alarm kind of tag before its shelving expires.
+func (e *AlarmEngine) Unshelve(tag string, kind AlarmKind, user string, comment string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	s, err := e.alarm(tag, kind)
+	if err != nil {
+		return err
+	}
+	if s.unshelf != nil {
+		s.unshelf.Stop()
+		s.unshelf = nil
+	}
+	s.Shelved = 0
+	return e.store(&s.Alarm, "UNSHELVE", user, comment)
+}
+
+func (e *AlarmEngine) alarm(tag string, kind AlarmKind) (*alarmState, error) {
+	s, ok := e.alarms[fmt.Sprintf("%s|%s", tag, kind)]
+	if !ok {
+		return nil, fmt.Errorf("Alarm %s|%s not found.", tag, kind)
+	}
+	return s, nil
+}
+
+// Run evaluates the changes of feed until it is closed.
+func (e *AlarmEngine) Run(feed *Feed) {
+	done := feed.Done()
+	for {
+		select {
+		case c := <-feed.C:
+			if c.Prop != "value" {
+				continue
+			}
+			v, ok := numberOf(fmt.Sprint(c.Value))
+			if !ok {
+				continue
+			}
+			if err := e.Evaluate(c.Tag, int(v)); err != nil {
+				log.Printf("could not evaluate alarms of %s: %s\n", c.Tag, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Evaluate checks the alarms of tag against value.
+func (e *AlarmEngine) Evaluate(tag string, value int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.evaluate(tag, value)
+}
+
+func (e *AlarmEngine) evaluate(tag string, value int) error {
+	l, ok := e.limits[tag]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	rate := 0.0
+	if s, ok := e.last[tag]; ok {
+		if dt := now.Sub(s.at).Seconds(); dt > 0 {
+			rate = math.Abs(float64(value-s.value)) / dt
+		}
+	}
+	e.last[tag] = &sample{value, now}
+
+	suppressed, err := e.suppressed(tag)
+	if err != nil {
+		log.Printf("could not evaluate suppression of %s: %s\n", tag, err)
+	}
+
+	check := func(kind AlarmKind, limit float64, cond func(active bool) bool) error {
+		if suppressed {
+			cond = func(active bool) bool { return false }
+		}
+		return e.check(tag, kind, l, value, limit, suppressed, cond)
+	}
+	db := float64(l.Deadband)
+
+	if l.HiHi != nil {
+		hh := float64(*l.HiHi)
+		err := check(HiHiAlarm, hh, func(active bool) bool { return exceeds(float64(value), hh, db, active) })
+		if err != nil {
+			return err
+		}
+	}
+	if l.Hi != nil {
+		h := float64(*l.Hi)
+		err := check(HiAlarm, h, func(active bool) bool { return exceeds(float64(value), h, db, active) })
+		if err != nil {
+			return err
+		}
+	}
+	if l.Lo != nil {
+		lo := float64(*l.Lo)
+		err := check(LoAlarm, lo, func(active bool) bool { return exceeds(-float64(value), -lo, db, active) })
+		if err != nil {
+			return err
+		}
+	}
+	if l.LoLo != nil {
+		ll := float64(*l.LoLo)
+		err := check(LoLoAlarm, ll, func(active bool) bool { return exceeds(-float64(value), -ll, db, active) })
+		if err != nil {
+			return err
+		}
+	}
+	if l.Rate != nil {
+		r := *l.Rate
+		err := check(RateAlarm, r, func(active bool) bool { return rate > r })
+		if err != nil {
+			return err
+		}
+		e.hold(tag)
+	}
+	if l.Setpoint != nil && l.Deviation != nil {
+		d := math.Abs(float64(value - *l.Setpoint))
+		dev := float64(*l.Deviation)
+		err := check(DeviationAlarm, dev, func(active bool) bool { return exceeds(d, dev, db, active) })
+		if err != nil {
+			return err
+		}
+	}
+	if l.Digital != nil {
+		on := *l.Digital
+		err := check(DigitalAlarm, boolNumber(on), func(active bool) bool { return (value != 0) == on })
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hold evaluates the alarms of tag again once it goes RateHold without a new
+// value, while its rate alarm is active or about to be.
+func (e *AlarmEngine) hold(tag string) {
+	if t := e.holds[tag]; t != nil {
+		t.Stop()
+		delete(e.holds, tag)
+	}
+	s := e.alarms[fmt.Sprintf("%s|%s", tag, RateAlarm)]
+	if s == nil || !s.Active && s.timer == nil {
+		return
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(e.RateHold, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.holds[tag] != t {
+			return
+		}
+		delete(e.holds, tag)
+		last, ok := e.last[tag]
+		if !ok {
+			return
+		}
+		if err := e.evaluate(tag, last.value); err != nil {
+			log.Printf("could not evaluate alarms of %s: %s\n", tag, err)
+		}
+	})
+	e.holds[tag] = t
+}
+
+// Alarms returns the alarms stored for tag.
+func (e *AlarmEngine) Alarms(tag string) ([]*Alarm, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	r, err := e.conn.Hgetall(alarmsKey(tag))
+	if err != nil {
+		return nil, err
+	}
+	return decodeAlarms(r.Elems)
+}
+
+// check moves the alarm kind of tag to the state returned by cond, once the
+// on or off delay has elapsed with cond unchanged.
+func (e *AlarmEngine) check(tag string, kind AlarmKind, l *Limits, value int, limit float64, suppressed bool, cond func(active bool) bool) error {
+	id := fmt.Sprintf("%s|%s", tag, kind)
+	s, ok := e.alarms[id]
+	if !ok {
+		s = &alarmState{Alarm: Alarm{Tag: tag, Kind: kind, State: AlarmNormal}}
+		e.alarms[id] = s
+	}
+	s.Value = value
+	s.Limit = limit
+
+	if suppressed != s.Suppressed {
+		s.Suppressed = suppressed
+		event := "UNSUPPRESS"
+		if suppressed {
+			event = "SUPPRESS"
+		}
+		if err := e.store(&s.Alarm, event, "", ""); err != nil {
+			return err
+		}
+	}
+
+	want := cond(s.Active)
+	if want == s.Active {
+		if s.timer != nil {
+			s.timer.Stop()
+			s.timer = nil
+		}
+		return nil
+	}
+
+	delay := time.Duration(l.OnDelay)
+	if !want {
+		delay = time.Duration(l.OffDelay)
+	}
+	if delay == 0 {
+		return e.transition(s, want)
+	}
+	if s.timer == nil {
+		var t *time.Timer
+		t = time.AfterFunc(delay, func() {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			if s.timer != t {
+				return
+			}
+			s.timer = nil
+			if err := e.transition(s, want); err != nil {
+				log.Printf("could not update %s: %s\n", &s.Alarm, err)
+			}
+		})
+		s.timer = t
+	}
+	return nil
+}
+
+func (e *AlarmEngine) transition(s *alarmState, active bool) error {
+	s.Active = active
+	s.Since = ts()
+
+	event := "RETURN"
+	if active {
+		event = "ACTIVE"
+	}
+
+	switch {
+	case active && (s.State == AlarmNormal || s.State == AlarmUnackReturned || s.State == ""):
+		s.State = AlarmUnackActive
+		s.AckedBy, s.AckComment = "", ""
+	case !active && s.State == AlarmUnackActive:
+		s.State = AlarmUnackReturned
+	case !active && s.State == AlarmAckActive:
+		s.State = AlarmNormal
+	}
+	return e.store(&s.Alarm, event, "", "")
+}
+
+// suppressed evaluates the suppress condition of tag, reading its inputs.
+func (e *AlarmEngine) suppressed(tag string) (bool, error) {
+	c, ok := e.suppress[tag]
+	if !ok {
+		return false, nil
+	}
+
+	env := map[string]float64{}
+	if len(c.refs) > 0 {
+		keys := make([]interface{}, len(c.refs))
+		for i, ref := range c.refs {
+			n, p := splitRef(ref)
+			keys[i] = fmt.Sprintf("%s:%s", n, p)
+		}
+		r, err := e.conn.Mget(keys...)
+		if err != nil {
+			return false, err
+		}
+		for i, ref := range c.refs {
+			if f, err := r.Elems[i].Float64(); err == nil {
+				env[ref] = f
+			}
+		}
+	}
+
+	v, err := c.expr.eval(env)
+	if err != nil {
+		return false, err
+	}
+	return v != 0, nil
+}
+
+// store writes the alarm and records event in the journal.
+func (e *AlarmEngine) store(a *Alarm, event string, user string, comment string) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	e.seq++
+	ev := &AlarmEvent{
+		Time:    time.Now().UnixNano() / int64(time.Millisecond),
+		Seq:     e.seq,
+		Tag:     a.Tag,
+		Kind:    a.Kind,
+		Event:   event,
+		State:   a.State,
+		Value:   a.Value,
+		User:    user,
+		Comment: comment,
+	}
+	j, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	e.conn.Multi()
+	e.conn.Add("hset", alarmsKey(a.Tag), string(a.Kind), string(b))
+	if a.State != AlarmNormal {
+		e.conn.Add("hset", activeAlarms, a.id(), string(b))
+	} else {
+		e.conn.Add("hdel", activeAlarms, a.id())
+	}
+	e.conn.Add("zadd", alarmJournal, ev.Time, string(j))
+	if e.JournalLen > 0 {
+		e.conn.Add("zremrangebyrank", alarmJournal, 0, -e.JournalLen-1)
+	}
+	_, err = e.conn.Exec()
+	return err
+}
+
+func NewAlarmEngine(conn *Client) *AlarmEngine {
+	return &AlarmEngine{
+		conn:       conn,
+		RateHold:   rateHold,
+		JournalLen: journalLen,
+		limits:     map[string]*Limits{},
+		alarms:     map[string]*alarmState{},
+		last:       map[string]*sample{},
+		suppress:   map[string]*condition{},
+		holds:      map[string]*time.Timer{},
+	}
+}
+
+// ActiveAlarms returns the alarms of every tag which are not in the normal
+// state, as any client sees them.
+func ActiveAlarms(conn *Client) ([]*Alarm, error) {
+	r, err := conn.Hgetall(activeAlarms)
+	if err != nil {
+		return nil, err
+	}
+	return decodeAlarms(r.Elems)
+}
+
+// utility ---------------------------------------------------------------------
+
+func alarmsKey(tag string) string {
+	return fmt.Sprintf("%s:alarms", tag)
+}
+
+// exceeds tells whether v is over limit, requiring it to fall deadband below
+// the limit before an active alarm clears.
+func exceeds(v float64, limit float64, deadband float64, active bool) bool {
+	if active {
+		return v > limit-deadband
+	}
+	return v > limit
+}
+
+// decodeAlarms reads the values of a field, value list as replied by HGETALL.
+func decodeAlarms(elems []*redis.Reply) ([]*Alarm, error) {
+	alarms := []*Alarm{}
+	for i := 1; i < len(elems); i += 2 {
+		s, err := elems[i].Str()
+		if err != nil {
+			return nil, err
+		}
+		a := &Alarm{}
+		if err := json.Unmarshal([]byte(s), a); err != nil {
+			return nil, err
+		}
+		alarms = append(alarms, a)
+	}
+	return alarms, nil
+}
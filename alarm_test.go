@@ -0,0 +1,368 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func intp(n int) *int { return &n }
+
+// alarmEngine returns an engine over an in-memory redis, closed with the test.
+func alarmEngine(t *testing.T) (*AlarmEngine, *testRedis) {
+	r := newTestRedis(t)
+	t.Cleanup(r.Close)
+	return NewAlarmEngine(r.dial(t)), r
+}
+
+// alarmStates returns the state of every alarm stored for tag, by kind.
+func alarmStates(t *testing.T, e *AlarmEngine, tag string) map[AlarmKind]AlarmState {
+	t.Helper()
+	alarms, err := e.Alarms(tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[AlarmKind]AlarmState{}
+	for _, a := range alarms {
+		states[a.Kind] = a.State
+	}
+	return states
+}
+
+// alarmStateOf returns the state of the alarm kind of tag, normal when it was
+// never raised.
+func alarmStateOf(t *testing.T, e *AlarmEngine, tag string, kind AlarmKind) AlarmState {
+	t.Helper()
+	if s, ok := alarmStates(t, e, tag)[kind]; ok {
+		return s
+	}
+	return AlarmNormal
+}
+
+func TestAlarmLimits(t *testing.T) {
+	digital := true
+	for _, c := range []struct {
+		name   string
+		limits *Limits
+		steps  []int
+		want   []map[AlarmKind]AlarmState
+	}{
+		{
+			"hi with deadband",
+			&Limits{Hi: intp(10), Deadband: 2},
+			[]int{9, 11, 9, 7, 12},
+			[]map[AlarmKind]AlarmState{
+				{HiAlarm: AlarmNormal},
+				{HiAlarm: AlarmUnackActive},
+				{HiAlarm: AlarmUnackActive},
+				{HiAlarm: AlarmUnackReturned},
+				{HiAlarm: AlarmUnackActive},
+			},
+		},
+		{
+			"hihi over hi",
+			&Limits{Hi: intp(10), HiHi: intp(20)},
+			[]int{15, 25, 15},
+			[]map[AlarmKind]AlarmState{
+				{HiAlarm: AlarmUnackActive, HiHiAlarm: AlarmNormal},
+				{HiAlarm: AlarmUnackActive, HiHiAlarm: AlarmUnackActive},
+				{HiAlarm: AlarmUnackActive, HiHiAlarm: AlarmUnackReturned},
+			},
+		},
+		{
+			"lo and lolo",
+			&Limits{Lo: intp(5), LoLo: intp(2), Deadband: 1},
+			[]int{4, 1, 2, 3, 6},
+			[]map[AlarmKind]AlarmState{
+				{LoAlarm: AlarmUnackActive, LoLoAlarm: AlarmNormal},
+				{LoAlarm: AlarmUnackActive, LoLoAlarm: AlarmUnackActive},
+				{LoAlarm: AlarmUnackActive, LoLoAlarm: AlarmUnackActive},
+				{LoAlarm: AlarmUnackActive, LoLoAlarm: AlarmUnackReturned},
+				{LoAlarm: AlarmUnackReturned, LoLoAlarm: AlarmUnackReturned},
+			},
+		},
+		{
+			"deviation",
+			&Limits{Setpoint: intp(50), Deviation: intp(5)},
+			[]int{54, 56, 44, 50},
+			[]map[AlarmKind]AlarmState{
+				{DeviationAlarm: AlarmNormal},
+				{DeviationAlarm: AlarmUnackActive},
+				{DeviationAlarm: AlarmUnackActive},
+				{DeviationAlarm: AlarmUnackReturned},
+			},
+		},
+		{
+			"digital",
+			&Limits{Digital: &digital},
+			[]int{0, 1, 0},
+			[]map[AlarmKind]AlarmState{
+				{DigitalAlarm: AlarmNormal},
+				{DigitalAlarm: AlarmUnackActive},
+				{DigitalAlarm: AlarmUnackReturned},
+			},
+		},
+	} {
+		e, _ := alarmEngine(t)
+		if err := e.Configure("@a:t", c.limits); err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range c.steps {
+			if err := e.Evaluate("@a:t", v); err != nil {
+				t.Fatal(err)
+			}
+			for kind, want := range c.want[i] {
+				if s := alarmStateOf(t, e, "@a:t", kind); s != want {
+					t.Errorf("%s: after %d, %s is %s, want %s", c.name, v, kind, s, want)
+				}
+			}
+		}
+	}
+}
+
+func TestAlarmUnconfiguredTag(t *testing.T) {
+	e, _ := alarmEngine(t)
+	if err := e.Evaluate("@a:t", 100); err != nil {
+		t.Fatal(err)
+	}
+	if states := alarmStates(t, e, "@a:t"); len(states) != 0 {
+		t.Errorf("Expected no alarms without limits, got %v", states)
+	}
+}
+
+func TestAlarmDelays(t *testing.T) {
+	e, _ := alarmEngine(t)
+	delay := 50 * time.Millisecond
+	if err := e.Configure("@a:t", &Limits{Hi: intp(10), OnDelay: Duration(delay), OffDelay: Duration(delay)}); err != nil {
+		t.Fatal(err)
+	}
+	hi := func() AlarmState { return alarmStateOf(t, e, "@a:t", HiAlarm) }
+
+	// a value returning before the on delay raises nothing.
+	e.Evaluate("@a:t", 11)
+	e.Evaluate("@a:t", 9)
+	time.Sleep(2 * delay)
+	if s := hi(); s != AlarmNormal {
+		t.Fatalf("Expected HI to stay normal, got %s", s)
+	}
+
+	e.Evaluate("@a:t", 11)
+	if s := hi(); s != AlarmNormal {
+		t.Fatalf("Expected HI to wait for the on delay, got %s", s)
+	}
+	waitFor(t, "HI to be active", func() bool { return hi() == AlarmUnackActive })
+
+	e.Evaluate("@a:t", 9)
+	if s := hi(); s != AlarmUnackActive {
+		t.Fatalf("Expected HI to wait for the off delay, got %s", s)
+	}
+	waitFor(t, "HI to return", func() bool { return hi() == AlarmUnackReturned })
+}
+
+func TestAlarmRateReturnsWhenSteady(t *testing.T) {
+	e, _ := alarmEngine(t)
+	e.RateHold = 50 * time.Millisecond
+	rate := 10.0
+	if err := e.Configure("@a:t", &Limits{Rate: &rate}); err != nil {
+		t.Fatal(err)
+	}
+	roc := func() AlarmState { return alarmStateOf(t, e, "@a:t", RateAlarm) }
+
+	e.Evaluate("@a:t", 0)
+	time.Sleep(10 * time.Millisecond)
+	e.Evaluate("@a:t", 100)
+	if s := roc(); s != AlarmUnackActive {
+		t.Fatalf("Expected ROC to be active, got %s", s)
+	}
+
+	// the tag stops updating, so its rate falls to zero.
+	waitFor(t, "ROC to return", func() bool { return roc() == AlarmUnackReturned })
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.holds) != 0 {
+		t.Errorf("Expected no hold timer left, got %d", len(e.holds))
+	}
+}
+
+func TestAlarmUnconfigureStopsHold(t *testing.T) {
+	e, _ := alarmEngine(t)
+	e.RateHold = time.Hour
+	rate := 10.0
+	if err := e.Configure("@a:t", &Limits{Rate: &rate}); err != nil {
+		t.Fatal(err)
+	}
+	e.Evaluate("@a:t", 0)
+	time.Sleep(10 * time.Millisecond)
+	e.Evaluate("@a:t", 100)
+
+	e.mu.Lock()
+	held := len(e.holds)
+	e.mu.Unlock()
+	if held != 1 {
+		t.Fatalf("Expected a hold timer while ROC is active, got %d", held)
+	}
+
+	if err := e.Unconfigure("@a:t"); err != nil {
+		t.Fatal(err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.holds) != 0 || len(e.alarms) != 0 {
+		t.Errorf("Expected no hold timer nor alarm left, got %d and %d", len(e.holds), len(e.alarms))
+	}
+}
+
+func TestAlarmActiveList(t *testing.T) {
+	e, _ := alarmEngine(t)
+	e.Configure("@a:t", &Limits{Hi: intp(10)})
+	e.Configure("@a:u", &Limits{Hi: intp(10)})
+	e.Evaluate("@a:t", 11)
+	e.Evaluate("@a:u", 5)
+
+	active, err := ActiveAlarms(e.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 1 || active[0].Tag != "@a:t" || active[0].Kind != HiAlarm {
+		t.Errorf("Expected only the HI alarm of @a:t active, got %v", active)
+	}
+
+	if err := e.Unconfigure("@a:t"); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := ActiveAlarms(e.conn); len(active) != 0 {
+		t.Errorf("Expected no active alarms once unconfigured, got %v", active)
+	}
+}
+
+func TestLimitsValidate(t *testing.T) {
+	for _, l := range []*Limits{
+		{Hi: intp(10), HiHi: intp(5)},
+		{LoLo: intp(5), Lo: intp(2)},
+		{Lo: intp(20), Hi: intp(10)},
+		{Setpoint: intp(5)},
+		{Deadband: -1},
+		{OnDelay: Duration(-time.Second)},
+		{Suppress: "1 +"},
+	} {
+		if err := l.Validate(); err == nil {
+			t.Errorf("Expected %s to be invalid", l)
+		}
+	}
+	if err := (&Limits{LoLo: intp(0), Lo: intp(1), Hi: intp(1), HiHi: intp(2)}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAlarmAck(t *testing.T) {
+	e, _ := alarmEngine(t)
+	e.Configure("@a:t", &Limits{Hi: intp(10)})
+	hi := func() AlarmState { return alarmStateOf(t, e, "@a:t", HiAlarm) }
+
+	if err := e.Ack("@a:t", HiAlarm, "op", ""); err == nil {
+		t.Error("Ack of an alarm never raised didn't fail")
+	}
+
+	// acknowledged while active, it's normal once it returns.
+	e.Evaluate("@a:t", 11)
+	if err := e.Ack("@a:t", HiAlarm, "op", "seen"); err != nil {
+		t.Fatal(err)
+	}
+	if s := hi(); s != AlarmAckActive {
+		t.Fatalf("Expected %s, got %s", AlarmAckActive, s)
+	}
+	if err := e.Ack("@a:t", HiAlarm, "op", ""); err == nil {
+		t.Error("Ack of an acknowledged alarm didn't fail")
+	}
+	e.Evaluate("@a:t", 5)
+	if s := hi(); s != AlarmNormal {
+		t.Fatalf("Expected %s, got %s", AlarmNormal, s)
+	}
+
+	// returned before being acknowledged, it's normal once acknowledged.
+	e.Evaluate("@a:t", 11)
+	e.Evaluate("@a:t", 5)
+	if s := hi(); s != AlarmUnackReturned {
+		t.Fatalf("Expected %s, got %s", AlarmUnackReturned, s)
+	}
+	if err := e.Ack("@a:t", HiAlarm, "op", ""); err != nil {
+		t.Fatal(err)
+	}
+	if s := hi(); s != AlarmNormal {
+		t.Fatalf("Expected %s, got %s", AlarmNormal, s)
+	}
+
+	alarms, _ := e.Alarms("@a:t")
+	if len(alarms) != 1 || alarms[0].AckedBy != "op" {
+		t.Errorf("Expected the alarm acknowledged by op, got %v", alarms)
+	}
+}
+
+func TestAlarmShelve(t *testing.T) {
+	e, _ := alarmEngine(t)
+	e.Configure("@a:t", &Limits{Hi: intp(10)})
+	shelved := func() bool {
+		alarms, _ := e.Alarms("@a:t")
+		return len(alarms) == 1 && alarms[0].IsShelved(time.Now().Unix())
+	}
+
+	if err := e.Shelve("@a:t", HiAlarm, time.Minute, "op", ""); err == nil {
+		t.Error("Shelve of an alarm never raised didn't fail")
+	}
+	e.Evaluate("@a:t", 11)
+	if err := e.Shelve("@a:t", HiAlarm, 0, "op", ""); err == nil {
+		t.Error("Shelve without a duration didn't fail")
+	}
+
+	if err := e.Shelve("@a:t", HiAlarm, time.Minute, "op", "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	if !shelved() {
+		t.Fatal("Expected the alarm to be shelved")
+	}
+	// shelved alarms are still evaluated.
+	e.Evaluate("@a:t", 5)
+	if s := alarmStateOf(t, e, "@a:t", HiAlarm); s != AlarmUnackReturned {
+		t.Errorf("Expected a shelved alarm to return, got %s", s)
+	}
+	if err := e.Unshelve("@a:t", HiAlarm, "op", ""); err != nil {
+		t.Fatal(err)
+	}
+	if shelved() {
+		t.Fatal("Expected the alarm to be unshelved")
+	}
+
+	// shelving expires on its own, once.
+	if err := e.Shelve("@a:t", HiAlarm, 50*time.Millisecond, "op", ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the shelving to expire", func() bool { return !shelved() })
+}
+
+func TestAlarmSuppress(t *testing.T) {
+	e, r := alarmEngine(t)
+	e.Configure("@a:t", &Limits{Hi: intp(10), Suppress: "@a:mode == 1"})
+	hi := func() AlarmState { return alarmStateOf(t, e, "@a:t", HiAlarm) }
+	suppressed := func() bool {
+		alarms, _ := e.Alarms("@a:t")
+		return len(alarms) == 1 && alarms[0].Suppressed
+	}
+
+	r.dial(t).Set("@a:mode:value", 1)
+	e.Evaluate("@a:t", 11)
+	if s := hi(); s != AlarmNormal || !suppressed() {
+		t.Fatalf("Expected a suppressed, normal alarm, got %s", s)
+	}
+
+	r.dial(t).Set("@a:mode:value", 0)
+	e.Evaluate("@a:t", 11)
+	if s := hi(); s != AlarmUnackActive || suppressed() {
+		t.Fatalf("Expected an active alarm once unsuppressed, got %s", s)
+	}
+
+	// suppression clears an active alarm.
+	r.dial(t).Set("@a:mode:value", 1)
+	e.Evaluate("@a:t", 11)
+	if s := hi(); s != AlarmUnackReturned {
+		t.Errorf("Expected a suppressed alarm to return, got %s", s)
+	}
+}
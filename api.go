@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// API exposes a TagManager over HTTP, with JSON bodies:
+//
+//	GET  /tags/{path}   browse a manager or read the full state of a tag
+//	PUT  /tags/{path}   write tag properties, as {"Value": 50}
+//	POST /batch/read    read many tags, as {"tags": ["area2/tank-1", ...]}
+//	POST /batch/write   write many tags, as {"writes": [{"tag", "prop", "value"}]}
+//	GET  /stream        server-sent events of tag changes, once Stream is called
+//	GET  /metrics       tag values and internal metrics for prometheus
+//
+// Paths are relative to the manager.
+type API struct {
+	manager *TagManager
+	mux     *http.ServeMux
+	hub     *hub
+	mu      sync.Mutex
+}
+
+type apiError struct {
+	Code  int    `json:"code"`
+	Error string `json:"error"`
+}
+
+type apiWrite struct {
+	Tag   string      `json:"tag"`
+	Prop  string      `json:"prop"`
+	Value interface{} `json:"value"`
+}
+
+type apiResult struct {
+	Tag   string                 `json:"tag"`
+	State map[string]interface{} `json:"state,omitempty"`
+	Error *apiError              `json:"error,omitempty"`
+}
+
+func (a *API) String() string {
+	return fmt.Sprintf("API{Manager: %s}", a.manager.Name)
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *API) handleTags(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/tags")
+	tag, err := a.manager.Lookup(path)
+	if err != nil {
+		writeError(w, &apiError{http.StatusNotFound, err.Error()})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, a.state(tag))
+	case "PUT":
+		props := map[string]interface{}{}
+		if err := decodeBody(r, &props); err != nil {
+			writeError(w, err)
+			return
+		}
+		written, werr := a.write(tag, props)
+		if werr != nil {
+			writeError(w, werr)
+			return
+		}
+		writeJSON(w, http.StatusOK, a.written(tag, written))
+	default:
+		writeError(w, &apiError{http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method)})
+	}
+}
+
+func (a *API) handleBatchRead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, &apiError{http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method)})
+		return
+	}
+	req := struct {
+		Tags []string `json:"tags"`
+	}{}
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	results := make([]*apiResult, len(req.Tags))
+	for i, p := range req.Tags {
+		results[i] = &apiResult{Tag: p}
+		tag, err := a.manager.Lookup(p)
+		if err != nil {
+			results[i].Error = &apiError{http.StatusNotFound, err.Error()}
+			continue
+		}
+		results[i].State = a.state(tag)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (a *API) handleBatchWrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, &apiError{http.StatusMethodNotAllowed, fmt.Sprintf("method %s not allowed", r.Method)})
+		return
+	}
+	req := struct {
+		Writes []apiWrite `json:"writes"`
+	}{}
+	if err := decodeBody(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	results := make([]*apiResult, len(req.Writes))
+	for i, e := range req.Writes {
+		results[i] = &apiResult{Tag: e.Tag}
+		tag, err := a.manager.Lookup(e.Tag)
+		if err != nil {
+			results[i].Error = &apiError{http.StatusNotFound, err.Error()}
+			continue
+		}
+		written, werr := a.write(tag, map[string]interface{}{e.Prop: e.Value})
+		if werr != nil {
+			results[i].Error = werr
+			continue
+		}
+		results[i].State = a.written(tag, written)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// state returns every property of tag, and the children of managers.
+func (a *API) state(tag Tagger) map[string]interface{} {
+	state := map[string]interface{}{"Path": keyPath(nameOf(tag))}
+	if s, err := schemaOf(tag); err == nil {
+		for _, p := range s.Props {
+			state[p.Name] = p.Get(tag)
+		}
+	}
+	if m, ok := tag.(*TagManager); ok {
+		tags := m.tags()
+		children := make([]string, len(tags))
+		for i, c := range tags {
+			children[i] = m.localName(c)
+		}
+		state["Children"] = children
+	}
+	return state
+}
+
+// written returns the state of tag with the values just written, since tags
+// mirroring redis only see them once their change comes back.
+func (a *API) written(tag Tagger, values map[string]interface{}) map[string]interface{} {
+	state := a.state(tag)
+	for name, v := range values {
+		state[name] = v
+	}
+	return state
+}
+
+// write checks every prop and value against the tag schema before writing
+// them through the tagger, so errors are reported with the proper status and
+// nothing is written when one of them is wrong. It returns the values
+// written, coerced and by property name.
+func (a *API) write(tag Tagger, props map[string]interface{}) (map[string]interface{}, *apiError) {
+	s, err := schemaOf(tag)
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, err.Error()}
+	}
+	values := map[string]interface{}{}
+	for prop, value := range props {
+		p, err := s.Lookup(prop)
+		if err != nil {
+			return nil, &apiError{http.StatusBadRequest, err.Error()}
+		}
+		if !p.Editable {
+			return nil, &apiError{http.StatusForbidden, fmt.Sprintf("%s property is not user editable.", prop)}
+		}
+		v, err := p.Coerce(value)
+		if err != nil {
+			return nil, &apiError{http.StatusUnprocessableEntity, err.Error()}
+		}
+		values[p.Name] = v
+	}
+	if err := setProps(tag, props); err != nil {
+		return nil, &apiError{http.StatusInternalServerError, err.Error()}
+	}
+	return values, nil
+}
+
+func NewAPI(manager *TagManager) *API {
+	a := &API{manager: manager, mux: http.NewServeMux()}
+	a.mux.HandleFunc("/tags", a.handleTags)
+	a.mux.HandleFunc("/tags/", a.handleTags)
+	a.mux.HandleFunc("/batch/read", a.handleBatchRead)
+	a.mux.HandleFunc("/batch/write", a.handleBatchWrite)
+	a.mux.HandleFunc("/stream", a.handleStream)
+	a.mux.HandleFunc("/metrics", a.handleMetrics)
+	return a
+}
+
+// utility ---------------------------------------------------------------------
+
+func decodeBody(r *http.Request, v interface{}) *apiError {
+	d := json.NewDecoder(r.Body)
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return &apiError{http.StatusBadRequest, fmt.Sprintf("invalid body: %s", err)}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("could not write response: %s\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, err *apiError) {
+	writeJSON(w, err.Code, err)
+}
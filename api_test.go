@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memTag is a tagger kept in memory, to test services without redis.
+type memTag struct {
+	Name    string
+	Value   int
+	Level   float64
+	Quality int
+	mu      sync.Mutex
+}
+
+func (t *memTag) String() string {
+	return fmt.Sprintf("memTag{Name: %s, Value: %d, Level: %g}", t.Name, t.Value, t.Level)
+}
+
+func (t *memTag) Init() error {
+	return nil
+}
+
+func (t *memTag) Get(tag string, prop string) (interface{}, error) {
+	return getProp(t, prop)
+}
+
+func (t *memTag) Set(tag string, prop string, args ...interface{}) error {
+	p, err := memSchema.Prop(prop)
+	if err != nil {
+		return err
+	}
+	v, err := p.Coerce(args[0])
+	if err != nil {
+		return err
+	}
+	p.Set(t, v)
+	return nil
+}
+
+func memProp(name string, typ PropType, get func(t *memTag) interface{}, set func(t *memTag, v interface{})) *Property {
+	return &Property{
+		Name:     name,
+		Type:     typ,
+		Key:      name,
+		Editable: true,
+		Get: func(t Tagger) interface{} {
+			m := t.(*memTag)
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return get(m)
+		},
+		Set: func(t Tagger, v interface{}) {
+			m := t.(*memTag)
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			set(m, v)
+		},
+	}
+}
+
+var memSchema = mustRegisterSchema(
+	&memTag{},
+	memProp("Name", StringProp,
+		func(t *memTag) interface{} { return t.Name },
+		func(t *memTag, v interface{}) { t.Name = v.(string) }),
+	memProp("Value", IntProp,
+		func(t *memTag) interface{} { return t.Value },
+		func(t *memTag, v interface{}) { t.Value = v.(int) }),
+	memProp("Level", FloatProp,
+		func(t *memTag) interface{} { return t.Level },
+		func(t *memTag, v interface{}) { t.Level = v.(float64) }),
+	memProp("Quality", IntProp,
+		func(t *memTag) interface{} { return t.Quality },
+		func(t *memTag, v interface{}) { t.Quality = v.(int) }),
+)
+
+// memManager returns a manager holding tags, named a, b and so on.
+func memManager(name string, tags ...*memTag) *TagManager {
+	tm := NewTagManager(name)
+	for i, t := range tags {
+		t.Name = string('a' + rune(i))
+		tm.Append(t)
+	}
+	return tm
+}
+
+func put(t *testing.T, api *API, path string, body string) int {
+	r := httptest.NewRequest("PUT", path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAPIPut(t *testing.T) {
+	a := &memTag{Value: 1, Level: 1}
+	api := NewAPI(memManager("@api", a))
+
+	for _, c := range []struct {
+		body string
+		want int
+	}{
+		{`{"Value": 3.7}`, http.StatusUnprocessableEntity},
+		{`{"Value": "x"}`, http.StatusUnprocessableEntity},
+		{`{"Level": 2, "Value": 3.7}`, http.StatusUnprocessableEntity},
+		{`{"Level": 2, "Colour": 1}`, http.StatusBadRequest},
+		{`{"Value": 4, "Level": 2.5}`, http.StatusOK},
+	} {
+		if code := put(t, api, "/tags/a", c.body); code != c.want {
+			t.Errorf("PUT %s replied %d, want %d", c.body, code, c.want)
+		}
+		if c.want != http.StatusOK && (a.Value != 1 || a.Level != 1) {
+			t.Fatalf("PUT %s wrote Value %d and Level %g", c.body, a.Value, a.Level)
+		}
+	}
+	if a.Value != 4 || a.Level != 2.5 {
+		t.Errorf("Value is %d and Level %g, want 4 and 2.5", a.Value, a.Level)
+	}
+}
+
+func TestAPIPutNotFound(t *testing.T) {
+	api := NewAPI(memManager("@api", &memTag{}))
+	if code := put(t, api, "/tags/z", `{"Value": 1}`); code != http.StatusNotFound {
+		t.Errorf("PUT replied %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestAPIPutReplies(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	tm := NewTagManager("@api")
+	tm.Mode = PublishChanges
+	defer tm.Close()
+	tm.Append(NewTag(conn, "a", "", 1, QualityGood))
+	api := NewAPI(tm)
+
+	for _, c := range []struct {
+		path  string
+		body  string
+		value string
+	}{
+		{"/tags/a", `{"value": 7, "Description": "pump"}`, "7"},
+		{"/batch/write", `{"writes": [{"tag": "a", "prop": "Value", "value": 8}, {"tag": "a", "prop": "description", "value": "pump"}]}`, "8"},
+	} {
+		method := "PUT"
+		if c.path == "/batch/write" {
+			method = "POST"
+		}
+		req := httptest.NewRequest(method, c.path, strings.NewReader(c.body))
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s replied %d", method, c.path, w.Code)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, `"Value":`+c.value) || !strings.Contains(body, `"Description":"pump"`) {
+			t.Errorf("Expected the written values in the reply to %s, got %s", c.path, body)
+		}
+		if v := r.get("@api:a:value"); v != c.value {
+			t.Errorf("Expected value %s stored, got %s", c.value, v)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// CalcTag is a tag whose value is computed from an expression over other tags
+// and evaluated again whenever one of them changes. Its quality is the worst
+// quality of its inputs.
+//
+// Value shadows the integer value of the embedded tag, as expressions are
+// computed in floating point.
+type CalcTag struct {
+	Tag
+	Value      float64
+	Expression string
+	expr       expr
+	refs       []string
+	feed       *Feed
+	feedConn   *Client
+}
+
+func (c *CalcTag) String() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return fmt.Sprintf(
+		"CalcTag{Name: %s, Expression: %s, Value: %g, Quality: %d, Timestamp: %d}",
+		c.Name,
+		c.Expression,
+		c.Value,
+		c.Quality,
+		c.Timestamp,
+	)
+}
+
+func (c *CalcTag) Init() error {
+	if err := registerCalc(c); err != nil {
+		return err
+	}
+
+	if err := c.store(); err != nil {
+		unregisterCalc(c)
+		return err
+	}
+
+	env, quality, err := c.read()
+	if err != nil {
+		unregisterCalc(c)
+		return err
+	}
+	c.evaluate(env, quality)
+
+	// the feed subscribes on a connection of its own, as it can't share it
+	// with the dispatchers of the tags or other feeds.
+	conn, err := c.conn.dial()
+	if err != nil {
+		unregisterCalc(c)
+		return err
+	}
+	c.feedConn = conn
+	c.feed = NewFeed(c.conn, NewPSClient(conn), c.mode, c.targets()...)
+	go c.watch(c.feed, env, quality)
+	return nil
+}
+
+func (c *CalcTag) Close() error {
+	unregisterCalc(c)
+	if c.feed != nil {
+		c.feed.Close()
+		c.feedConn.Close()
+		c.feed = nil
+	}
+	return nil
+}
+
+func (c *CalcTag) load(name string) error {
+	return c.Tag.loadSchema(c, calcSchema, name)
+}
+
+func (c *CalcTag) Set(tag string, prop string, args ...interface{}) error {
+	if calculated(prop) {
+		return fmt.Errorf("%s property is calculated from %s.", prop, c.Expression)
+	}
+	return c.Tag.Set(tag, prop, args...)
+}
+
+func (c *CalcTag) SetProps(tag string, props map[string]interface{}) error {
+	for prop := range props {
+		if calculated(prop) {
+			return fmt.Errorf("%s property is calculated from %s.", prop, c.Expression)
+		}
+	}
+	return c.Tag.SetProps(tag, props)
+}
+
+// Inputs returns the names of the tags read by the expression.
+func (c *CalcTag) Inputs() []string {
+	inputs := []string{}
+	for _, r := range c.refs {
+		if n, _ := splitRef(r); !containsString(inputs, n) {
+			inputs = append(inputs, n)
+		}
+	}
+	return inputs
+}
+
+func (c *CalcTag) store() error {
+	name := nameOf(c)
+	c.conn.Multi()
+	for _, p := range calcSchema.Props {
+		c.conn.Add("set", c.key(name, p.Key), p.Encode(p.Get(c)))
+	}
+	_, err := c.conn.Exec()
+	return err
+}
+
+// read returns the current value of every key in the expression, and the
+// quality of every input.
+func (c *CalcTag) read() (map[string]float64, map[string]int, error) {
+	env := map[string]float64{}
+	quality := map[string]int{}
+
+	keys := []interface{}{}
+	for _, r := range c.refs {
+		keys = append(keys, c.refKey(r))
+	}
+	inputs := c.Inputs()
+	for _, n := range inputs {
+		keys = append(keys, c.key(n, "quality"))
+	}
+	if len(keys) == 0 {
+		return env, quality, nil
+	}
+
+	r, err := c.conn.Mget(keys...)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, ref := range c.refs {
+		if f, err := r.Elems[i].Float64(); err == nil {
+			env[ref] = f
+		}
+	}
+	for i, n := range inputs {
+		q, err := r.Elems[len(c.refs)+i].Int()
+		if err != nil {
+			q = QualityBad
+		}
+		quality[n] = q
+	}
+	return env, quality, nil
+}
+
+func (c *CalcTag) watch(feed *Feed, env map[string]float64, quality map[string]int) {
+	done := feed.Done()
+	for {
+		var ch *Change
+		select {
+		case ch = <-feed.C:
+		case <-done:
+			return
+		}
+
+		changed := false
+		for _, r := range c.refs {
+			if n, p := splitRef(r); n == ch.Tag && p == ch.Prop {
+				if f, ok := numberOf(fmt.Sprint(ch.Value)); ok {
+					env[r] = f
+					changed = true
+				}
+			}
+		}
+		if _, ok := quality[ch.Tag]; ok && ch.Prop == "quality" {
+			if q, ok := numberOf(fmt.Sprint(ch.Value)); ok {
+				quality[ch.Tag] = int(q)
+				changed = true
+			}
+		}
+
+		if changed {
+			c.evaluate(env, quality)
+		}
+	}
+}
+
+// evaluate computes the expression and writes the result, unless both value
+// and quality are unchanged.
+func (c *CalcTag) evaluate(env map[string]float64, quality map[string]int) {
+	q := QualityGood
+	for _, v := range quality {
+		if v < q {
+			q = v
+		}
+	}
+
+	name := nameOf(c)
+	p := calcValueProp()
+	last := p.Get(c)
+	value := last
+	v, err := c.expr.eval(env)
+	if err == nil {
+		// the result takes the type the value property declares.
+		value, err = p.Coerce(v)
+	}
+	if err != nil {
+		log.Printf("could not evaluate %s: %s\n", c, err)
+		q = QualityBad
+		value = last
+	}
+
+	if value != last {
+		p.Set(c, value)
+		if err := c.update(name, p, value); err != nil {
+			log.Printf("could not write %s: %s\n", c, err)
+		}
+	}
+	if q != qualityProp().Get(&c.Tag).(int) {
+		qualityProp().Set(&c.Tag, q)
+		if err := c.update(name, qualityProp(), q); err != nil {
+			log.Printf("could not write %s: %s\n", c, err)
+		}
+	}
+}
+
+func (c *CalcTag) refKey(ref string) string {
+	n, p := splitRef(ref)
+	return c.key(n, p)
+}
+
+// targets returns what the feed of the tag must watch, according to its
+// ChangeMode, assuming inputs use the same mode.
+func (c *CalcTag) targets() []string {
+	targets := []string{}
+	add := func(t string) {
+		if !containsString(targets, t) {
+			targets = append(targets, t)
+		}
+	}
+
+	for _, n := range c.Inputs() {
+		m := n
+		if i := strings.LastIndex(n, ":"); i >= 0 {
+			m = n[:i]
+		}
+		switch c.mode {
+		case PublishChanges:
+			add(changeChannel(m))
+		case StreamChanges:
+			add(changeLog(m))
+		default:
+			add(c.key(n, "*"))
+		}
+	}
+	return targets
+}
+
+func NewCalcTag(conn *Client, name string, description string, expression string) (*CalcTag, error) {
+	e, refs, err := parseExpr(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &CalcTag{
+		Tag: Tag{
+			conn:        conn,
+			Name:        name,
+			Description: description,
+			Quality:     QualityBad,
+			Timestamp:   ts(),
+			Meta:        map[string]string{},
+		},
+		Expression: expression,
+		expr:       e,
+		refs:       refs,
+	}
+	return c, nil
+}
+
+var calcSchema = mustRegisterSchema(&CalcTag{}, calcProps()...)
+
+// calcProps exposes the properties of the embedded tag, read only, with a
+// floating point value, plus the expression.
+func calcProps() []*Property {
+	props := []*Property{}
+	for _, p := range tagSchema.Props {
+		p := p
+		if p.Name == "Value" {
+			props = append(props, &Property{
+				Name: p.Name,
+				Type: FloatProp,
+				Key:  p.Key,
+				Get:  calcGetter(func(c *CalcTag) interface{} { return c.Value }),
+				Set:  calcSetter(func(c *CalcTag, v interface{}) { c.Value = v.(float64) }),
+			})
+			continue
+		}
+		props = append(props, &Property{
+			Name:     p.Name,
+			Type:     p.Type,
+			Key:      p.Key,
+			Editable: p.Editable && p.Name != "Value" && p.Name != "Quality",
+			Validate: p.Validate,
+			Get:      func(t Tagger) interface{} { return p.Get(&t.(*CalcTag).Tag) },
+			Set:      func(t Tagger, v interface{}) { p.Set(&t.(*CalcTag).Tag, v) },
+		})
+	}
+	return append(props, &Property{
+		Name: "Expression",
+		Type: StringProp,
+		Key:  "expression",
+		Get:  func(t Tagger) interface{} { return t.(*CalcTag).Expression },
+		Set:  func(t Tagger, v interface{}) { t.(*CalcTag).Expression = v.(string) },
+	})
+}
+
+// calculated tells whether prop, named or given by its key, is computed from
+// the expression of calculated tags.
+func calculated(prop string) bool {
+	p, err := calcSchema.Lookup(prop)
+	return err == nil && (p.Name == "Value" || p.Name == "Quality" || p.Name == "Expression")
+}
+
+// calcGetter reads a property of a calculated tag under the lock of its tag.
+func calcGetter(get func(c *CalcTag) interface{}) func(t Tagger) interface{} {
+	return func(t Tagger) interface{} {
+		c := t.(*CalcTag)
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return get(c)
+	}
+}
+
+// calcSetter writes a property of a calculated tag under the lock of its tag.
+func calcSetter(set func(c *CalcTag, v interface{})) func(t Tagger, v interface{}) {
+	return func(t Tagger, v interface{}) {
+		c := t.(*CalcTag)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		set(c, v)
+	}
+}
+
+func calcValueProp() *Property {
+	p, _ := calcSchema.Prop("Value")
+	return p
+}
+
+func qualityProp() *Property {
+	p, _ := tagSchema.Prop("Quality")
+	return p
+}
+
+// splitRef splits a key in an expression into the tag name and the property
+// key, which defaults to value.
+func splitRef(ref string) (string, string) {
+	if i := strings.LastIndex(ref, ":"); i >= 0 {
+		if _, err := tagSchema.ByKey(ref[i+1:]); err == nil {
+			return ref[:i], ref[i+1:]
+		}
+	}
+	return ref, "value"
+}
+
+// dependency graph ------------------------------------------------------------
+
+var (
+	calcsMu sync.Mutex
+	calcs   = map[string]*CalcTag{}
+)
+
+// registerCalc records c, failing when its inputs depend on it, directly or
+// through other calculated tags.
+func registerCalc(c *CalcTag) error {
+	calcsMu.Lock()
+	defer calcsMu.Unlock()
+
+	if o, ok := calcs[c.Name]; ok && o != c {
+		return fmt.Errorf("calculated tag %s already defined", c.Name)
+	}
+
+	seen := map[string]bool{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if name == c.Name {
+			return fmt.Errorf("cyclic dependency %s", strings.Join(append(path, name), " -> "))
+		}
+		if seen[name] {
+			return nil
+		}
+		seen[name] = true
+		if d, ok := calcs[name]; ok {
+			for _, n := range d.Inputs() {
+				if err := visit(n, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	for _, n := range c.Inputs() {
+		if err := visit(n, []string{c.Name}); err != nil {
+			return err
+		}
+	}
+
+	calcs[c.Name] = c
+	return nil
+}
+
+func unregisterCalc(c *CalcTag) {
+	calcsMu.Lock()
+	defer calcsMu.Unlock()
+	if calcs[c.Name] == c {
+		delete(calcs, c.Name)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCalcEvaluate(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+
+	for k, v := range map[string]string{
+		"@k:a:value": "3", "@k:a:quality": "100",
+		"@k:b:value": "2", "@k:b:quality": "100",
+	} {
+		if _, err := conn.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := NewCalcTag(conn, "@k:c", "", "@k:a / @k:b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r.subscribed(t, 1)
+
+	if v := r.get("@k:c:value"); v != "1.5" {
+		t.Errorf("Expected value 1.5, got %s", v)
+	}
+	if q := r.get("@k:c:quality"); q != "100" {
+		t.Errorf("Expected quality 100, got %s", q)
+	}
+	if v, _ := getProp(c, "Value"); v != 1.5 {
+		t.Errorf("Expected the tag to hold 1.5, got %v", v)
+	}
+
+	// the worst quality of the inputs is kept.
+	if _, err := conn.Set("@k:b:quality", "50"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "quality 50", func() bool { return r.get("@k:c:quality") == "50" })
+
+	if _, err := conn.Set("@k:a:value", "5"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "value 2.5", func() bool { return r.get("@k:c:value") == "2.5" })
+
+	// a failed evaluation keeps the last value, with a bad quality.
+	if _, err := conn.Set("@k:b:value", "0"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "quality 0", func() bool { return r.get("@k:c:quality") == "0" })
+	if v := r.get("@k:c:value"); v != "2.5" {
+		t.Errorf("Expected value 2.5 kept, got %s", v)
+	}
+
+	if _, err := conn.Set("@k:b:value", "4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Set("@k:b:quality", "100"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "value 1.25", func() bool {
+		return r.get("@k:c:value") == "1.25" && r.get("@k:c:quality") == "100"
+	})
+
+	l, err := loadTagger(conn, "@k:c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := getProp(l, "Value"); v != 1.25 {
+		t.Errorf("Expected 1.25 loaded, got %v", v)
+	}
+}
+
+func TestCalcCycles(t *testing.T) {
+	calc := func(name, expression string) *CalcTag {
+		c, err := NewCalcTag(nil, name, "", expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	x := calc("@x", "@y + 1")
+	y := calc("@y", "@z:value * 2")
+	if err := registerCalc(x); err != nil {
+		t.Fatal(err)
+	}
+	defer unregisterCalc(x)
+	if err := registerCalc(y); err != nil {
+		t.Fatal(err)
+	}
+	defer unregisterCalc(y)
+
+	z := calc("@z", "@x - 1")
+	err := registerCalc(z)
+	if err == nil {
+		unregisterCalc(z)
+		t.Fatal("Expected a cyclic dependency")
+	}
+	if !strings.Contains(err.Error(), "@z -> @x -> @y -> @z") {
+		t.Errorf("Expected the cycle in %q", err)
+	}
+
+	if err := registerCalc(calc("@y", "1")); err == nil {
+		t.Error("Expected @y to be defined twice")
+	}
+	if err := registerCalc(calc("@s", "@s + 1")); err == nil {
+		t.Error("Expected a tag reading itself to be rejected")
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fzzy/radix/extra/pubsub"
+	"github.com/fzzy/radix/redis"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChangeMode selects how tag writes are propagated to the tags mirroring them.
+type ChangeMode int
+
+const (
+	// KeyspaceChanges relies on redis keyspace notifications, which must be
+	// enabled in the server (notify-keyspace-events).
+	KeyspaceChanges ChangeMode = iota
+	// PublishChanges publishes a Change message on the manager channel for
+	// every write, carrying the new value inline.
+	PublishChanges
+	// StreamChanges appends every write to the manager change log stream, so
+	// changes are kept while nobody is listening.
+	StreamChanges
+)
+
+func (m ChangeMode) String() string {
+	switch m {
+	case KeyspaceChanges:
+		return "keyspace"
+	case PublishChanges:
+		return "publish"
+	case StreamChanges:
+		return "stream"
+	}
+	return fmt.Sprintf("ChangeMode(%d)", int(m))
+}
+
+func ParseChangeMode(s string) (ChangeMode, error) {
+	for _, m := range []ChangeMode{KeyspaceChanges, PublishChanges, StreamChanges} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid change mode %s", s)
+}
+
+// Change is the message published for each tag write.
+type Change struct {
+	Tag       string      `json:"tag"`
+	Prop      string      `json:"prop"`
+	Value     interface{} `json:"value"`
+	Timestamp int64       `json:"timestamp"`
+}
+
+func (c *Change) String() string {
+	return fmt.Sprintf(
+		"Change{Tag: %s, Prop: %s, Value: %v, Timestamp: %d}",
+		c.Tag,
+		c.Prop,
+		c.Value,
+		c.Timestamp,
+	)
+}
+
+func encodeChange(c *Change) (string, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func decodeChange(msg string) (*Change, error) {
+	c := &Change{}
+	d := json.NewDecoder(strings.NewReader(msg))
+	d.UseNumber()
+	if err := d.Decode(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// changeValue returns the value of c with the type of the property in the
+// schema of its tag under manager, as values read from keyspace notifications
+// are strings. Changes of tags the manager does not hold keep their value.
+// Without a manager, as when reading the change logs of other processes,
+// values are typed as those of plain tags.
+func changeValue(manager *TagManager, c *Change) interface{} {
+	s := tagSchema
+	if manager != nil {
+		tag, err := manager.getTag(c.Tag)
+		if err != nil {
+			return c.Value
+		}
+		if s, err = schemaOf(tag); err != nil {
+			return c.Value
+		}
+	}
+	p, err := s.ByKey(c.Prop)
+	if err != nil {
+		return c.Value
+	}
+	v, err := p.Coerce(c.Value)
+	if err != nil {
+		return c.Value
+	}
+	return v
+}
+
+func changeChannel(manager string) string {
+	return fmt.Sprintf("%s:changes", manager)
+}
+
+func changeLog(manager string) string {
+	return fmt.Sprintf("%s:changelog", manager)
+}
+
+// changeTarget returns the channel or stream used by mode in manager.
+func changeTarget(mode ChangeMode, manager string) string {
+	switch mode {
+	case PublishChanges:
+		return changeChannel(manager)
+	case StreamChanges:
+		return changeLog(manager)
+	}
+	return ""
+}
+
+// managerModes is the hash of the change mode of every manager built from a
+// config, so the tools writing to or watching its tags follow it.
+const managerModes = "managers:mode"
+
+func storeMode(conn *Client, tm *TagManager) error {
+	_, err := conn.Hset(managerModes, tm.Name, tm.Mode.String())
+	return err
+}
+
+// storedMode returns the change mode stored for the manager called name, or
+// for the closest of its parents, and false when none is stored.
+func storedMode(conn *Client, name string) (ChangeMode, bool, error) {
+	for {
+		r, err := conn.Hget(managerModes, name)
+		if err != nil {
+			return 0, false, err
+		}
+		if r.Type != redis.NilReply {
+			s, _ := r.Str()
+			mode, err := ParseChangeMode(s)
+			return mode, err == nil, err
+		}
+		i := strings.LastIndex(name, ":")
+		if i < 0 {
+			return 0, false, nil
+		}
+		name = name[:i]
+	}
+}
+
+// changeNotifier is implemented by taggers which propagate their writes, so a
+// TagManager can tell them how to do it before they are initialized.
+type changeNotifier interface {
+	notifyOn(mode ChangeMode, channel string)
+}
+
+// feed ------------------------------------------------------------------------
+
+// Feed streams the changes of a set of tags on C, whatever the ChangeMode used
+// to propagate them. It needs its own psconn, which is subscribed until the
+// feed is closed.
+type Feed struct {
+	conn    *Client
+	psconn  *PSClient
+	Mode    ChangeMode
+	Targets []string
+	C       chan *Change
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (f *Feed) String() string {
+	return fmt.Sprintf("Feed{Mode: %s, Targets: %v}", f.Mode, f.Targets)
+}
+
+func (f *Feed) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+	})
+	return nil
+}
+
+// Done is closed when the feed is.
+func (f *Feed) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *Feed) send(c *Change, done chan struct{}) bool {
+	select {
+	case f.C <- c:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (f *Feed) watchKeyspace(done chan struct{}) {
+	patterns := make([]interface{}, len(f.Targets))
+	for i, t := range f.Targets {
+		patterns[i] = f.conn.keyspace(t)
+	}
+	f.psconn.PSubscribe(patterns...)
+	defer f.psconn.PUnsubscribe(patterns...)
+
+	for !stopped(done) {
+		sub := f.psconn.Receive()
+		if sub.Err != nil {
+			if !sub.Timeout() && !stopped(done) {
+				log.Printf("Error receiving changes for %s: %s\n", f, sub.Err)
+				time.Sleep(autoWait)
+			}
+			continue
+		}
+		if sub.Type != pubsub.MessageReply {
+			continue
+		}
+
+		key := strings.SplitN(sub.Channel, ":", 2)[1]
+		i := strings.LastIndex(key, ":")
+		if i < 0 {
+			continue
+		}
+		if _, err := tagSchema.ByKey(key[i+1:]); err != nil {
+			continue
+		}
+		keyspaceEvents.Inc("")
+
+		r, err := f.conn.Get(key)
+		if err != nil {
+			log.Printf("Couldn't get value for key %s: %s\n", key, err)
+			continue
+		}
+		v, _ := r.Str()
+
+		c := &Change{Tag: key[:i], Prop: key[i+1:], Value: v, Timestamp: ts()}
+		if !f.send(c, done) {
+			return
+		}
+	}
+}
+
+func (f *Feed) watchChanges(done chan struct{}) {
+	patterns := make([]interface{}, len(f.Targets))
+	for i, t := range f.Targets {
+		patterns[i] = t
+	}
+	f.psconn.PSubscribe(patterns...)
+	defer f.psconn.PUnsubscribe(patterns...)
+
+	for !stopped(done) {
+		sub := f.psconn.Receive()
+		if sub.Err != nil {
+			if !sub.Timeout() && !stopped(done) {
+				log.Printf("Error receiving changes for %s: %s\n", f, sub.Err)
+				time.Sleep(autoWait)
+			}
+			continue
+		}
+		if sub.Type != pubsub.MessageReply {
+			continue
+		}
+
+		c, err := decodeChange(sub.Message)
+		if err != nil {
+			log.Printf("Couldn't decode change %s: %s\n", sub.Message, err)
+			continue
+		}
+		if !f.send(c, done) {
+			return
+		}
+	}
+}
+
+func (f *Feed) watchStream(done chan struct{}) {
+	last := make([]string, len(f.Targets))
+	for i := range last {
+		last[i] = "$"
+	}
+
+	for !stopped(done) {
+		args := []interface{}{"block", int64(streamBlock / time.Millisecond), "streams"}
+		for _, t := range f.Targets {
+			args = append(args, t)
+		}
+		for _, l := range last {
+			args = append(args, l)
+		}
+
+		r, err := f.psconn.Client.Xread(args...)
+		if err != nil {
+			if !stopped(done) {
+				log.Printf("Error receiving changes for %s: %s\n", f, err)
+				time.Sleep(autoWait)
+			}
+			continue
+		}
+
+		for _, s := range r.Elems {
+			if len(s.Elems) != 2 {
+				continue
+			}
+			name, _ := s.Elems[0].Str()
+			entries, err := parseStreamEntries(s.Elems[1])
+			if err != nil {
+				log.Printf("Couldn't read changes from %s: %s\n", name, err)
+				continue
+			}
+			for _, e := range entries {
+				for i, t := range f.Targets {
+					if t == name {
+						last[i] = e.ID
+					}
+				}
+				if !f.send(e.Change, done) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// NewFeed starts streaming changes from targets: key patterns for
+// KeyspaceChanges, channel patterns for PublishChanges and stream keys for
+// StreamChanges.
+func NewFeed(conn *Client, psconn *PSClient, mode ChangeMode, targets ...string) *Feed {
+	f := &Feed{
+		conn:    conn,
+		psconn:  psconn,
+		Mode:    mode,
+		Targets: targets,
+		C:       make(chan *Change),
+		done:    make(chan struct{}),
+	}
+
+	switch mode {
+	case PublishChanges:
+		go f.watchChanges(f.done)
+	case StreamChanges:
+		go f.watchStream(f.done)
+	default:
+		go f.watchKeyspace(f.done)
+	}
+
+	return f
+}
+
+// Feed streams the changes of every tag under the manager, which must use the
+// same ChangeMode as its descendants.
+func (t *TagManager) Feed(conn *Client, psconn *PSClient) *Feed {
+	return NewFeed(conn, psconn, t.Mode, t.changeTargets()...)
+}
+
+func (t *TagManager) changeTargets() []string {
+	switch t.Mode {
+	case PublishChanges:
+		return []string{changeChannel(t.Name), changeChannel(t.Name + ":*")}
+	case StreamChanges:
+		targets := []string{changeLog(t.Name)}
+		t.Walk(func(p string, tag Tagger) error {
+			if m, ok := tag.(*TagManager); ok {
+				targets = append(targets, changeLog(m.Name))
+			}
+			return nil
+		})
+		return targets
+	}
+	return []string{t.Name + ":*"}
+}
+
+// dispatcher ------------------------------------------------------------------
+
+// dispatcher mirrors the changes of the tags of a manager into them. It reads
+// them on a single feed, over a connection of its own, and routes each change
+// to its tag by name, so tags never compete for the messages of a shared
+// subscription.
+type dispatcher struct {
+	key  string
+	mode ChangeMode
+	feed *Feed
+	conn io.Closer
+	tags map[string]*Tag
+	mu   sync.Mutex
+}
+
+var (
+	dispatchers   = map[string]*dispatcher{}
+	dispatchersMu sync.Mutex
+)
+
+func (d *dispatcher) String() string {
+	return fmt.Sprintf("dispatcher{Mode: %s, Targets: %v}", d.mode, d.feed.Targets)
+}
+
+func (d *dispatcher) run() {
+	done := d.feed.Done()
+	for {
+		var c *Change
+		select {
+		case c = <-d.feed.C:
+		case <-done:
+			return
+		}
+
+		d.mu.Lock()
+		t := d.tags[c.Tag]
+		d.mu.Unlock()
+		if t == nil {
+			continue
+		}
+
+		var err error
+		if d.mode == KeyspaceChanges {
+			err = t.apply(c.Tag, c.Prop, fmt.Sprint(c.Value))
+		} else {
+			err = t.applyChange(c)
+		}
+		if err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
+}
+
+func (d *dispatcher) close() {
+	d.feed.Close()
+	d.conn.Close()
+}
+
+// subscribe starts mirroring t, through the dispatcher of the other tags of
+// its manager, which is started for the first one.
+func subscribe(t *Tag) (*dispatcher, error) {
+	target := t.channel
+	if t.mode == KeyspaceChanges {
+		target = t.key(managerName(t.Name), "*")
+	}
+	key := fmt.Sprintf("%p %s %s", t.conn, t.mode, target)
+
+	dispatchersMu.Lock()
+	defer dispatchersMu.Unlock()
+	d := dispatchers[key]
+	if d == nil {
+		conn, err := t.conn.dial()
+		if err != nil {
+			return nil, err
+		}
+		d = &dispatcher{
+			key:  key,
+			mode: t.mode,
+			feed: NewFeed(t.conn, NewPSClient(conn), t.mode, target),
+			conn: conn,
+			tags: map[string]*Tag{},
+		}
+		dispatchers[key] = d
+		go d.run()
+	}
+
+	d.mu.Lock()
+	d.tags[t.Name] = t
+	d.mu.Unlock()
+	return d, nil
+}
+
+// unsubscribe stops mirroring t, stopping its dispatcher after the last tag.
+func (d *dispatcher) unsubscribe(t *Tag) {
+	dispatchersMu.Lock()
+	defer dispatchersMu.Unlock()
+
+	d.mu.Lock()
+	if d.tags[t.Name] == t {
+		delete(d.tags, t.Name)
+	}
+	empty := len(d.tags) == 0
+	d.mu.Unlock()
+
+	if empty && dispatchers[d.key] == d {
+		delete(dispatchers, d.key)
+		d.close()
+	}
+}
+
+// managerName returns the name of the manager of the tag called name.
+func managerName(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// publishManager builds a manager in PublishChanges holding the tags a and b,
+// over conn.
+func publishManager(conn *Client) *TagManager {
+	tm := NewTagManager("@p")
+	tm.Mode = PublishChanges
+	tm.Append(NewTag(conn, "a", "", 0, 0))
+	tm.Append(NewTag(conn, "b", "", 0, 0))
+	return tm
+}
+
+func TestPublishChangesPropagate(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	writer := publishManager(r.dial(t))
+	mirror := publishManager(r.dial(t))
+	r.subscribed(t, 2)
+
+	if err := writer.Tags[0].Set("@p:a", "Value", 42); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the value in the mirror", func() bool {
+		v, _ := mirror.Get("@p:a", "Value")
+		return v == 42
+	})
+	if v, _ := mirror.Get("@p:b", "Value"); v != 0 {
+		t.Errorf("Expected b to keep 0, got %v", v)
+	}
+	if ts, _ := mirror.Get("@p:a", "Timestamp"); ts.(int64) == 0 {
+		t.Error("timestamp not propagated")
+	}
+}
+
+func TestPublishFeedCarriesValues(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	tm := publishManager(conn)
+
+	feed := NewFeed(conn, NewPSClient(r.dial(t)), PublishChanges, changeChannel(tm.Name))
+	defer feed.Close()
+	r.subscribed(t, 2)
+
+	b := tm.Tags[1]
+	if err := b.Set("@p:b", "Value", 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set("@p:b", "Quality", 50); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"quality": "50", "value": "7"}
+	for len(expected) > 0 {
+		select {
+		case c := <-feed.C:
+			if c.Tag != "@p:b" || expected[c.Prop] != fmt.Sprint(c.Value) {
+				t.Fatalf("Unexpected change %s", c)
+			}
+			delete(expected, c.Prop)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Changes %v not received", expected)
+		}
+	}
+}
+
+func TestChangeTargets(t *testing.T) {
+	tm := NewTagManager("@p")
+	for _, tc := range []struct {
+		mode     ChangeMode
+		expected []string
+	}{
+		{KeyspaceChanges, []string{"@p:*"}},
+		{PublishChanges, []string{"@p:changes", "@p:*:changes"}},
+		{StreamChanges, []string{"@p:changelog"}},
+	} {
+		tm.Mode = tc.mode
+		targets := tm.changeTargets()
+		if len(targets) != len(tc.expected) {
+			t.Errorf("%s: expected targets %v, got %v", tc.mode, tc.expected, targets)
+			continue
+		}
+		for i := range targets {
+			if targets[i] != tc.expected[i] {
+				t.Errorf("%s: expected targets %v, got %v", tc.mode, tc.expected, targets)
+			}
+		}
+	}
+}
+
+func TestChangeValue(t *testing.T) {
+	tm := memManager("@c", &memTag{})
+	for _, e := range []struct {
+		c    *Change
+		want interface{}
+	}{
+		{&Change{Tag: "@c:a", Prop: "Value", Value: "2"}, 2},
+		{&Change{Tag: "@c:a", Prop: "Level", Value: "2"}, 2.0},
+		{&Change{Tag: "@c:a", Prop: "Colour", Value: "2"}, "2"},
+		{&Change{Tag: "@c:z", Prop: "Value", Value: "2"}, "2"},
+	} {
+		if v := changeValue(tm, e.c); v != e.want {
+			t.Errorf("Expected %s to hold %#v, got %#v", e.c, e.want, v)
+		}
+	}
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"github.com/fzzy/radix/redis"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Client is safe for concurrent use: commands are serialized on the
+// connection, and a transaction holds the client from Multi to Exec or
+// Discard, so goroutines queue their transactions one after the other.
 type Client struct {
-	Client *redis.Client
-	pipe   []*pipe
+	Client   *redis.Client
+	DB       int
+	addr     string
+	password string
+	pipe     []*pipe
+	mu       sync.Mutex
+	tx       sync.Mutex
 }
 
 func NewClient(cs string) (*Client, error) {
@@ -17,15 +28,50 @@ func NewClient(cs string) (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{client, []*pipe{}}, nil
+	return &Client{Client: client, addr: cs, pipe: []*pipe{}}, nil
+}
+
+// Dial connects to the redis server at cs, authenticating with password and
+// selecting db when given.
+func Dial(cs string, password string, db int) (*Client, error) {
+	c, err := NewClient(cs)
+	if err != nil {
+		return nil, err
+	}
+	if password != "" {
+		if _, err := c.cmd("auth", password); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.password = password
+	}
+	if db != 0 {
+		if _, err := c.cmd("select", db); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.DB = db
+	}
+	return c, nil
+}
+
+// dial opens another connection to the server and database of c, for the
+// subscriptions and blocking reads which can't share it.
+func (c *Client) dial() (*Client, error) {
+	return Dial(c.addr, c.password, c.DB)
 }
 
 // keys interface --------------------------------------------------------------
 
+// Keys blocks the server while it walks the whole keyspace, prefer Scan.
 func (c *Client) Keys(key string) (*redis.Reply, error) {
 	return c.cmd("keys", key)
 }
 
+func (c *Client) Scan(cursor string, args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("scan", cursor, args)
+}
+
 // string interface ------------------------------------------------------------
 
 func (c *Client) Get(key string) (*redis.Reply, error) {
@@ -36,6 +82,10 @@ func (c *Client) Set(key string, value interface{}) (*redis.Reply, error) {
 	return c.cmd("set", key, value)
 }
 
+func (c *Client) Mget(keys ...interface{}) (*redis.Reply, error) {
+	return c.cmd("mget", keys...)
+}
+
 // set interface ---------------------------------------------------------------
 
 func (c *Client) Sadd(key string, args ...interface{}) (*redis.Reply, error) {
@@ -54,30 +104,106 @@ func (c *Client) Smembers(key string) (*redis.Reply, error) {
 	return c.cmd("smembers", key)
 }
 
+// hash interface --------------------------------------------------------------
+
+func (c *Client) Hset(key string, field string, value interface{}) (*redis.Reply, error) {
+	return c.cmd("hset", key, field, value)
+}
+
+func (c *Client) Hdel(key string, fields ...interface{}) (*redis.Reply, error) {
+	return c.cmd("hdel", key, fields)
+}
+
+func (c *Client) Hget(key string, field string) (*redis.Reply, error) {
+	return c.cmd("hget", key, field)
+}
+
+func (c *Client) Hgetall(key string) (*redis.Reply, error) {
+	return c.cmd("hgetall", key)
+}
+
+// sorted set interface --------------------------------------------------------
+
+func (c *Client) Zadd(key string, args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("zadd", key, args)
+}
+
+func (c *Client) Zrangebyscore(key string, min interface{}, max interface{}, args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("zrangebyscore", key, min, max, args)
+}
+
 // pub/sub interface -----------------------------------------------------------
 
 func (c *Client) Publish(channel string, value interface{}) (*redis.Reply, error) {
 	return c.cmd("publish", channel, value)
 }
 
+// stream interface ------------------------------------------------------------
+
+func (c *Client) Xadd(key string, id string, args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("xadd", key, id, args)
+}
+
+func (c *Client) Xrange(key string, start string, end string, args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("xrange", key, start, end, args)
+}
+
+func (c *Client) Xrevrange(key string, end string, start string, args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("xrevrange", key, end, start, args)
+}
+
+func (c *Client) Xtrim(key string, args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("xtrim", key, args)
+}
+
+func (c *Client) Xinfo(args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("xinfo", args...)
+}
+
+func (c *Client) Xread(args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("xread", args...)
+}
+
+func (c *Client) Xreadgroup(group string, consumer string, args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("xreadgroup", "group", group, consumer, args)
+}
+
+func (c *Client) Xack(key string, group string, ids ...interface{}) (*redis.Reply, error) {
+	return c.cmd("xack", key, group, ids)
+}
+
+func (c *Client) Xpending(key string, group string, args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("xpending", key, group, args)
+}
+
+func (c *Client) Xgroup(args ...interface{}) (*redis.Reply, error) {
+	return c.cmd("xgroup", args...)
+}
+
 // batch interface -------------------------------------------------------------
 
+// Multi starts a transaction, waiting for the one of another goroutine to
+// end. It must be ended with Exec or Discard.
 func (c *Client) Multi() {
+	c.tx.Lock()
 	c.cleanPipe()
 }
 
 func (c *Client) Add(cmd string, args ...interface{}) asyncReply {
-	reply := make(asyncReply)
+	reply := make(asyncReply, 1)
 	c.pipe = append(c.pipe, &pipe{cmd, args, reply})
 	return reply
 }
 
 func (c *Client) Exec() (*redis.Reply, error) {
+	defer c.tx.Unlock()
 	defer c.cleanPipe()
 
-	c.cmd("multi")
+	c.mu.Lock()
+	c.do("multi")
 	c.execPipe()
-	r, err := c.cmd("exec")
+	r, err := c.do("exec")
+	c.mu.Unlock()
 
 	if err != nil {
 		return r, err
@@ -91,10 +217,14 @@ func (c *Client) Exec() (*redis.Reply, error) {
 }
 
 func (c *Client) Discard() (*redis.Reply, error) {
-	c.cmd("Multi")
+	defer c.tx.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.do("Multi")
 	c.execPipe()
 	c.cleanPipe()
-	return c.cmd("discard")
+	return c.do("discard")
 }
 
 func (c *Client) cleanPipe() {
@@ -103,17 +233,35 @@ func (c *Client) cleanPipe() {
 
 func (c *Client) execPipe() {
 	for _, p := range c.pipe {
-		c.cmd(p.cmd, p.args...)
+		c.do(p.cmd, p.args...)
 	}
 }
 
 // utility ---------------------------------------------------------------------
 
 func (c *Client) cmd(cmd string, args ...interface{}) (*redis.Reply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.do(cmd, args...)
+}
+
+// do runs cmd, the caller holding the connection.
+func (c *Client) do(cmd string, args ...interface{}) (*redis.Reply, error) {
+	start := time.Now()
 	r := c.Client.Cmd(cmd, args)
+	redisLatency.Since(strings.ToLower(cmd), start)
+	if r.Err != nil {
+		redisErrors.Inc(strings.ToLower(cmd))
+	}
 	return r, r.Err
 }
 
+// keyspace returns the keyspace notification channel of the keys matching
+// pattern in the client database.
+func (c *Client) keyspace(pattern string) string {
+	return fmt.Sprintf("__keyspace@%d__:%s", c.DB, pattern)
+}
+
 func (c *Client) Close() error {
 	return c.Client.Close()
 }
@@ -126,8 +274,8 @@ type pipe struct {
 	reply asyncReply
 }
 
+// send hands r to the reply channel, buffered so replies nobody waits for
+// don't hold a goroutine.
 func (p *pipe) send(r *redis.Reply) {
-	go func() {
-		p.reply <- r
-	}()
+	p.reply <- r
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fzzy/radix/redis"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestPipeSend(t *testing.T) {
+	c := &Client{}
+	before := runtime.NumGoroutine()
+	replies := []asyncReply{}
+	for i := 0; i < 100; i++ {
+		replies = append(replies, c.Add("get", "k"))
+	}
+	for _, p := range c.pipe {
+		p.send(&redis.Reply{Type: redis.NilReply})
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("Expected no goroutines left by unread replies, got %d more", n-before)
+	}
+	if r := <-replies[0]; r.Type != redis.NilReply {
+		t.Errorf("Unexpected reply %v", r)
+	}
+}
+
+func TestClientShared(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	c := r.dial(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("k%d", i)
+			for n := 0; n < 50; n++ {
+				c.Multi()
+				c.Add("set", key, n)
+				c.Add("set", key+":ts", n)
+				if _, err := c.Exec(); err != nil {
+					errs <- err
+					return
+				}
+				reply, err := c.Get(key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if s, _ := reply.Str(); s != fmt.Sprint(n) {
+					errs <- fmt.Errorf("Expected %s to be %d, got %q", key, n, s)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config declares a tag database: templates, and a tree of managers holding
+// tags, calculated tags, template instances and other managers. It is read
+// from and written to JSON, as
+//
+//	{
+//	  "templates": [{"name": "pump", "members": [{"name": "speed"}]}],
+//	  "managers": [{
+//	    "name": "@pressure",
+//	    "mode": "stream",
+//	    "tags": [
+//	      {"name": "tank-0", "unit": "bar", "limits": {"hi": 80}},
+//	      {"name": "total", "expression": "@pressure:tank-0 * 2"}
+//	    ],
+//	    "instances": [{"name": "pump-1", "template": "pump"}],
+//	    "managers": [{"name": "area2", "tags": [{"name": "tank-1"}]}]
+//	  }]
+//	}
+//
+// The services started by tagctl serve are declared in Server.
+//
+// Only JSON is read and written, as no YAML or TOML parser is vendored.
+type Config struct {
+	Templates []*Template      `json:"templates,omitempty"`
+	Managers  []*ManagerConfig `json:"managers"`
+	Server    *ServerConfig    `json:"server,omitempty"`
+}
+
+type ManagerConfig struct {
+	Name      string            `json:"name"`
+	Mode      string            `json:"mode,omitempty"`
+	Tags      []*TagConfig      `json:"tags,omitempty"`
+	Instances []*InstanceConfig `json:"instances,omitempty"`
+	Managers  []*ManagerConfig  `json:"managers,omitempty"`
+}
+
+// TagConfig declares a tag, or a calculated tag when it has an expression.
+// Unit is kept in the tag Meta, and Limits configure its alarms. Quality is
+// good unless given.
+type TagConfig struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Value       int               `json:"value,omitempty"`
+	Quality     *int              `json:"quality,omitempty"`
+	Unit        string            `json:"unit,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	Expression  string            `json:"expression,omitempty"`
+	Limits      *Limits           `json:"limits,omitempty"`
+}
+
+type InstanceConfig struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+}
+
+// Duration is a time.Duration written in configs as a string, as 1.5s.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string as 1.5s, got %s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (c *Config) String() string {
+	return fmt.Sprintf("Config{Templates#len: %d, Managers#len: %d}", len(c.Templates), len(c.Managers))
+}
+
+// ConfigError is an error found in a config file, at a line of it.
+type ConfigError struct {
+	Line int
+	Path string
+	Err  string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Path, e.Err)
+}
+
+// ConfigErrors holds every error found validating a config.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks the config, reporting errors at the lines given by lines,
+// as returned by jsonLines.
+func (c *Config) Validate(lines map[string]int) error {
+	errs := ConfigErrors{}
+	fail := func(path string, msg string, args ...interface{}) {
+		errs = append(errs, &ConfigError{lines[path], path, fmt.Sprintf(msg, args...)})
+	}
+
+	templates := map[string]bool{}
+	for i, t := range c.Templates {
+		p := fmt.Sprintf("templates.%d", i)
+		if err := validateMembers(t.Name, t.Members); err != nil {
+			fail(p, "%s", err)
+		}
+		if templates[t.Name] {
+			fail(p, "duplicated template %s", t.Name)
+		}
+		templates[t.Name] = true
+	}
+	known := func(name string) bool {
+		if templates[name] {
+			return true
+		}
+		_, err := LookupTemplate(name)
+		return err == nil
+	}
+
+	var manager func(p string, m *ManagerConfig)
+	manager = func(p string, m *ManagerConfig) {
+		names := map[string]bool{}
+		name := func(p string, n string) {
+			switch {
+			case n == "":
+				fail(p, "name is required")
+			case !validName(n):
+				fail(p, "invalid name %s", n)
+			case names[n]:
+				fail(p, "duplicated name %s", n)
+			}
+			names[n] = true
+		}
+
+		if m.Mode != "" {
+			if _, err := ParseChangeMode(m.Mode); err != nil {
+				fail(p+".mode", "%s", err)
+			}
+		}
+		for i, t := range m.Tags {
+			tp := fmt.Sprintf("%s.tags.%d", p, i)
+			name(tp, t.Name)
+			if t.Quality != nil {
+				if err := validateQuality(*t.Quality); err != nil {
+					fail(tp+".quality", "%s", err)
+				}
+			}
+			if t.Expression != "" {
+				if _, _, err := parseExpr(t.Expression); err != nil {
+					fail(tp+".expression", "%s", err)
+				}
+			}
+			if t.Limits != nil {
+				if err := t.Limits.Validate(); err != nil {
+					fail(tp+".limits", "%s", err)
+				}
+			}
+		}
+		for i, e := range m.Instances {
+			ip := fmt.Sprintf("%s.instances.%d", p, i)
+			name(ip, e.Name)
+			if !known(e.Template) {
+				fail(ip+".template", "Template %s not found.", e.Template)
+			}
+		}
+		for i, c := range m.Managers {
+			mp := fmt.Sprintf("%s.managers.%d", p, i)
+			name(mp, c.Name)
+			manager(mp, c)
+		}
+	}
+
+	roots := map[string]bool{}
+	for i, m := range c.Managers {
+		p := fmt.Sprintf("managers.%d", i)
+		if roots[m.Name] {
+			fail(p, "duplicated manager %s", m.Name)
+		}
+		roots[m.Name] = true
+		switch {
+		case m.Name == "":
+			fail(p, "name is required")
+		case !validName(m.Name):
+			fail(p, "invalid name %s", m.Name)
+		}
+		manager(p, m)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Build registers the templates and creates the managers of the config, with
+// their tags initialized. Limits are configured in alarms, when given.
+func (c *Config) Build(conn *Client, alarms *AlarmEngine) ([]*TagManager, error) {
+	for _, t := range c.Templates {
+		RegisterTemplate(t)
+	}
+
+	managers := []*TagManager{}
+	for _, m := range c.Managers {
+		tm := NewTagManager(m.Name)
+		if err := m.build(tm, conn, alarms); err != nil {
+			return managers, err
+		}
+		managers = append(managers, tm)
+	}
+	return managers, nil
+}
+
+// build fills tm, already appended into its parent, with the declared tags,
+// and stores its change mode.
+func (m *ManagerConfig) build(tm *TagManager, conn *Client, alarms *AlarmEngine) error {
+	if m.Mode != "" {
+		mode, err := ParseChangeMode(m.Mode)
+		if err != nil {
+			return err
+		}
+		tm.Mode = mode
+	}
+	if err := storeMode(conn, tm); err != nil {
+		return err
+	}
+
+	for _, t := range m.Tags {
+		tag, err := t.tag(conn)
+		if err != nil {
+			return fmt.Errorf("could not create %s:%s: %s", tm.Name, t.Name, err)
+		}
+		if err := tm.Append(tag); err != nil {
+			return err
+		}
+		if t.Limits != nil && alarms != nil {
+			if err := alarms.Configure(nameOf(tag), t.Limits); err != nil {
+				return err
+			}
+		}
+	}
+	for _, i := range m.Instances {
+		t, err := LookupTemplate(i.Template)
+		if err != nil {
+			return err
+		}
+		if _, err := t.Instantiate(tm, i.Name, conn); err != nil {
+			return err
+		}
+	}
+	for _, c := range m.Managers {
+		child := NewTagManager(c.Name)
+		child.Mode = tm.Mode
+		if err := tm.Append(child); err != nil {
+			return err
+		}
+		if err := c.build(child, conn, alarms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TagConfig) tag(conn *Client) (Tagger, error) {
+	quality := QualityGood
+	if t.Quality != nil {
+		quality = *t.Quality
+	}
+
+	var tag *Tag
+	var tagger Tagger
+	if t.Expression != "" {
+		c, err := NewCalcTag(conn, t.Name, t.Description, t.Expression)
+		if err != nil {
+			return nil, err
+		}
+		tag, tagger = &c.Tag, c
+	} else {
+		tag = NewTag(conn, t.Name, t.Description, t.Value, quality)
+		tagger = tag
+	}
+
+	for k, v := range t.Meta {
+		tag.Meta[k] = v
+	}
+	if t.Unit != "" {
+		tag.Meta["unit"] = t.Unit
+	}
+	return tagger, nil
+}
+
+// LoadConfig reads and validates a JSON config.
+func LoadConfig(r io.Reader) (*Config, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(c); err != nil {
+		return nil, decodeError(data, err)
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, ConfigErrors{{lineAt(data, d.InputOffset()), "", "unexpected data after the config"}}
+	}
+	if err := c.Validate(jsonLines(data)); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// decodeError returns the error decoding data into a Config as ConfigErrors,
+// at the line of the offending key or value.
+func decodeError(data []byte, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return ConfigErrors{{lineAt(data, e.Offset), "", e.Error()}}
+	case *json.UnmarshalTypeError:
+		return ConfigErrors{{lineAt(data, e.Offset), e.Field, e.Error()}}
+	}
+
+	// The other errors do not tell where they happened, so look for the
+	// first key or value of the document that causes them.
+	var doc interface{}
+	if json.Unmarshal(data, &doc) != nil {
+		return err
+	}
+	lines := jsonLines(data)
+	paths := make([]string, 0, len(lines))
+	for p := range lines {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if lines[paths[i]] != lines[paths[j]] {
+			return lines[paths[i]] < lines[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+
+	unknown := ""
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		unknown, _ = strconv.Unquote(strings.TrimPrefix(msg, "json: unknown field "))
+	}
+	unmarshaler := reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshaler := reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	for _, p := range paths {
+		parts := strings.Split(p, ".")
+		t := configType(parts)
+		if unknown != "" {
+			if t == nil && strings.EqualFold(parts[len(parts)-1], unknown) && configType(parts[:len(parts)-1]) != nil {
+				return ConfigErrors{{lines[p], p, fmt.Sprintf("unknown field %s", unknown)}}
+			}
+			continue
+		}
+		if t == nil || !reflect.PtrTo(t).Implements(unmarshaler) && !reflect.PtrTo(t).Implements(textUnmarshaler) {
+			continue
+		}
+		raw, _ := json.Marshal(valueAt(doc, parts))
+		if e := json.Unmarshal(raw, reflect.New(t).Interface()); e != nil {
+			return ConfigErrors{{lines[p], p, e.Error()}}
+		}
+	}
+	return err
+}
+
+// configType returns the type of the value at path in a Config, as decoded
+// by encoding/json, or nil when no field is there.
+func configType(path []string) reflect.Type {
+	t := reflect.TypeOf(Config{})
+	for _, part := range path {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			f, ok := jsonField(t, part)
+			if !ok {
+				return nil
+			}
+			t = f.Type
+		default:
+			return nil
+		}
+	}
+	return t
+}
+
+// jsonField returns the field of t decoded from key, matched as
+// encoding/json does.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if n := strings.Split(tag, ",")[0]; n == "-" {
+				continue
+			} else if n != "" {
+				name = n
+			}
+		}
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// valueAt returns the value at path in doc, decoded as an interface{}.
+func valueAt(doc interface{}, path []string) interface{} {
+	for _, part := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			doc = v[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil
+			}
+			doc = v[i]
+		default:
+			return nil
+		}
+	}
+	return doc
+}
+
+// export ----------------------------------------------------------------------
+
+// ExportConfig returns the config of the running managers, with the limits
+// configured in alarms when given. Managers whose tags all come from the same
+// registered template are exported as instances of it.
+func ExportConfig(managers []*TagManager, alarms *AlarmEngine) *Config {
+	c := &Config{Managers: []*ManagerConfig{}}
+	used := map[string]bool{}
+	for _, tm := range managers {
+		c.Managers = append(c.Managers, exportManager(tm, tm.Name, alarms, used))
+	}
+	for name := range used {
+		if t, err := LookupTemplate(name); err == nil {
+			c.Templates = append(c.Templates, t)
+		}
+	}
+	return c
+}
+
+// Write writes the config as indented JSON.
+func (c *Config) Write(w io.Writer) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+func exportManager(tm *TagManager, name string, alarms *AlarmEngine, used map[string]bool) *ManagerConfig {
+	m := &ManagerConfig{Name: name, Mode: tm.Mode.String()}
+	for _, c := range tm.tags() {
+		local := tm.localName(c)
+		switch t := c.(type) {
+		case *TagManager:
+			if template := instanceOf(t); template != "" {
+				used[template] = true
+				m.Instances = append(m.Instances, &InstanceConfig{local, template})
+				continue
+			}
+			child := exportManager(t, local, alarms, used)
+			if child.Mode == m.Mode {
+				child.Mode = ""
+			}
+			m.Managers = append(m.Managers, child)
+		case *CalcTag:
+			tc := exportTag(&t.Tag, local, alarms)
+			tc.Value, tc.Quality, tc.Expression = 0, nil, t.Expression
+			m.Tags = append(m.Tags, tc)
+		case *Tag:
+			m.Tags = append(m.Tags, exportTag(t, local, alarms))
+		}
+	}
+	return m
+}
+
+func exportTag(t *Tag, name string, alarms *AlarmEngine) *TagConfig {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tc := &TagConfig{Name: name, Description: t.Description, Value: t.Value}
+	if t.Quality != QualityGood {
+		q := t.Quality
+		tc.Quality = &q
+	}
+	for k, v := range t.Meta {
+		if k == "unit" {
+			tc.Unit = v
+			continue
+		}
+		if tc.Meta == nil {
+			tc.Meta = map[string]string{}
+		}
+		tc.Meta[k] = v
+	}
+	if alarms != nil {
+		tc.Limits = alarms.Limits(t.Name)
+	}
+	return tc
+}
+
+// instanceOf returns the template tm was created from, or an empty string.
+func instanceOf(tm *TagManager) string {
+	template := ""
+	for _, c := range tm.tags() {
+		t, ok := c.(*Tag)
+		if !ok {
+			return ""
+		}
+		meta, _ := getProp(t, "Meta")
+		name := meta.(map[string]string)["template"]
+		if name == "" || template != "" && name != template {
+			return ""
+		}
+		template = name
+	}
+	if _, err := LookupTemplate(template); err != nil {
+		return ""
+	}
+	return template
+}
+
+// utility ---------------------------------------------------------------------
+
+// validName tells whether n may name a manager or a tag of a config. Colons
+// separate the names in a tag path, and the other characters are patterns.
+func validName(n string) bool {
+	return !strings.ContainsAny(n, ":/*?[]")
+}
+
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// jsonLines maps the path of every value in the JSON document data, as
+// managers.0.tags.2, to the line where it starts. data must be valid JSON.
+func jsonLines(data []byte) map[string]int {
+	type frame struct {
+		array bool
+		index int
+		key   string
+	}
+	lines := map[string]int{}
+	stack := []*frame{}
+	line := 1
+	key := false
+
+	path := func() string {
+		parts := make([]string, len(stack))
+		for i, f := range stack {
+			if f.array {
+				parts[i] = strconv.Itoa(f.index)
+			} else {
+				parts[i] = f.key
+			}
+		}
+		return strings.Join(parts, ".")
+	}
+	value := func() {
+		if p := path(); lines[p] == 0 {
+			lines[p] = line
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '\n':
+			line++
+		case ' ', '\t', '\r', ':':
+		case ',':
+			if f := stack[len(stack)-1]; f.array {
+				f.index++
+			} else {
+				key = true
+			}
+		case '{', '[':
+			value()
+			stack = append(stack, &frame{array: c == '['})
+			key = c == '{'
+		case '}', ']':
+			stack = stack[:len(stack)-1]
+		case '"':
+			j := i + 1
+			for ; j < len(data) && data[j] != '"'; j++ {
+				if data[j] == '\\' {
+					j++
+				}
+			}
+			if key {
+				s, _ := strconv.Unquote(string(data[i : j+1]))
+				stack[len(stack)-1].key = s
+				key = false
+			} else {
+				value()
+			}
+			i = j
+		default:
+			value()
+			for i+1 < len(data) && !strings.ContainsRune(",}] \t\r\n", rune(data[i+1])) {
+				i++
+			}
+		}
+	}
+	return lines
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `{
+  "templates": [{"name": "config-pump", "members": [
+    {"name": "speed", "description": "", "value": 1500, "quality": 100, "meta": {"unit": "rpm"}}
+  ]}],
+  "managers": [{
+    "name": "@plant",
+    "mode": "keyspace",
+    "tags": [
+      {"name": "level", "description": "tank level", "value": 40, "unit": "m",
+       "meta": {"zone": "north"}, "limits": {"hi": 80, "deadband": 2}},
+      {"name": "flow", "value": 3, "quality": 50},
+      {"name": "double", "expression": "@plant:level * 2"}
+    ],
+    "instances": [{"name": "pump-1", "template": "config-pump"}],
+    "managers": [{"name": "area2", "tags": [{"name": "tank-1", "value": 7}]}]
+  }]
+}
+`
+
+func TestConfigRoundTrip(t *testing.T) {
+	c, err := LoadConfig(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alarms, r := alarmEngine(t)
+	managers, err := c.Build(r.dial(t), alarms)
+	for _, tm := range managers {
+		defer tm.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := r.get("@plant:area2:tank-1:value"); v != "7" {
+		t.Errorf("Expected tank-1 stored with 7, got %s", v)
+	}
+	if v := r.get("@plant:double:value"); v != "80" {
+		t.Errorf("Expected double calculated as 80, got %s", v)
+	}
+	if v := r.get("@plant:pump-1:speed:value"); v != "1500" {
+		t.Errorf("Expected the instance stored, got %s", v)
+	}
+	if l := alarms.Limits("@plant:level"); l == nil || *l.Hi != 80 {
+		t.Errorf("Expected the limits of level configured, got %v", l)
+	}
+
+	var b bytes.Buffer
+	if err := ExportConfig(managers, alarms).Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := LoadConfig(&b)
+	if err != nil {
+		t.Fatalf("Expected the export to load, got %s:\n%s", err, b.String())
+	}
+	exported.Templates = nil
+	c.Templates = nil
+	if !reflect.DeepEqual(exported, c) {
+		var want bytes.Buffer
+		c.Write(&want)
+		t.Errorf("Expected the export\n%s\ngot\n%s", want.String(), b.String())
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	_, err := LoadConfig(strings.NewReader(`{
+  "managers": [{
+    "name": "@a:b",
+    "tags": [
+      {"name": "x:y"},
+      {"name": "q", "quality": 200},
+      {"name": "e", "expression": "1 +"},
+      {"name": "l", "limits": {"hi": 1, "hihi": 0}}
+    ],
+    "instances": [{"name": "i", "template": "missing"}],
+    "managers": [{
+      "name": "n",
+      "mode": "bogus",
+      "tags": [{"name": ""}, {"name": "t"}, {"name": "t"}]
+    }]
+  }, {
+    "name": "@c"
+  }, {
+    "name": "@c"
+  }]
+}`))
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected config errors, got %v", err)
+	}
+
+	got := []string{}
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	want := []string{
+		"line 2: managers.0: invalid name @a:b",
+		"line 5: managers.0.tags.0: invalid name x:y",
+		"line 6: managers.0.tags.1.quality: quality must be between 0 and 100",
+		"line 7: managers.0.tags.2.expression: unexpected end of expression",
+		"line 8: managers.0.tags.3.limits: limits must be ordered as LOLO <= LO <= HI <= HIHI",
+		"line 10: managers.0.instances.0.template: Template missing not found.",
+		"line 13: managers.0.managers.0.mode: invalid change mode bogus",
+		"line 14: managers.0.managers.0.tags.0: name is required",
+		"line 14: managers.0.managers.0.tags.2: duplicated name t",
+		"line 18: managers.2: duplicated manager @c",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected errors\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestConfigSyntaxError(t *testing.T) {
+	_, err := LoadConfig(strings.NewReader("{\n  \"managers\": [\n    {\"name\": \"@a\",}\n  ]\n}"))
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 3 {
+		t.Errorf("Expected a syntax error at line 3, got %v", err)
+	}
+
+	_, err = LoadConfig(strings.NewReader("{\n  \"managers\": [\n    {\"name\": 1}\n  ]\n}"))
+	errs, ok = err.(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 3 {
+		t.Errorf("Expected a type error at line 3, got %v", err)
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	lines := jsonLines([]byte(`{
+  "a": [
+    1,
+    {"b": "x,y",
+     "c": [true, null]}
+  ],
+  "d\"e": {}
+}`))
+	want := map[string]int{
+		"":        1,
+		"a":       2,
+		"a.0":     3,
+		"a.1":     4,
+		"a.1.b":   4,
+		"a.1.c":   5,
+		"a.1.c.0": 5,
+		"a.1.c.1": 5,
+		"d\"e":    7,
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("Expected lines %v, got %v", want, lines)
+	}
+}
+
+func TestConfigUnknownField(t *testing.T) {
+	_, err := LoadConfig(strings.NewReader(`{
+  "managers": [{
+    "name": "@a",
+    "tags": [
+      {"name": "x"},
+      {"name": "y", "mode": "publish"}
+    ]
+  }]
+}`))
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Error() != "line 6: managers.0.tags.1.mode: unknown field mode" {
+		t.Errorf("Expected the unknown field at line 6, got %v", err)
+	}
+}
+
+func TestConfigDelays(t *testing.T) {
+	c, err := LoadConfig(strings.NewReader(`{
+  "managers": [{
+    "name": "@a",
+    "tags": [{"name": "x", "limits": {"hi": 1, "on_delay": "1.5s"}}]
+  }]
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := c.Managers[0].Tags[0].Limits.OnDelay; d != Duration(1500*time.Millisecond) {
+		t.Errorf("Expected an on delay of 1.5s, got %s", d)
+	}
+	var b bytes.Buffer
+	c.Write(&b)
+	if !strings.Contains(b.String(), `"on_delay": "1.5s"`) {
+		t.Errorf("Expected the delay written as 1.5s, got\n%s", b.String())
+	}
+
+	_, err = LoadConfig(strings.NewReader(`{
+  "managers": [{
+    "name": "@a",
+    "tags": [
+      {"name": "x",
+       "limits": {"off_delay": 1500000000}}
+    ]
+  }]
+}`))
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 6 || errs[0].Path != "managers.0.tags.0.limits.off_delay" {
+		t.Errorf("Expected the bad delay at line 6, got %v", err)
+	}
+}
+
+func TestConfigModbusMaps(t *testing.T) {
+	c, err := LoadConfig(strings.NewReader(`{
+  "managers": [{"name": "@a", "tags": [{"name": "x"}]}],
+  "server": {"modbus_drivers": [{"manager": "@a", "addr": "plc:502", "groups": [{
+    "rate": "500ms",
+    "maps": [{"table": "holding registers", "address": 3, "tag": "@a:x", "format": "float32"}]
+  }]}]}
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := c.Server.ModbusDrivers[0].Groups[0]
+	if g.Rate != Duration(500*time.Millisecond) || g.Maps[0].Table != HoldingRegisters || g.Maps[0].Format != Float32 {
+		t.Errorf("Expected the group read, got %s %s", g, g.Maps[0])
+	}
+	var b bytes.Buffer
+	c.Write(&b)
+	for _, s := range []string{`"rate": "500ms"`, `"table": "holding registers"`, `"format": "float32"`} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("Expected %s written, got\n%s", s, b.String())
+		}
+	}
+
+	_, err = LoadConfig(strings.NewReader(`{
+  "managers": [],
+  "server": {"modbus_servers": [{"manager": "@a", "listen": ":502", "maps": [
+    {"table": "registers", "address": 3, "tag": "@a:x"}
+  ]}]}
+}`))
+	errs, ok := err.(ConfigErrors)
+	if !ok || len(errs) != 1 || errs[0].Line != 4 || errs[0].Path != "server.modbus_servers.0.maps.0.table" {
+		t.Errorf("Expected the bad table at line 4, got %v", err)
+	}
+}
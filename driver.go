@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// modbus rtu ------------------------------------------------------------------
+
+// ModbusRTU is a modbus RTU transport over a serial line. Timeouts are up to
+// the line, which should fail reads when a device does not answer.
+type ModbusRTU struct {
+	rw io.ReadWriter
+	mu sync.Mutex
+}
+
+func (t *ModbusRTU) String() string {
+	return "ModbusRTU{}"
+}
+
+func (t *ModbusRTU) Send(unit byte, pdu []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	frame := append([]byte{unit}, pdu...)
+	crc := crc16(frame)
+	if _, err := t.rw.Write(append(frame, byte(crc), byte(crc>>8))); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(t.rw, reply); err != nil {
+		return nil, err
+	}
+	var n int
+	switch fc := reply[1]; {
+	case fc&0x80 != 0:
+		n = 2
+	case fc <= fcReadInputRegisters:
+		n = int(reply[2]) + 2
+	default:
+		n = 5
+	}
+	rest := make([]byte, n)
+	if _, err := io.ReadFull(t.rw, rest); err != nil {
+		return nil, err
+	}
+	reply = append(reply, rest...)
+
+	crc = crc16(reply[:len(reply)-2])
+	if reply[len(reply)-2] != byte(crc) || reply[len(reply)-1] != byte(crc>>8) {
+		return nil, fmt.Errorf("invalid crc from unit %d", unit)
+	}
+	if reply[0] != unit {
+		return nil, fmt.Errorf("reply from unit %d, expected %d", reply[0], unit)
+	}
+	return reply[1 : len(reply)-2], nil
+}
+
+func (t *ModbusRTU) Close() error {
+	if c, ok := t.rw.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func NewModbusRTU(rw io.ReadWriter) *ModbusRTU {
+	return &ModbusRTU{rw: rw}
+}
+
+// crc16 is the modbus RTU checksum, sent low byte first.
+func crc16(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, c := range b {
+		crc ^= uint16(c)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// modbus driver ---------------------------------------------------------------
+
+// ScanGroup is a set of maps polled every Rate.
+type ScanGroup struct {
+	Rate   Duration       `json:"rate"`
+	Maps   []*RegisterMap `json:"maps"`
+	blocks []*scanBlock
+}
+
+func (g *ScanGroup) String() string {
+	return fmt.Sprintf("ScanGroup{Rate: %s, Maps#len: %d}", g.Rate, len(g.Maps))
+}
+
+// scanBlock is a run of contiguous addresses read in a single request.
+type scanBlock struct {
+	Table   ModbusTable
+	Address uint16
+	Count   int
+	Maps    []*RegisterMap
+	failed  bool
+}
+
+// ModbusDriver polls a device and writes the values read into the tags of a
+// manager. Maps that can't be read have their tag quality set bad until they
+// are read again. Groups are read concurrently, but tags are written one at a
+// time, as they share a redis connection. Values are only written when they
+// differ from the last the driver wrote, as the tags may not mirror a write
+// yet when the next poll reads the same value.
+type ModbusDriver struct {
+	manager *TagManager
+	client  *ModbusClient
+	Groups  []*ScanGroup
+	written map[string]float64
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+}
+
+func (d *ModbusDriver) String() string {
+	return fmt.Sprintf("ModbusDriver{Client: %s, Groups#len: %d}", d.client, len(d.Groups))
+}
+
+// Start polls every group on its own schedule, until the driver is closed.
+func (d *ModbusDriver) Start() {
+	for _, g := range d.Groups {
+		d.wg.Add(1)
+		go d.scan(g)
+	}
+}
+
+func (d *ModbusDriver) Close() error {
+	var err error
+	d.once.Do(func() {
+		close(d.done)
+		d.wg.Wait()
+		err = d.client.Close()
+	})
+	return err
+}
+
+// Poll reads every block of g once.
+func (d *ModbusDriver) Poll(g *ScanGroup) error {
+	var failed error
+	for _, b := range g.blocks {
+		err := d.poll(b)
+		if err != nil {
+			if !b.failed {
+				log.Printf("could not poll %d %s from %d with %s: %s\n", b.Count, b.Table, b.Address, d.client, err)
+			}
+			d.fail(b)
+			failed = err
+		}
+		b.failed = err != nil
+	}
+	return failed
+}
+
+func (d *ModbusDriver) scan(g *ScanGroup) {
+	defer d.wg.Done()
+	ticker := time.NewTicker(time.Duration(g.Rate))
+	defer ticker.Stop()
+	for {
+		d.Poll(g)
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *ModbusDriver) poll(b *scanBlock) error {
+	if b.Table.bits() {
+		bits, err := d.client.ReadBits(b.Table, b.Address, b.Count)
+		if err != nil {
+			return err
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, m := range b.Maps {
+			d.update(m, boolNumber(bits[m.Address-b.Address]))
+		}
+		return nil
+	}
+
+	words, err := d.client.ReadRegisters(b.Table, b.Address, b.Count)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, m := range b.Maps {
+		i := int(m.Address - b.Address)
+		d.update(m, m.decode(words[i:i+m.size()]))
+	}
+	return nil
+}
+
+// update writes v and a good quality into the tag of m.
+func (d *ModbusDriver) update(m *RegisterMap, v float64) {
+	if err := d.write(m.Tag, m.prop(), v); err != nil {
+		log.Printf("could not update %s: %s\n", m, err)
+		return
+	}
+	d.quality(m, QualityGood)
+}
+
+func (d *ModbusDriver) fail(b *scanBlock) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, m := range b.Maps {
+		d.quality(m, QualityBad)
+	}
+}
+
+func (d *ModbusDriver) quality(m *RegisterMap, q int) {
+	if err := d.write(m.Tag, "Quality", float64(q)); err != nil {
+		log.Printf("could not set quality of %s: %s\n", m, err)
+	}
+}
+
+// write sets prop of tag to v, unless it's the value last written there.
+func (d *ModbusDriver) write(tag string, prop string, v float64) error {
+	key := tag + "\x00" + prop
+	if last, ok := d.written[key]; ok && last == v {
+		return nil
+	}
+	if err := d.manager.Set(tag, prop, v); err != nil {
+		delete(d.written, key)
+		return err
+	}
+	d.written[key] = v
+	return nil
+}
+
+// NewModbusDriver polls groups from client into the tags of manager.
+func NewModbusDriver(manager *TagManager, client *ModbusClient, groups ...*ScanGroup) (*ModbusDriver, error) {
+	for _, g := range groups {
+		if g.Rate <= 0 {
+			return nil, fmt.Errorf("invalid scan rate %s", g.Rate)
+		}
+		for _, m := range g.Maps {
+			if err := m.bind(manager); err != nil {
+				return nil, err
+			}
+		}
+		g.blocks = scanBlocks(g.Maps)
+	}
+	return &ModbusDriver{
+		manager: manager,
+		client:  client,
+		Groups:  groups,
+		written: map[string]float64{},
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// scanBlocks joins maps of contiguous addresses into blocks, up to the size
+// of a single read.
+func scanBlocks(maps []*RegisterMap) []*scanBlock {
+	sorted := make([]*RegisterMap, len(maps))
+	copy(sorted, maps)
+	sort.Sort(byAddress(sorted))
+
+	var blocks []*scanBlock
+	var b *scanBlock
+	for _, m := range sorted {
+		limit := 125
+		if m.Table.bits() {
+			limit = 2000
+		}
+		end := int(m.Address) + m.size()
+		if b == nil || b.Table != m.Table || int(m.Address) > int(b.Address)+b.Count || end-int(b.Address) > limit {
+			b = &scanBlock{Table: m.Table, Address: m.Address}
+			blocks = append(blocks, b)
+		}
+		if end-int(b.Address) > b.Count {
+			b.Count = end - int(b.Address)
+		}
+		b.Maps = append(b.Maps, m)
+	}
+	return blocks
+}
+
+type byAddress []*RegisterMap
+
+func (a byAddress) Len() int      { return len(a) }
+func (a byAddress) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byAddress) Less(i, j int) bool {
+	if a[i].Table != a[j].Table {
+		return a[i].Table < a[j].Table
+	}
+	return a[i].Address < a[j].Address
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// simulate serves the registers of a simulated device, returning a driver
+// polling them into the tags of tm with a func stopping both.
+func simulate(t *testing.T, device *TagManager, tm *TagManager, maps ...*RegisterMap) (*ModbusDriver, *ScanGroup, func()) {
+	c, stop := serveModbus(t, device, maps...)
+
+	polled := make([]*RegisterMap, len(maps))
+	for i, m := range maps {
+		p := *m
+		p.Tag = tm.Name + m.Tag[len(device.Name):]
+		polled[i] = &p
+	}
+	g := &ScanGroup{Rate: Duration(time.Second), Maps: polled}
+	d, err := NewModbusDriver(tm, c, g)
+	if err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	return d, g, func() {
+		d.Close()
+		stop()
+	}
+}
+
+func TestModbusDriverPoll(t *testing.T) {
+	device := &memTag{Value: 42, Level: 2.5}
+	a := &memTag{Quality: QualityBad}
+	d, g, stop := simulate(t, memManager("@dev", device), memManager("@drv", a),
+		&RegisterMap{Table: HoldingRegisters, Address: 0, Tag: "@dev:a", Scale: 10},
+		&RegisterMap{Table: HoldingRegisters, Address: 1, Tag: "@dev:a", Prop: "Level", Format: Float32},
+	)
+	defer stop()
+
+	if len(g.blocks) != 1 {
+		t.Errorf("%d blocks, want contiguous maps read at once", len(g.blocks))
+	}
+	if err := d.Poll(g); err != nil {
+		t.Fatal(err)
+	}
+	if a.Value != 42 || a.Level != 2.5 || a.Quality != QualityGood {
+		t.Errorf("polled %s with quality %d", a, a.Quality)
+	}
+
+	// values are written again only when the device changes them
+	a.Value = 7
+	d.Poll(g)
+	if a.Value != 7 {
+		t.Errorf("Value is %d, the unchanged value was written again", a.Value)
+	}
+	device.Value = 43
+	d.Poll(g)
+	if a.Value != 43 {
+		t.Errorf("Value is %d, want 43", a.Value)
+	}
+}
+
+func TestModbusDriverFail(t *testing.T) {
+	a := &memTag{}
+	d, g, stop := simulate(t, memManager("@dev", &memTag{Value: 1}), memManager("@drv", a),
+		&RegisterMap{Table: HoldingRegisters, Address: 0, Tag: "@dev:a"},
+	)
+	if err := d.Poll(g); err != nil || a.Quality != QualityGood {
+		t.Fatalf("polled quality %d: %v", a.Quality, err)
+	}
+
+	stop()
+	if err := d.Poll(g); err == nil {
+		t.Error("polled a stopped device")
+	}
+	if a.Quality != QualityBad {
+		t.Errorf("quality is %d after a failed poll, want bad", a.Quality)
+	}
+	if err := d.Close(); err != nil {
+		t.Errorf("second close: %s", err)
+	}
+}
+
+func TestModbusDriverStartClose(t *testing.T) {
+	a := &memTag{}
+	d, _, stop := simulate(t, memManager("@dev", &memTag{Value: 5}), memManager("@drv", a),
+		&RegisterMap{Table: HoldingRegisters, Address: 0, Tag: "@dev:a"},
+	)
+	defer stop()
+
+	d.Start()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := getProp(a, "Value"); v != 5 {
+		t.Errorf("Value is %v, want the first scan to have run", v)
+	}
+}
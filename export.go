@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyPage is how many entries are read from a change log at once.
+var historyPage = 1000
+
+// ReadHistory calls fn with the changes logged by managers using
+// StreamChanges between from and to, oldest first, of the tags matching any
+// of patterns, as @pressure:tank-*. Every tag matches when patterns is empty.
+// The change logs are read a page at a time and merged, so the range is never
+// held whole in memory. It stops at the first error of fn.
+func ReadHistory(conn *Client, managers []string, from time.Time, to time.Time, patterns []string, fn func(e *StreamEntry) error) error {
+	logs := make([]*historyLog, len(managers))
+	for i, m := range managers {
+		logs[i] = &historyLog{
+			key:   changeLog(m),
+			start: strconv.FormatInt(from.UnixNano()/int64(time.Millisecond), 10),
+			end:   strconv.FormatInt(to.UnixNano()/int64(time.Millisecond), 10),
+		}
+	}
+
+	for {
+		var next *historyLog
+		for _, l := range logs {
+			if err := l.fill(conn); err != nil {
+				return err
+			}
+			if len(l.page) > 0 && (next == nil || entryTime(l.page[0]).Before(entryTime(next.page[0]))) {
+				next = l
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		e := next.page[0]
+		next.page = next.page[1:]
+		if matchTag(e.Change.Tag, patterns) {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// historyLog pages through the change log of a manager for ReadHistory.
+type historyLog struct {
+	key   string
+	start string
+	end   string
+	page  []*StreamEntry
+	done  bool
+}
+
+// fill reads the next page of the log once the current one is consumed.
+func (l *historyLog) fill(conn *Client) error {
+	if len(l.page) > 0 || l.done {
+		return nil
+	}
+	r, err := conn.Xrange(l.key, l.start, l.end, "count", historyPage)
+	if err != nil {
+		return err
+	}
+	entries, err := parseStreamEntries(r)
+	if err != nil {
+		return err
+	}
+	l.page = entries
+	l.done = len(entries) < historyPage
+	if len(entries) > 0 {
+		l.start = "(" + entries[len(entries)-1].ID
+	}
+	return nil
+}
+
+// entryTime returns the time an entry was logged, from its id.
+func entryTime(e *StreamEntry) time.Time {
+	ms, err := strconv.ParseInt(strings.SplitN(e.ID, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Unix(e.Change.Timestamp, 0).UTC()
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+// changeTime returns when c was made: now, the time it is received, when it
+// falls in the second of its timestamp, which only holds seconds. Changes
+// received later, from a backlog, are at the start of their second.
+func changeTime(c *Change, now time.Time) time.Time {
+	if now.Unix() == c.Timestamp {
+		return now
+	}
+	return time.Unix(c.Timestamp, 0)
+}
+
+// line protocol ---------------------------------------------------------------
+
+// LineWriter writes changes in influxdb line protocol, as
+//
+//	tagging,manager=@pressure,tag=tank-0 value=42i 1500000000000000000
+//
+// with the prop key as field. Values are typed by the schemas of the tags
+// under Manager, when set, and as those of plain tags otherwise.
+type LineWriter struct {
+	w           io.Writer
+	Measurement string
+	Manager     *TagManager
+	last        time.Time
+}
+
+func (l *LineWriter) String() string {
+	return fmt.Sprintf("LineWriter{Measurement: %s}", l.Measurement)
+}
+
+// Write writes c, changed at t.
+func (l *LineWriter) Write(c *Change, t time.Time) error {
+	manager, tag := c.Tag, c.Tag
+	if i := strings.LastIndex(c.Tag, ":"); i >= 0 {
+		manager, tag = c.Tag[:i], c.Tag[i+1:]
+	}
+	_, err := fmt.Fprintf(
+		l.w,
+		"%s,manager=%s,tag=%s %s=%s %d\n",
+		lineEscaper.Replace(l.Measurement),
+		lineEscaper.Replace(manager),
+		lineEscaper.Replace(tag),
+		lineEscaper.Replace(c.Prop),
+		lineField(changeValue(l.Manager, c)),
+		t.UnixNano(),
+	)
+	return err
+}
+
+// WriteEntry writes an entry of a change log, at the time it was logged.
+func (l *LineWriter) WriteEntry(e *StreamEntry) error {
+	return l.Write(e.Change, entryTime(e))
+}
+
+// Live writes the changes of feed until it is closed, flushing the writer
+// every interval when it buffers, as InfluxHTTP does. Changes are written at
+// the time they are received, see changeTime, and a nanosecond apart at least,
+// so influxdb doesn't overwrite changes made in the same second.
+func (l *LineWriter) Live(feed *Feed, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-feed.Done():
+			l.Flush()
+			return
+		case c := <-feed.C:
+			at := changeTime(c, time.Now())
+			if !at.After(l.last) {
+				at = l.last.Add(time.Nanosecond)
+			}
+			l.last = at
+			if err := l.Write(c, at); err != nil {
+				log.Printf("Couldn't export %s: %s\n", c, err)
+			}
+		case <-t.C:
+			if err := l.Flush(); err != nil {
+				log.Printf("Couldn't flush %s: %s\n", l, err)
+			}
+		}
+	}
+}
+
+// Flush flushes the underlying writer, when it buffers.
+func (l *LineWriter) Flush() error {
+	if f, ok := l.w.(interface {
+		Flush() error
+	}); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func NewLineWriter(w io.Writer, measurement string) *LineWriter {
+	return &LineWriter{w: w, Measurement: measurement}
+}
+
+// influxBuffer is how many bytes InfluxHTTP keeps while posts fail.
+const influxBuffer = 8 << 20
+
+// InfluxHTTP buffers the lines written to it and posts them to URL on Flush,
+// as http://localhost:8086/write?db=plant. Token, when set, is sent as the
+// authorization of influxdb 2. While posts fail, the buffer holds MaxBuffer
+// bytes at most, dropping the oldest lines.
+type InfluxHTTP struct {
+	URL       string
+	Token     string
+	MaxBuffer int
+	buf       bytes.Buffer
+	dropped   int
+	mu        sync.Mutex
+}
+
+func (i *InfluxHTTP) String() string {
+	return fmt.Sprintf("InfluxHTTP{URL: %s}", i.URL)
+}
+
+func (i *InfluxHTTP) Write(p []byte) (int, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	n, err := i.buf.Write(p)
+	if over := i.buf.Len() - i.MaxBuffer; i.MaxBuffer > 0 && over > 0 {
+		if i.dropped == 0 {
+			log.Printf("%s buffer is full, dropping the oldest lines\n", i)
+		}
+		b := i.buf.Bytes()
+		end := bytes.IndexByte(b[over-1:], '\n')
+		if end < 0 {
+			i.dropped += bytes.Count(b, []byte("\n")) + 1
+			i.buf.Reset()
+		} else {
+			i.dropped += bytes.Count(b[:over+end], []byte("\n"))
+			i.buf.Next(over + end)
+		}
+	}
+	return n, err
+}
+
+// Flush posts the buffered lines. They are kept for the next flush when the
+// post fails.
+func (i *InfluxHTTP) Flush() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.buf.Len() == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", i.URL, bytes.NewReader(i.buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if i.Token != "" {
+		req.Header.Set("Authorization", "Token "+i.Token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("influxdb replied %s: %s", res.Status, body)
+	}
+	i.buf.Reset()
+	if i.dropped > 0 {
+		log.Printf("%s dropped %d lines while posts failed\n", i, i.dropped)
+		i.dropped = 0
+	}
+	return nil
+}
+
+func NewInfluxHTTP(url string) *InfluxHTTP {
+	return &InfluxHTTP{URL: url, MaxBuffer: influxBuffer}
+}
+
+// csv -------------------------------------------------------------------------
+
+// CSVWriter writes entries of change logs as time,tag,prop,value rows, after
+// a header. The time is formatted with Layout, or as seconds or milliseconds
+// since the epoch when Layout is unix or unixms.
+type CSVWriter struct {
+	w      *csv.Writer
+	Layout string
+	header bool
+}
+
+func (c *CSVWriter) String() string {
+	return fmt.Sprintf("CSVWriter{Layout: %s}", c.Layout)
+}
+
+func (c *CSVWriter) WriteEntry(e *StreamEntry) error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write([]string{"time", "tag", "prop", "value"}); err != nil {
+			return err
+		}
+	}
+
+	var t string
+	switch at := entryTime(e); c.Layout {
+	case "unix":
+		t = strconv.FormatInt(at.Unix(), 10)
+	case "unixms":
+		t = strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10)
+	default:
+		t = at.Format(c.Layout)
+	}
+	return c.w.Write([]string{t, e.Change.Tag, e.Change.Prop, fmt.Sprint(e.Change.Value)})
+}
+
+// Flush writes the buffered rows, and the header when no entry was written.
+func (c *CSVWriter) Flush() error {
+	if !c.header {
+		c.header = true
+		c.w.Write([]string{"time", "tag", "prop", "value"})
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func NewCSVWriter(w io.Writer, layout string) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w), Layout: layout}
+}
+
+// utility ---------------------------------------------------------------------
+
+var (
+	lineEscaper   = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	stringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// lineField formats v as a line protocol field value.
+func lineField(v interface{}) string {
+	switch n := v.(type) {
+	case int:
+		return fmt.Sprintf("%di", n)
+	case int64:
+		return fmt.Sprintf("%di", n)
+	case float64:
+		return strconv.FormatFloat(n, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(n)
+	case map[string]string:
+		v = encodeMeta(n)
+	}
+	return `"` + stringEscaper.Replace(fmt.Sprint(v)) + `"`
+}
+
+func matchTag(tag string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, tag); ok {
+			return true
+		}
+	}
+	return len(patterns) == 0
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLineWriter(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLineWriter(&b, "tag ging")
+	at := time.Unix(1500000000, 5)
+	for _, c := range []*Change{
+		{Tag: "@pressure:tank-0", Prop: "value", Value: 42},
+		{Tag: "@pressure:area,2:tank=1", Prop: "level", Value: 2.5},
+		{Tag: "@pressure:tank-0", Prop: "description", Value: `big "tank"`},
+		{Tag: "@pressure:tank-0", Prop: "meta", Value: map[string]string{"unit": "bar"}},
+		{Tag: "@pressure:tank-0", Prop: "running", Value: true},
+		{Tag: "@pressure:tank-0", Prop: "value", Value: "17"},
+		{Tag: "@pressure:tank-0", Prop: "description", Value: "pump"},
+	} {
+		if err := l.Write(c, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := strings.Join([]string{
+		`tag\ ging,manager=@pressure,tag=tank-0 value=42i 1500000000000000005`,
+		`tag\ ging,manager=@pressure:area\,2,tag=tank\=1 level=2.5 1500000000000000005`,
+		`tag\ ging,manager=@pressure,tag=tank-0 description="big \"tank\"" 1500000000000000005`,
+		`tag\ ging,manager=@pressure,tag=tank-0 meta="{\"unit\":\"bar\"}" 1500000000000000005`,
+		`tag\ ging,manager=@pressure,tag=tank-0 running=true 1500000000000000005`,
+		`tag\ ging,manager=@pressure,tag=tank-0 value=17i 1500000000000000005`,
+		`tag\ ging,manager=@pressure,tag=tank-0 description="pump" 1500000000000000005`,
+	}, "\n") + "\n"
+	if b.String() != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, b.String())
+	}
+}
+
+func TestLineWriterEntries(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLineWriter(&b, "tagging")
+	for _, e := range []*StreamEntry{
+		{ID: "1500000000123-0", Change: &Change{Tag: "@p:a", Prop: "value", Value: "1", Timestamp: 1500000000}},
+		{ID: "1500000000456-1", Change: &Change{Tag: "@p:a", Prop: "value", Value: "2", Timestamp: 1500000000}},
+	} {
+		if err := l.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := "tagging,manager=@p,tag=a value=1i 1500000000123000000\n" +
+		"tagging,manager=@p,tag=a value=2i 1500000000456000000\n"
+	if b.String() != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, b.String())
+	}
+}
+
+func TestLineWriterLive(t *testing.T) {
+	var b bytes.Buffer
+	l := NewLineWriter(&b, "tagging")
+	feed := testFeed()
+	done := make(chan struct{})
+	go func() {
+		l.Live(feed, time.Hour)
+		close(done)
+	}()
+
+	// a backlog of changes made in the same second.
+	for i := 0; i < 3; i++ {
+		feed.C <- &Change{Tag: "@p:a", Prop: "value", Value: "1", Timestamp: 1500000000}
+	}
+	now := ts()
+	feed.C <- &Change{Tag: "@p:a", Prop: "value", Value: "2", Timestamp: now}
+	close(feed.done)
+	<-done
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 lines, got %q", lines)
+	}
+	for i, want := range []string{"1500000000000000000", "1500000000000000001", "1500000000000000002"} {
+		if !strings.HasSuffix(lines[i], " "+want) {
+			t.Errorf("Expected line %d at %s, got %s", i, want, lines[i])
+		}
+	}
+	last, err := strconv.ParseInt(lines[3][strings.LastIndex(lines[3], " ")+1:], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last < now*int64(time.Second) || last >= (now+1)*int64(time.Second) {
+		t.Errorf("Expected the last line within second %d, got %s", now, lines[3])
+	}
+}
+
+func TestInfluxHTTP(t *testing.T) {
+	var mu sync.Mutex
+	fail := true
+	posted := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != "Token secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		posted += string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	i := NewInfluxHTTP(srv.URL)
+	i.Token = "secret"
+	i.MaxBuffer = 20
+	for _, line := range []string{"a value=1i 1\n", "b value=2i 2\n", "c value=3i 3\n"} {
+		i.Write([]byte(line))
+	}
+	if err := i.Flush(); err == nil {
+		t.Fatal("Expected the post to fail")
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	if err := i.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if posted != "c value=3i 3\n" {
+		t.Errorf("Expected the newest line kept, got %q", posted)
+	}
+	if err := i.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if posted != "c value=3i 3\n" {
+		t.Errorf("Expected nothing posted again, got %q", posted)
+	}
+}
+
+func TestCSVWriter(t *testing.T) {
+	entries := []*StreamEntry{
+		{ID: "1500000000123-0", Change: &Change{Tag: "@p:a", Prop: "value", Value: "1"}},
+		{ID: "1500000001000-0", Change: &Change{Tag: "@p:b,c", Prop: "description", Value: `say "hi"`}},
+	}
+	for layout, want := range map[string]string{
+		time.RFC3339: "time,tag,prop,value\n" +
+			"2017-07-14T02:40:00Z,@p:a,value,1\n" +
+			"2017-07-14T02:40:01Z,\"@p:b,c\",description,\"say \"\"hi\"\"\"\n",
+		"unix": "time,tag,prop,value\n" +
+			"1500000000,@p:a,value,1\n" +
+			"1500000001,\"@p:b,c\",description,\"say \"\"hi\"\"\"\n",
+		"unixms": "time,tag,prop,value\n" +
+			"1500000000123,@p:a,value,1\n" +
+			"1500000001000,\"@p:b,c\",description,\"say \"\"hi\"\"\"\n",
+	} {
+		var b bytes.Buffer
+		c := NewCSVWriter(&b, layout)
+		for _, e := range entries {
+			if err := c.WriteEntry(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != want {
+			t.Errorf("Expected with layout %s\n%s\ngot\n%s", layout, want, b.String())
+		}
+	}
+}
+
+func TestReadHistory(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	defer func(n int) { historyPage = n }(historyPage)
+	historyPage = 2
+
+	for _, e := range []struct {
+		manager string
+		id      int
+		tag     string
+	}{
+		{"@h1", 1000, "@h1:a"},
+		{"@h2", 1500, "@h2:b"},
+		{"@h1", 2000, "@h1:b"},
+		{"@h1", 3000, "@h1:a"},
+		{"@h2", 3000, "@h2:a"},
+		{"@h1", 4000, "@h1:a"},
+		{"@h2", 9000, "@h2:a"},
+	} {
+		_, err := conn.Xadd(changeLog(e.manager), fmt.Sprintf("%d-0", e.id), "tag", e.tag, "prop", "value", "value", e.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := func(patterns ...string) []string {
+		got := []string{}
+		err := ReadHistory(conn, []string{"@h1", "@h2"}, time.Unix(1, 0), time.Unix(5, 0), patterns, func(e *StreamEntry) error {
+			got = append(got, fmt.Sprintf("%s=%s", e.Change.Tag, e.Change.Value))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	want := []string{"@h1:a=1000", "@h2:b=1500", "@h1:b=2000", "@h1:a=3000", "@h2:a=3000", "@h1:a=4000"}
+	if got := read(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	want = []string{"@h1:a=1000", "@h1:a=3000", "@h2:a=3000", "@h1:a=4000"}
+	if got := read("@h*:a"); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	stop := fmt.Errorf("stop")
+	n := 0
+	err := ReadHistory(conn, []string{"@h1", "@h2"}, time.Unix(0, 0), time.Unix(10, 0), nil, func(e *StreamEntry) error {
+		if n++; n == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 2 {
+		t.Errorf("Expected to stop at the second entry with its error, got %d entries and %v", n, err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expressions are written over tag keys, such as
+//
+//	(@pressure:tank-1:value + @pressure:tank-2:value) / 2
+//
+// with the arithmetic, comparison and boolean operators of Go, parentheses
+// and the functions abs, min and max. Since tag names may hold dashes, binary
+// minus must be surrounded by spaces. Booleans evaluate to 1 and 0.
+type expr interface {
+	eval(env map[string]float64) (float64, error)
+}
+
+type numberExpr float64
+
+func (e numberExpr) eval(env map[string]float64) (float64, error) {
+	return float64(e), nil
+}
+
+type refExpr string
+
+func (e refExpr) eval(env map[string]float64) (float64, error) {
+	v, ok := env[string(e)]
+	if !ok {
+		return 0, fmt.Errorf("no value for %s", string(e))
+	}
+	return v, nil
+}
+
+type unaryExpr struct {
+	op string
+	x  expr
+}
+
+func (e *unaryExpr) eval(env map[string]float64) (float64, error) {
+	x, err := e.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	if e.op == "!" {
+		return boolNumber(x == 0), nil
+	}
+	return -x, nil
+}
+
+type binaryExpr struct {
+	op   string
+	x, y expr
+}
+
+func (e *binaryExpr) eval(env map[string]float64) (float64, error) {
+	x, err := e.x.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	y, err := e.y.eval(env)
+	if err != nil {
+		return 0, err
+	}
+
+	switch e.op {
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return x / y, nil
+	case "%":
+		if y == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return math.Mod(x, y), nil
+	case "==":
+		return boolNumber(x == y), nil
+	case "!=":
+		return boolNumber(x != y), nil
+	case "<":
+		return boolNumber(x < y), nil
+	case "<=":
+		return boolNumber(x <= y), nil
+	case ">":
+		return boolNumber(x > y), nil
+	case ">=":
+		return boolNumber(x >= y), nil
+	case "&&":
+		return boolNumber(x != 0 && y != 0), nil
+	case "||":
+		return boolNumber(x != 0 || y != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator %s", e.op)
+}
+
+type callExpr struct {
+	fn   string
+	args []expr
+}
+
+func (e *callExpr) eval(env map[string]float64) (float64, error) {
+	args := make([]float64, len(e.args))
+	for i, a := range e.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+
+	switch e.fn {
+	case "abs":
+		return math.Abs(args[0]), nil
+	case "min":
+		return math.Min(args[0], args[1]), nil
+	case "max":
+		return math.Max(args[0], args[1]), nil
+	}
+	return 0, fmt.Errorf("unknown function %s", e.fn)
+}
+
+var exprFuncs = map[string]int{"abs": 1, "min": 2, "max": 2}
+
+// parser ----------------------------------------------------------------------
+
+// exprLevels lists the binary operators from the lowest to the highest
+// precedence.
+var exprLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<=", ">=", "<", ">"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+	refs   []string
+}
+
+// parseExpr parses s, returning the expression and the tag keys it reads, in
+// order of appearance and without duplicates.
+func parseExpr(s string) (expr, []string, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	e, err := p.binary(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, nil, fmt.Errorf("unexpected %s in %q", p.tokens[p.pos], s)
+	}
+	return e, p.refs, nil
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *exprParser) expect(t string) error {
+	if n := p.next(); n != t {
+		return fmt.Errorf("expected %s, found %q", t, n)
+	}
+	return nil
+}
+
+func (p *exprParser) binary(level int) (expr, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if !containsString(exprLevels[level], op) {
+			return x, nil
+		}
+		p.next()
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryExpr{op, x, y}
+	}
+}
+
+func (p *exprParser) unary() (expr, error) {
+	if op := p.peek(); op == "-" || op == "!" {
+		p.next()
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op, x}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (expr, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case t == "(":
+		e, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case unicode.IsDigit(rune(t[0])) || t[0] == '.':
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t)
+		}
+		return numberExpr(f), nil
+	case isExprIdent(rune(t[0])):
+		if n, ok := exprFuncs[t]; ok && p.peek() == "(" {
+			return p.call(t, n)
+		}
+		if !containsString(p.refs, t) {
+			p.refs = append(p.refs, t)
+		}
+		return refExpr(t), nil
+	}
+	return nil, fmt.Errorf("unexpected %s", t)
+}
+
+func (p *exprParser) call(fn string, n int) (expr, error) {
+	p.next()
+	args := []expr{}
+	for {
+		a, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if len(args) != n {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", fn, n, len(args))
+	}
+	return &callExpr{fn, args}, nil
+}
+
+func tokenizeExpr(s string) ([]string, error) {
+	tokens := []string{}
+	r := []rune(s)
+	for i := 0; i < len(r); {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(r) && (unicode.IsDigit(r[j]) || r[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, string(r[i:j]))
+			i = j
+		case isExprIdent(c):
+			j := i
+			for j < len(r) && (isExprIdent(r[j]) || unicode.IsDigit(r[j]) || strings.ContainsRune(":-.", r[j])) {
+				j++
+			}
+			tokens = append(tokens, string(r[i:j]))
+			i = j
+		case i+1 < len(r) && containsString([]string{"||", "&&", "==", "!=", "<=", ">="}, string(r[i:i+2])):
+			tokens = append(tokens, string(r[i:i+2]))
+			i += 2
+		case strings.ContainsRune("+-*/%<>!(),", c):
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q in %q", c, s)
+		}
+	}
+	return tokens, nil
+}
+
+func isExprIdent(c rune) bool {
+	return unicode.IsLetter(c) || c == '@' || c == '_'
+}
+
+func boolNumber(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	env := map[string]float64{"@a": 6, "@b:c": 4, "@t-1": 1.5}
+	tests := []struct {
+		expr  string
+		value float64
+		refs  []string
+	}{
+		{"1 + 2 * 3", 7, nil},
+		{"(1 + 2) * 3", 9, nil},
+		{"7 % 4 - 1", 2, nil},
+		{"10 / 4", 2.5, nil},
+		{"-@a + 1", -5, []string{"@a"}},
+		{"@a - @b:c", 2, []string{"@a", "@b:c"}},
+		{"@a / @b:c + @a", 7.5, []string{"@a", "@b:c"}},
+		{"@t-1 * 2", 3, []string{"@t-1"}},
+		{"1 < 2 && 2 <= 2", 1, nil},
+		{"1 > 2 || !(3 != 3)", 1, nil},
+		{"@a == 6", 1, []string{"@a"}},
+		{"abs(-2) + min(@a, 3) + max(1, .5)", 6, []string{"@a"}},
+	}
+
+	for _, test := range tests {
+		e, refs, err := parseExpr(test.expr)
+		if err != nil {
+			t.Errorf("Expected %q to parse, got %s", test.expr, err)
+			continue
+		}
+		if fmt.Sprint(refs) != fmt.Sprint(test.refs) {
+			t.Errorf("Expected refs %v in %q, got %v", test.refs, test.expr, refs)
+		}
+		v, err := e.eval(env)
+		if err != nil {
+			t.Errorf("Expected %q to evaluate, got %s", test.expr, err)
+			continue
+		}
+		if v != test.value {
+			t.Errorf("Expected %q to be %g, got %g", test.expr, test.value, v)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 2",
+		"abs(1, 2)",
+		"max(1)",
+		"1 # 2",
+		"1..2",
+	} {
+		if _, _, err := parseExpr(s); err == nil {
+			t.Errorf("Expected %q not to parse", s)
+		}
+	}
+}
+
+func TestEvalExprErrors(t *testing.T) {
+	env := map[string]float64{"@a": 0}
+	for _, s := range []string{"1 / @a", "1 % @a", "@b + 1", "@a-1"} {
+		e, _, err := parseExpr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := e.eval(env); err == nil {
+			t.Errorf("Expected %q to fail, got %g", s, v)
+		}
+	}
+}
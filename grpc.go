@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"github.com/joaodubas/tagging/tagpb"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// GRPCServer serves the Tagging service of tagging.proto for the manager of
+// an API, over HTTP/2 without TLS. Writes are checked as the HTTP API does,
+// and Subscribe is fed by the stream of the API.
+type GRPCServer struct {
+	api *API
+}
+
+func (g *GRPCServer) String() string {
+	return fmt.Sprintf("GRPCServer{Manager: %s}", g.api.manager.Name)
+}
+
+// Serve answers the calls accepted on l, until l is closed.
+func (g *GRPCServer) Serve(l net.Listener) error {
+	return newH2CServer(g).Serve(l)
+}
+
+func (g *GRPCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "only gRPC calls are served", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+
+	req, err := tagpb.ReadMessage(r.Body)
+	if err != nil {
+		tagpb.FinishCall(w, &tagpb.RemoteError{Code: tagpb.InvalidArgument, Message: err.Error()})
+		return
+	}
+
+	var reply []byte
+	switch strings.TrimPrefix(r.URL.Path, tagpb.Service) {
+	case "Read":
+		reply, err = g.read(req)
+	case "Write":
+		reply, err = g.write(req)
+	case "Browse":
+		reply, err = g.browse(req)
+	case "Subscribe":
+		tagpb.FinishCall(w, g.subscribe(w, r, req))
+		return
+	default:
+		err = &tagpb.RemoteError{Code: tagpb.Unimplemented, Message: fmt.Sprintf("unknown method %s", r.URL.Path)}
+	}
+	if err == nil {
+		err = tagpb.WriteMessage(w, reply)
+	}
+	tagpb.FinishCall(w, err)
+}
+
+func (g *GRPCServer) read(b []byte) ([]byte, error) {
+	req := &tagpb.ReadRequest{}
+	if err := req.Unmarshal(b); err != nil {
+		return nil, &tagpb.RemoteError{Code: tagpb.InvalidArgument, Message: err.Error()}
+	}
+
+	reply := &tagpb.ReadResponse{}
+	for _, p := range req.Paths {
+		result := &tagpb.ReadResult{Path: p}
+		if tag, err := g.lookup(p); err != nil {
+			result.Err = &tagpb.RemoteError{Code: http.StatusNotFound, Message: err.Error()}
+		} else {
+			result.State = g.state(tag)
+		}
+		reply.Results = append(reply.Results, result)
+	}
+	return reply.Marshal(), nil
+}
+
+func (g *GRPCServer) write(b []byte) ([]byte, error) {
+	req := &tagpb.WriteRequest{}
+	if err := req.Unmarshal(b); err != nil {
+		return nil, &tagpb.RemoteError{Code: tagpb.InvalidArgument, Message: err.Error()}
+	}
+
+	reply := &tagpb.WriteResponse{}
+	for _, w := range req.Writes {
+		result := &tagpb.WriteResult{Path: w.Path}
+		if tag, err := g.lookup(w.Path); err != nil {
+			result.Err = &tagpb.RemoteError{Code: http.StatusNotFound, Message: err.Error()}
+		} else if _, err := g.api.write(tag, map[string]interface{}{w.Prop: w.Value}); err != nil {
+			result.Err = &tagpb.RemoteError{Code: err.Code, Message: err.Error}
+		}
+		reply.Results = append(reply.Results, result)
+	}
+	return reply.Marshal(), nil
+}
+
+func (g *GRPCServer) browse(b []byte) ([]byte, error) {
+	req := &tagpb.BrowseRequest{}
+	if err := req.Unmarshal(b); err != nil {
+		return nil, &tagpb.RemoteError{Code: tagpb.InvalidArgument, Message: err.Error()}
+	}
+
+	tag, err := g.lookup(req.Path)
+	if err != nil {
+		return nil, &tagpb.RemoteError{Code: tagpb.NotFound, Message: err.Error()}
+	}
+	m, ok := tag.(*TagManager)
+	if !ok {
+		return nil, &tagpb.RemoteError{Code: tagpb.InvalidArgument, Message: fmt.Sprintf("%s is not a tag manager.", req.Path)}
+	}
+
+	reply := &tagpb.BrowseResponse{}
+	for _, c := range m.tags() {
+		reply.Children = append(reply.Children, g.state(c))
+	}
+	return reply.Marshal(), nil
+}
+
+// subscribe sends a snapshot of the selected tags, then their changes until
+// the client cancels the call or the stream of the API ends.
+func (g *GRPCServer) subscribe(w http.ResponseWriter, r *http.Request, b []byte) error {
+	req := &tagpb.SubscribeRequest{}
+	if err := req.Unmarshal(b); err != nil {
+		return &tagpb.RemoteError{Code: tagpb.InvalidArgument, Message: err.Error()}
+	}
+
+	h := g.api.streamHub()
+	if h == nil {
+		return &tagpb.RemoteError{Code: tagpb.FailedPrecondition, Message: "streaming is not enabled"}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return &tagpb.RemoteError{Code: tagpb.Internal, Message: "streaming is not supported"}
+	}
+	s := newSubscriber(g.api.manager.Name, req.Paths, req.Patterns)
+	if !h.add(s) {
+		return &tagpb.RemoteError{Code: tagpb.FailedPrecondition, Message: "streaming is restarting"}
+	}
+	defer h.remove(s)
+
+	snapshot := &tagpb.Event{Snapshot: []*tagpb.TagState{}}
+	g.api.manager.Walk(func(p string, tag Tagger) error {
+		if _, ok := tag.(*TagManager); !ok && s.match(p) {
+			snapshot.Snapshot = append(snapshot.Snapshot, g.state(tag))
+		}
+		return nil
+	})
+	if err := tagpb.WriteMessage(w, snapshot.Marshal()); err != nil {
+		return err
+	}
+	flusher.Flush()
+
+	var failed error
+	send := func(changes []*Change) bool {
+		for _, c := range changes {
+			e := &tagpb.Event{Change: g.change(c)}
+			if failed = tagpb.WriteMessage(w, e.Marshal()); failed != nil {
+				return false
+			}
+		}
+		flusher.Flush()
+		return true
+	}
+	s.follow(req.Throttle, nil, r.Context().Done(), send, nil)
+	return failed
+}
+
+// lookup finds a tagger by path relative to the manager, or by full name.
+func (g *GRPCServer) lookup(p string) (Tagger, error) {
+	if strings.Contains(p, ":") {
+		return g.api.manager.getTag(p)
+	}
+	return g.api.manager.Lookup(p)
+}
+
+// state returns the TagState of tag.
+func (g *GRPCServer) state(tag Tagger) *tagpb.TagState {
+	state := g.api.state(tag)
+	s := &tagpb.TagState{Path: fmt.Sprint(state["Path"]), Props: map[string]interface{}{}}
+	for name, v := range state {
+		if name != "Path" && name != "Children" {
+			s.Props[name] = v
+		}
+	}
+	if children, ok := state["Children"].([]string); ok {
+		s.Children = children
+	}
+	return s
+}
+
+// change converts the Change c, whose raw value is typed by the schema of its
+// tag, and whose property is named as in the schema.
+func (g *GRPCServer) change(c *Change) *tagpb.Change {
+	prop, value := c.Prop, c.Value
+	if tag, err := g.api.manager.Lookup(c.Tag); err == nil {
+		if s, err := schemaOf(tag); err == nil {
+			if p, err := s.ByKey(c.Prop); err == nil {
+				prop = p.Name
+				if v, err := p.Coerce(fmt.Sprint(c.Value)); err == nil {
+					value = v
+				}
+			}
+		}
+	}
+	return &tagpb.Change{Path: c.Tag, Prop: prop, Value: value, Timestamp: c.Timestamp}
+}
+
+// NewGRPCServer serves the manager of api. Subscribe needs API.Stream.
+func NewGRPCServer(api *API) *GRPCServer {
+	return &GRPCServer{api: api}
+}
+
+func newH2CServer(h http.Handler) *http.Server {
+	return &http.Server{Handler: h, Protocols: tagpb.Protocols()}
+}
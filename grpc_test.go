@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/joaodubas/tagging/tagpb"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveGRPC serves tm on a local port, returning a remote tagger of it, the
+// feed streamed to subscribers and a func stopping the server.
+func serveGRPC(t *testing.T, tm *TagManager) (*tagpb.RemoteTagger, *Feed, func()) {
+	api := NewAPI(tm)
+	feed := testFeed()
+	api.Stream(feed)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newH2CServer(NewGRPCServer(api))
+	go s.Serve(l)
+	return tagpb.NewRemoteTagger(l.Addr().String(), ""), feed, func() { s.Close() }
+}
+
+func TestRemoteTagger(t *testing.T) {
+	a := &memTag{Value: 12, Level: 1.5}
+	remote, _, stop := serveGRPC(t, memManager("@g", a, &memTag{}))
+	defer stop()
+
+	if err := remote.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := remote.Get("a", "Value"); err != nil || v != int64(12) {
+		t.Errorf("Value is %v (%v), want 12", v, err)
+	}
+	if v, err := remote.Get("a", "Level"); err != nil || v != 1.5 {
+		t.Errorf("Level is %v (%v), want 1.5", v, err)
+	}
+	if _, err := remote.Get("z", "Value"); err == nil {
+		t.Error("read an unknown tag")
+	}
+
+	if err := remote.Set("a", "Value", 7); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := getProp(a, "Value"); v != 7 {
+		t.Errorf("Value is %v, want 7", v)
+	}
+	for prop, value := range map[string]interface{}{"Value": 3.5, "Colour": 1} {
+		err := remote.Set("a", prop, value)
+		if e, ok := err.(*tagpb.RemoteError); !ok || e.Code < 400 {
+			t.Errorf("wrote %v to %s: %v", value, prop, err)
+		}
+	}
+
+	states, err := remote.Browse("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 2 || states[1].Props["Name"] != "@g:b" {
+		t.Errorf("browsed %v, want a and b", states)
+	}
+	if _, err := remote.Browse("a"); err == nil {
+		t.Error("browsed a tag")
+	}
+}
+
+func TestRemoteSubscribe(t *testing.T) {
+	remote, feed, stop := serveGRPC(t, memManager("@g", &memTag{Value: 1}, &memTag{}))
+	defer stop()
+
+	s, err := remote.Subscribe([]string{"a"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if len(s.Snapshot) != 1 || s.Snapshot[0].Props["Value"] != int64(1) {
+		t.Fatalf("snapshot is %v, want a with Value 1", s.Snapshot)
+	}
+
+	go func() {
+		feed.C <- &Change{Tag: "@g:b", Prop: "Value", Value: "3"}
+		feed.C <- &Change{Tag: "@g:a", Prop: "Value", Value: "2"}
+	}()
+	select {
+	case c := <-s.C:
+		if c.Path != "a" || c.Prop != "Value" || c.Value != int64(2) {
+			t.Errorf("received %s, want Value 2 of a", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no change received")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// alarmJournal is the sorted set holding every alarm event, scored by its time
+// in milliseconds.
+const alarmJournal = "alarms:journal"
+
+// journalLen is the number of events the alarm journal keeps by default.
+const journalLen = 100000
+
+// AlarmEvent is an entry of the alarm journal: a change of condition (ACTIVE,
+// RETURN), an operator action (ACK, SHELVE, UNSHELVE) or a suppression change
+// (SUPPRESS, UNSUPPRESS).
+type AlarmEvent struct {
+	Time    int64      `json:"time"`
+	Seq     int64      `json:"seq"`
+	Tag     string     `json:"tag"`
+	Kind    AlarmKind  `json:"kind"`
+	Event   string     `json:"event"`
+	State   AlarmState `json:"state"`
+	Value   int        `json:"value"`
+	User    string     `json:"user,omitempty"`
+	Comment string     `json:"comment,omitempty"`
+}
+
+func (e *AlarmEvent) String() string {
+	return fmt.Sprintf(
+		"AlarmEvent{Time: %d, Tag: %s, Kind: %s, Event: %s, State: %s, User: %s}",
+		e.Time,
+		e.Tag,
+		e.Kind,
+		e.Event,
+		e.State,
+		e.User,
+	)
+}
+
+// QueryJournal returns the alarm events between from and to, oldest first, of
+// the tags whose name starts with prefix.
+func QueryJournal(conn *Client, from time.Time, to time.Time, prefix string) ([]*AlarmEvent, error) {
+	r, err := conn.Zrangebyscore(
+		alarmJournal,
+		from.UnixNano()/int64(time.Millisecond),
+		to.UnixNano()/int64(time.Millisecond),
+	)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*AlarmEvent{}
+	for _, s := range entries {
+		e := &AlarmEvent{}
+		if err := json.Unmarshal([]byte(s), e); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(e.Tag, prefix) {
+			events = append(events, e)
+		}
+	}
+
+	// events of the same millisecond are sorted by their JSON, not by when
+	// they happened.
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Time != events[j].Time {
+			return events[i].Time < events[j].Time
+		}
+		return events[i].Seq < events[j].Seq
+	})
+	return events, nil
+}
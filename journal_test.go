@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryJournal(t *testing.T) {
+	e, _ := alarmEngine(t)
+	e.Configure("@a:t", &Limits{Hi: intp(10)})
+	e.Configure("@b:t", &Limits{Hi: intp(10)})
+	from := time.Now().Add(-time.Second)
+
+	e.Evaluate("@a:t", 11)
+	e.Evaluate("@b:t", 11)
+	e.Ack("@a:t", HiAlarm, "op", "seen")
+	e.Shelve("@a:t", HiAlarm, time.Minute, "op", "")
+	e.Evaluate("@a:t", 5)
+
+	events, err := QueryJournal(e.conn, from, time.Now().Add(time.Second), "@a:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		event string
+		state AlarmState
+		user  string
+	}{
+		{"ACTIVE", AlarmUnackActive, ""},
+		{"ACK", AlarmAckActive, "op"},
+		{"SHELVE", AlarmAckActive, "op"},
+		{"RETURN", AlarmNormal, ""},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events of @a:, got %v", len(expected), events)
+	}
+	for i, x := range expected {
+		ev := events[i]
+		if ev.Event != x.event || ev.State != x.state || ev.User != x.user || ev.Tag != "@a:t" {
+			t.Errorf("Expected event %d to be %s %s by %q, got %s", i, x.event, x.state, x.user, ev)
+		}
+	}
+	if events[1].Comment != "seen" {
+		t.Errorf("Expected the ACK comment, got %q", events[1].Comment)
+	}
+
+	if events, _ := QueryJournal(e.conn, from.Add(-time.Hour), from, ""); len(events) != 0 {
+		t.Errorf("Expected no events before the test, got %v", events)
+	}
+}
+
+func TestJournalRetention(t *testing.T) {
+	e, r := alarmEngine(t)
+	e.JournalLen = 3
+	e.Configure("@a:t", &Limits{Hi: intp(10)})
+	for i := 0; i < 5; i++ {
+		e.Evaluate("@a:t", 11)
+		e.Evaluate("@a:t", 5)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	r.mu.Lock()
+	n := len(r.zsets[alarmJournal])
+	r.mu.Unlock()
+	if n != 3 {
+		t.Fatalf("Expected the journal to keep 3 events, got %d", n)
+	}
+	events, err := QueryJournal(e.conn, time.Now().Add(-time.Minute), time.Now(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[2].Event != "RETURN" || events[2].Seq != 10 {
+		t.Errorf("Expected the newest events to be kept, got %v", events)
+	}
+}
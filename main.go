@@ -1,155 +1,900 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	"time"
 )
 
+// tagctl inspects and writes the tags stored in redis. Build it with
+// go build -o tagctl, then run tagctl help for the commands.
 func main() {
-	conn, err := NewClient("127.0.0.1:6379")
-	handleError("Error connecting with redis:", err)
-	defer conn.Close()
+	log.SetFlags(0)
+	log.SetPrefix("tagctl: ")
 
-	toyHandler(conn)
+	c := &ctl{}
+	flag.StringVar(&c.Addr, "addr", "127.0.0.1:6379", "redis `address`")
+	flag.StringVar(&c.Auth, "auth", "", "redis `password`")
+	flag.IntVar(&c.DB, "db", 0, "redis database `number`")
+	flag.StringVar(&c.Output, "o", "table", "output `format`, table or json")
+	flag.StringVar(&c.Mode, "mode", "", "change `mode` of the managers: keyspace, publish or stream, the one stored for them or keyspace by default")
+	flag.Usage = usage
+	flag.Parse()
 
-	tagManagerHandler(conn)
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		log.Printf("unknown command %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := c.run(cmd, flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func handleError(msg string, err error) {
-	if err != nil {
-		log.Fatal(msg, err)
-		os.Exit(1)
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: tagctl [flags] command [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s %s\t%s\n", name, commands[name].Args, commands[name].Help)
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stderr, "\nTags are named as @pressure:tank-0 or by path, as @pressure/tank-0.\n\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// command ---------------------------------------------------------------------
+
+// command is a tagctl subcommand. Run receives the arguments following the
+// command name.
+type command struct {
+	Args string
+	Help string
+	Run  func(c *ctl, args []string) error
 }
 
-// toy method ------------------------------------------------------------------
+var commands = map[string]*command{}
 
-func toyHandler(conn *Client) {
-	setString(conn)
-	setSet(conn)
-	setPubSub(conn)
-	setMultiExec(conn)
-	setMultiDiscard(conn)
+func init() {
+	commands["list"] = &command{"[pattern]", "list the tags matching pattern, all by default", (*ctl).list}
+	commands["get"] = &command{"tag [prop]", "read a tag, or one of its props", (*ctl).get}
+	commands["set"] = &command{"tag prop value", "write a prop of a tag", (*ctl).set}
+	commands["watch"] = &command{"[manager...]", "stream the changes of managers, all by default", (*ctl).watch}
+	commands["describe"] = &command{"tag", "show the props, meta and alarms of a tag", (*ctl).describe}
+	commands["import"] = &command{"[-n] file", "write the tags of a config file, or print its diff with -n", (*ctl).importConfig}
+	commands["export"] = &command{"[pattern]", "print the config of the stored tags", (*ctl).exportConfig}
+	commands["history"] = &command{"[-from t] [-to t] [-tags patterns] [-format f] manager...", "print the change log of managers in stream mode", (*ctl).history}
+	commands["alarms"] = &command{"[-journal] [-from t] [-to t] [tag]", "list the active alarms, or the alarm journal, of the tags under tag", (*ctl).alarms}
+	commands["serve"] = &command{"config", "run the tags, alarms and services of a config file, reloading it on SIGHUP", (*ctl).serve}
+	commands["help"] = &command{"", "show this help", func(c *ctl, args []string) error {
+		usage()
+		return nil
+	}}
 }
 
-func setString(conn *Client) {
-	conn.Set("key:string", "ola")
-	r, err := conn.Get("key:string")
-	handleError("Error getting key:", err)
-	fmt.Printf("the key %s is %s\n", "key:string", r)
+// ctl holds the global flags and the connections shared by commands.
+type ctl struct {
+	Addr   string
+	Auth   string
+	DB     int
+	Output string
+	Mode   string
+	conn   *Client
+	psconn *PSClient
+	mode   ChangeMode
+	out    io.Writer
 }
 
-func setSet(conn *Client) {
-	conn.Sadd("key:set", "ola", "mundo")
-	r, err := conn.Scard("key:set")
-	handleError("Error getting key:", err)
-	fmt.Printf("the key %s has len %s\n", "key:set", r)
-	r, err = conn.Smembers("key:set")
-	handleError("Error getting key:", err)
-	for _, e := range r.Elems {
-		fmt.Printf("the key %s has elem %s\n", "key:set", e)
+func (c *ctl) String() string {
+	return fmt.Sprintf("ctl{Addr: %s, DB: %d, Output: %s, Mode: %s}", c.Addr, c.DB, c.Output, c.Mode)
+}
+
+func (c *ctl) run(cmd *command, args []string) error {
+	if c.Output != "table" && c.Output != "json" {
+		return fmt.Errorf("invalid output %s", c.Output)
+	}
+	c.mode = KeyspaceChanges
+	if c.Mode != "" {
+		mode, err := ParseChangeMode(c.Mode)
+		if err != nil {
+			return err
+		}
+		c.mode = mode
 	}
+	if c.out == nil {
+		c.out = os.Stdout
+	}
+
+	defer c.close()
+	return cmd.Run(c, args)
 }
 
-func setPubSub(conn *Client) {
-	nconn, err := NewClient("127.0.0.1:6379")
-	handleError("Error getting key:", err)
-	psconn := NewPSClient(nconn)
-	defer psconn.Close()
+// managerMode returns the change mode stored for the manager called name, or
+// the one of the mode flag. A mode flag contradicting the stored mode is an
+// error, as changes would be propagated where nobody listens.
+func (c *ctl) managerMode(conn *Client, name string) (ChangeMode, error) {
+	mode, ok, err := storedMode(conn, name)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return c.mode, nil
+	}
+	if c.Mode != "" && mode != c.mode {
+		return 0, fmt.Errorf("%s is in %s mode, not %s", name, mode, c.mode)
+	}
+	return mode, nil
+}
 
-	sub := psconn.Subscribe("channel:test")
-	_, err = conn.Publish("channel:test", "hello")
-	handleError("Did not publish message:", err)
-	sub = psconn.Receive()
-	if !sub.Timeout() {
-		fmt.Printf("Received message from channel %s %s\n", sub.Channel, sub.Message)
-	} else {
-		handleError("Timeout for receive message", fmt.Errorf("Timeout"))
+// connect dials redis once, on the first command needing it.
+func (c *ctl) connect() (*Client, error) {
+	if c.conn != nil {
+		return c.conn, nil
+	}
+	conn, err := Dial(c.Addr, c.Auth, c.DB)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to redis at %s: %s", c.Addr, err)
 	}
+	c.conn = conn
+	return conn, nil
 }
 
-func setMultiExec(conn *Client) {
-	conn.Multi()
-	conn.Add("set", "key:pipe:1", "ola")
-	conn.Add("set", "key:pipe:2", "hello")
-	conn.Add("set", "key:pipe:3", "oie")
-	conn.Add("set", "key:pipe:4", "hi")
-	ar1 := conn.Add("get", "key:pipe:1")
-	ar2 := conn.Add("get", "key:pipe:2")
-	ar3 := conn.Add("get", "key:pipe:3")
-	ar4 := conn.Add("get", "key:pipe:4")
-	r, err := conn.Exec()
-	handleError("Something went wrong with pipe:", err)
-	fmt.Printf("Responses: %s, %s, %s, %s\n", <-ar1, <-ar2, <-ar3, <-ar4)
-	for i, e := range r.Elems {
-		fmt.Printf("Result for op %d: %s\n", i, e)
+// subscribe dials the connection used by feeds and tag watchers.
+func (c *ctl) subscribe() (*PSClient, error) {
+	if c.psconn != nil {
+		return c.psconn, nil
+	}
+	conn, err := Dial(c.Addr, c.Auth, c.DB)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to redis at %s: %s", c.Addr, err)
 	}
+	c.psconn = NewPSClient(conn)
+	return c.psconn, nil
 }
 
-func setMultiDiscard(conn *Client) {
-	conn.Multi()
-	conn.Add("set", "key:pipe:1", "ola")
-	conn.Add("set", "key:pipe:2", "hello")
-	conn.Add("get", "key:pipe:1")
-	conn.Add("get", "key:pipe:2")
-	r, err := conn.Discard()
-	handleError("Something went wrong with pipe:", err)
-	fmt.Printf("Result for discard %s\n", r)
+func (c *ctl) close() {
+	if c.psconn != nil {
+		c.psconn.Close()
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
 }
 
-// tag method ------------------------------------------------------------------
+// commands --------------------------------------------------------------------
 
-func tagManagerHandler(conn *Client) {
-	tm := NewTagManager("@pressure")
+func (c *ctl) list(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("list takes a single pattern")
+	}
+	pattern := "*"
+	if len(args) == 1 {
+		pattern = tagName(args[0])
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	names, err := ScanTags(conn, pattern)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
 
-	ch := make(chan *Tag)
-	limit := 1
-	info := 1
+	tags := []Tagger{}
+	for _, name := range names {
+		t, err := loadTagger(conn, name)
+		if err != nil {
+			return err
+		}
+		tags = append(tags, t)
+	}
 
-	initial := time.Now()
-	go func(tm *TagManager, conn *Client) {
-		psclient, err := NewClient("127.0.0.1:6379")
-		handleError("Could not connect with redis:", err)
-		psconn := NewPSClient(psclient)
+	if c.Output == "json" {
+		states := make([]map[string]interface{}, len(tags))
+		for i, t := range tags {
+			states[i] = tagState(t)
+		}
+		return c.json(states)
+	}
+	rows := [][]string{}
+	for _, t := range tags {
+		tag := tagOf(t)
+		value, _ := getProp(t, "Value")
+		rows = append(rows, []string{
+			tag.Name,
+			fmt.Sprint(value),
+			fmt.Sprint(tag.Quality),
+			formatTime(time.Unix(tag.Timestamp, 0)),
+			tag.Description,
+		})
+	}
+	return c.table([]string{"TAG", "VALUE", "QUALITY", "UPDATED", "DESCRIPTION"}, rows)
+}
 
-		for i := 0; i < limit; i++ {
-			go func(tm *TagManager, conn *Client, psconn *PSClient, i int) {
-				ch <- NewTag(
-					conn,
-					psconn,
-					fmt.Sprintf("tank-%d", i),
-					fmt.Sprintf("tank %d", i),
-					0,
-					100,
-				)
-			}(tm, conn, psconn, i)
+func (c *ctl) get(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("get takes a tag and an optional prop")
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	t, err := loadTagger(conn, tagName(args[0]))
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		return c.state(t)
+	}
+	v, err := getProp(t, propName(t, args[1]))
+	if err != nil {
+		return err
+	}
+	if c.Output == "json" {
+		return c.json(v)
+	}
+	if m, ok := v.(map[string]string); ok {
+		v = encodeMeta(m)
+	}
+	_, err = fmt.Fprintln(c.out, v)
+	return err
+}
+
+// set writes through the tag, so the change is propagated with the mode of
+// its manager.
+func (c *ctl) set(args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("set takes a tag, a prop and a value")
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	name := tagName(args[0])
+	t, err := loadTagger(conn, name)
+	if err != nil {
+		return err
+	}
+
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		mode, err := c.managerMode(conn, name[:i])
+		if err != nil {
+			return err
+		}
+		t.(changeNotifier).notifyOn(mode, changeTarget(mode, name[:i]))
+	}
+	if err := t.Set(name, propName(t, args[1]), args[2]); err != nil {
+		return err
+	}
+
+	if t, err = loadTagger(conn, name); err != nil {
+		return err
+	}
+	return c.state(t)
+}
+
+// watch prints changes until interrupted. Managers in stream mode must be
+// listed, nested ones included, as each has its own change log.
+func (c *ctl) watch(args []string) error {
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		args = []string{"*"}
+	}
+	managers := make([]*TagManager, len(args))
+	for i, a := range args {
+		mode, err := c.managerMode(conn, tagName(a))
+		if err != nil {
+			return err
 		}
-	}(tm, conn)
-	endCreate := time.Now()
+		if i > 0 && mode != managers[0].Mode {
+			return fmt.Errorf("%s and %s have different change modes, watch them apart", managers[0].Name, tagName(a))
+		}
+		managers[i] = &TagManager{Name: tagName(a), Mode: mode}
+	}
+	mode := managers[0].Mode
+	if mode == StreamChanges && args[0] == "*" {
+		return fmt.Errorf("watch needs the managers to follow in stream mode")
+	}
+	psconn, err := c.subscribe()
+	if err != nil {
+		return err
+	}
+
+	targets := []string{}
+	for _, tm := range managers {
+		targets = append(targets, tm.changeTargets()...)
+	}
+	feed := NewFeed(conn, psconn, mode, targets...)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
 
-	prev := endCreate
+	e := json.NewEncoder(c.out)
 	for {
-		v := <-ch
-		tm.Append(v)
-		v.Set(v.Name, "value", 50)
-		if len(tm.Tags)%info == 0 {
-			now := time.Now()
-			fmt.Printf("To append %d: %s\n", len(tm.Tags), now.Sub(prev))
-			prev = now
+		select {
+		case <-interrupt:
+			return feed.Close()
+		case ch := <-feed.C:
+			if c.Output == "json" {
+				ch.Value = changeValue(nil, ch)
+				err = e.Encode(ch)
+			} else {
+				_, err = fmt.Fprintf(
+					c.out,
+					"%s  %s  %s  %v\n",
+					formatTime(time.Unix(ch.Timestamp, 0)),
+					ch.Tag,
+					ch.Prop,
+					ch.Value,
+				)
+			}
+			if err != nil {
+				feed.Close()
+				return err
+			}
 		}
-		if len(tm.Tags) == limit {
-			break
+	}
+}
+
+func (c *ctl) describe(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("describe takes a tag")
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	name := tagName(args[0])
+	t, err := loadTagger(conn, name)
+	if err != nil {
+		return err
+	}
+	s, err := schemaOf(t)
+	if err != nil {
+		return err
+	}
+	r, err := conn.Hgetall(alarmsKey(name))
+	if err != nil {
+		return err
+	}
+	alarms, err := decodeAlarms(r.Elems)
+	if err != nil {
+		return err
+	}
+
+	if c.Output == "json" {
+		props := []map[string]interface{}{}
+		for _, p := range s.Props {
+			props = append(props, map[string]interface{}{
+				"Name":     p.Name,
+				"Key":      p.Key,
+				"Type":     p.Type.String(),
+				"Editable": p.Editable,
+				"Value":    p.Get(t),
+			})
 		}
+		return c.json(map[string]interface{}{
+			"Path":   keyPath(name),
+			"Props":  props,
+			"Alarms": alarms,
+		})
 	}
-	endAppend := time.Now()
 
-	fmt.Println("Added:", tm)
+	rows := [][]string{}
+	meta := map[string]string{}
+	for _, p := range s.Props {
+		v := p.Get(t)
+		if m, ok := v.(map[string]string); ok {
+			meta, v = m, encodeMeta(m)
+		}
+		rows = append(rows, []string{p.Name, p.Key, p.Type.String(), fmt.Sprint(p.Editable), fmt.Sprint(v)})
+	}
+	if err := c.table([]string{"PROP", "KEY", "TYPE", "EDITABLE", "VALUE"}, rows); err != nil {
+		return err
+	}
+
+	if len(meta) > 0 {
+		rows = [][]string{}
+		for _, k := range sortedMeta(meta) {
+			rows = append(rows, []string{k, meta[k]})
+		}
+		fmt.Fprintln(c.out)
+		if err := c.table([]string{"META", "VALUE"}, rows); err != nil {
+			return err
+		}
+	}
+
+	if len(alarms) > 0 {
+		fmt.Fprintln(c.out)
+		return c.alarmTable(alarms)
+	}
+	return nil
+}
+
+// importConfig writes every tag of the config file, values included. Limits
+// are only applied by a running server. With -n, it prints how the stored
+// tags differ from the file instead, as a reload would see it.
+func (c *ctl) importConfig(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("n", false, "print the changes without writing them")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("import takes a config file, - for stdin")
+	}
+
+	r := io.Reader(os.Stdin)
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	cfg, err := LoadConfig(r)
+	if err != nil {
+		return err
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
 
-	fmt.Println("To create tags:", endCreate.Sub(initial))
-	fmt.Println("To append tags:", endAppend.Sub(endCreate))
-	fmt.Println("Total:", endAppend.Sub(initial))
+	if *dryRun {
+		managers, err := loadManagers(conn, "*", c.mode)
+		if err != nil {
+			return err
+		}
+		diff := DiffConfig(managers, cfg, conn, nil)
+		for _, m := range cfg.Managers {
+			if !hasManager(managers, m.Name) {
+				diff = append(diff, &ConfigChange{Op: "+", Name: m.Name})
+			}
+		}
+		if c.Output == "json" {
+			return c.json(diff)
+		}
+		_, err = fmt.Fprintln(c.out, diff)
+		return err
+	}
 
-	time.Sleep(15 * time.Second)
+	managers, err := cfg.Build(conn, nil)
+	for _, tm := range managers {
+		tm.Close()
+	}
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, tm := range managers {
+		tm.Walk(func(p string, tag Tagger) error {
+			if _, ok := tag.(*TagManager); !ok {
+				count++
+			}
+			return nil
+		})
+	}
+	_, err = fmt.Fprintf(c.out, "imported %d tags\n", count)
+	return err
+}
+
+// exportConfig prints the stored tags as a config. Every manager is exported
+// with its stored mode, or the mode flag, and instances of templates as plain managers.
+func (c *ctl) exportConfig(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("export takes a single pattern")
+	}
+	pattern := "*"
+	if len(args) == 1 {
+		pattern = tagName(args[0])
+	}
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	managers, err := loadManagers(conn, pattern, c.mode)
+	if err != nil {
+		return err
+	}
+	return ExportConfig(managers, nil).Write(c.out)
+}
+
+// serve runs the server over connections of its own, dialed with the global
+// flags.
+func (c *ctl) serve(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("serve takes a config file")
+	}
+	log.SetFlags(log.LstdFlags)
+	return NewServer(args[0], func() (*Client, error) {
+		return Dial(c.Addr, c.Auth, c.DB)
+	}).Run()
+}
+
+func (c *ctl) history(args []string) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	from := fs.String("from", "1h", "start `time`, as RFC 3339 or a duration before now")
+	to := fs.String("to", "0s", "end `time`, as RFC 3339 or a duration before now")
+	tags := fs.String("tags", "", "comma separated tag `patterns`, as @pressure:tank-*")
+	format := fs.String("format", "", "output `format`: table, json, csv or line, the -o flag by default")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("history needs the managers to read")
+	}
+
+	now := time.Now()
+	start, err := parseTime(*from, now)
+	if err != nil {
+		return err
+	}
+	end, err := parseTime(*to, now)
+	if err != nil {
+		return err
+	}
+	managers := make([]string, fs.NArg())
+	for i, a := range fs.Args() {
+		managers[i] = tagName(a)
+	}
+	patterns := []string{}
+	for _, p := range splitParam(*tags) {
+		patterns = append(patterns, tagName(p))
+	}
+
+	if *format == "" {
+		*format = c.Output
+	}
+	var write func(e *StreamEntry) error
+	var flush func() error
+	switch *format {
+	case "csv":
+		w := NewCSVWriter(c.out, time.RFC3339)
+		write, flush = w.WriteEntry, w.Flush
+	case "line":
+		w := NewLineWriter(c.out, "tagging")
+		write, flush = w.WriteEntry, w.Flush
+	case "json":
+		changes := []*Change{}
+		write = func(e *StreamEntry) error {
+			e.Change.Value = changeValue(nil, e.Change)
+			changes = append(changes, e.Change)
+			return nil
+		}
+		flush = func() error { return c.json(changes) }
+	case "table":
+		rows := [][]string{}
+		write = func(e *StreamEntry) error {
+			rows = append(rows, []string{formatTime(entryTime(e)), e.Change.Tag, e.Change.Prop, fmt.Sprint(e.Change.Value)})
+			return nil
+		}
+		flush = func() error { return c.table([]string{"TIME", "TAG", "PROP", "VALUE"}, rows) }
+	default:
+		return fmt.Errorf("invalid format %s", *format)
+	}
+
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	if err := ReadHistory(conn, managers, start, end, patterns, write); err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (c *ctl) alarms(args []string) error {
+	fs := flag.NewFlagSet("alarms", flag.ExitOnError)
+	journal := fs.Bool("journal", false, "list the alarm events instead of the active alarms")
+	from := fs.String("from", "24h", "start `time` of the journal, as RFC 3339 or a duration before now")
+	to := fs.String("to", "0s", "end `time` of the journal, as RFC 3339 or a duration before now")
+	fs.Parse(args)
+	if fs.NArg() > 1 {
+		return fmt.Errorf("alarms takes a single tag")
+	}
+	tag := tagName(fs.Arg(0))
+
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	if !*journal {
+		all, err := ActiveAlarms(conn)
+		if err != nil {
+			return err
+		}
+		alarms := []*Alarm{}
+		for _, a := range all {
+			if underTag(a.Tag, tag) {
+				alarms = append(alarms, a)
+			}
+		}
+		sort.Sort(byAlarm(alarms))
+		if c.Output == "json" {
+			return c.json(alarms)
+		}
+		return c.alarmTable(alarms)
+	}
+
+	now := time.Now()
+	start, err := parseTime(*from, now)
+	if err != nil {
+		return err
+	}
+	end, err := parseTime(*to, now)
+	if err != nil {
+		return err
+	}
+	all, err := QueryJournal(conn, start, end, tag)
+	if err != nil {
+		return err
+	}
+	events := []*AlarmEvent{}
+	for _, e := range all {
+		if underTag(e.Tag, tag) {
+			events = append(events, e)
+		}
+	}
+	if c.Output == "json" {
+		return c.json(events)
+	}
+	rows := [][]string{}
+	for _, e := range events {
+		rows = append(rows, []string{
+			formatTime(time.Unix(0, e.Time*int64(time.Millisecond))),
+			e.Tag,
+			string(e.Kind),
+			e.Event,
+			string(e.State),
+			fmt.Sprint(e.Value),
+			e.User,
+			e.Comment,
+		})
+	}
+	return c.table([]string{"TIME", "TAG", "KIND", "EVENT", "STATE", "VALUE", "USER", "COMMENT"}, rows)
+}
+
+// output ----------------------------------------------------------------------
+
+func (c *ctl) table(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, r := range rows {
+		fmt.Fprintln(w, strings.Join(r, "\t"))
+	}
+	return w.Flush()
+}
+
+func (c *ctl) json(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = c.out.Write(append(b, '\n'))
+	return err
+}
+
+// state prints every prop of t, one per row.
+func (c *ctl) state(t Tagger) error {
+	state := tagState(t)
+	if c.Output == "json" {
+		return c.json(state)
+	}
+	s, err := schemaOf(t)
+	if err != nil {
+		return err
+	}
+	rows := [][]string{}
+	for _, p := range s.Props {
+		v := state[p.Name]
+		if m, ok := v.(map[string]string); ok {
+			v = encodeMeta(m)
+		}
+		rows = append(rows, []string{p.Name, fmt.Sprint(v)})
+	}
+	return c.table([]string{"PROP", "VALUE"}, rows)
+}
+
+func (c *ctl) alarmTable(alarms []*Alarm) error {
+	rows := [][]string{}
+	for _, a := range alarms {
+		state := string(a.State)
+		if a.IsShelved(ts()) {
+			state += " (shelved)"
+		}
+		if a.Suppressed {
+			state += " (suppressed)"
+		}
+		rows = append(rows, []string{
+			a.Tag,
+			string(a.Kind),
+			state,
+			fmt.Sprint(a.Value),
+			formatFloat(a.Limit),
+			formatTime(time.Unix(a.Since, 0)),
+			a.AckedBy,
+		})
+	}
+	return c.table([]string{"TAG", "KIND", "STATE", "VALUE", "LIMIT", "SINCE", "ACKED BY"}, rows)
+}
+
+// redis -----------------------------------------------------------------------
+
+// loadTagger reads the tag called name from redis, as a CalcTag when an
+// expression is stored for it.
+func loadTagger(conn *Client, name string) (Tagger, error) {
+	t := &Tag{conn: conn, Name: name, Meta: map[string]string{}}
+	r, err := conn.Get(t.key(name, "expression"))
+	if err != nil {
+		return nil, err
+	}
+	if e, err := r.Str(); err == nil {
+		c := &CalcTag{Tag: Tag{conn: conn, Name: name, Meta: map[string]string{}}, Expression: e}
+		if err := c.load(name); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	if err := t.load(name); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// loadManagers rebuilds the managers of the tags stored in redis matching
+// pattern, from their names. Managers take their stored change mode, or mode.
+// Neither managers nor tags are initialized.
+func loadManagers(conn *Client, pattern string, mode ChangeMode) ([]*TagManager, error) {
+	names, err := ScanTags(conn, pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	roots := []*TagManager{}
+	managers := map[string]*TagManager{}
+	for _, name := range names {
+		parts := strings.Split(name, ":")
+		if len(parts) < 2 {
+			log.Printf("Skipping %s, out of any manager.\n", name)
+			continue
+		}
+
+		var parent *TagManager
+		for i := range parts[:len(parts)-1] {
+			n := strings.Join(parts[:i+1], ":")
+			tm, ok := managers[n]
+			if !ok {
+				tm = NewTagManager(n)
+				tm.Mode = mode
+				if m, ok, err := storedMode(conn, n); err != nil {
+					return nil, err
+				} else if ok {
+					tm.Mode = m
+				}
+				managers[n] = tm
+				if parent == nil {
+					roots = append(roots, tm)
+				} else {
+					parent.add(tm)
+				}
+			}
+			parent = tm
+		}
+
+		t, err := loadTagger(conn, name)
+		if err != nil {
+			return nil, err
+		}
+		parent.add(t)
+	}
+	return roots, nil
+}
+
+// utility ---------------------------------------------------------------------
+
+// tagName turns a tag path into a tag name.
+func tagName(s string) string {
+	return strings.Replace(strings.Trim(s, "/"), "/", ":", -1)
+}
+
+// underTag tells whether name is tag or a tag under it, as @a:b is under @a
+// but @ab isn't. Every name is under the empty tag.
+func underTag(name string, tag string) bool {
+	return tag == "" || name == tag || strings.HasPrefix(name, tag+":")
+}
+
+// propName returns the name of the prop of t stored under the key s, as value
+// for Value, or s itself.
+func propName(t Tagger, s string) string {
+	if schema, err := schemaOf(t); err == nil {
+		if p, err := schema.ByKey(s); err == nil {
+			return p.Name
+		}
+	}
+	return s
+}
+
+func tagOf(t Tagger) *Tag {
+	if c, ok := t.(*CalcTag); ok {
+		return &c.Tag
+	}
+	return t.(*Tag)
+}
+
+func tagState(t Tagger) map[string]interface{} {
+	state := map[string]interface{}{"Path": keyPath(nameOf(t))}
+	if s, err := schemaOf(t); err == nil {
+		for _, p := range s.Props {
+			state[p.Name] = p.Get(t)
+		}
+	}
+	return state
+}
+
+// parseTime reads s as an RFC 3339 time, or as a duration before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %s, use RFC 3339 or a duration", s)
+	}
+	return t, nil
+}
+
+func formatTime(t time.Time) string {
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func sortedMeta(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func hasManager(managers []*TagManager, name string) bool {
+	for _, tm := range managers {
+		if tm.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type byAlarm []*Alarm
+
+func (a byAlarm) Len() int      { return len(a) }
+func (a byAlarm) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byAlarm) Less(i, j int) bool {
+	if a[i].Tag != a[j].Tag {
+		return a[i].Tag < a[j].Tag
+	}
+	return a[i].Kind < a[j].Kind
 }
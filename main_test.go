@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runCtl runs the tagctl command name against r, returning what it printed.
+func runCtl(t *testing.T, r *testRedis, name string, args ...string) (string, error) {
+	var b bytes.Buffer
+	c := &ctl{Addr: r.Addr(), Output: "table", out: &b}
+	err := c.run(commands[name], args)
+	return b.String(), err
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for s, want := range map[string]time.Time{
+		"1h":                   now.Add(-time.Hour),
+		"90s":                  now.Add(-90 * time.Second),
+		"2020-04-30T10:00:00Z": time.Date(2020, 4, 30, 10, 0, 0, 0, time.UTC),
+	} {
+		got, err := parseTime(s, now)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("Expected %s to be %s, got %s", s, want, got)
+		}
+	}
+	for _, s := range []string{"", "yesterday", "2020-04-30"} {
+		if _, err := parseTime(s, now); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestTagName(t *testing.T) {
+	for s, want := range map[string]string{
+		"@p:a":      "@p:a",
+		"@p/a":      "@p:a",
+		"/@p/b/c/":  "@p:b:c",
+		"@p/b:c/d":  "@p:b:c:d",
+		"@pressure": "@pressure",
+	} {
+		if got := tagName(s); got != want {
+			t.Errorf("Expected %s named %s, got %s", s, want, got)
+		}
+	}
+}
+
+func TestLoadTagger(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+
+	tm := NewTagManager("@l")
+	defer tm.Close()
+	if err := tm.Append(NewTag(conn, "a", "pump", 3, QualityGood)); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCalcTag(conn, "c", "", "@l:a / 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Append(c); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := loadTagger(conn, "@l:a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, ok := a.(*Tag); !ok || tag.Value != 3 || tag.Description != "pump" {
+		t.Errorf("Expected tag @l:a with 3, got %v", a)
+	}
+
+	l, err := loadTagger(conn, "@l:c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calc, ok := l.(*CalcTag); !ok || calc.Value != 1.5 || calc.Expression != "@l:a / 2" {
+		t.Errorf("Expected calculated tag @l:c with 1.5, got %v", l)
+	}
+
+	if _, err := loadTagger(conn, "@l:z"); err == nil {
+		t.Error("Expected @l:z not to be found")
+	}
+}
+
+func TestCtlImport(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+
+	file := filepath.Join(t.TempDir(), "tags.json")
+	config := `{"managers": [{"name": "@i", "tags": [
+  {"name": "a", "value": 4, "description": "tank"},
+  {"name": "b", "value": 5}
+]}]}`
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runCtl(t, r, "import", "-n", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "+ @i") {
+		t.Errorf("Expected @i to be added, got %q", out)
+	}
+	if v := r.get("@i:a:value"); v != "" {
+		t.Errorf("Expected nothing written by a dry run, got %s", v)
+	}
+
+	out, err = runCtl(t, r, "import", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "imported 2 tags\n" {
+		t.Errorf("Expected 2 tags imported, got %q", out)
+	}
+	if v := r.get("@i:b:value"); v != "5" {
+		t.Errorf("Expected b imported with 5, got %s", v)
+	}
+
+	config = strings.Replace(config, `"value": 5`, `"value": 5, "description": "valve"`, 1)
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runCtl(t, r, "import", "-n", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "+") || !strings.Contains(out, `~ @i:b description "valve"`) {
+		t.Errorf("Expected only the description of b to change, got %q", out)
+	}
+
+	if out, err = runCtl(t, r, "get", "@i/a", "value"); err != nil || out != "4\n" {
+		t.Errorf("Expected get to print 4, got %q, %v", out, err)
+	}
+	if _, err = runCtl(t, r, "set", "@i/a", "value", "6"); err != nil {
+		t.Fatal(err)
+	}
+	if v := r.get("@i:a:value"); v != "6" {
+		t.Errorf("Expected set to write 6, got %s", v)
+	}
+	if _, err = runCtl(t, r, "get", "@i/z"); err == nil {
+		t.Error("Expected get to fail for an unknown tag")
+	}
+}
+
+func TestCtlStoredMode(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+
+	file := filepath.Join(t.TempDir(), "tags.json")
+	config := `{"managers": [{"name": "@s", "mode": "stream", "tags": [{"name": "a", "value": 1}]}]}`
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runCtl(t, r, "import", file); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runCtl(t, r, "set", "@s/a", "value", "2"); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	n := len(r.stream("@s:changelog").entries)
+	r.mu.Unlock()
+	if n != 1 {
+		t.Errorf("Expected the write logged in the stream of @s, got %d entries", n)
+	}
+
+	var b bytes.Buffer
+	c := &ctl{Addr: r.Addr(), Output: "table", Mode: "keyspace", out: &b}
+	if err := c.run(commands["set"], []string{"@s/a", "value", "3"}); err == nil {
+		t.Error("Expected set to fail with a mode flag contradicting the stored mode")
+	}
+	if v := r.get("@s:a:value"); v != "2" {
+		t.Errorf("Expected a not to be written, got %s", v)
+	}
+}
+
+func TestUnderTag(t *testing.T) {
+	for _, c := range []struct {
+		name, tag string
+		want      bool
+	}{
+		{"@a:b", "", true},
+		{"@a:b", "@a", true},
+		{"@a:b", "@a:b", true},
+		{"@ab:c", "@a", false},
+		{"@a:bc", "@a:b", false},
+	} {
+		if got := underTag(c.name, c.tag); got != c.want {
+			t.Errorf("Expected underTag(%q, %q) to be %v", c.name, c.tag, c.want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is an internal metric exported in the prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// counter ---------------------------------------------------------------------
+
+// counter is a prometheus counter with an optional label.
+type counter struct {
+	Name   string
+	Help   string
+	Label  string
+	values map[string]float64
+	mu     sync.Mutex
+}
+
+func (c *counter) String() string {
+	return fmt.Sprintf("counter{Name: %s}", c.Name)
+}
+
+// Inc increments the series of label value l, which is ignored when the
+// counter has no label.
+func (c *counter) Inc(l string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[l]++
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name)
+	if c.Label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.Name, formatFloat(c.values[""]))
+		return
+	}
+	for _, l := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", c.Name, c.Label, escapeLabel(l), formatFloat(c.values[l]))
+	}
+}
+
+func newCounter(name string, help string, label string) *counter {
+	return &counter{Name: name, Help: help, Label: label, values: map[string]float64{}}
+}
+
+// histogram -------------------------------------------------------------------
+
+// histogram is a prometheus histogram of durations, in seconds, with an
+// optional label.
+type histogram struct {
+	Name    string
+	Help    string
+	Label   string
+	Buckets []float64
+	series  map[string]*histogramSeries
+	mu      sync.Mutex
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) String() string {
+	return fmt.Sprintf("histogram{Name: %s}", h.Name)
+}
+
+// Since observes the time elapsed since start in the series of label value l.
+func (h *histogram) Since(l string, start time.Time) {
+	v := time.Since(start).Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[l]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.Buckets))}
+		h.series[l] = s
+	}
+	for i, b := range h.Buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name)
+
+	keys := make([]string, 0, len(h.series))
+	for l := range h.series {
+		keys = append(keys, l)
+	}
+	sort.Strings(keys)
+	for _, l := range keys {
+		s := h.series[l]
+		labels := ""
+		if h.Label != "" {
+			labels = fmt.Sprintf("%s=\"%s\",", h.Label, escapeLabel(l))
+		}
+		for i, b := range h.Buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.Name, labels, formatFloat(b), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.Name, labels, s.count)
+		labels = strings.TrimSuffix(labels, ",")
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, labels, s.count)
+	}
+}
+
+func newHistogram(name string, help string, label string) *histogram {
+	return &histogram{
+		Name:    name,
+		Help:    help,
+		Label:   label,
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		series:  map[string]*histogramSeries{},
+	}
+}
+
+// internal metrics ------------------------------------------------------------
+
+var (
+	keyspaceEvents = newCounter("tagging_keyspace_events_total", "Keyspace notifications processed.", "")
+	updateLatency  = newHistogram("tagging_update_seconds", "Latency of tag writes, until stored and propagated.", "")
+	redisLatency   = newHistogram("tagging_redis_command_seconds", "Latency of redis commands.", "command")
+	redisErrors    = newCounter("tagging_redis_errors_total", "Failed redis commands.", "command")
+	reconnects     = newCounter("tagging_reconnects_total", "Reconnections to brokers and devices.", "client")
+
+	internalMetrics = []metric{keyspaceEvents, updateLatency, redisLatency, redisErrors, reconnects}
+)
+
+// api -------------------------------------------------------------------------
+
+// handleMetrics exports the tags of the manager and the internal metrics in
+// the prometheus text format. Tags export their numeric value, their quality
+// and the seconds since their last update, labelled by the path of their
+// manager and their name.
+func (a *API) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	var values, quality, age []string
+	now := time.Now().UTC().Unix()
+	a.manager.Walk(func(p string, tag Tagger) error {
+		if _, ok := tag.(*TagManager); ok {
+			return nil
+		}
+		manager := a.manager.Path()
+		i := strings.LastIndex(p, "/")
+		if i >= 0 {
+			manager += "/" + p[:i]
+		}
+		labels := fmt.Sprintf("{manager=\"%s\",tag=\"%s\"}", escapeLabel(manager), escapeLabel(p[i+1:]))
+
+		if v, err := getProp(tag, "Value"); err == nil {
+			if f, ok := numberOf(v); ok {
+				values = append(values, "tagging_tag_value"+labels+" "+formatFloat(f))
+			}
+		}
+		if q, err := getProp(tag, "Quality"); err == nil {
+			quality = append(quality, fmt.Sprintf("tagging_tag_quality%s %d", labels, q))
+		}
+		if t, err := getProp(tag, "Timestamp"); err == nil {
+			if t, ok := t.(int64); ok {
+				age = append(age, fmt.Sprintf("tagging_tag_age_seconds%s %d", labels, now-t))
+			}
+		}
+		return nil
+	})
+
+	writeFamily(w, "tagging_tag_value", "Value of numeric tags.", values)
+	writeFamily(w, "tagging_tag_quality", "Quality of tags, 100 when good.", quality)
+	writeFamily(w, "tagging_tag_age_seconds", "Seconds since the last update of tags.", age)
+	for _, m := range internalMetrics {
+		m.write(w)
+	}
+}
+
+// utility ---------------------------------------------------------------------
+
+func writeFamily(w io.Writer, name string, help string, samples []string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	for _, s := range samples {
+		fmt.Fprintln(w, s)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return fmt.Sprint(f)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleMetrics(t *testing.T) {
+	api := NewAPI(memManager(`@m"1`, &memTag{Value: 12, Quality: QualityGood}, &memTag{Value: -3}))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type is %s, want text/plain", ct)
+	}
+
+	body := w.Body.String()
+	for _, line := range []string{
+		"# HELP tagging_tag_value Value of numeric tags.",
+		"# TYPE tagging_tag_value gauge",
+		`tagging_tag_value{manager="@m\"1",tag="a"} 12`,
+		`tagging_tag_value{manager="@m\"1",tag="b"} -3`,
+		"# TYPE tagging_tag_quality gauge",
+		`tagging_tag_quality{manager="@m\"1",tag="a"} 100`,
+		"# TYPE tagging_keyspace_events_total counter",
+		"# TYPE tagging_redis_command_seconds histogram",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected line %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestCounterWrite(t *testing.T) {
+	c := newCounter("test_total", "Test counter.", "client")
+	c.Inc("mqtt")
+	c.Inc("mqtt")
+	c.Inc("a\"b\\c\nd")
+
+	b := &bytes.Buffer{}
+	c.write(b)
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{client="a\"b\\c\nd"} 1
+test_total{client="mqtt"} 2
+`
+	if b.String() != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, b.String())
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	h := newHistogram("test_seconds", "Test histogram.", "command")
+	h.Buckets = []float64{1, 2}
+	now := time.Now()
+	h.Since("get", now.Add(-500*time.Millisecond))
+	h.Since("get", now.Add(-1500*time.Millisecond))
+	h.Since("get", now.Add(-3*time.Second))
+	h.Since("set", now)
+
+	b := &bytes.Buffer{}
+	h.write(b)
+	lines := strings.Split(b.String(), "\n")
+	want := []string{
+		"# HELP test_seconds Test histogram.",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{command="get",le="1"} 1`,
+		`test_seconds_bucket{command="get",le="2"} 2`,
+		`test_seconds_bucket{command="get",le="+Inf"} 3`,
+	}
+	for i, l := range want {
+		if lines[i] != l {
+			t.Errorf("Expected line %d to be %q, got %q", i, l, lines[i])
+		}
+	}
+	if !strings.HasPrefix(lines[5], `test_seconds_sum{command="get"} 5`) {
+		t.Errorf("Expected the sum of get near 5, got %q", lines[5])
+	}
+	if lines[6] != `test_seconds_count{command="get"} 3` {
+		t.Errorf("Expected the count of get, got %q", lines[6])
+	}
+	if lines[9] != `test_seconds_bucket{command="set",le="+Inf"} 1` {
+		t.Errorf("Expected set in +Inf, got %q", lines[9])
+	}
+}
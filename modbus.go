@@ -0,0 +1,778 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// ModbusTable is one of the four modbus data tables.
+type ModbusTable int
+
+const (
+	Coils ModbusTable = iota
+	DiscreteInputs
+	InputRegisters
+	HoldingRegisters
+)
+
+func (t ModbusTable) String() string {
+	switch t {
+	case Coils:
+		return "coils"
+	case DiscreteInputs:
+		return "discrete inputs"
+	case InputRegisters:
+		return "input registers"
+	case HoldingRegisters:
+		return "holding registers"
+	}
+	return fmt.Sprintf("ModbusTable(%d)", int(t))
+}
+
+// MarshalText writes the table by name, as holding registers.
+func (t ModbusTable) MarshalText() ([]byte, error) {
+	if t < Coils || t > HoldingRegisters {
+		return nil, fmt.Errorf("invalid modbus table %d", int(t))
+	}
+	return []byte(t.String()), nil
+}
+
+func (t *ModbusTable) UnmarshalText(b []byte) error {
+	for _, v := range []ModbusTable{Coils, DiscreteInputs, InputRegisters, HoldingRegisters} {
+		if v.String() == string(b) {
+			*t = v
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid modbus table %s", b)
+}
+
+func (t ModbusTable) bits() bool {
+	return t == Coils || t == DiscreteInputs
+}
+
+func (t ModbusTable) writable() bool {
+	return t == Coils || t == HoldingRegisters
+}
+
+// RegisterFormat is how a value is laid in registers.
+type RegisterFormat int
+
+const (
+	Int16 RegisterFormat = iota
+	Uint16
+	Int32
+	Uint32
+	Float32
+)
+
+func (f RegisterFormat) String() string {
+	switch f {
+	case Int16:
+		return "int16"
+	case Uint16:
+		return "uint16"
+	case Int32:
+		return "int32"
+	case Uint32:
+		return "uint32"
+	case Float32:
+		return "float32"
+	}
+	return fmt.Sprintf("RegisterFormat(%d)", int(f))
+}
+
+// MarshalText writes the format by name, as float32.
+func (f RegisterFormat) MarshalText() ([]byte, error) {
+	if f < Int16 || f > Float32 {
+		return nil, fmt.Errorf("invalid register format %d", int(f))
+	}
+	return []byte(f.String()), nil
+}
+
+func (f *RegisterFormat) UnmarshalText(b []byte) error {
+	for _, v := range []RegisterFormat{Int16, Uint16, Int32, Uint32, Float32} {
+		if v.String() == string(b) {
+			*f = v
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid register format %s", b)
+}
+
+// words returns how many registers the format takes.
+func (f RegisterFormat) words() int {
+	switch f {
+	case Int32, Uint32, Float32:
+		return 2
+	}
+	return 1
+}
+
+// modbus function codes and exceptions.
+const (
+	fcReadCoils              = 0x01
+	fcReadDiscreteInputs     = 0x02
+	fcReadHoldingRegisters   = 0x03
+	fcReadInputRegisters     = 0x04
+	fcWriteSingleCoil        = 0x05
+	fcWriteSingleRegister    = 0x06
+	fcWriteMultipleCoils     = 0x0f
+	fcWriteMultipleRegisters = 0x10
+
+	exIllegalFunction    = 0x01
+	exIllegalDataAddress = 0x02
+	exIllegalDataValue   = 0x03
+	exServerFailure      = 0x04
+)
+
+// ModbusError is an exception replied by a modbus device.
+type ModbusError struct {
+	Function  byte
+	Exception byte
+}
+
+func (e *ModbusError) Error() string {
+	return fmt.Sprintf("modbus exception %d on function %d", e.Exception, e.Function)
+}
+
+// register map ----------------------------------------------------------------
+
+// RegisterMap binds a tag property to modbus addresses. The register value is
+// the property multiplied by Scale, and 32 bit formats take two registers,
+// high word first unless WordSwap is set.
+type RegisterMap struct {
+	Table    ModbusTable    `json:"table"`
+	Address  uint16         `json:"address"`
+	Tag      string         `json:"tag"`
+	Prop     string         `json:"prop,omitempty"`
+	Format   RegisterFormat `json:"format,omitempty"`
+	Scale    float64        `json:"scale,omitempty"`
+	WordSwap bool           `json:"word_swap,omitempty"`
+	integral bool
+}
+
+func (m *RegisterMap) String() string {
+	return fmt.Sprintf(
+		"RegisterMap{Table: %s, Address: %d, Tag: %s, Prop: %s, Format: %s}",
+		m.Table,
+		m.Address,
+		m.Tag,
+		m.prop(),
+		m.Format,
+	)
+}
+
+func (m *RegisterMap) prop() string {
+	if m.Prop == "" {
+		return "Value"
+	}
+	return m.Prop
+}
+
+func (m *RegisterMap) scale() float64 {
+	if m.Scale == 0 {
+		return 1
+	}
+	return m.Scale
+}
+
+// size returns how many addresses the map takes in its table.
+func (m *RegisterMap) size() int {
+	if m.Table.bits() {
+		return 1
+	}
+	return m.Format.words()
+}
+
+func (m *RegisterMap) covers(t ModbusTable, addr int) bool {
+	return m.Table == t && addr >= int(m.Address) && addr < int(m.Address)+m.size()
+}
+
+// encode lays v in registers.
+func (m *RegisterMap) encode(v float64) []uint16 {
+	v = v * m.scale()
+	var w []uint16
+	switch m.Format {
+	case Uint16:
+		w = []uint16{uint16(clamp(v, 0, math.MaxUint16))}
+	case Int32:
+		n := uint32(int32(clamp(v, math.MinInt32, math.MaxInt32)))
+		w = []uint16{uint16(n >> 16), uint16(n)}
+	case Uint32:
+		n := uint32(clamp(v, 0, math.MaxUint32))
+		w = []uint16{uint16(n >> 16), uint16(n)}
+	case Float32:
+		n := math.Float32bits(float32(v))
+		w = []uint16{uint16(n >> 16), uint16(n)}
+	default:
+		w = []uint16{uint16(int16(clamp(v, math.MinInt16, math.MaxInt16)))}
+	}
+	if m.WordSwap && len(w) == 2 {
+		w[0], w[1] = w[1], w[0]
+	}
+	return w
+}
+
+// decode reads the value laid in registers w, rounded when the property
+// holds integers.
+func (m *RegisterMap) decode(w []uint16) float64 {
+	if m.WordSwap && len(w) == 2 {
+		w = []uint16{w[1], w[0]}
+	}
+	var v float64
+	switch m.Format {
+	case Uint16:
+		v = float64(w[0])
+	case Int32:
+		v = float64(int32(uint32(w[0])<<16 | uint32(w[1])))
+	case Uint32:
+		v = float64(uint32(w[0])<<16 | uint32(w[1]))
+	case Float32:
+		v = float64(math.Float32frombits(uint32(w[0])<<16 | uint32(w[1])))
+	default:
+		v = float64(int16(w[0]))
+	}
+	return m.round(v / m.scale())
+}
+
+// round rounds v to the nearest integer when the property holds integers, as
+// tags reject fractions there.
+func (m *RegisterMap) round(v float64) float64 {
+	if m.integral {
+		return math.Floor(v + 0.5)
+	}
+	return v
+}
+
+// bind checks the tag and property of m exist under manager, and learns
+// whether the property holds integers.
+func (m *RegisterMap) bind(manager *TagManager) error {
+	t, err := manager.getTag(m.Tag)
+	if err != nil {
+		return err
+	}
+	s, err := schemaOf(t)
+	if err != nil {
+		return err
+	}
+	p, err := s.Prop(m.prop())
+	if err != nil {
+		return err
+	}
+	m.integral = p.Type == IntProp || p.Type == Int64Prop
+	return nil
+}
+
+// ParseModbusAddress reads a modicon address, such as 40001 for the first
+// holding register.
+func ParseModbusAddress(n int) (ModbusTable, uint16, error) {
+	switch {
+	case n >= 1 && n <= 9999:
+		return Coils, uint16(n - 1), nil
+	case n >= 10001 && n <= 19999:
+		return DiscreteInputs, uint16(n - 10001), nil
+	case n >= 30001 && n <= 39999:
+		return InputRegisters, uint16(n - 30001), nil
+	case n >= 40001 && n <= 49999:
+		return HoldingRegisters, uint16(n - 40001), nil
+	}
+	return 0, 0, fmt.Errorf("invalid modbus address %d", n)
+}
+
+// modbus server ---------------------------------------------------------------
+
+// ModbusServer serves the mapped tags of a manager to modbus TCP masters.
+// Reads come from the tags in memory and writes go through Tagger.Set.
+type ModbusServer struct {
+	manager  *TagManager
+	maps     []*RegisterMap
+	UnitID   byte
+	listener net.Listener
+	conns    map[net.Conn]bool
+	mu       sync.Mutex
+}
+
+func (s *ModbusServer) String() string {
+	return fmt.Sprintf("ModbusServer{Manager: %s, Maps#len: %d}", s.manager.Name, len(s.maps))
+}
+
+func (s *ModbusServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts masters on l until the server is closed.
+func (s *ModbusServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+func (s *ModbusServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *ModbusServer) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF {
+				log.Printf("modbus: could not read from %s: %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		length := binary.BigEndian.Uint16(header[4:6])
+		if length < 2 || length > 254 {
+			log.Printf("modbus: invalid frame length %d from %s\n", length, conn.RemoteAddr())
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			log.Printf("modbus: could not read from %s: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+		if s.UnitID != 0 && header[6] != s.UnitID {
+			continue
+		}
+
+		reply := s.handle(pdu)
+		binary.BigEndian.PutUint16(header[4:6], uint16(len(reply)+1))
+		if _, err := conn.Write(append(header, reply...)); err != nil {
+			log.Printf("modbus: could not write to %s: %s\n", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// handle answers a request pdu.
+func (s *ModbusServer) handle(pdu []byte) []byte {
+	fc := pdu[0]
+	exception := func(code byte) []byte {
+		return []byte{fc | 0x80, code}
+	}
+	if len(pdu) < 5 {
+		return exception(exIllegalDataValue)
+	}
+	addr := int(binary.BigEndian.Uint16(pdu[1:3]))
+	n := int(binary.BigEndian.Uint16(pdu[3:5]))
+
+	switch fc {
+	case fcReadCoils, fcReadDiscreteInputs:
+		t := Coils
+		if fc == fcReadDiscreteInputs {
+			t = DiscreteInputs
+		}
+		if n < 1 || n > 2000 {
+			return exception(exIllegalDataValue)
+		}
+		bits, ex := s.readBits(t, addr, n)
+		if ex != 0 {
+			return exception(ex)
+		}
+		return append([]byte{fc, byte(len(bits))}, bits...)
+	case fcReadHoldingRegisters, fcReadInputRegisters:
+		t := HoldingRegisters
+		if fc == fcReadInputRegisters {
+			t = InputRegisters
+		}
+		if n < 1 || n > 125 {
+			return exception(exIllegalDataValue)
+		}
+		words, ex := s.readWords(t, addr, n)
+		if ex != 0 {
+			return exception(ex)
+		}
+		reply := []byte{fc, byte(2 * n)}
+		for _, w := range words {
+			reply = append(reply, byte(w>>8), byte(w))
+		}
+		return reply
+	case fcWriteSingleCoil:
+		if n != 0xff00 && n != 0 {
+			return exception(exIllegalDataValue)
+		}
+		if ex := s.writeBits(addr, []bool{n == 0xff00}); ex != 0 {
+			return exception(ex)
+		}
+		return pdu[:5]
+	case fcWriteSingleRegister:
+		if ex := s.writeWords(addr, []uint16{uint16(n)}); ex != 0 {
+			return exception(ex)
+		}
+		return pdu[:5]
+	case fcWriteMultipleCoils:
+		if len(pdu) < 6 || n < 1 || n > 1968 || int(pdu[5]) != (n+7)/8 || len(pdu) < 6+int(pdu[5]) {
+			return exception(exIllegalDataValue)
+		}
+		bits := make([]bool, n)
+		for i := range bits {
+			bits[i] = pdu[6+i/8]&(1<<uint(i%8)) != 0
+		}
+		if ex := s.writeBits(addr, bits); ex != 0 {
+			return exception(ex)
+		}
+		return pdu[:5]
+	case fcWriteMultipleRegisters:
+		if len(pdu) < 6 || n < 1 || n > 123 || int(pdu[5]) != 2*n || len(pdu) < 6+2*n {
+			return exception(exIllegalDataValue)
+		}
+		words := make([]uint16, n)
+		for i := range words {
+			words[i] = binary.BigEndian.Uint16(pdu[6+2*i:])
+		}
+		if ex := s.writeWords(addr, words); ex != 0 {
+			return exception(ex)
+		}
+		return pdu[:5]
+	}
+	return exception(exIllegalFunction)
+}
+
+// readBits packs the bits of t from addr, failing when none is mapped.
+func (s *ModbusServer) readBits(t ModbusTable, addr int, n int) ([]byte, byte) {
+	bits := make([]byte, (n+7)/8)
+	mapped := false
+	for i := 0; i < n; i++ {
+		m := s.find(t, addr+i)
+		if m == nil {
+			continue
+		}
+		mapped = true
+		v, err := s.manager.Get(m.Tag, m.prop())
+		if err != nil {
+			return nil, exServerFailure
+		}
+		if f, _ := numberOf(v); f != 0 || v == true {
+			bits[i/8] |= 1 << uint(i%8)
+		}
+	}
+	if !mapped {
+		return nil, exIllegalDataAddress
+	}
+	return bits, 0
+}
+
+// readWords returns the registers of t from addr, failing when none is
+// mapped. Unmapped registers in between read as zero.
+func (s *ModbusServer) readWords(t ModbusTable, addr int, n int) ([]uint16, byte) {
+	words := make([]uint16, n)
+	mapped := false
+	for i := 0; i < n; {
+		m := s.find(t, addr+i)
+		if m == nil {
+			i++
+			continue
+		}
+		mapped = true
+		v, err := s.manager.Get(m.Tag, m.prop())
+		if err != nil {
+			return nil, exServerFailure
+		}
+		f, _ := numberOf(v)
+		w := m.encode(f)
+		for j := addr + i - int(m.Address); j < len(w) && i < n; j++ {
+			words[i] = w[j]
+			i++
+		}
+	}
+	if !mapped {
+		return nil, exIllegalDataAddress
+	}
+	return words, 0
+}
+
+func (s *ModbusServer) writeBits(addr int, bits []bool) byte {
+	for i, b := range bits {
+		m := s.find(Coils, addr+i)
+		if m == nil {
+			return exIllegalDataAddress
+		}
+		if ex := s.set(m, boolNumber(b)); ex != 0 {
+			return ex
+		}
+	}
+	return 0
+}
+
+// writeWords writes registers from addr. Values taking more than a register
+// must be written whole.
+func (s *ModbusServer) writeWords(addr int, words []uint16) byte {
+	for i := 0; i < len(words); {
+		m := s.find(HoldingRegisters, addr+i)
+		if m == nil || int(m.Address) != addr+i || i+m.size() > len(words) {
+			return exIllegalDataAddress
+		}
+		if ex := s.set(m, m.decode(words[i:i+m.size()])); ex != 0 {
+			return ex
+		}
+		i += m.size()
+	}
+	return 0
+}
+
+func (s *ModbusServer) set(m *RegisterMap, v float64) byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.manager.Set(m.Tag, m.prop(), m.round(v)); err != nil {
+		log.Printf("modbus: could not write %s: %s\n", m, err)
+		return exIllegalDataValue
+	}
+	return 0
+}
+
+func (s *ModbusServer) find(t ModbusTable, addr int) *RegisterMap {
+	for _, m := range s.maps {
+		if m.covers(t, addr) {
+			return m
+		}
+	}
+	return nil
+}
+
+// NewModbusServer serves maps over the tags of manager. Maps must not overlap.
+func NewModbusServer(manager *TagManager, maps ...*RegisterMap) (*ModbusServer, error) {
+	for i, m := range maps {
+		if err := m.bind(manager); err != nil {
+			return nil, err
+		}
+		if int(m.Address)+m.size() > 0x10000 {
+			return nil, fmt.Errorf("%s is out of range", m)
+		}
+		for _, o := range maps[:i] {
+			for a := 0; a < m.size(); a++ {
+				if o.covers(m.Table, int(m.Address)+a) {
+					return nil, fmt.Errorf("%s overlaps %s", m, o)
+				}
+			}
+		}
+	}
+
+	return &ModbusServer{
+		manager: manager,
+		maps:    maps,
+		conns:   map[net.Conn]bool{},
+	}, nil
+}
+
+// modbus tcp ------------------------------------------------------------------
+
+// ModbusTransport sends a request pdu to a unit and returns the reply pdu.
+type ModbusTransport interface {
+	Send(unit byte, pdu []byte) ([]byte, error)
+	Close() error
+}
+
+// ModbusTCP is a modbus TCP transport, dialing Addr when first used and again
+// after a failure.
+type ModbusTCP struct {
+	Addr    string
+	Timeout time.Duration
+	conn    net.Conn
+	tid     uint16
+	mu      sync.Mutex
+}
+
+func (t *ModbusTCP) String() string {
+	return fmt.Sprintf("ModbusTCP{Addr: %s}", t.Addr)
+}
+
+func (t *ModbusTCP) Send(unit byte, pdu []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		conn, err := net.DialTimeout("tcp", t.Addr, t.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		if t.tid != 0 {
+			reconnects.Inc("modbus")
+		}
+		t.conn = conn
+	}
+	reply, err := t.send(unit, pdu)
+	if err != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	return reply, err
+}
+
+func (t *ModbusTCP) send(unit byte, pdu []byte) ([]byte, error) {
+	t.tid++
+	frame := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:2], t.tid)
+	binary.BigEndian.PutUint16(frame[4:6], uint16(len(pdu)+1))
+	frame[6] = unit
+	t.conn.SetDeadline(time.Now().Add(t.Timeout))
+	if _, err := t.conn.Write(append(frame, pdu...)); err != nil {
+		return nil, err
+	}
+
+	for {
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(t.conn, header); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint16(header[4:6])
+		if length < 2 || length > 254 {
+			return nil, fmt.Errorf("invalid frame length %d from %s", length, t.Addr)
+		}
+		reply := make([]byte, length-1)
+		if _, err := io.ReadFull(t.conn, reply); err != nil {
+			return nil, err
+		}
+		// late replies to timed out requests are dropped
+		if binary.BigEndian.Uint16(header[0:2]) == t.tid {
+			return reply, nil
+		}
+	}
+}
+
+func (t *ModbusTCP) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+func NewModbusTCP(addr string) *ModbusTCP {
+	return &ModbusTCP{Addr: addr, Timeout: 3 * time.Second}
+}
+
+// modbus client ---------------------------------------------------------------
+
+// ModbusClient reads and writes the data tables of a device.
+type ModbusClient struct {
+	transport ModbusTransport
+	Unit      byte
+}
+
+func (c *ModbusClient) String() string {
+	return fmt.Sprintf("ModbusClient{Transport: %s, Unit: %d}", c.transport, c.Unit)
+}
+
+func (c *ModbusClient) ReadBits(t ModbusTable, addr uint16, n int) ([]bool, error) {
+	fc := byte(fcReadCoils)
+	if t == DiscreteInputs {
+		fc = fcReadDiscreteInputs
+	}
+	reply, err := c.send(fc, addr, uint16(n))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 2 || int(reply[1]) != (n+7)/8 || len(reply) < 2+int(reply[1]) {
+		return nil, fmt.Errorf("invalid reply reading %d %s", n, t)
+	}
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = reply[2+i/8]&(1<<uint(i%8)) != 0
+	}
+	return bits, nil
+}
+
+func (c *ModbusClient) ReadRegisters(t ModbusTable, addr uint16, n int) ([]uint16, error) {
+	fc := byte(fcReadHoldingRegisters)
+	if t == InputRegisters {
+		fc = fcReadInputRegisters
+	}
+	reply, err := c.send(fc, addr, uint16(n))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 2 || int(reply[1]) != 2*n || len(reply) < 2+2*n {
+		return nil, fmt.Errorf("invalid reply reading %d %s", n, t)
+	}
+	words := make([]uint16, n)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint16(reply[2+2*i:])
+	}
+	return words, nil
+}
+
+func (c *ModbusClient) WriteCoil(addr uint16, v bool) error {
+	n := uint16(0)
+	if v {
+		n = 0xff00
+	}
+	_, err := c.send(fcWriteSingleCoil, addr, n)
+	return err
+}
+
+func (c *ModbusClient) WriteRegisters(addr uint16, words ...uint16) error {
+	data := []byte{byte(2 * len(words))}
+	for _, w := range words {
+		data = append(data, byte(w>>8), byte(w))
+	}
+	_, err := c.send(fcWriteMultipleRegisters, addr, uint16(len(words)), data...)
+	return err
+}
+
+func (c *ModbusClient) Close() error {
+	return c.transport.Close()
+}
+
+func (c *ModbusClient) send(fc byte, addr uint16, n uint16, data ...byte) ([]byte, error) {
+	pdu := []byte{fc, byte(addr >> 8), byte(addr), byte(n >> 8), byte(n)}
+	reply, err := c.transport.Send(c.Unit, append(pdu, data...))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) == 2 && reply[0] == fc|0x80 {
+		return nil, &ModbusError{fc, reply[1]}
+	}
+	if len(reply) == 0 || reply[0] != fc {
+		return nil, fmt.Errorf("invalid reply to function %d", fc)
+	}
+	return reply, nil
+}
+
+func NewModbusClient(transport ModbusTransport, unit byte) *ModbusClient {
+	return &ModbusClient{transport: transport, Unit: unit}
+}
+
+// utility ---------------------------------------------------------------------
+
+func clamp(v float64, min float64, max float64) float64 {
+	return math.Max(min, math.Min(max, math.Floor(v+0.5)))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"net"
+	"testing"
+)
+
+// serveModbus serves maps over tm on a local port, returning a client of it
+// and a func stopping both.
+func serveModbus(t *testing.T, tm *TagManager, maps ...*RegisterMap) (*ModbusClient, func()) {
+	s, err := NewModbusServer(tm, maps...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+
+	c := NewModbusClient(NewModbusTCP(l.Addr().String()), 1)
+	return c, func() {
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestModbusServer(t *testing.T) {
+	a := &memTag{Value: 12, Level: 1.5}
+	tm := memManager("@mb", a)
+	c, stop := serveModbus(t, tm,
+		&RegisterMap{Table: HoldingRegisters, Address: 0, Tag: "@mb:a", Scale: 10},
+		&RegisterMap{Table: HoldingRegisters, Address: 1, Tag: "@mb:a", Prop: "Level", Format: Float32},
+	)
+	defer stop()
+
+	words, err := c.ReadRegisters(HoldingRegisters, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if words[0] != 120 {
+		t.Errorf("read %d for Value, want 120", words[0])
+	}
+	if f := math.Float32frombits(uint32(words[1])<<16 | uint32(words[2])); f != 1.5 {
+		t.Errorf("read %g for Level, want 1.5", f)
+	}
+
+	for w, want := range map[uint16]int{123: 12, 127: 13, 65535: 0} {
+		if err := c.WriteRegisters(0, w); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := tm.Get("@mb:a", "Value"); v != want {
+			t.Errorf("wrote %d, Value is %v, want %d", w, v, want)
+		}
+	}
+
+	n := math.Float32bits(2.25)
+	if err := c.WriteRegisters(1, uint16(n>>16), uint16(n)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := tm.Get("@mb:a", "Level"); v != 2.25 {
+		t.Errorf("Level is %v, want 2.25", v)
+	}
+
+	if err := c.WriteRegisters(2, 0); err == nil {
+		t.Error("wrote half of a float32")
+	}
+}
+
+func TestModbusServerCoils(t *testing.T) {
+	a := &memTag{Value: 1}
+	tm := memManager("@mb", a, &memTag{})
+	c, stop := serveModbus(t, tm,
+		&RegisterMap{Table: Coils, Address: 0, Tag: "@mb:a"},
+		&RegisterMap{Table: DiscreteInputs, Address: 0, Tag: "@mb:b"},
+	)
+	defer stop()
+
+	bits, err := c.ReadBits(Coils, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bits[0] {
+		t.Error("read coil 0 off, want on")
+	}
+	if bits, err := c.ReadBits(DiscreteInputs, 0, 1); err != nil || bits[0] {
+		t.Errorf("read input 0 %v (%v), want off", bits, err)
+	}
+
+	if err := c.WriteCoil(0, false); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := tm.Get("@mb:a", "Value"); v != 0 {
+		t.Errorf("Value is %v, want 0", v)
+	}
+	if _, err := c.ReadBits(Coils, 1, 1); err == nil {
+		t.Error("read an unmapped coil")
+	}
+}
+
+func TestModbusServerUnknownProp(t *testing.T) {
+	tm := memManager("@mb", &memTag{})
+	if _, err := NewModbusServer(tm, &RegisterMap{Table: HoldingRegisters, Tag: "@mb:a", Prop: "Colour"}); err == nil {
+		t.Error("mapped an unknown property")
+	}
+}
+
+func TestRegisterMapDecode(t *testing.T) {
+	m := &RegisterMap{Scale: 10, integral: true}
+	if v := m.decode([]uint16{125}); v != 13 {
+		t.Errorf("decoded %g into an integer, want 13", v)
+	}
+	m.integral = false
+	if v := m.decode([]uint16{125}); v != 12.5 {
+		t.Errorf("decoded %g, want 12.5", v)
+	}
+}
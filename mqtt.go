@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mqtt packet types.
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+	mqttMaxInflight = 10000
+)
+
+// MQTTMessage is a message published to or received from a broker.
+type MQTTMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+func (m *MQTTMessage) String() string {
+	return fmt.Sprintf(
+		"MQTTMessage{Topic: %s, Payload#len: %d, QoS: %d, Retain: %t}",
+		m.Topic,
+		len(m.Payload),
+		m.QoS,
+		m.Retain,
+	)
+}
+
+// MQTTOptions configures the connection of a MQTTClient to a broker.
+type MQTTOptions struct {
+	Addr      string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	Will      *MQTTMessage
+	Retry     time.Duration
+}
+
+type mqttSub struct {
+	Filter  string
+	QoS     byte
+	handler func(m *MQTTMessage)
+}
+
+// mqtt client -----------------------------------------------------------------
+
+// MQTTClient is a MQTT 3.1.1 client supporting QoS 0 and 1. It reconnects
+// every Retry while the broker is gone, subscribing again and resending the
+// QoS 1 messages not acknowledged yet. BeforeConnect is called before every
+// connection, and may change the will in Options; OnConnect is called after
+// it.
+type MQTTClient struct {
+	Options       MQTTOptions
+	BeforeConnect func()
+	OnConnect     func()
+	conn          net.Conn
+	ids           uint16
+	inflight      map[uint16]*MQTTMessage
+	subs          []*mqttSub
+	done          chan struct{}
+	once          sync.Once
+	mu            sync.Mutex
+}
+
+func (c *MQTTClient) String() string {
+	return fmt.Sprintf("MQTTClient{Addr: %s, ClientID: %s}", c.Options.Addr, c.Options.ClientID)
+}
+
+// Connect connects to the broker, and keeps the client connected until it is
+// closed.
+func (c *MQTTClient) Connect() error {
+	conn, err := c.connect()
+	if err != nil {
+		return err
+	}
+	go c.run(conn)
+	go c.ping()
+	return nil
+}
+
+// Publish sends m. QoS 1 messages are queued while the client is
+// disconnected, QoS 0 ones fail.
+func (c *MQTTClient) Publish(m *MQTTMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var id uint16
+	if m.QoS > 0 {
+		if len(c.inflight) >= mqttMaxInflight {
+			return fmt.Errorf("could not publish to %s: too many messages in flight", m.Topic)
+		}
+		id = c.nextID()
+		c.inflight[id] = m
+	}
+	if c.conn == nil {
+		if m.QoS > 0 {
+			return nil
+		}
+		return fmt.Errorf("could not publish to %s: not connected", m.Topic)
+	}
+	return c.write(mqttPublishPacket(m, id, false))
+}
+
+// Subscribe calls handler with the messages published to topics matching
+// filter, which may hold + and # wildcards.
+func (c *MQTTClient) Subscribe(filter string, qos byte, handler func(m *MQTTMessage)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := &mqttSub{filter, qos, handler}
+	c.subs = append(c.subs, s)
+	if c.conn == nil {
+		return nil
+	}
+	return c.write(c.subscribePacket(s))
+}
+
+// Close disconnects from the broker, without sending the last will.
+func (c *MQTTClient) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	c.write(mqttPacket(mqttDisconnect, 0, nil))
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func (c *MQTTClient) connect() (net.Conn, error) {
+	if c.BeforeConnect != nil {
+		c.BeforeConnect()
+	}
+	conn, err := net.DialTimeout("tcp", c.Options.Addr, c.Options.Retry)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(c.Options.Retry))
+	if _, err := conn.Write(c.connectPacket()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	kind, _, body, err := readMQTTPacket(r)
+	if err == nil && (kind != mqttConnack || len(body) != 2) {
+		err = fmt.Errorf("expected connack from %s", c.Options.Addr)
+	}
+	if err == nil && body[1] != 0 {
+		err = fmt.Errorf("connection refused by %s with code %d", c.Options.Addr, body[1])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	c.conn = conn
+	for _, s := range c.subs {
+		c.write(c.subscribePacket(s))
+	}
+	ids := make([]int, 0, len(c.inflight))
+	for id := range c.inflight {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		c.write(mqttPublishPacket(c.inflight[uint16(id)], uint16(id), true))
+	}
+	c.mu.Unlock()
+
+	if c.OnConnect != nil {
+		c.OnConnect()
+	}
+	return conn, nil
+}
+
+// run reads from conn until it fails, then reconnects, until the client is
+// closed.
+func (c *MQTTClient) run(conn net.Conn) {
+	for {
+		err := c.read(conn)
+		if stopped(c.done) {
+			return
+		}
+		log.Printf("Lost connection of %s: %s\n", c, err)
+		c.mu.Lock()
+		if c.conn == conn {
+			c.conn.Close()
+			c.conn = nil
+		}
+		c.mu.Unlock()
+
+		for conn = nil; conn == nil; {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(c.Options.Retry):
+			}
+			if conn, err = c.connect(); err != nil {
+				log.Printf("Could not reconnect %s: %s\n", c, err)
+				continue
+			}
+			reconnects.Inc("mqtt")
+		}
+	}
+}
+
+func (c *MQTTClient) read(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(c.Options.KeepAlive * 3 / 2))
+		kind, flags, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case mqttPublish:
+			m, id, err := parseMQTTPublish(flags, body)
+			if err != nil {
+				return err
+			}
+			c.dispatch(m)
+			if m.QoS > 0 {
+				c.mu.Lock()
+				c.write(mqttPacket(mqttPuback, 0, []byte{byte(id >> 8), byte(id)}))
+				c.mu.Unlock()
+			}
+		case mqttPuback:
+			if len(body) == 2 {
+				c.mu.Lock()
+				delete(c.inflight, uint16(body[0])<<8|uint16(body[1]))
+				c.mu.Unlock()
+			}
+		case mqttSuback:
+			if len(body) < 2 {
+				return fmt.Errorf("invalid suback packet")
+			}
+			for _, rc := range body[2:] {
+				if rc == 0x80 {
+					log.Printf("Subscription of %s refused\n", c)
+				}
+			}
+		}
+	}
+}
+
+func (c *MQTTClient) dispatch(m *MQTTMessage) {
+	c.mu.Lock()
+	var handlers []func(m *MQTTMessage)
+	for _, s := range c.subs {
+		if topicMatch(s.Filter, m.Topic) {
+			handlers = append(handlers, s.handler)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, h := range handlers {
+		h(m)
+	}
+}
+
+func (c *MQTTClient) ping() {
+	t := time.NewTicker(c.Options.KeepAlive / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		if c.conn != nil {
+			c.write(mqttPacket(mqttPingreq, 0, nil))
+		}
+		c.mu.Unlock()
+	}
+}
+
+// write sends p with c.mu held. A failed write closes the connection, so run
+// notices and reconnects.
+func (c *MQTTClient) write(p []byte) error {
+	if c.conn == nil {
+		return fmt.Errorf("%s is not connected", c)
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.Options.KeepAlive))
+	_, err := c.conn.Write(p)
+	if err != nil {
+		c.conn.Close()
+	}
+	return err
+}
+
+func (c *MQTTClient) nextID() uint16 {
+	for {
+		c.ids++
+		if _, ok := c.inflight[c.ids]; c.ids != 0 && !ok {
+			return c.ids
+		}
+	}
+}
+
+func (c *MQTTClient) connectPacket() []byte {
+	o := c.Options
+	flags := byte(0x02)
+	keepAlive := int(o.KeepAlive / time.Second)
+	body := append(mqttString("MQTT"), 4, 0, byte(keepAlive>>8), byte(keepAlive))
+	body = append(body, mqttString(o.ClientID)...)
+	if o.Will != nil {
+		flags |= 0x04 | o.Will.QoS<<3
+		if o.Will.Retain {
+			flags |= 0x20
+		}
+		body = append(body, mqttString(o.Will.Topic)...)
+		body = append(body, mqttString(string(o.Will.Payload))...)
+	}
+	if o.Username != "" {
+		flags |= 0x80
+		body = append(body, mqttString(o.Username)...)
+	}
+	if o.Password != "" {
+		flags |= 0x40
+		body = append(body, mqttString(o.Password)...)
+	}
+	body[7] = flags
+	return mqttPacket(mqttConnect, 0, body)
+}
+
+func (c *MQTTClient) subscribePacket(s *mqttSub) []byte {
+	id := c.nextID()
+	body := append([]byte{byte(id >> 8), byte(id)}, mqttString(s.Filter)...)
+	return mqttPacket(mqttSubscribe, 0x02, append(body, s.QoS))
+}
+
+func NewMQTTClient(options MQTTOptions) *MQTTClient {
+	if options.KeepAlive == 0 {
+		options.KeepAlive = 30 * time.Second
+	}
+	if options.Retry == 0 {
+		options.Retry = 5 * time.Second
+	}
+	return &MQTTClient{
+		Options:  options,
+		inflight: map[uint16]*MQTTMessage{},
+		done:     make(chan struct{}),
+	}
+}
+
+// mqtt bridge -----------------------------------------------------------------
+
+// MQTTBridge publishes the changes of the tags under a manager to topics as
+// Prefix/@pressure/tank-0/value, with JSON payloads, and writes the payloads
+// published to Prefix/cmd/@pressure/tank-0/value into the tags. The bridge
+// status, online or offline, is retained in Prefix/status.
+type MQTTBridge struct {
+	manager *TagManager
+	client  *MQTTClient
+	Prefix  string
+	QoS     byte
+	Retain  bool
+}
+
+func (b *MQTTBridge) String() string {
+	return fmt.Sprintf("MQTTBridge{Manager: %s, Prefix: %s}", b.manager.Name, b.Prefix)
+}
+
+// Topic returns the topic of the prop key of tag.
+func (b *MQTTBridge) Topic(tag string, key string) string {
+	return fmt.Sprintf("%s/%s/%s", b.Prefix, keyPath(tag), key)
+}
+
+// Run publishes the state of every tag and then the changes of feed, until
+// the feed ends or the bridge is closed.
+func (b *MQTTBridge) Run(feed *Feed) {
+	b.manager.Walk(func(p string, tag Tagger) error {
+		if _, ok := tag.(*TagManager); ok {
+			return nil
+		}
+		s, err := schemaOf(tag)
+		if err != nil {
+			return nil
+		}
+		for _, prop := range s.Props {
+			if prop.Name != "Name" {
+				b.publish(nameOf(tag), prop.Key, prop.Get(tag))
+			}
+		}
+		return nil
+	})
+
+	for {
+		select {
+		case <-feed.Done():
+			return
+		case <-b.client.done:
+			return
+		case c := <-feed.C:
+			b.publish(c.Tag, c.Prop, changeValue(b.manager, c))
+		}
+	}
+}
+
+func (b *MQTTBridge) Close() error {
+	b.client.Publish(b.status("offline"))
+	return b.client.Close()
+}
+
+func (b *MQTTBridge) publish(tag string, key string, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Couldn't encode %s of %s: %s\n", key, tag, err)
+		return
+	}
+	m := &MQTTMessage{Topic: b.Topic(tag, key), Payload: payload, QoS: b.QoS, Retain: b.Retain}
+	if err := b.client.Publish(m); err != nil {
+		log.Printf("Couldn't publish %s: %s\n", m, err)
+	}
+}
+
+// command writes the payload of m into the tag prop of its topic.
+func (b *MQTTBridge) command(m *MQTTMessage) {
+	p := strings.TrimPrefix(m.Topic, b.Prefix+"/cmd/")
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		log.Printf("Invalid command topic %s\n", m.Topic)
+		return
+	}
+	tag, err := b.manager.getTag(strings.Replace(p[:i], "/", ":", -1))
+	if err != nil {
+		log.Printf("Couldn't write %s: %s\n", m.Topic, err)
+		return
+	}
+	s, err := schemaOf(tag)
+	if err != nil {
+		log.Printf("Couldn't write %s: %s\n", m.Topic, err)
+		return
+	}
+	prop, err := s.ByKey(p[i+1:])
+	if err != nil {
+		log.Printf("Couldn't write %s: %s\n", m.Topic, err)
+		return
+	}
+
+	var v interface{}
+	d := json.NewDecoder(strings.NewReader(string(m.Payload)))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		v = string(m.Payload)
+	}
+	if err := b.manager.Set(nameOf(tag), prop.Name, v); err != nil {
+		log.Printf("Couldn't write %s: %s\n", m.Topic, err)
+	}
+}
+
+func (b *MQTTBridge) status(s string) *MQTTMessage {
+	return &MQTTMessage{Topic: b.Prefix + "/status", Payload: []byte(s), QoS: 1, Retain: true}
+}
+
+// NewMQTTBridge connects to the broker in options, with a last will marking
+// the bridge offline, and subscribes to the command topics. Start publishing
+// with Run.
+func NewMQTTBridge(manager *TagManager, prefix string, options MQTTOptions) (*MQTTBridge, error) {
+	b := &MQTTBridge{manager: manager, Prefix: prefix, QoS: 1, Retain: true}
+	options.Will = b.status("offline")
+	b.client = NewMQTTClient(options)
+	b.client.OnConnect = func() {
+		b.client.Publish(b.status("online"))
+	}
+	b.client.Subscribe(prefix+"/cmd/#", 1, b.command)
+	if err := b.client.Connect(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// utility ---------------------------------------------------------------------
+
+func mqttPacket(kind byte, flags byte, body []byte) []byte {
+	p := []byte{kind<<4 | flags}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		p = append(p, d)
+		if n == 0 {
+			break
+		}
+	}
+	return append(p, body...)
+}
+
+func mqttPublishPacket(m *MQTTMessage, id uint16, dup bool) []byte {
+	flags := m.QoS << 1
+	if m.Retain {
+		flags |= 0x01
+	}
+	if dup {
+		flags |= 0x08
+	}
+	body := mqttString(m.Topic)
+	if m.QoS > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+	return mqttPacket(mqttPublish, flags, append(body, m.Payload...))
+}
+
+func parseMQTTPublish(flags byte, body []byte) (*MQTTMessage, uint16, error) {
+	m := &MQTTMessage{QoS: flags >> 1 & 0x03, Retain: flags&0x01 != 0}
+	if len(body) < 2 {
+		return nil, 0, fmt.Errorf("invalid publish packet")
+	}
+	n := int(body[0])<<8 | int(body[1])
+	if len(body) < 2+n {
+		return nil, 0, fmt.Errorf("invalid publish packet")
+	}
+	m.Topic = string(body[2 : 2+n])
+	body = body[2+n:]
+
+	var id uint16
+	if m.QoS > 0 {
+		if len(body) < 2 {
+			return nil, 0, fmt.Errorf("invalid publish packet")
+		}
+		id = uint16(body[0])<<8 | uint16(body[1])
+		body = body[2:]
+	}
+	m.Payload = body
+	return m, id, nil
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	n, shift := 0, uint(0)
+	for {
+		d, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		n |= int(d&0x7f) << shift
+		if d&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, 0, nil, fmt.Errorf("invalid packet length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return h >> 4, h & 0x0f, body, nil
+}
+
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// topicMatch tells if topic matches filter, with its + and # wildcards.
+func topicMatch(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, p := range f {
+		if p == "#" {
+			return true
+		}
+		if i >= len(t) || p != "+" && p != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBroker is a MQTT broker for tests, delivering messages at QoS 0. It
+// keeps retained messages, sends the will of connections lost without a
+// disconnect, and records the will of every connect.
+type testBroker struct {
+	l        net.Listener
+	conns    map[net.Conn][]string
+	ids      map[net.Conn]string
+	wills    []*MQTTMessage
+	retained map[string]*MQTTMessage
+	mu       sync.Mutex
+}
+
+func (b *testBroker) Addr() string {
+	return b.l.Addr().String()
+}
+
+func (b *testBroker) Close() {
+	b.l.Close()
+	b.kick("")
+}
+
+// kick drops the connections of a client, or every connection when id is
+// empty, as a broker restarting would.
+func (b *testBroker) kick(id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		if id == "" || b.ids[conn] == id {
+			conn.Close()
+		}
+	}
+}
+
+// subscribed waits until a connection subscribes to filter.
+func (b *testBroker) subscribed(t *testing.T, filter string) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		for _, filters := range b.conns {
+			for _, f := range filters {
+				if f == filter {
+					b.mu.Unlock()
+					return
+				}
+			}
+		}
+		b.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("no subscription to %s", filter)
+}
+
+// connects returns the wills of the connects so far.
+func (b *testBroker) connects() []*MQTTMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*MQTTMessage{}, b.wills...)
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	kind, _, body, err := readMQTTPacket(r)
+	if err != nil || kind != mqttConnect || len(body) < 12 {
+		return
+	}
+	flags := body[7]
+	body = body[10:]
+	next := func() string {
+		if len(body) < 2 {
+			return ""
+		}
+		n := int(body[0])<<8 | int(body[1])
+		s := string(body[2 : 2+n])
+		body = body[2+n:]
+		return s
+	}
+	id := next()
+	var will *MQTTMessage
+	if flags&0x04 != 0 {
+		will = &MQTTMessage{Topic: next(), QoS: flags >> 3 & 0x03, Retain: flags&0x20 != 0}
+		will.Payload = []byte(next())
+	}
+
+	b.mu.Lock()
+	b.wills = append(b.wills, will)
+	b.conns[conn] = nil
+	b.ids[conn] = id
+	conn.Write([]byte{mqttConnack << 4, 2, 0, 0})
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		delete(b.ids, conn)
+		b.mu.Unlock()
+		if will != nil {
+			b.publish(will)
+		}
+	}()
+
+	for {
+		kind, flags, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		switch kind {
+		case mqttPublish:
+			m, id, err := parseMQTTPublish(flags, body)
+			if err != nil {
+				return
+			}
+			if m.QoS > 0 {
+				b.mu.Lock()
+				conn.Write(mqttPacket(mqttPuback, 0, []byte{byte(id >> 8), byte(id)}))
+				b.mu.Unlock()
+			}
+			b.publish(m)
+		case mqttSubscribe:
+			filter := string(body[4 : len(body)-1])
+			b.mu.Lock()
+			b.conns[conn] = append(b.conns[conn], filter)
+			conn.Write(mqttPacket(mqttSuback, 0, []byte{body[0], body[1], 0}))
+			for _, m := range b.retained {
+				if topicMatch(filter, m.Topic) {
+					conn.Write(mqttPublishPacket(&MQTTMessage{Topic: m.Topic, Payload: m.Payload}, 0, false))
+				}
+			}
+			b.mu.Unlock()
+		case mqttPingreq:
+			b.mu.Lock()
+			conn.Write(mqttPacket(mqttPingresp, 0, nil))
+			b.mu.Unlock()
+		case mqttDisconnect:
+			will = nil
+			return
+		}
+	}
+}
+
+func (b *testBroker) publish(m *MQTTMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if m.Retain {
+		b.retained[m.Topic] = m
+	}
+	for conn, filters := range b.conns {
+		for _, f := range filters {
+			if topicMatch(f, m.Topic) {
+				conn.Write(mqttPublishPacket(&MQTTMessage{Topic: m.Topic, Payload: m.Payload}, 0, false))
+				break
+			}
+		}
+	}
+}
+
+// newTestBroker listens on addr, a free port when empty.
+func newTestBroker(t *testing.T, addr string) *testBroker {
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{l: l, conns: map[net.Conn][]string{}, ids: map[net.Conn]string{}, retained: map[string]*MQTTMessage{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// watchTopics subscribes to filter, returning the messages received.
+func watchTopics(t *testing.T, b *testBroker, filter string) (*MQTTClient, chan *MQTTMessage) {
+	c := NewMQTTClient(MQTTOptions{Addr: b.Addr(), ClientID: "watcher", Retry: 50 * time.Millisecond})
+	received := make(chan *MQTTMessage, 100)
+	c.Subscribe(filter, 1, func(m *MQTTMessage) { received <- m })
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	b.subscribed(t, filter)
+	return c, received
+}
+
+// expectMessage waits for a message to topic, failing unless its payload is
+// payload.
+func expectMessage(t *testing.T, received chan *MQTTMessage, topic string, payload string) {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case m := <-received:
+			if m.Topic != topic {
+				continue
+			}
+			if string(m.Payload) != payload {
+				t.Errorf("%s received %q, want %q", topic, m.Payload, payload)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("nothing published to %s", topic)
+		}
+	}
+}
+
+func TestMQTTBridge(t *testing.T) {
+	broker := newTestBroker(t, "")
+	defer broker.Close()
+	watcher, received := watchTopics(t, broker, "plant/#")
+	defer watcher.Close()
+
+	a := &memTag{Value: 12}
+	bridge, err := NewMQTTBridge(memManager("@m", a), "plant", MQTTOptions{
+		Addr:     broker.Addr(),
+		ClientID: "bridge",
+		Retry:    50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed := testFeed()
+	ran := make(chan struct{})
+	go func() {
+		bridge.Run(feed)
+		close(ran)
+	}()
+
+	expectMessage(t, received, "plant/status", "online")
+	expectMessage(t, received, "plant/@m/a/Value", "12")
+	feed.C <- &Change{Tag: "@m:a", Prop: "Value", Value: 13}
+	expectMessage(t, received, "plant/@m/a/Value", "13")
+
+	broker.subscribed(t, "plant/cmd/#")
+	watcher.Publish(&MQTTMessage{Topic: "plant/cmd/@m/a/Value", Payload: []byte("5"), QoS: 1})
+	deadline := time.Now().Add(time.Second)
+	for v, _ := getProp(a, "Value"); v != 5; v, _ = getProp(a, "Value") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Value is %v after the command, want 5", v)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the will marks the bridge offline until it reconnects
+	broker.kick("bridge")
+	expectMessage(t, received, "plant/status", "offline")
+	expectMessage(t, received, "plant/status", "online")
+
+	bridge.Close()
+	expectMessage(t, received, "plant/status", "offline")
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Error("Run still going after Close")
+	}
+}
+
+func TestMQTTClientResends(t *testing.T) {
+	broker := newTestBroker(t, "")
+	defer broker.Close()
+
+	c := NewMQTTClient(MQTTOptions{Addr: broker.Addr(), ClientID: "c", Retry: 50 * time.Millisecond})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	broker.Close()
+	deadline := time.Now().Add(time.Second)
+	for connected := true; connected; {
+		if time.Now().After(deadline) {
+			t.Fatal("the client did not notice the broker closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+		c.mu.Lock()
+		connected = c.conn != nil
+		c.mu.Unlock()
+	}
+
+	if err := c.Publish(&MQTTMessage{Topic: "t", Payload: []byte("0"), QoS: 0}); err == nil {
+		t.Error("published at QoS 0 while disconnected")
+	}
+	if err := c.Publish(&MQTTMessage{Topic: "t", Payload: []byte("1"), QoS: 1, Retain: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newTestBroker(t, broker.Addr())
+	defer restarted.Close()
+	deadline = time.Now().Add(time.Second)
+	for {
+		restarted.mu.Lock()
+		m := restarted.retained["t"]
+		restarted.mu.Unlock()
+		if m != nil {
+			if string(m.Payload) != "1" {
+				t.Errorf("resent %q, want 1", m.Payload)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the QoS 1 message was not resent")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTopicMatch(t *testing.T) {
+	for _, c := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"plant/#", "plant/@m/a/Value", true},
+		{"plant/+/a/Value", "plant/@m/a/Value", true},
+		{"plant/+", "plant/@m/a", false},
+		{"plant/cmd/#", "plant/@m/a", false},
+	} {
+		if topicMatch(c.filter, c.topic) != c.want {
+			t.Errorf("%s matches %s: %t", c.filter, c.topic, !c.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// opc ua status codes.
+const (
+	StatusGood                         uint32 = 0x00000000
+	StatusUncertain                    uint32 = 0x40000000
+	StatusBad                          uint32 = 0x80000000
+	StatusBadInternalError             uint32 = 0x80020000
+	StatusBadDecodingError             uint32 = 0x80070000
+	StatusBadServiceUnsupported        uint32 = 0x800b0000
+	StatusBadNothingToDo               uint32 = 0x800f0000
+	StatusBadIdentityTokenInvalid      uint32 = 0x80200000
+	StatusBadSecureChannelIdInvalid    uint32 = 0x80220000
+	StatusBadSessionIdInvalid          uint32 = 0x80250000
+	StatusBadSessionClosed             uint32 = 0x80260000
+	StatusBadSessionNotActivated       uint32 = 0x80270000
+	StatusBadSubscriptionIdInvalid     uint32 = 0x80280000
+	StatusBadTimestampsToReturnInvalid uint32 = 0x802b0000
+	StatusBadNodeIdUnknown             uint32 = 0x80340000
+	StatusBadAttributeIdInvalid        uint32 = 0x80350000
+	StatusBadNotWritable               uint32 = 0x803b0000
+	StatusBadMonitoredItemIdInvalid    uint32 = 0x80420000
+	StatusBadMonitoringModeInvalid     uint32 = 0x80430000
+	StatusBadContinuationPointInvalid  uint32 = 0x804a0000
+	StatusBadSecurityPolicyRejected    uint32 = 0x80550000
+	StatusBadSecurityModeRejected      uint32 = 0x80560000
+	StatusBadWriteNotSupported         uint32 = 0x80730000
+	StatusBadTypeMismatch              uint32 = 0x80740000
+	StatusBadTooManyPublishRequests    uint32 = 0x80780000
+	StatusBadNoSubscription            uint32 = 0x80790000
+	StatusBadSequenceNumberUnknown     uint32 = 0x807a0000
+	StatusBadMessageNotAvailable       uint32 = 0x807b0000
+	StatusBadTcpMessageTypeInvalid     uint32 = 0x807e0000
+	StatusBadTcpMessageTooLarge        uint32 = 0x80800000
+)
+
+// UANodeClass is the class of a node in an address space.
+type UANodeClass int
+
+const (
+	ObjectNode   UANodeClass = 1
+	VariableNode UANodeClass = 2
+)
+
+func (c UANodeClass) String() string {
+	switch c {
+	case ObjectNode:
+		return "Object"
+	case VariableNode:
+		return "Variable"
+	}
+	return fmt.Sprintf("UANodeClass(%d)", int(c))
+}
+
+// UANode is a node of an address space: a folder object for each manager, a
+// variable for each tag holding its Value, and a property variable for each
+// other prop of the tag.
+type UANode struct {
+	NodeID     string
+	Class      UANodeClass
+	BrowseName string
+	tag        Tagger
+	prop       *Property
+}
+
+func (n *UANode) String() string {
+	return fmt.Sprintf("UANode{NodeID: %s, Class: %s, BrowseName: %s}", n.NodeID, n.Class, n.BrowseName)
+}
+
+// DataValue is the value of a variable node with its status and source
+// timestamp.
+type DataValue struct {
+	Value           interface{}
+	Status          uint32
+	SourceTimestamp time.Time
+}
+
+func (v *DataValue) String() string {
+	return fmt.Sprintf("DataValue{Value: %v, Status: 0x%08x, SourceTimestamp: %s}", v.Value, v.Status, v.SourceTimestamp)
+}
+
+// AddressSpace maps the tags of a manager to opc ua nodes, with string node
+// ids as ns=1;s=area2/tank-1 for tags and ns=1;s=area2/tank-1#Quality for
+// their props, and the manager name, as ns=1;s=@pressure, for the manager.
+// It implements the Read, Write and Browse services over the tags, served
+// over opc.tcp by an OPCUAServer.
+type AddressSpace struct {
+	manager   *TagManager
+	Namespace int
+}
+
+func (a *AddressSpace) String() string {
+	return fmt.Sprintf("AddressSpace{Manager: %s, Namespace: %d}", a.manager.Name, a.Namespace)
+}
+
+// NodeID returns the node id of the tag at path, or of its prop when given.
+func (a *AddressSpace) NodeID(path string, prop string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		path = a.manager.Name
+	}
+	id := fmt.Sprintf("ns=%d;s=%s", a.Namespace, path)
+	if prop != "" {
+		id += "#" + prop
+	}
+	return id
+}
+
+// Node finds the node of id. The manager is the node with an empty path.
+func (a *AddressSpace) Node(id string) (*UANode, uint32) {
+	path, prop, ok := a.parseNodeID(id)
+	if !ok {
+		return nil, StatusBadNodeIdUnknown
+	}
+	tag, err := a.manager.Lookup(path)
+	if err != nil {
+		return nil, StatusBadNodeIdUnknown
+	}
+	n := &UANode{NodeID: id, BrowseName: a.browseName(path), tag: tag}
+	if _, ok := tag.(*TagManager); ok {
+		if prop != "" {
+			return nil, StatusBadNodeIdUnknown
+		}
+		n.Class = ObjectNode
+		return n, StatusGood
+	}
+
+	s, err := schemaOf(tag)
+	if err != nil {
+		return nil, StatusBadNodeIdUnknown
+	}
+	if prop == "" {
+		prop = "Value"
+	} else {
+		n.BrowseName = prop
+	}
+	if n.prop, err = s.Prop(prop); err != nil {
+		return nil, StatusBadNodeIdUnknown
+	}
+	n.Class = VariableNode
+	return n, StatusGood
+}
+
+// Browse returns the children of the node of id: the tags of a manager, or
+// the property nodes of a tag.
+func (a *AddressSpace) Browse(id string) ([]*UANode, uint32) {
+	n, status := a.Node(id)
+	if status != StatusGood {
+		return nil, status
+	}
+	path, prop, _ := a.parseNodeID(id)
+
+	var children []*UANode
+	switch t := n.tag.(type) {
+	case *TagManager:
+		for _, c := range t.tags() {
+			if c, status := a.Node(a.NodeID(path+"/"+t.localName(c), "")); status == StatusGood {
+				children = append(children, c)
+			}
+		}
+	default:
+		if prop != "" {
+			return nil, StatusGood
+		}
+		s, _ := schemaOf(t)
+		for _, p := range s.Props {
+			if p.Name != "Name" && p.Name != "Value" {
+				c, _ := a.Node(a.NodeID(path, p.Name))
+				children = append(children, c)
+			}
+		}
+	}
+	return children, StatusGood
+}
+
+// Read returns the value of a variable node. The status of tag values comes
+// from their quality, and their source timestamp from their Timestamp.
+func (a *AddressSpace) Read(id string) *DataValue {
+	n, status := a.Node(id)
+	if status != StatusGood {
+		return &DataValue{Status: status}
+	}
+	if n.Class != VariableNode {
+		return &DataValue{Status: StatusBadAttributeIdInvalid}
+	}
+
+	v := &DataValue{Value: n.prop.Get(n.tag), Status: StatusGood}
+	if n.prop.Type == MetaProp {
+		v.Value = encodeMeta(n.prop.Get(n.tag).(map[string]string))
+	}
+	if t, err := getProp(n.tag, "Timestamp"); err == nil {
+		v.SourceTimestamp = time.Unix(t.(int64), 0).UTC()
+	}
+	if n.prop.Name == "Value" {
+		if q, err := getProp(n.tag, "Quality"); err == nil {
+			v.Status = qualityStatus(q.(int))
+		}
+	}
+	return v
+}
+
+// Write writes v into a variable node through Tagger.Set.
+func (a *AddressSpace) Write(id string, v interface{}) uint32 {
+	n, status := a.Node(id)
+	if status != StatusGood {
+		return status
+	}
+	if n.Class != VariableNode {
+		return StatusBadAttributeIdInvalid
+	}
+	if !n.prop.Editable {
+		return StatusBadNotWritable
+	}
+	if _, err := n.prop.Coerce(v); err != nil {
+		return StatusBadTypeMismatch
+	}
+	if err := n.tag.Set(nameOf(n.tag), n.prop.Name, v); err != nil {
+		return StatusBad
+	}
+	return StatusGood
+}
+
+func (a *AddressSpace) parseNodeID(id string) (string, string, bool) {
+	prefix := fmt.Sprintf("ns=%d;s=", a.Namespace)
+	if !strings.HasPrefix(id, prefix) {
+		return "", "", false
+	}
+	path := strings.TrimPrefix(id, prefix)
+	prop := ""
+	if i := strings.LastIndex(path, "#"); i >= 0 {
+		path, prop = path[:i], path[i+1:]
+	}
+	if path == a.manager.Name {
+		path = ""
+	}
+	return path, prop, true
+}
+
+func (a *AddressSpace) browseName(path string) string {
+	if path == "" {
+		return a.manager.Name
+	}
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+func NewAddressSpace(manager *TagManager, namespace int) *AddressSpace {
+	return &AddressSpace{manager: manager, Namespace: namespace}
+}
+
+// qualityStatus maps a tag quality to an opc ua status code, uncertain
+// between bad and good.
+func qualityStatus(q int) uint32 {
+	switch {
+	case q >= QualityGood:
+		return StatusGood
+	case q <= QualityBad:
+		return StatusBad
+	}
+	return StatusUncertain
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUANodeIDEncoding(t *testing.T) {
+	for _, c := range []struct {
+		id  uaNodeID
+		enc []byte
+	}{
+		{uaNodeID{Kind: uaNumericNodeID, Num: 85}, []byte{0x00, 0x55}},
+		{uaNodeID{NS: 5, Kind: uaNumericNodeID, Num: 1025}, []byte{0x01, 0x05, 0x01, 0x04}},
+		{uaNodeID{NS: 1, Kind: uaStringNodeID, Str: "Hot水"},
+			[]byte{0x03, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00, 0x48, 0x6f, 0x74, 0xe6, 0xb0, 0xb4}},
+		{uaNodeID{NS: 2, Kind: uaNumericNodeID, Num: 70000}, []byte{0x02, 0x02, 0x00, 0x70, 0x11, 0x01, 0x00}},
+	} {
+		e := &uaEncoder{}
+		e.nodeID(c.id)
+		if !bytes.Equal(e.b, c.enc) {
+			t.Errorf("%s encoded as % x, expected % x", c.id, e.b, c.enc)
+		}
+		d := &uaDecoder{b: c.enc}
+		if id := d.nodeID(); id != c.id || d.err != nil {
+			t.Errorf("% x decoded as %s (%v), expected %s", c.enc, id, d.err, c.id)
+		}
+		if id := parseUANodeID(c.id.String()); id != c.id {
+			t.Errorf("%s parsed as %s", c.id, id)
+		}
+	}
+
+	d := &uaDecoder{b: []byte{0x03, 0x01, 0x00, 0x10, 0x00, 0x00, 0x00, 'a'}}
+	if d.nodeID(); d.err == nil {
+		t.Error("Expected truncated node id to fail")
+	}
+}
+
+func TestUAVariant(t *testing.T) {
+	now := time.Unix(1400000000, 0).UTC()
+	for _, v := range []interface{}{true, int64(-3), 2.5, "tank", now} {
+		e := &uaEncoder{}
+		e.variant(v)
+		d := &uaDecoder{b: e.b}
+		if got := d.variant(); got != v || d.err != nil || len(d.b) != 0 {
+			t.Errorf("%v decoded as %v (%v)", v, got, d.err)
+		}
+	}
+
+	e := &uaEncoder{}
+	e.time(time.Unix(0, 0))
+	if ticks := binary.LittleEndian.Uint64(e.b); ticks != uaEpoch {
+		t.Errorf("Unix epoch encoded as %d ticks", ticks)
+	}
+}
+
+func TestOPCUAServer(t *testing.T) {
+	a, b := &memTag{Value: 1, Quality: QualityGood}, &memTag{Value: 2, Quality: QualityGood}
+	tm := memManager("@u", a, b)
+	s := NewOPCUAServer(tm)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	c := dialUA(t, l.Addr().String())
+	defer c.conn.Close()
+
+	d := c.call(t, uaGetEndpointsRequest, uaGetEndpointsResponse, func(e *uaEncoder) {
+		e.str("")
+		e.null()
+		e.null()
+	})
+	if n := d.count(); n != 1 {
+		t.Fatalf("Expected 1 endpoint, got %d", n)
+	}
+	if url := d.str(); url != "opc.tcp://"+l.Addr().String() {
+		t.Errorf("Unexpected endpoint %s", url)
+	}
+
+	c.session(t)
+
+	// browse the objects folder and the manager
+	refs := c.browse(t, uaNodeID{Kind: uaNumericNodeID, Num: 85})
+	if len(refs) != 2 || refs[0] != "ns=1;s=@u" || refs[1] != "i=2253" {
+		t.Errorf("Unexpected references of Objects: %v", refs)
+	}
+	refs = c.browse(t, parseUANodeID("ns=1;s=@u"))
+	if len(refs) != 2 || refs[0] != "ns=1;s=a" || refs[1] != "ns=1;s=b" {
+		t.Errorf("Unexpected references of @u: %v", refs)
+	}
+
+	// read values, a data type and an unknown node
+	d = c.call(t, uaReadRequest, uaReadResponse, func(e *uaEncoder) {
+		e.f64(0)
+		e.u32(3)
+		e.i32(4)
+		for _, r := range []struct {
+			id   string
+			attr uint32
+		}{{"ns=1;s=a", uaAttrValue}, {"ns=1;s=b#Level", uaAttrValue}, {"ns=1;s=a", uaAttrDataType}, {"ns=1;s=z", uaAttrValue}} {
+			e.nodeID(parseUANodeID(r.id))
+			e.u32(r.attr)
+			e.null()
+			e.qname(&uaQName{})
+		}
+	})
+	values := make([]*DataValue, d.count())
+	for i := range values {
+		values[i] = d.dataValue()
+	}
+	if len(values) != 4 || values[0].Value != int64(1) || values[1].Value != 0.0 {
+		t.Fatalf("Unexpected values %v", values)
+	}
+	if id, ok := values[2].Value.(uaNodeID); !ok || id.Num != uaInt64 {
+		t.Errorf("Expected Int64 data type, got %v", values[2].Value)
+	}
+	if values[3].Status != StatusBadNodeIdUnknown {
+		t.Errorf("Expected unknown node, got %x", values[3].Status)
+	}
+
+	// monitor a, then write it
+	d = c.call(t, uaCreateSubscriptionRequest, uaCreateSubscriptionResponse, func(e *uaEncoder) {
+		e.f64(50)
+		e.u32(100)
+		e.u32(10)
+		e.u32(0)
+		e.boolean(true)
+		e.u8(0)
+	})
+	sub := d.u32()
+	d = c.call(t, uaCreateMonitoredItemsRequest, uaCreateMonitoredItemsReply, func(e *uaEncoder) {
+		e.u32(sub)
+		e.u32(0)
+		e.i32(1)
+		e.nodeID(parseUANodeID("ns=1;s=a"))
+		e.u32(uaAttrValue)
+		e.null()
+		e.qname(&uaQName{})
+		e.u32(2)
+		e.u32(7)
+		e.f64(0)
+		e.nodeID(uaNodeID{})
+		e.u8(0)
+		e.u32(1)
+		e.boolean(true)
+	})
+	if d.count() != 1 || d.u32() != StatusGood {
+		t.Fatal("Couldn't monitor a")
+	}
+
+	if v := c.publish(t, sub); len(v) != 1 || v[7].Value != int64(1) {
+		t.Fatalf("Expected initial value of a, got %v", v)
+	}
+
+	d = c.call(t, uaWriteRequest, uaWriteResponse, func(e *uaEncoder) {
+		e.i32(1)
+		e.nodeID(parseUANodeID("ns=1;s=a"))
+		e.u32(uaAttrValue)
+		e.null()
+		e.u8(0x01)
+		e.variant(int64(42))
+	})
+	if d.count() != 1 || d.u32() != StatusGood {
+		t.Fatal("Couldn't write a")
+	}
+	if v := c.publish(t, sub); len(v) != 1 || v[7].Value != int64(42) {
+		t.Fatalf("Expected written value of a, got %v", v)
+	}
+	if got, _ := tm.Get("@u:a", "Value"); got != 42 {
+		t.Errorf("Expected a to be 42, got %v", got)
+	}
+
+	// without changes, publish returns keep alives
+	if v := c.publish(t, sub); len(v) != 0 {
+		t.Errorf("Expected keep alive, got %v", v)
+	}
+}
+
+func TestOPCUAServerSession(t *testing.T) {
+	s := NewOPCUAServer(memManager("@u", &memTag{}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	c := dialUA(t, l.Addr().String())
+	defer c.conn.Close()
+	if status := c.fault(t, uaReadRequest, func(e *uaEncoder) {}); status != StatusBadSessionIdInvalid {
+		t.Errorf("Expected read without session to fail, got %x", status)
+	}
+
+	c.session(t)
+	if status := c.fault(t, uaPublishRequest, func(e *uaEncoder) { e.i32(0) }); status != StatusBadNoSubscription {
+		t.Errorf("Expected publish without subscription to fail, got %x", status)
+	}
+	c.call(t, uaCloseSessionRequest, uaCloseSessionResponse, func(e *uaEncoder) { e.boolean(true) })
+	if status := c.fault(t, uaReadRequest, func(e *uaEncoder) {}); status != StatusBadSessionIdInvalid {
+		t.Errorf("Expected read of closed session to fail, got %x", status)
+	}
+}
+
+// uaTestClient is an opc.tcp client over a secure channel without security.
+type uaTestClient struct {
+	conn    net.Conn
+	channel uint32
+	token   uaNodeID
+	req     uint32
+}
+
+func dialUA(t *testing.T, addr string) *uaTestClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &uaTestClient{conn: conn}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	hello := &uaEncoder{}
+	hello.u32(0)
+	hello.u32(8192)
+	hello.u32(8192)
+	hello.u32(0)
+	hello.u32(0)
+	hello.str("opc.tcp://" + addr)
+	c.write(t, "HEL", hello.b)
+	if kind, _, _ := c.read(t); kind != "ACK" {
+		t.Fatalf("Expected ACK, got %s", kind)
+	}
+
+	open := &uaEncoder{}
+	open.u32(0)
+	open.str(uaSecurityPolicyNone)
+	open.null()
+	open.null()
+	open.u32(1)
+	open.u32(1)
+	open.nodeID(uaNodeID{Kind: uaNumericNodeID, Num: uaOpenSecureChannelRequest})
+	c.header(open)
+	open.u32(0)
+	open.u32(0)
+	open.u32(uaSecurityModeNone)
+	open.bytes([]byte{})
+	open.u32(60000)
+	c.write(t, "OPN", open.b)
+	kind, _, body := c.read(t)
+	if kind != "OPN" {
+		t.Fatalf("Expected OPN, got %s", kind)
+	}
+	d := &uaDecoder{b: body}
+	c.channel = d.u32()
+	return c
+}
+
+func (c *uaTestClient) header(e *uaEncoder) {
+	e.nodeID(c.token)
+	e.time(time.Now())
+	e.u32(c.req)
+	e.u32(0)
+	e.null()
+	e.u32(5000)
+	e.nodeID(uaNodeID{})
+	e.u8(0)
+}
+
+func (c *uaTestClient) write(t *testing.T, kind string, body []byte) {
+	header := make([]byte, 8)
+	copy(header, kind)
+	header[3] = 'F'
+	binary.LittleEndian.PutUint32(header[4:], uint32(8+len(body)))
+	if _, err := c.conn.Write(append(header, body...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *uaTestClient) read(t *testing.T) (string, byte, []byte) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(header[4:])-8)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		t.Fatal(err)
+	}
+	return string(header[:3]), header[3], body
+}
+
+// send sends a request, returning the type of its response and the body
+// after the response header.
+func (c *uaTestClient) send(t *testing.T, typeID uint32, body func(e *uaEncoder)) (uint32, uint32, *uaDecoder) {
+	c.req++
+	e := &uaEncoder{}
+	e.u32(c.channel)
+	e.u32(1)
+	e.u32(c.req)
+	e.u32(c.req)
+	e.nodeID(uaNodeID{Kind: uaNumericNodeID, Num: typeID})
+	c.header(e)
+	body(e)
+	c.write(t, "MSG", e.b)
+
+	var msg []byte
+	for {
+		kind, chunk, b := c.read(t)
+		if kind != "MSG" {
+			t.Fatalf("Expected MSG, got %s", kind)
+		}
+		if reqID := binary.LittleEndian.Uint32(b[12:]); reqID != c.req {
+			t.Fatalf("Expected response to %d, got %d", c.req, reqID)
+		}
+		if msg = append(msg, b[16:]...); chunk == 'F' {
+			break
+		}
+	}
+	d := &uaDecoder{b: msg}
+	resp := d.nodeID()
+	d.time()
+	d.u32()
+	status := d.u32()
+	d.diagnosticInfo()
+	d.strs()
+	d.extension()
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	return resp.Num, status, d
+}
+
+func (c *uaTestClient) call(t *testing.T, typeID uint32, respID uint32, body func(e *uaEncoder)) *uaDecoder {
+	resp, status, d := c.send(t, typeID, body)
+	if resp != respID || status != StatusGood {
+		t.Fatalf("Request %d answered with %d (%x)", typeID, resp, status)
+	}
+	return d
+}
+
+func (c *uaTestClient) fault(t *testing.T, typeID uint32, body func(e *uaEncoder)) uint32 {
+	resp, status, _ := c.send(t, typeID, body)
+	if resp != uaServiceFault {
+		t.Fatalf("Expected request %d to fail, got %d", typeID, resp)
+	}
+	return status
+}
+
+func (c *uaTestClient) session(t *testing.T) {
+	d := c.call(t, uaCreateSessionRequest, uaCreateSessionResponse, func(e *uaEncoder) {
+		e.str("urn:test")
+		e.str("urn:test")
+		e.text("test")
+		e.u32(1)
+		e.null()
+		e.null()
+		e.null()
+		e.null()
+		e.null()
+		e.str("test")
+		e.bytes(make([]byte, 32))
+		e.null()
+		e.f64(60000)
+		e.u32(0)
+	})
+	d.nodeID()
+	c.token = d.nodeID()
+	c.call(t, uaActivateSessionRequest, uaActivateSessionResponse, func(e *uaEncoder) {
+		e.null()
+		e.null()
+		e.i32(0)
+		e.null()
+		e.nodeID(uaNodeID{Kind: uaNumericNodeID, Num: uaAnonymousIdentityToken})
+		e.u8(1)
+		anonymous := &uaEncoder{}
+		anonymous.str("anonymous")
+		e.bytes(anonymous.b)
+		e.nodeID(uaNodeID{})
+		e.u8(0)
+	})
+}
+
+// browse returns the targets of the hierarchical forward references of id.
+func (c *uaTestClient) browse(t *testing.T, id uaNodeID) []string {
+	d := c.call(t, uaBrowseRequest, uaBrowseResponse, func(e *uaEncoder) {
+		e.nodeID(uaNodeID{})
+		e.u64(0)
+		e.u32(0)
+		e.u32(0)
+		e.i32(1)
+		e.nodeID(id)
+		e.u32(0)
+		e.nodeID(uaNodeID{Kind: uaNumericNodeID, Num: uaHierarchical})
+		e.boolean(true)
+		e.u32(0)
+		e.u32(0x3f)
+	})
+	if n := d.count(); n != 1 {
+		t.Fatalf("Expected 1 browse result, got %d", n)
+	}
+	if status := d.u32(); status != StatusGood {
+		t.Fatalf("Couldn't browse %s: %x", id, status)
+	}
+	d.bytes()
+	var targets []string
+	for i, n := 0, d.count(); i < n; i++ {
+		d.nodeID()
+		d.boolean()
+		targets = append(targets, d.expandedNodeID().String())
+		d.qname()
+		d.text()
+		d.u32()
+		d.expandedNodeID()
+	}
+	return targets
+}
+
+// publish returns the values of a notification message of sub, by client
+// handle.
+func (c *uaTestClient) publish(t *testing.T, sub uint32) map[uint32]*DataValue {
+	d := c.call(t, uaPublishRequest, uaPublishResponse, func(e *uaEncoder) {
+		e.i32(0)
+	})
+	if id := d.u32(); id != sub {
+		t.Fatalf("Expected publish of %d, got %d", sub, id)
+	}
+	d.u32s()
+	d.boolean()
+	d.u32()
+	d.time()
+
+	values := map[uint32]*DataValue{}
+	for i, n := 0, d.count(); i < n; i++ {
+		typeID, body := d.extension()
+		if typeID.Num != uaDataChangeNotification {
+			t.Fatalf("Unexpected notification %s", typeID)
+		}
+		n := &uaDecoder{b: body}
+		for j, m := 0, n.count(); j < m; j++ {
+			handle := n.u32()
+			values[handle] = n.dataValue()
+		}
+	}
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	return values
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// PropType is the Go type held by a property.
+type PropType int
+
+const (
+	IntProp PropType = iota
+	Int64Prop
+	FloatProp
+	BoolProp
+	StringProp
+	MetaProp
+)
+
+func (p PropType) String() string {
+	switch p {
+	case IntProp:
+		return "int"
+	case Int64Prop:
+		return "int64"
+	case FloatProp:
+		return "float64"
+	case BoolProp:
+		return "bool"
+	case StringProp:
+		return "string"
+	case MetaProp:
+		return "map[string]string"
+	}
+	return fmt.Sprintf("PropType(%d)", int(p))
+}
+
+// Property describes one property of a tagger type: how it is read and written
+// in memory, the redis key suffix holding it and whether users may write it.
+type Property struct {
+	Name     string
+	Type     PropType
+	Key      string
+	Editable bool
+	Validate func(v interface{}) error
+	Get      func(t Tagger) interface{}
+	Set      func(t Tagger, v interface{})
+}
+
+func (p *Property) String() string {
+	return fmt.Sprintf(
+		"Property{Name: %s, Type: %s, Key: %s, Editable: %t}",
+		p.Name,
+		p.Type,
+		p.Key,
+		p.Editable,
+	)
+}
+
+// Coerce converts v to the property type and validates it. Strings are parsed,
+// so values read from redis or sent by users can be written directly.
+func (p *Property) Coerce(v interface{}) (interface{}, error) {
+	c, err := p.coerce(v)
+	if err != nil {
+		return nil, fmt.Errorf("prop %s is of type %s, can't receive value %v: %s", p.Name, p.Type, v, err)
+	}
+	if p.Validate != nil {
+		if err := p.Validate(c); err != nil {
+			return nil, fmt.Errorf("invalid value %v for prop %s: %s", v, p.Name, err)
+		}
+	}
+	return c, nil
+}
+
+// Encode returns the value stored in redis for v.
+func (p *Property) Encode(v interface{}) interface{} {
+	if p.Type == MetaProp {
+		m, _ := v.(map[string]string)
+		return encodeMeta(m)
+	}
+	if p.Type == BoolProp {
+		if b, ok := v.(bool); ok && b {
+			return 1
+		}
+		return 0
+	}
+	return v
+}
+
+func (p *Property) coerce(v interface{}) (interface{}, error) {
+	if s, ok := v.(string); ok {
+		return p.parse(s)
+	}
+
+	switch p.Type {
+	case IntProp:
+		n, err := integerOf(v)
+		if err != nil {
+			return nil, err
+		}
+		if int64(int(n)) != n {
+			return nil, fmt.Errorf("out of range")
+		}
+		return int(n), nil
+	case Int64Prop:
+		return integerOf(v)
+	case FloatProp:
+		f, ok := numberOf(v)
+		if !ok {
+			return nil, fmt.Errorf("not a number")
+		}
+		return f, nil
+	case BoolProp:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		f, ok := numberOf(v)
+		if !ok {
+			return nil, fmt.Errorf("not a bool")
+		}
+		return f != 0, nil
+	case MetaProp:
+		switch m := v.(type) {
+		case map[string]string:
+			return m, nil
+		case map[string]interface{}:
+			c := map[string]string{}
+			for k, e := range m {
+				c[k] = fmt.Sprint(e)
+			}
+			return c, nil
+		}
+		return nil, fmt.Errorf("not a map[string]string")
+	}
+	return fmt.Sprint(v), nil
+}
+
+func (p *Property) parse(s string) (interface{}, error) {
+	switch p.Type {
+	case IntProp, Int64Prop:
+		return p.coerce(json.Number(s))
+	case FloatProp:
+		return strconv.ParseFloat(s, 64)
+	case BoolProp:
+		if n, err := strconv.Atoi(s); err == nil {
+			return n != 0, nil
+		}
+		return strconv.ParseBool(s)
+	case MetaProp:
+		return decodeMeta(s)
+	}
+	return s, nil
+}
+
+func (p *Property) check(proto Tagger) error {
+	if p.Name == "" || p.Key == "" {
+		return fmt.Errorf("property %s needs a name and a key", p)
+	}
+	if p.Get == nil || p.Set == nil {
+		return fmt.Errorf("property %s needs Get and Set", p)
+	}
+
+	var ok bool
+	v := p.Get(proto)
+	switch p.Type {
+	case IntProp:
+		_, ok = v.(int)
+	case Int64Prop:
+		_, ok = v.(int64)
+	case FloatProp:
+		_, ok = v.(float64)
+	case BoolProp:
+		_, ok = v.(bool)
+	case StringProp:
+		_, ok = v.(string)
+	case MetaProp:
+		_, ok = v.(map[string]string)
+	}
+	if !ok {
+		return fmt.Errorf("property %s declared as %s, but Get returns %T", p.Name, p.Type, v)
+	}
+	return nil
+}
+
+// schema ----------------------------------------------------------------------
+
+// Schema lists the properties of a tagger type, in declaration order.
+type Schema struct {
+	Type  string
+	Props []*Property
+	names map[string]*Property
+	keys  map[string]*Property
+}
+
+func (s *Schema) String() string {
+	return fmt.Sprintf("Schema{Type: %s, Props#len: %d}", s.Type, len(s.Props))
+}
+
+func (s *Schema) Prop(name string) (*Property, error) {
+	if p, ok := s.names[name]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("prop %s do not exist in %s", name, s.Type)
+}
+
+// Lookup finds a property by its name, as Value, or by the redis key suffix
+// holding it, as value.
+func (s *Schema) Lookup(prop string) (*Property, error) {
+	if p, ok := s.names[prop]; ok {
+		return p, nil
+	}
+	if p, ok := s.keys[prop]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("prop %s do not exist in %s", prop, s.Type)
+}
+
+// ByKey finds the property stored under the redis key suffix key.
+func (s *Schema) ByKey(key string) (*Property, error) {
+	if p, ok := s.keys[key]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("key %s do not belong to %s", key, s.Type)
+}
+
+var (
+	schemasMu sync.RWMutex
+	schemas   = map[reflect.Type]*Schema{}
+)
+
+// RegisterSchema declares the properties of the type of proto, which must be a
+// pointer to a zero or default value of the type. Properties are checked
+// against proto, so a Get returning the wrong type fails here and not when
+// the property is first written.
+func RegisterSchema(proto Tagger, props ...*Property) (*Schema, error) {
+	s := &Schema{
+		Type:  fmt.Sprintf("%T", proto),
+		Props: props,
+		names: map[string]*Property{},
+		keys:  map[string]*Property{},
+	}
+	for _, p := range props {
+		if err := p.check(proto); err != nil {
+			return nil, fmt.Errorf("could not register %s: %s", s.Type, err)
+		}
+		if _, ok := s.names[p.Name]; ok {
+			return nil, fmt.Errorf("could not register %s: duplicated prop %s", s.Type, p.Name)
+		}
+		if _, ok := s.keys[p.Key]; ok {
+			return nil, fmt.Errorf("could not register %s: duplicated key %s", s.Type, p.Key)
+		}
+		s.names[p.Name] = p
+		s.keys[p.Key] = p
+	}
+	if _, ok := s.names["Name"]; !ok {
+		return nil, fmt.Errorf("could not register %s: a Name prop is required", s.Type)
+	}
+
+	schemasMu.Lock()
+	defer schemasMu.Unlock()
+	schemas[reflect.TypeOf(proto)] = s
+	return s, nil
+}
+
+func mustRegisterSchema(proto Tagger, props ...*Property) *Schema {
+	s, err := RegisterSchema(proto, props...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func schemaOf(t Tagger) (*Schema, error) {
+	schemasMu.RLock()
+	defer schemasMu.RUnlock()
+	if s, ok := schemas[reflect.TypeOf(t)]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("no schema registered for %T", t)
+}
+
+// property access -------------------------------------------------------------
+
+func getProp(t Tagger, prop string) (interface{}, error) {
+	s, err := schemaOf(t)
+	if err != nil {
+		return nil, err
+	}
+	p, err := s.Lookup(prop)
+	if err != nil {
+		return nil, err
+	}
+	return p.Get(t), nil
+}
+
+func setProp(t Tagger, prop string, v interface{}) error {
+	s, err := schemaOf(t)
+	if err != nil {
+		return err
+	}
+	p, err := s.Lookup(prop)
+	if err != nil {
+		return err
+	}
+	c, err := p.Coerce(v)
+	if err != nil {
+		return err
+	}
+	p.Set(t, c)
+	return nil
+}
+
+func nameOf(t Tagger) string {
+	n, err := getProp(t, "Name")
+	if err != nil {
+		return ""
+	}
+	return n.(string)
+}
+
+func numberOf(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	case interface {
+		Float64() (float64, error)
+	}:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// integerOf returns the integer held by v. Integers are converted exactly,
+// and floats only when they have no fraction and fit in an int64.
+func integerOf(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case int32:
+		return int64(n), nil
+	case uint16:
+		return int64(n), nil
+	case interface {
+		Int64() (int64, error)
+	}:
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+	}
+
+	f, ok := numberOf(v)
+	if !ok {
+		return 0, fmt.Errorf("not a number")
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) || f < -(1<<63) || f >= 1<<63 {
+		return 0, fmt.Errorf("out of range")
+	}
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("not an integer")
+	}
+	return int64(f), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestCoerceInt(t *testing.T) {
+	p, err := tagSchema.Prop("Value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []interface{}{3, int64(3), 3.0, float32(3), "3"} {
+		c, err := p.Coerce(v)
+		if err != nil {
+			t.Errorf("Coerce(%#v): %s", v, err)
+		} else if c != 3 {
+			t.Errorf("Coerce(%#v) = %#v, want 3", v, c)
+		}
+	}
+	for _, v := range []interface{}{3.7, float32(0.5), "3.7", "x", true} {
+		if c, err := p.Coerce(v); err == nil {
+			t.Errorf("Coerce(%#v) = %#v, want an error", v, c)
+		}
+	}
+}
+
+func TestCoerceFloat(t *testing.T) {
+	p := &Property{Name: "Level", Type: FloatProp}
+	for _, v := range []interface{}{3.7, "3.7", float32(3.75)} {
+		c, err := p.Coerce(v)
+		if err != nil {
+			t.Errorf("Coerce(%#v): %s", v, err)
+		} else if f := c.(float64); f < 3.7 || f > 3.75 {
+			t.Errorf("Coerce(%#v) = %g", v, f)
+		}
+	}
+}
+
+func TestCoerceInt64Range(t *testing.T) {
+	p, err := tagSchema.Prop("Timestamp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const big = 1<<53 + 1
+	for _, v := range []interface{}{int64(big), "9007199254740993", json.Number("9007199254740993")} {
+		c, err := p.Coerce(v)
+		if err != nil {
+			t.Errorf("Coerce(%#v): %s", v, err)
+		} else if c != int64(big) {
+			t.Errorf("Coerce(%#v) = %#v, want %d", v, c, int64(big))
+		}
+	}
+	for _, v := range []interface{}{1e300, -1e300, math.Inf(1), math.Inf(-1), math.NaN(), "1e300", float64(1 << 63)} {
+		if c, err := p.Coerce(v); err == nil {
+			t.Errorf("Coerce(%#v) = %#v, want an error", v, c)
+		}
+	}
+	if c, err := p.Coerce(-float64(1 << 63)); err != nil || c != int64(-1<<63) {
+		t.Errorf("Coerce(-2^63) = %#v, %v", c, err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Query selects taggers in a TagManager. Glob and Regex match the tagger path
+// relative to the manager, and every condition in Where must hold. Empty
+// fields match everything.
+type Query struct {
+	Glob  string
+	Regex *regexp.Regexp
+	Where []Condition
+}
+
+func (q *Query) String() string {
+	return fmt.Sprintf("Query{Glob: %s, Regex: %v, Where: %v}", q.Glob, q.Regex, q.Where)
+}
+
+// Condition compares a property, named as in the schema or by its redis key,
+// or a Meta entry when the tagger has no such property, against Value. Op is
+// one of =, !=, <, <=, > and >=. Quality also compares against good and bad.
+type Condition struct {
+	Prop  string
+	Op    string
+	Value interface{}
+}
+
+func (c Condition) String() string {
+	return fmt.Sprintf("%s %s %v", c.Prop, c.Op, c.Value)
+}
+
+func (c Condition) match(tag Tagger) (bool, error) {
+	v, ok := queryProp(tag, c.Prop)
+	if !ok {
+		return false, nil
+	}
+
+	if bad, ok := c.badQuality(); ok && (c.Op == "=" || c.Op == "==" || c.Op == "!=") {
+		q, _ := numberOf(v)
+		return (isBad(int(q)) == bad) == (c.Op != "!="), nil
+	}
+
+	cmp := compareValues(v, c.value())
+	switch c.Op {
+	case "=", "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	}
+	return false, fmt.Errorf("unknown operator %s in %s", c.Op, c)
+}
+
+// badQuality tells whether c is a condition on quality against good or bad,
+// and which one. Equality then matches with isBad, as aggregates do, so any
+// quality short of QualityGood is bad.
+func (c Condition) badQuality() (bool, bool) {
+	if !strings.EqualFold(c.Prop, "quality") {
+		return false, false
+	}
+	switch strings.ToLower(fmt.Sprint(c.Value)) {
+	case "good":
+		return false, true
+	case "bad":
+		return true, true
+	}
+	return false, false
+}
+
+// value returns Value, with good and bad standing for QualityGood and
+// QualityBad in ordered conditions on quality.
+func (c Condition) value() interface{} {
+	if !strings.EqualFold(c.Prop, "quality") {
+		return c.Value
+	}
+	switch strings.ToLower(fmt.Sprint(c.Value)) {
+	case "good":
+		return QualityGood
+	case "bad":
+		return QualityBad
+	}
+	return c.Value
+}
+
+func Where(prop string, op string, value interface{}) Condition {
+	return Condition{prop, op, value}
+}
+
+// ParseCondition reads conditions written as "unit = bar" or "Value > 50". The
+// operator is the leftmost one, and the longest at its position, so values may
+// hold operators, as in "label = a<b".
+func ParseCondition(s string) (Condition, error) {
+	for i := range s {
+		for _, op := range []string{"!=", "<=", ">=", "==", "=", "<", ">"} {
+			if !strings.HasPrefix(s[i:], op) {
+				continue
+			}
+			prop := strings.TrimSpace(s[:i])
+			value := strings.TrimSpace(s[i+len(op):])
+			if prop == "" || value == "" {
+				return Condition{}, fmt.Errorf("invalid condition %q", s)
+			}
+			return Condition{prop, op, value}, nil
+		}
+	}
+	return Condition{}, fmt.Errorf("invalid condition %q", s)
+}
+
+// tag manager -----------------------------------------------------------------
+
+// Find returns the taggers under the manager matching q, in tree order. It
+// only reads the manager index, so it never walks the redis keyspace. A
+// condition on a property no tagger has, nor as a Meta entry, is an error.
+func (t *TagManager) Find(q *Query) ([]Tagger, error) {
+	found := []Tagger{}
+	known := make([]bool, len(q.Where))
+	err := t.Walk(func(p string, tag Tagger) error {
+		for i, c := range q.Where {
+			if !known[i] {
+				_, known[i] = queryProp(tag, c.Prop)
+			}
+		}
+		ok, err := q.match(p, tag)
+		if ok {
+			found = append(found, tag)
+		}
+		return err
+	})
+	if err != nil {
+		return found, err
+	}
+	for i, c := range q.Where {
+		if !known[i] && t.Len() > 0 {
+			return nil, fmt.Errorf("unknown property %s in %s", c.Prop, c)
+		}
+	}
+	return found, nil
+}
+
+// FindVector returns a vector of the tags matching q, which is kept to
+// refresh the vector membership later.
+func (t *TagManager) FindVector(name string, conn *Client, q *Query) (*Vector, error) {
+	v := NewVector(name, conn)
+	v.manager = t
+	v.query = q
+	return v, v.Refresh()
+}
+
+func (q *Query) match(p string, tag Tagger) (bool, error) {
+	if q.Glob != "" {
+		ok, err := path.Match(q.Glob, p)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	if q.Regex != nil && !q.Regex.MatchString(p) {
+		return false, nil
+	}
+	for _, c := range q.Where {
+		ok, err := c.match(tag)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// redis -----------------------------------------------------------------------
+
+// ScanTags returns the names of the tags stored in redis matching pattern,
+// walking the keyspace with SCAN so the server is never blocked.
+func ScanTags(conn *Client, pattern string) ([]string, error) {
+	keys, err := scanKeys(conn, fmt.Sprintf("%s:name", pattern))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = strings.TrimSuffix(k, ":name")
+	}
+	return names, nil
+}
+
+func scanKeys(conn *Client, match string) ([]string, error) {
+	keys := []string{}
+	cursor := "0"
+	for {
+		r, err := conn.Scan(cursor, "match", match, "count", 1000)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Elems) != 2 {
+			return nil, fmt.Errorf("unexpected scan reply %s", r)
+		}
+
+		cursor, err = r.Elems[0].Str()
+		if err != nil {
+			return nil, err
+		}
+		page, err := r.Elems[1].List()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+
+		if cursor == "0" {
+			return keys, nil
+		}
+	}
+}
+
+// utility ---------------------------------------------------------------------
+
+// queryProp reads prop from tag by name, by redis key or from its Meta.
+func queryProp(tag Tagger, prop string) (interface{}, bool) {
+	if s, err := schemaOf(tag); err == nil {
+		p, err := s.Prop(prop)
+		if err != nil {
+			p, err = s.ByKey(strings.ToLower(prop))
+		}
+		if err == nil {
+			return p.Get(tag), true
+		}
+	}
+	m, err := getProp(tag, "Meta")
+	if err != nil {
+		return nil, false
+	}
+	meta, ok := m.(map[string]string)
+	if !ok {
+		return nil, false
+	}
+	v, ok := meta[prop]
+	return v, ok
+}
+
+// compareValues compares a and b as numbers when both are numeric, and as
+// strings otherwise.
+func compareValues(a interface{}, b interface{}) int {
+	sa, sb := fmt.Sprint(a), fmt.Sprint(b)
+	fa, erra := strconv.ParseFloat(sa, 64)
+	fb, errb := strconv.ParseFloat(sb, 64)
+	if erra == nil && errb == nil {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(sa, sb)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func queryManager() *TagManager {
+	tm := NewTagManager("@q")
+	for _, t := range []*Tag{
+		{Name: "@q:a", Value: 10, Quality: QualityGood, Meta: map[string]string{"unit": "bar"}},
+		{Name: "@q:b", Value: 60, Quality: QualityBad, Meta: map[string]string{}},
+		{Name: "@q:c", Value: 80, Quality: QualityGood, Meta: map[string]string{"unit": "psi"}},
+		{Name: "@q:d", Value: 5, Quality: 50, Meta: map[string]string{}},
+	} {
+		tm.add(t)
+	}
+	return tm
+}
+
+func TestFind(t *testing.T) {
+	tm := queryManager()
+	for cond, want := range map[string]int{
+		"Value > 50":      2,
+		"value > 50":      2,
+		"VALUE <= 10":     2,
+		"quality = good":  2,
+		"Quality = bad":   2,
+		"quality != bad":  2,
+		"quality != good": 2,
+		"quality = 100":   2,
+		"quality > bad":   3,
+		"unit = bar":      1,
+	} {
+		c, err := ParseCondition(cond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := tm.Find(&Query{Where: []Condition{c}})
+		if err != nil {
+			t.Errorf("%s: %s", cond, err)
+			continue
+		}
+		if len(found) != want {
+			t.Errorf("%s found %d tags, want %d", cond, len(found), want)
+		}
+	}
+}
+
+func TestParseCondition(t *testing.T) {
+	for s, want := range map[string]Condition{
+		"unit = bar":  Where("unit", "=", "bar"),
+		"Value>=50":   Where("Value", ">=", "50"),
+		"x < a=b":     Where("x", "<", "a=b"),
+		"x != a<=b":   Where("x", "!=", "a<=b"),
+		"label == =":  Where("label", "==", "="),
+		"quality!=ok": Where("quality", "!=", "ok"),
+	} {
+		c, err := ParseCondition(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if c != want {
+			t.Errorf("%s: expected %v, got %v", s, want, c)
+		}
+	}
+	for _, s := range []string{"unit", "= bar", "unit =", "< 5"} {
+		if _, err := ParseCondition(s); err == nil {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestFindUnknownProp(t *testing.T) {
+	tm := queryManager()
+	if _, err := tm.Find(&Query{Where: []Condition{Where("colour", "=", "red")}}); err == nil {
+		t.Error("Find accepted an unknown property")
+	}
+}
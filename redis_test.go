@@ -0,0 +1,873 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRedis is a redis server for tests, keeping the strings, hashes, sorted
+// sets and streams the package uses in memory. It publishes keyspace
+// notifications for set and del, and runs transactions atomically.
+type testRedis struct {
+	l       net.Listener
+	strs    map[string]string
+	hashes  map[string]map[string]string
+	zsets   map[string]map[string]float64
+	streams map[string]*testStream
+	subs    map[*testRedisConn]bool
+	seq     int64
+	mu      sync.Mutex
+}
+
+type testStream struct {
+	entries []*testEntry
+	groups  map[string]*testGroup
+	last    int64
+}
+
+type testEntry struct {
+	id     int64
+	fields []string
+}
+
+type testGroup struct {
+	last    int64
+	pending map[int64]*testPending
+}
+
+type testPending struct {
+	consumer   string
+	deliveries int
+}
+
+type testRedisConn struct {
+	conn     net.Conn
+	channels map[string]bool
+	patterns map[string]bool
+	multi    [][]string
+	db       int
+	mu       sync.Mutex
+}
+
+func newTestRedis(t *testing.T) *testRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRedis{
+		l:       l,
+		strs:    map[string]string{},
+		hashes:  map[string]map[string]string{},
+		zsets:   map[string]map[string]float64{},
+		streams: map[string]*testStream{},
+		subs:    map[*testRedisConn]bool{},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(&testRedisConn{conn: conn, channels: map[string]bool{}, patterns: map[string]bool{}})
+		}
+	}()
+	return r
+}
+
+func (r *testRedis) Addr() string {
+	return r.l.Addr().String()
+}
+
+func (r *testRedis) Close() {
+	r.l.Close()
+}
+
+// dial returns a client of the server, closed with the test.
+func (r *testRedis) dial(t *testing.T) *Client {
+	c, err := Dial(r.Addr(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// get returns the string stored at key.
+func (r *testRedis) get(key string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.strs[key]
+}
+
+// subscribers returns the number of connections subscribed.
+func (r *testRedis) subscribers() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.subs)
+}
+
+// subscribed waits until n connections are subscribed.
+func (r *testRedis) subscribed(t *testing.T, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for r.subscribers() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d subscribers, got %d", n, r.subscribers())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (r *testRedis) serve(c *testRedisConn) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.subs, c)
+		r.mu.Unlock()
+		c.conn.Close()
+	}()
+	br := bufio.NewReader(c.conn)
+	for {
+		args, err := readTestCommand(br)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToLower(args[0])
+		switch {
+		case cmd == "multi":
+			c.multi = [][]string{}
+			c.write("+OK")
+		case cmd == "discard":
+			c.multi = nil
+			c.write("+OK")
+		case cmd == "exec":
+			if c.multi == nil {
+				c.write(fmt.Errorf("ERR EXEC without MULTI"))
+				continue
+			}
+			r.mu.Lock()
+			replies := []interface{}{}
+			for _, a := range c.multi {
+				replies = append(replies, r.run(c, a))
+			}
+			r.mu.Unlock()
+			c.multi = nil
+			c.write(replies)
+		case c.multi != nil:
+			c.multi = append(c.multi, args)
+			c.write("+QUEUED")
+		case cmd == "subscribe" || cmd == "psubscribe" || cmd == "unsubscribe" || cmd == "punsubscribe":
+			r.subscribe(c, cmd, args[1:])
+		case cmd == "xread" || cmd == "xreadgroup":
+			c.write(r.blockingRead(c, args))
+		default:
+			r.mu.Lock()
+			reply := r.run(c, args)
+			r.mu.Unlock()
+			c.write(reply)
+		}
+	}
+}
+
+func (r *testRedis) subscribe(c *testRedisConn, cmd string, names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	set := c.channels
+	if cmd[0] == 'p' {
+		set = c.patterns
+	}
+	for _, n := range names {
+		if strings.Contains(cmd, "unsubscribe") {
+			delete(set, n)
+		} else {
+			set[n] = true
+		}
+		c.write([]interface{}{cmd, n, int64(len(c.channels) + len(c.patterns))})
+	}
+	if len(c.channels)+len(c.patterns) > 0 {
+		r.subs[c] = true
+	} else {
+		delete(r.subs, c)
+	}
+}
+
+// publish sends msg to the subscribers of channel, with r.mu held.
+func (r *testRedis) publish(channel string, msg string) int64 {
+	n := int64(0)
+	for c := range r.subs {
+		if c.channels[channel] {
+			c.write([]interface{}{"message", channel, msg})
+			n++
+		}
+		for p := range c.patterns {
+			if ok, _ := path.Match(p, channel); ok {
+				c.write([]interface{}{"pmessage", p, channel, msg})
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// blockingRead runs XREAD and XREADGROUP, polling for entries until their
+// block timeout.
+func (r *testRedis) blockingRead(c *testRedisConn, args []string) interface{} {
+	block := time.Duration(-1)
+	for i := 1; i < len(args)-1; i++ {
+		if strings.ToLower(args[i]) == "block" {
+			ms, _ := strconv.Atoi(args[i+1])
+			block = time.Duration(ms) * time.Millisecond
+		}
+	}
+	deadline := time.Now().Add(block)
+	resolved := false
+	for {
+		r.mu.Lock()
+		if !resolved {
+			// $ reads entries after the last one when the read starts.
+			for i, a := range args {
+				if a == "$" {
+					s := r.stream(args[i-(len(args)-i)])
+					args[i] = strconv.FormatInt(s.last, 10)
+				}
+			}
+			resolved = true
+		}
+		reply := r.run(c, args)
+		r.mu.Unlock()
+		if reply != nil || block < 0 || time.Now().After(deadline) && block > 0 {
+			return reply
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (r *testRedis) stream(key string) *testStream {
+	s := r.streams[key]
+	if s == nil {
+		s = &testStream{groups: map[string]*testGroup{}}
+		r.streams[key] = s
+	}
+	return s
+}
+
+func (r *testRedis) exists(key string) bool {
+	_, s := r.strs[key]
+	_, h := r.hashes[key]
+	_, z := r.zsets[key]
+	_, x := r.streams[key]
+	return s || h || z || x
+}
+
+func (r *testRedis) keys(pattern string) []interface{} {
+	keys := []string{}
+	for _, m := range []interface{}{r.strs, r.hashes, r.zsets, r.streams} {
+		switch m := m.(type) {
+		case map[string]string:
+			for k := range m {
+				keys = append(keys, k)
+			}
+		case map[string]map[string]string:
+			for k := range m {
+				keys = append(keys, k)
+			}
+		case map[string]map[string]float64:
+			for k := range m {
+				keys = append(keys, k)
+			}
+		case map[string]*testStream:
+			for k := range m {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	found := []interface{}{}
+	for _, k := range keys {
+		if ok, _ := path.Match(pattern, k); ok {
+			found = append(found, k)
+		}
+	}
+	return found
+}
+
+// run runs a command with r.mu held. A nil reply is a null.
+func (r *testRedis) run(c *testRedisConn, args []string) interface{} {
+	a := args[1:]
+	switch strings.ToLower(args[0]) {
+	case "ping":
+		return "+PONG"
+	case "auth":
+		return "+OK"
+	case "select":
+		c.db, _ = strconv.Atoi(a[0])
+		return "+OK"
+	case "get":
+		if v, ok := r.strs[a[0]]; ok {
+			return v
+		}
+		return nil
+	case "set":
+		r.strs[a[0]] = a[1]
+		r.publish(fmt.Sprintf("__keyspace@%d__:%s", c.db, a[0]), "set")
+		return "+OK"
+	case "mget":
+		l := []interface{}{}
+		for _, k := range a {
+			if v, ok := r.strs[k]; ok {
+				l = append(l, v)
+			} else {
+				l = append(l, nil)
+			}
+		}
+		return l
+	case "del":
+		n := int64(0)
+		for _, k := range a {
+			if r.exists(k) {
+				n++
+				r.publish(fmt.Sprintf("__keyspace@%d__:%s", c.db, k), "del")
+			}
+			delete(r.strs, k)
+			delete(r.hashes, k)
+			delete(r.zsets, k)
+			delete(r.streams, k)
+		}
+		return n
+	case "keys":
+		return r.keys(a[0])
+	case "scan":
+		pattern := "*"
+		for i := 1; i < len(a)-1; i++ {
+			if strings.ToLower(a[i]) == "match" {
+				pattern = a[i+1]
+			}
+		}
+		return []interface{}{"0", r.keys(pattern)}
+	case "hset":
+		h := r.hashes[a[0]]
+		if h == nil {
+			h = map[string]string{}
+			r.hashes[a[0]] = h
+		}
+		_, ok := h[a[1]]
+		h[a[1]] = a[2]
+		if ok {
+			return int64(0)
+		}
+		return int64(1)
+	case "hget":
+		if v, ok := r.hashes[a[0]][a[1]]; ok {
+			return v
+		}
+		return nil
+	case "hdel":
+		n := int64(0)
+		for _, f := range a[1:] {
+			if _, ok := r.hashes[a[0]][f]; ok {
+				delete(r.hashes[a[0]], f)
+				n++
+			}
+		}
+		return n
+	case "hgetall":
+		fields := []string{}
+		for f := range r.hashes[a[0]] {
+			fields = append(fields, f)
+		}
+		sort.Strings(fields)
+		l := []interface{}{}
+		for _, f := range fields {
+			l = append(l, f, r.hashes[a[0]][f])
+		}
+		return l
+	case "zadd":
+		z := r.zsets[a[0]]
+		if z == nil {
+			z = map[string]float64{}
+			r.zsets[a[0]] = z
+		}
+		n := int64(0)
+		for i := 1; i+1 < len(a); i += 2 {
+			score, _ := strconv.ParseFloat(a[i], 64)
+			if _, ok := z[a[i+1]]; !ok {
+				n++
+			}
+			z[a[i+1]] = score
+		}
+		return n
+	case "zcard":
+		return int64(len(r.zsets[a[0]]))
+	case "zrangebyscore", "zrevrangebyscore":
+		return r.zrangeByScore(strings.HasPrefix(strings.ToLower(args[0]), "zrev"), a)
+	case "zrange", "zrevrange":
+		members := r.zsorted(a[0])
+		if strings.ToLower(args[0]) == "zrevrange" {
+			for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+				members[i], members[j] = members[j], members[i]
+			}
+		}
+		start, stop := r.zrank(a[1], len(members)), r.zrank(a[2], len(members))
+		l := []interface{}{}
+		for i := max(start, 0); i <= stop && i < len(members); i++ {
+			l = append(l, members[i])
+		}
+		return l
+	case "zremrangebyrank":
+		members := r.zsorted(a[0])
+		start, stop := r.zrank(a[1], len(members)), r.zrank(a[2], len(members))
+		n := int64(0)
+		for i := max(start, 0); i <= stop && i < len(members); i++ {
+			delete(r.zsets[a[0]], members[i])
+			n++
+		}
+		return n
+	case "publish":
+		return r.publish(a[0], a[1])
+	case "xadd":
+		return r.xadd(a)
+	case "xlen":
+		if s, ok := r.streams[a[0]]; ok {
+			return int64(len(s.entries))
+		}
+		return int64(0)
+	case "xrange":
+		s := r.stream(a[0])
+		from, to := parseTestID(a[1], 0), parseTestID(a[2], 1<<62)
+		if strings.HasPrefix(a[1], "(") {
+			from++
+		}
+		count := len(s.entries)
+		if len(a) == 5 && strings.ToLower(a[3]) == "count" {
+			count, _ = strconv.Atoi(a[4])
+		}
+		l := []interface{}{}
+		for _, e := range s.entries {
+			if e.id >= from && e.id <= to && len(l) < count {
+				l = append(l, e.reply())
+			}
+		}
+		return l
+	case "xrevrange":
+		s := r.stream(a[0])
+		to, from := parseTestID(a[1], 1<<62), parseTestID(a[2], 0)
+		count := len(s.entries)
+		if len(a) > 4 && strings.ToLower(a[3]) == "count" {
+			count, _ = strconv.Atoi(a[4])
+		}
+		l := []interface{}{}
+		for i := len(s.entries) - 1; i >= 0 && len(l) < count; i-- {
+			if e := s.entries[i]; e.id >= from && e.id <= to {
+				l = append(l, e.reply())
+			}
+		}
+		return l
+	case "xtrim":
+		s := r.stream(a[0])
+		if strings.ToLower(a[1]) != "minid" {
+			return fmt.Errorf("ERR syntax error")
+		}
+		min := parseTestID(a[len(a)-1], 0)
+		kept := []*testEntry{}
+		for _, e := range s.entries {
+			if e.id >= min {
+				kept = append(kept, e)
+			}
+		}
+		n := int64(len(s.entries) - len(kept))
+		s.entries = kept
+		return n
+	case "xinfo":
+		if strings.ToLower(a[0]) != "groups" {
+			return fmt.Errorf("ERR syntax error")
+		}
+		s := r.stream(a[1])
+		names := []string{}
+		for name := range s.groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		l := []interface{}{}
+		for _, name := range names {
+			g := s.groups[name]
+			l = append(l, []interface{}{
+				"name", name,
+				"consumers", int64(1),
+				"pending", int64(len(g.pending)),
+				"last-delivered-id", formatTestID(g.last),
+			})
+		}
+		return l
+	case "xgroup":
+		s := r.stream(a[1])
+		if _, ok := s.groups[a[2]]; ok {
+			return fmt.Errorf("BUSYGROUP Consumer Group name already exists")
+		}
+		s.groups[a[2]] = &testGroup{last: parseTestID(a[3], s.last), pending: map[int64]*testPending{}}
+		return "+OK"
+	case "xack":
+		g := r.stream(a[0]).groups[a[1]]
+		n := int64(0)
+		for _, id := range a[2:] {
+			if g != nil && g.pending[parseTestID(id, 0)] != nil {
+				delete(g.pending, parseTestID(id, 0))
+				n++
+			}
+		}
+		return n
+	case "xpending":
+		return r.xpending(a)
+	case "xread":
+		return r.xread(a, "", "")
+	case "xreadgroup":
+		return r.xread(a[3:], a[1], a[2])
+	}
+	return fmt.Errorf("ERR unknown command '%s'", args[0])
+}
+
+func (r *testRedis) zsorted(key string) []string {
+	z := r.zsets[key]
+	members := []string{}
+	for m := range z {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if z[members[i]] != z[members[j]] {
+			return z[members[i]] < z[members[j]]
+		}
+		return members[i] < members[j]
+	})
+	return members
+}
+
+// zrank reads a rank of a sorted set of n members, counting negative ones
+// from the end. A rank still negative is before the first member.
+func (r *testRedis) zrank(s string, n int) int {
+	i, _ := strconv.Atoi(s)
+	if i < 0 {
+		i += n
+	}
+	return i
+}
+
+func (r *testRedis) zrangeByScore(rev bool, a []string) interface{} {
+	bound := func(s string, inf float64) float64 {
+		switch s {
+		case "-inf":
+			return -inf
+		case "+inf", "inf":
+			return inf
+		}
+		f, _ := strconv.ParseFloat(strings.TrimPrefix(s, "("), 64)
+		return f
+	}
+	min, max := bound(a[1], 1e308), bound(a[2], 1e308)
+	if rev {
+		min, max = bound(a[2], 1e308), bound(a[1], 1e308)
+	}
+	members := r.zsorted(a[0])
+	if rev {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+	limit := -1
+	for i := 3; i+2 < len(a)+0 || i+2 == len(a); i++ {
+		if strings.ToLower(a[i]) == "limit" && i+2 < len(a) {
+			limit, _ = strconv.Atoi(a[i+2])
+			break
+		}
+		if i+2 >= len(a) {
+			break
+		}
+	}
+	l := []interface{}{}
+	for _, m := range members {
+		if s := r.zsets[a[0]][m]; s >= min && s <= max && (limit < 0 || len(l) < limit) {
+			l = append(l, m)
+		}
+	}
+	return l
+}
+
+func (r *testRedis) xadd(a []string) interface{} {
+	s := r.stream(a[0])
+	a = a[1:]
+	maxlen := -1
+	if strings.ToLower(a[0]) == "maxlen" {
+		a = a[1:]
+		if a[0] == "~" || a[0] == "=" {
+			a = a[1:]
+		}
+		maxlen, _ = strconv.Atoi(a[0])
+		a = a[1:]
+	}
+	id := s.last + 1
+	if a[0] != "*" {
+		id = parseTestID(a[0], 0)
+		if id <= s.last {
+			return fmt.Errorf("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		}
+	}
+	s.last = id
+	s.entries = append(s.entries, &testEntry{id, a[1:]})
+	if maxlen >= 0 && len(s.entries) > maxlen {
+		s.entries = s.entries[len(s.entries)-maxlen:]
+	}
+	return formatTestID(id)
+}
+
+// xread reads streams, for a consumer of group when group is set.
+func (r *testRedis) xread(a []string, group string, consumer string) interface{} {
+	count := -1
+	i := 0
+	for ; i < len(a); i++ {
+		switch strings.ToLower(a[i]) {
+		case "count":
+			count, _ = strconv.Atoi(a[i+1])
+			i++
+		case "block":
+			i++
+		}
+		if strings.ToLower(a[i]) == "streams" {
+			break
+		}
+	}
+	keys := a[i+1:]
+	n := len(keys) / 2
+	l := []interface{}{}
+	for k := 0; k < n; k++ {
+		s := r.stream(keys[k])
+		from := keys[n+k]
+		entries := []interface{}{}
+		switch {
+		case group == "":
+			after := parseTestID(from, s.last)
+			for _, e := range s.entries {
+				if e.id > after && (count < 0 || len(entries) < count) {
+					entries = append(entries, e.reply())
+				}
+			}
+		case from == ">":
+			g := s.groups[group]
+			if g == nil {
+				return fmt.Errorf("NOGROUP No such consumer group")
+			}
+			for _, e := range s.entries {
+				if e.id > g.last && (count < 0 || len(entries) < count) {
+					g.last = e.id
+					g.pending[e.id] = &testPending{consumer, 1}
+					entries = append(entries, e.reply())
+				}
+			}
+			if len(entries) == 0 {
+				continue
+			}
+		default:
+			g := s.groups[group]
+			if g == nil {
+				return fmt.Errorf("NOGROUP No such consumer group")
+			}
+			after := parseTestID(from, 0)
+			ids := []int64{}
+			for id, p := range g.pending {
+				if id > after && p.consumer == consumer {
+					ids = append(ids, id)
+				}
+			}
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+			for _, id := range ids {
+				if count >= 0 && len(entries) >= count {
+					break
+				}
+				g.pending[id].deliveries++
+				e := s.entry(id)
+				if e == nil {
+					entries = append(entries, []interface{}{formatTestID(id), nil})
+				} else {
+					entries = append(entries, e.reply())
+				}
+			}
+		}
+		if len(entries) > 0 || group != "" {
+			l = append(l, []interface{}{keys[k], entries})
+		}
+	}
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+func (r *testRedis) xpending(a []string) interface{} {
+	g := r.stream(a[0]).groups[a[1]]
+	if g == nil {
+		return fmt.Errorf("NOGROUP No such consumer group")
+	}
+	if len(a) == 2 {
+		if len(g.pending) == 0 {
+			return []interface{}{int64(0), nil, nil, nil}
+		}
+		ids := []int64{}
+		for id := range g.pending {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return []interface{}{int64(len(ids)), formatTestID(ids[0]), formatTestID(ids[len(ids)-1]), []interface{}{}}
+	}
+	from, to := parseTestID(a[2], 0), parseTestID(a[3], 1<<62)
+	count, _ := strconv.Atoi(a[4])
+	consumer := ""
+	if len(a) > 5 {
+		consumer = a[5]
+	}
+	ids := []int64{}
+	for id, p := range g.pending {
+		if id >= from && id <= to && (consumer == "" || p.consumer == consumer) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	l := []interface{}{}
+	for _, id := range ids {
+		if len(l) < count {
+			p := g.pending[id]
+			l = append(l, []interface{}{formatTestID(id), p.consumer, int64(0), int64(p.deliveries)})
+		}
+	}
+	return l
+}
+
+func (s *testStream) entry(id int64) *testEntry {
+	for _, e := range s.entries {
+		if e.id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+func (e *testEntry) reply() interface{} {
+	fields := []interface{}{}
+	for _, f := range e.fields {
+		fields = append(fields, f)
+	}
+	return []interface{}{formatTestID(e.id), fields}
+}
+
+// parseTestID reads the ms part of a stream id, used as a sequence number.
+func parseTestID(s string, dflt int64) int64 {
+	switch s {
+	case "-":
+		return 0
+	case "+":
+		return 1 << 62
+	case "$":
+		return dflt
+	}
+	n, err := strconv.ParseInt(strings.SplitN(strings.TrimPrefix(s, "("), "-", 2)[0], 10, 64)
+	if err != nil {
+		return dflt
+	}
+	return n
+}
+
+func formatTestID(id int64) string {
+	return fmt.Sprintf("%d-0", id)
+}
+
+func readTestCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func (c *testRedisConn) write(v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write(encodeTestReply(nil, v))
+}
+
+func encodeTestReply(b []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, "$-1\r\n"...)
+	case error:
+		return append(b, "-"+v.Error()+"\r\n"...)
+	case int64:
+		return append(b, fmt.Sprintf(":%d\r\n", v)...)
+	case string:
+		if strings.HasPrefix(v, "+") {
+			return append(b, v+"\r\n"...)
+		}
+		return append(b, fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)...)
+	case []interface{}:
+		b = append(b, fmt.Sprintf("*%d\r\n", len(v))...)
+		for _, e := range v {
+			b = encodeTestReply(b, e)
+		}
+		return b
+	}
+	panic(fmt.Sprintf("unexpected reply %T", v))
+}
+
+func TestTestRedis(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	c := r.dial(t)
+
+	if _, err := c.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	c.Multi()
+	c.Add("set", "b", "2")
+	c.Add("hset", "h", "f", "v")
+	if _, err := c.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := c.Mget("a", "b", "c")
+	if err != nil || len(reply.Elems) != 3 {
+		t.Fatal(reply, err)
+	}
+	if s, _ := reply.Elems[1].Str(); s != "2" {
+		t.Errorf("Expected b to be 2, got %s", s)
+	}
+}
+
+// waitFor fails the test when cond isn't true within two seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfigChange is a difference between a config and the running managers,
+// applied by Apply.
+type ConfigChange struct {
+	Op     string
+	Name   string
+	Detail string
+	apply  func() error
+}
+
+func (c *ConfigChange) String() string {
+	if c.Detail == "" {
+		return fmt.Sprintf("%s %s", c.Op, c.Name)
+	}
+	return fmt.Sprintf("%s %s %s", c.Op, c.Name, c.Detail)
+}
+
+// ConfigDiff lists the changes needed to bring running managers to a config:
+// + for taggers to create, - for taggers to remove and ~ for metadata to
+// update in place.
+type ConfigDiff []*ConfigChange
+
+func (d ConfigDiff) String() string {
+	lines := make([]string, len(d))
+	for i, c := range d {
+		lines[i] = c.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Apply applies every change, stopping at the first failure.
+func (d ConfigDiff) Apply() error {
+	for _, c := range d {
+		if err := c.apply(); err != nil {
+			return fmt.Errorf("could not apply %s: %s", c, err)
+		}
+	}
+	return nil
+}
+
+// differ builds the diff of a config against running managers.
+type differ struct {
+	conn   *Client
+	alarms *AlarmEngine
+	diff   ConfigDiff
+}
+
+func (d *differ) add(op string, name string, detail string, apply func() error) {
+	d.diff = append(d.diff, &ConfigChange{op, name, detail, apply})
+}
+
+// manager diffs the children of tm against m. Tag values are left alone, only
+// descriptions, meta and limits are updated, so running tags keep their state.
+func (d *differ) manager(tm *TagManager, m *ManagerConfig) {
+	declared := map[string]bool{}
+
+	for _, t := range m.Tags {
+		t := t
+		declared[t.Name] = true
+		name := tm.Name + ":" + t.Name
+		switch c := tm.child(t.Name).(type) {
+		case nil:
+			d.add("+", name, "", func() error { return d.addTag(tm, t) })
+		case *CalcTag:
+			if t.Expression != c.Expression {
+				d.replace(tm, name, fmt.Sprintf("expression %q", t.Expression), func() error { return d.addTag(tm, t) })
+				continue
+			}
+			d.tag(&c.Tag, c, t)
+		case *Tag:
+			if t.Expression != "" {
+				d.replace(tm, name, fmt.Sprintf("expression %q", t.Expression), func() error { return d.addTag(tm, t) })
+				continue
+			}
+			d.tag(c, c, t)
+		default:
+			d.replace(tm, name, "as tag", func() error { return d.addTag(tm, t) })
+		}
+	}
+
+	for _, i := range m.Instances {
+		i := i
+		declared[i.Name] = true
+		name := tm.Name + ":" + i.Name
+		instantiate := func() error {
+			t, err := LookupTemplate(i.Template)
+			if err != nil {
+				return err
+			}
+			_, err = t.Instantiate(tm, i.Name, d.conn)
+			return err
+		}
+		switch c := tm.child(i.Name).(type) {
+		case nil:
+			d.add("+", name, "of "+i.Template, instantiate)
+		case *TagManager:
+			if instanceOf(c) != i.Template {
+				d.replace(tm, name, "of "+i.Template, instantiate)
+			}
+		default:
+			d.replace(tm, name, "of "+i.Template, instantiate)
+		}
+	}
+
+	for _, cm := range m.Managers {
+		cm := cm
+		declared[cm.Name] = true
+		name := tm.Name + ":" + cm.Name
+		create := func() error {
+			child := NewTagManager(cm.Name)
+			child.Mode = tm.Mode
+			if err := tm.Append(child); err != nil {
+				return err
+			}
+			return cm.build(child, d.conn, d.alarms)
+		}
+		switch c := tm.child(cm.Name).(type) {
+		case nil:
+			d.add("+", name, "", create)
+		case *TagManager:
+			if instanceOf(c) != "" {
+				d.replace(tm, name, "as manager", create)
+				continue
+			}
+			d.manager(c, cm)
+		default:
+			d.replace(tm, name, "as manager", create)
+		}
+	}
+
+	for _, c := range tm.tags() {
+		if local := tm.localName(c); !declared[local] {
+			name := nameOf(c)
+			d.add("-", name, "", func() error { return d.remove(tm, name) })
+		}
+	}
+}
+
+// remove takes the tagger called name out of tm, clearing the alarms of the
+// tags removed with it.
+func (d *differ) remove(tm *TagManager, name string) error {
+	c, err := tm.getTag(name)
+	if err != nil {
+		return err
+	}
+	if err := tm.Remove(name); err != nil {
+		return err
+	}
+	return unconfigureAlarms(d.alarms, c)
+}
+
+// tag diffs the metadata of the running tag t against its config.
+func (d *differ) tag(t *Tag, tagger Tagger, c *TagConfig) {
+	name := nameOf(t)
+	if description, _ := getProp(t, "Description"); description != c.Description {
+		d.add("~", name, fmt.Sprintf("description %q", c.Description), func() error {
+			return tagger.Set(name, "Description", c.Description)
+		})
+	}
+
+	meta := map[string]string{}
+	for k, v := range c.Meta {
+		meta[k] = v
+	}
+	if c.Unit != "" {
+		meta["unit"] = c.Unit
+	}
+	current, _ := getProp(t, "Meta")
+	if m := current.(map[string]string); !reflect.DeepEqual(meta, m) && (len(meta) > 0 || len(m) > 0) {
+		d.add("~", name, fmt.Sprintf("meta %s", encodeMeta(meta)), func() error {
+			return tagger.Set(name, "Meta", meta)
+		})
+	}
+
+	if d.alarms == nil {
+		return
+	}
+	l := d.alarms.Limits(name)
+	switch {
+	case c.Limits == nil && l != nil:
+		d.add("~", name, "limits removed", func() error {
+			return d.alarms.Unconfigure(name)
+		})
+	case c.Limits != nil && (l == nil || l.String() != c.Limits.String()):
+		d.add("~", name, fmt.Sprintf("limits %s", c.Limits), func() error {
+			return d.alarms.Configure(name, c.Limits)
+		})
+	}
+}
+
+// replace removes the tagger called name from tm and creates it again.
+func (d *differ) replace(tm *TagManager, name string, detail string, create func() error) {
+	d.add("-", name, "", func() error { return d.remove(tm, name) })
+	d.add("+", name, detail, create)
+}
+
+func (d *differ) addTag(tm *TagManager, t *TagConfig) error {
+	tag, err := t.tag(d.conn)
+	if err != nil {
+		return err
+	}
+	if err := tm.Append(tag); err != nil {
+		return err
+	}
+	if t.Limits != nil && d.alarms != nil {
+		return d.alarms.Configure(nameOf(tag), t.Limits)
+	}
+	return nil
+}
+
+// DiffConfig returns the changes bringing the tags of managers to c. Changes
+// to the change mode of running managers are not detected, they need a
+// restart.
+func DiffConfig(managers []*TagManager, c *Config, conn *Client, alarms *AlarmEngine) ConfigDiff {
+	d := &differ{conn: conn, alarms: alarms, diff: ConfigDiff{}}
+	for _, t := range c.Templates {
+		t := t
+		if old, err := LookupTemplate(t.Name); err != nil || !reflect.DeepEqual(old.Members, t.Members) {
+			d.add("~", "template "+t.Name, "", func() error {
+				if old, err := LookupTemplate(t.Name); err == nil {
+					return old.Update(t.Members...)
+				}
+				RegisterTemplate(t)
+				return nil
+			})
+		}
+	}
+	for _, m := range c.Managers {
+		for _, tm := range managers {
+			if tm.Name == m.Name {
+				d.manager(tm, m)
+			}
+		}
+	}
+	return d.diff
+}
+
+// reloader --------------------------------------------------------------------
+
+// Reloader applies a config file to running managers whenever it changes.
+// Managers added to or removed from the top of the file are built or closed,
+// and Managers returns the current ones. Keep names the managers others hold
+// on to, which a reload may not remove or replace.
+type Reloader struct {
+	Path     string
+	DryRun   bool
+	Keep     []string
+	conn     *Client
+	alarms   *AlarmEngine
+	managers []*TagManager
+	modified time.Time
+	mu       sync.Mutex
+}
+
+func (r *Reloader) String() string {
+	return fmt.Sprintf("Reloader{Path: %s, DryRun: %t}", r.Path, r.DryRun)
+}
+
+func (r *Reloader) Managers() []*TagManager {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.managers
+}
+
+// Reload loads the config file and applies its diff, unless DryRun is set or
+// the diff removes a manager in Keep. The diff is returned either way. When applying fails, Managers keeps the
+// managers built or closed before the failure, and a manager failing to build
+// is closed.
+func (r *Reloader) Reload() (ConfigDiff, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := os.Open(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := LoadConfig(f)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := DiffConfig(r.managers, c, r.conn, r.alarms)
+	managers := []*TagManager{}
+	for _, m := range c.Managers {
+		var found *TagManager
+		for _, tm := range r.managers {
+			if tm.Name == m.Name {
+				found = tm
+			}
+		}
+		if found != nil {
+			managers = append(managers, found)
+			continue
+		}
+		tm := NewTagManager(m.Name)
+		m := m
+		diff = append(diff, &ConfigChange{"+", m.Name, "", func() error {
+			if err := m.build(tm, r.conn, r.alarms); err != nil {
+				tm.Close()
+				unconfigureAlarms(r.alarms, tm)
+				return err
+			}
+			r.managers = append(r.managers, tm)
+			return nil
+		}})
+		managers = append(managers, tm)
+	}
+	for _, tm := range r.managers {
+		tm := tm
+		if !containsManager(managers, tm) {
+			diff = append(diff, &ConfigChange{"-", tm.Name, "", func() error {
+				r.managers = removeManager(r.managers, tm)
+				if err := tm.Close(); err != nil {
+					return err
+				}
+				return unconfigureAlarms(r.alarms, tm)
+			}})
+		}
+	}
+
+	for _, c := range diff {
+		if c.Op != "-" {
+			continue
+		}
+		for _, k := range r.Keep {
+			if underTag(k, c.Name) {
+				return diff, fmt.Errorf("could not apply %s: %s is in use", c, k)
+			}
+		}
+	}
+
+	if r.DryRun {
+		return diff, nil
+	}
+	if err := diff.Apply(); err != nil {
+		return diff, err
+	}
+	r.managers = managers
+	return diff, nil
+}
+
+// Watch reloads the config file whenever its modification time changes,
+// checking every interval until done is closed.
+func (r *Reloader) Watch(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		info, err := os.Stat(r.Path)
+		if err != nil {
+			log.Printf("Couldn't stat %s: %s\n", r.Path, err)
+			continue
+		}
+		if info.ModTime().Equal(r.modified) {
+			continue
+		}
+		r.modified = info.ModTime()
+
+		diff, err := r.Reload()
+		switch {
+		case len(diff) == 0:
+		case r.DryRun:
+			log.Printf("Changes to %s, not applied:\n%s\n", r.Path, diff)
+		default:
+			log.Printf("Reloaded %s:\n%s\n", r.Path, diff)
+		}
+		if err != nil {
+			log.Printf("Couldn't reload %s: %s\n", r.Path, err)
+		}
+	}
+}
+
+// NewReloader watches the config file at path for the managers built from it.
+func NewReloader(path string, managers []*TagManager, conn *Client, alarms *AlarmEngine) *Reloader {
+	r := &Reloader{
+		Path:     path,
+		conn:     conn,
+		alarms:   alarms,
+		managers: managers,
+	}
+	if info, err := os.Stat(path); err == nil {
+		r.modified = info.ModTime()
+	}
+	return r
+}
+
+// unconfigureAlarms clears the alarms of tag, and of every tag under it when
+// it's a manager.
+func unconfigureAlarms(alarms *AlarmEngine, tag Tagger) error {
+	if alarms == nil {
+		return nil
+	}
+	m, ok := tag.(*TagManager)
+	if !ok {
+		return alarms.Unconfigure(nameOf(tag))
+	}
+	return m.Walk(func(path string, t Tagger) error {
+		if _, ok := t.(*TagManager); ok {
+			return nil
+		}
+		return alarms.Unconfigure(nameOf(t))
+	})
+}
+
+// removeManager returns managers without tm, leaving managers untouched.
+func removeManager(managers []*TagManager, tm *TagManager) []*TagManager {
+	kept := []*TagManager{}
+	for _, m := range managers {
+		if m != tm {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+func containsManager(managers []*TagManager, tm *TagManager) bool {
+	for _, m := range managers {
+		if m == tm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDiffConfigLimits(t *testing.T) {
+	tm := NewTagManager("@m")
+	for _, n := range []string{"a", "b", "c"} {
+		tag := NewTag(nil, "@m:"+n, "", 0, QualityGood)
+		tm.add(tag)
+	}
+	hi, lo := 10, 2
+	alarms := NewAlarmEngine(nil)
+	alarms.limits["@m:a"] = &Limits{Hi: &hi}
+	alarms.limits["@m:b"] = &Limits{Hi: &hi}
+
+	c := &Config{Managers: []*ManagerConfig{{
+		Name: "@m",
+		Tags: []*TagConfig{
+			{Name: "a"},
+			{Name: "b", Limits: &Limits{Hi: &hi, Lo: &lo}},
+		},
+	}}}
+	diff := DiffConfig([]*TagManager{tm}, c, nil, alarms)
+
+	expected := []string{
+		"~ @m:a limits removed",
+		"~ @m:b limits " + (&Limits{Hi: &hi, Lo: &lo}).String(),
+		"- @m:c",
+	}
+	if len(diff) != len(expected) {
+		t.Fatalf("Expected diff\n%s\ngot\n%s", expected, diff)
+	}
+	for i, c := range diff {
+		if c.String() != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], c)
+		}
+	}
+}
+
+// reloader writes config to a file and returns a reloader of the managers
+// built from it, over conn. Managers are closed with the test.
+func reloader(t *testing.T, conn *Client, config string) (*Reloader, func(string)) {
+	path := filepath.Join(t.TempDir(), "tags.json")
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(config)
+
+	c, err := LoadConfig(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	managers, err := c.Build(conn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReloader(path, managers, conn, nil)
+	t.Cleanup(func() {
+		for _, tm := range r.Managers() {
+			tm.Close()
+		}
+	})
+	return r, write
+}
+
+// TestReloadWhileReading reloads a manager while the API browses it, to be
+// run with -race.
+func TestReloadWhileReading(t *testing.T) {
+	s := newTestRedis(t)
+	defer s.Close()
+	r, write := reloader(t, s.dial(t), `{"managers": [{"name": "@r", "tags": [{"name": "a"}]}]}`)
+	tm := r.Managers()[0]
+	api := NewAPI(tm)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for !stopped(done) {
+			for _, p := range []string{"/tags/", "/tags/a", "/tags/b"} {
+				api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", p, nil))
+			}
+			tm.Walk(func(path string, tag Tagger) error { return nil })
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		if i%2 == 0 {
+			write(`{"managers": [{"name": "@r", "tags": [{"name": "a"}, {"name": "b"}]}]}`)
+		} else {
+			write(`{"managers": [{"name": "@r", "tags": [{"name": "a"}]}]}`)
+		}
+		if _, err := r.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if _, err := tm.Lookup("b"); err == nil {
+		t.Error("Expected b to be removed by the last reload")
+	}
+}
+
+func TestReloadFailureKeepsApplied(t *testing.T) {
+	s := newTestRedis(t)
+	defer s.Close()
+	r, write := reloader(t, s.dial(t), `{"managers": [{"name": "@m", "tags": [{"name": "a"}]}]}`)
+
+	// @x fails to build, as its calculated tag depends on itself.
+	write(`{"managers": [
+		{"name": "@n", "tags": [{"name": "a"}]},
+		{"name": "@x", "tags": [{"name": "a"}, {"name": "c", "expression": "@x:c + 1"}]}
+	]}`)
+	if _, err := r.Reload(); err == nil {
+		t.Fatal("Expected the reload to fail")
+	}
+	names := []string{}
+	for _, tm := range r.Managers() {
+		names = append(names, tm.Name)
+	}
+	if strings.Join(names, " ") != "@m @n" {
+		t.Fatalf("Expected managers @m @n after the failure, got %s", names)
+	}
+
+	write(`{"managers": [{"name": "@n", "tags": [{"name": "a"}]}]}`)
+	diff, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.String() != "- @m" {
+		t.Errorf("Expected only @m to be removed, got\n%s", diff)
+	}
+	if len(r.Managers()) != 1 || r.Managers()[0].Name != "@n" {
+		t.Errorf("Expected only @n to be running, got %v", r.Managers())
+	}
+}
+
+func TestReloadKeep(t *testing.T) {
+	s := newTestRedis(t)
+	defer s.Close()
+	r, write := reloader(t, s.dial(t), `{"managers": [
+		{"name": "@m", "managers": [{"name": "area", "tags": [{"name": "a"}]}]},
+		{"name": "@n"}
+	]}`)
+	r.Keep = []string{"@m:area"}
+
+	write(`{"managers": [{"name": "@m", "managers": [{"name": "area", "tags": [{"name": "b"}]}]}]}`)
+	if _, err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, config := range []string{
+		`{"managers": [{"name": "@m"}]}`,
+		`{"managers": [{"name": "@n"}]}`,
+	} {
+		write(config)
+		if _, err := r.Reload(); err == nil || !strings.Contains(err.Error(), "@m:area is in use") {
+			t.Errorf("Expected the reload of %s to be refused, got %v", config, err)
+		}
+	}
+	if len(r.Managers()) != 1 || r.Managers()[0].Name != "@m" {
+		t.Errorf("Expected @m kept, got %v", r.Managers())
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/joaodubas/tagging/tagpb"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ServerConfig declares the services run next to the managers of a Config,
+// each bound to a manager by name or path:
+//
+//	"server": {
+//	  "http": ":8080",
+//	  "grpc": ":9090",
+//	  "modbus_drivers": [{"manager": "@pressure", "addr": "10.0.0.5:502", "unit": 1,
+//	    "groups": [{"rate": "1s", "maps": [{"table": "holding registers", "address": 0, "tag": "@pressure:tank-0"}]}]}],
+//	  "modbus_servers": [{"manager": "@pressure", "listen": ":502", "unit": 1, "maps": [...]}],
+//	  "mqtt": [{"manager": "@pressure", "addr": "broker:1883", "prefix": "plant"}],
+//	  "opcua": [{"manager": "@pressure", "listen": ":4840", "url": "opc.tcp://plant:4840"}],
+//	  "change_log_len": 100000
+//	}
+//
+// Maps name their tags in full. The HTTP API of each root manager is served
+// under its name, as /@pressure/tags/tank-0. gRPC calls select theirs with
+// the Tagging-Manager header, which may be left out when there's only one.
+//
+// ChangeLogLen trims the change logs of the managers in stream mode to that
+// many entries every minute, keeping the entries a consumer group hasn't
+// read or acknowledged yet. Left out, change logs are never trimmed.
+type ServerConfig struct {
+	HTTP          string                `json:"http,omitempty"`
+	GRPC          string                `json:"grpc,omitempty"`
+	ModbusDrivers []*ModbusDriverConfig `json:"modbus_drivers,omitempty"`
+	ModbusServers []*ModbusServerConfig `json:"modbus_servers,omitempty"`
+	MQTT          []*MQTTBridgeConfig   `json:"mqtt,omitempty"`
+	OPCUA         []*OPCUAServerConfig  `json:"opcua,omitempty"`
+	ChangeLogLen  int                   `json:"change_log_len,omitempty"`
+}
+
+type ModbusDriverConfig struct {
+	Manager string       `json:"manager"`
+	Addr    string       `json:"addr"`
+	Unit    byte         `json:"unit"`
+	Groups  []*ScanGroup `json:"groups"`
+}
+
+type ModbusServerConfig struct {
+	Manager string         `json:"manager"`
+	Listen  string         `json:"listen"`
+	Unit    byte           `json:"unit"`
+	Maps    []*RegisterMap `json:"maps"`
+}
+
+type MQTTBridgeConfig struct {
+	Manager  string `json:"manager"`
+	Addr     string `json:"addr"`
+	ClientID string `json:"client_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Prefix   string `json:"prefix"`
+}
+
+type OPCUAServerConfig struct {
+	Manager string `json:"manager"`
+	Listen  string `json:"listen"`
+	URL     string `json:"url,omitempty"`
+}
+
+// server ----------------------------------------------------------------------
+
+// Server runs the managers of a config file with their alarms, the services
+// of its server section and a change feed for each consumer. Reload applies
+// the file again to the managers; the server section is only read on Start,
+// so a reload removing a manager bound to a service is refused.
+type Server struct {
+	Path     string
+	dial     func() (*Client, error)
+	conn     *Client
+	alarms   *AlarmEngine
+	reloader *Reloader
+	http     *http.Server
+	grpc     *http.Server
+	services []io.Closer
+	watchers map[string]*watcher
+	conns    []io.Closer
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+// watcher holds the consumers of the changes of a root manager.
+type watcher struct {
+	api   *API
+	feeds []*Feed
+	conns []io.Closer
+}
+
+func (s *Server) String() string {
+	return fmt.Sprintf("Server{Path: %s}", s.Path)
+}
+
+// Start builds the managers and starts the services. Services started before
+// a failure are left running, to be stopped by Close.
+func (s *Server) Start() error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	c, err := LoadConfig(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	if s.conn, err = s.connect(); err != nil {
+		return err
+	}
+	alarmConn, err := s.connect()
+	if err != nil {
+		return err
+	}
+	s.alarms = NewAlarmEngine(alarmConn)
+
+	managers, err := c.Build(s.conn, s.alarms)
+	s.reloader = NewReloader(s.Path, managers, s.conn, s.alarms)
+	if err != nil {
+		return err
+	}
+	if err := s.watch(); err != nil {
+		return err
+	}
+
+	if c.Server == nil {
+		return nil
+	}
+	return s.startServices(c.Server)
+}
+
+// Reload applies the config file to the running managers, and watches the
+// changes of the managers it adds.
+func (s *Server) Reload() (ConfigDiff, error) {
+	diff, err := s.reloader.Reload()
+	if err != nil {
+		return diff, err
+	}
+	return diff, s.watch()
+}
+
+// Run starts the server and serves until SIGINT or SIGTERM, reloading the
+// config file on SIGHUP.
+func (s *Server) Run() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	if err := s.Start(); err != nil {
+		s.Close()
+		return err
+	}
+	log.Printf("Serving %s.\n", s.Path)
+
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %s, shutting down.\n", sig)
+			break
+		}
+		diff, err := s.Reload()
+		if len(diff) > 0 {
+			log.Printf("Reloaded %s:\n%s\n", s.Path, diff)
+		}
+		if err != nil {
+			log.Printf("Couldn't reload %s: %s\n", s.Path, err)
+		}
+	}
+	return s.Close()
+}
+
+// Close stops the server in order: the HTTP and gRPC APIs stop taking
+// requests, the services stop writing tags and publishing, the feeds
+// unsubscribe, the tags stop mirroring redis and then every connection is
+// closed.
+func (s *Server) Close() error {
+	if !stopped(s.done) {
+		close(s.done)
+	}
+	for _, h := range []*http.Server{s.http, s.grpc} {
+		if h == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := h.Shutdown(ctx); err != nil {
+			h.Close()
+		}
+		cancel()
+	}
+
+	for i := len(s.services) - 1; i >= 0; i-- {
+		if err := s.services[i].Close(); err != nil {
+			log.Printf("Couldn't stop %s: %s\n", s.services[i], err)
+		}
+	}
+
+	s.mu.Lock()
+	for name, w := range s.watchers {
+		w.close()
+		delete(s.watchers, name)
+	}
+	s.mu.Unlock()
+
+	if s.reloader != nil {
+		for _, tm := range s.reloader.Managers() {
+			tm.Close()
+		}
+	}
+
+	for i := len(s.conns) - 1; i >= 0; i-- {
+		s.conns[i].Close()
+	}
+	return nil
+}
+
+// ServeHTTP routes requests to the API of the root manager named by the
+// first path segment, and lists the root managers on /.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if p == "" {
+		s.mu.Lock()
+		names := make([]string, 0, len(s.watchers))
+		for name := range s.watchers {
+			names = append(names, name)
+		}
+		s.mu.Unlock()
+		sort.Strings(names)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"managers": names})
+		return
+	}
+
+	name := strings.SplitN(p, "/", 2)[0]
+	s.mu.Lock()
+	wt := s.watchers[name]
+	s.mu.Unlock()
+	if wt == nil {
+		writeError(w, &apiError{http.StatusNotFound, fmt.Sprintf("Manager %s not found.", name)})
+		return
+	}
+	http.StripPrefix("/"+name, wt.api).ServeHTTP(w, r)
+}
+
+// serveGRPC routes calls to the Tagging service of the root manager named by
+// the Tagging-Manager header.
+func (s *Server) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get(tagpb.ManagerHeader)
+	s.mu.Lock()
+	wt := s.watchers[name]
+	if name == "" && len(s.watchers) == 1 {
+		for _, only := range s.watchers {
+			wt = only
+		}
+	}
+	s.mu.Unlock()
+	if wt == nil {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		tagpb.FinishCall(w, &tagpb.RemoteError{Code: tagpb.NotFound, Message: fmt.Sprintf("Manager %s not found.", name)})
+		return
+	}
+	NewGRPCServer(wt.api).ServeHTTP(w, r)
+}
+
+// watch starts the alarm and API feeds of the managers not yet watched, and
+// stops those of the managers removed.
+func (s *Server) watch() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	managers := s.reloader.Managers()
+	for name, w := range s.watchers {
+		if !hasManager(managers, name) {
+			w.close()
+			delete(s.watchers, name)
+		}
+	}
+	for _, tm := range managers {
+		if _, ok := s.watchers[tm.Name]; ok {
+			continue
+		}
+		w := &watcher{api: NewAPI(tm)}
+		s.watchers[tm.Name] = w
+
+		feed, err := s.feed(tm, &w.conns)
+		if err != nil {
+			return err
+		}
+		w.feeds = append(w.feeds, feed)
+		go s.alarms.Run(feed)
+
+		if feed, err = s.feed(tm, &w.conns); err != nil {
+			return err
+		}
+		w.feeds = append(w.feeds, feed)
+		w.api.Stream(feed)
+	}
+	return nil
+}
+
+func (s *Server) startServices(c *ServerConfig) error {
+	for _, d := range c.ModbusDrivers {
+		tm, err := s.manager(d.Manager)
+		if err != nil {
+			return err
+		}
+		driver, err := NewModbusDriver(tm, NewModbusClient(NewModbusTCP(d.Addr), d.Unit), d.Groups...)
+		if err != nil {
+			return fmt.Errorf("could not create modbus driver of %s: %s", d.Addr, err)
+		}
+		driver.Start()
+		s.services = append(s.services, driver)
+	}
+
+	for _, m := range c.ModbusServers {
+		tm, err := s.manager(m.Manager)
+		if err != nil {
+			return err
+		}
+		server, err := NewModbusServer(tm, m.Maps...)
+		if err != nil {
+			return fmt.Errorf("could not create modbus server on %s: %s", m.Listen, err)
+		}
+		server.UnitID = m.Unit
+		l, err := net.Listen("tcp", m.Listen)
+		if err != nil {
+			return err
+		}
+		go server.Serve(l)
+		s.services = append(s.services, server)
+	}
+
+	for _, m := range c.MQTT {
+		tm, err := s.manager(m.Manager)
+		if err != nil {
+			return err
+		}
+		bridge, err := NewMQTTBridge(tm, m.Prefix, MQTTOptions{
+			Addr:     m.Addr,
+			ClientID: m.ClientID,
+			Username: m.Username,
+			Password: m.Password,
+		})
+		if err != nil {
+			return fmt.Errorf("could not connect to mqtt broker %s: %s", m.Addr, err)
+		}
+		s.services = append(s.services, bridge)
+		feed, err := s.feed(tm, &s.conns)
+		if err != nil {
+			return err
+		}
+		s.services = append(s.services, feed)
+		go bridge.Run(feed)
+	}
+
+	for _, o := range c.OPCUA {
+		tm, err := s.manager(o.Manager)
+		if err != nil {
+			return err
+		}
+		server := NewOPCUAServer(tm)
+		server.URL = o.URL
+		l, err := net.Listen("tcp", o.Listen)
+		if err != nil {
+			return err
+		}
+		go server.Serve(l)
+		s.services = append(s.services, server)
+	}
+
+	if c.HTTP != "" {
+		l, err := net.Listen("tcp", c.HTTP)
+		if err != nil {
+			return err
+		}
+		s.http = &http.Server{Handler: s}
+		go s.http.Serve(l)
+	}
+
+	if c.GRPC != "" {
+		l, err := net.Listen("tcp", c.GRPC)
+		if err != nil {
+			return err
+		}
+		s.grpc = newH2CServer(http.HandlerFunc(s.serveGRPC))
+		go s.grpc.Serve(l)
+	}
+
+	if c.ChangeLogLen > 0 {
+		go s.trimChanges(c.ChangeLogLen)
+	}
+	return nil
+}
+
+// trimChanges trims the change logs of the managers in stream mode to n
+// entries every changeLogTrim, until the server is closed.
+func (s *Server) trimChanges(n int) {
+	t := time.NewTicker(changeLogTrim)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+
+		for _, tm := range s.reloader.Managers() {
+			trim := func(path string, tag Tagger) error {
+				m, ok := tag.(*TagManager)
+				if !ok || m.Mode != StreamChanges {
+					return nil
+				}
+				if _, err := TrimChanges(s.conn, changeLog(m.Name), n); err != nil {
+					log.Printf("Couldn't trim the change log of %s: %s\n", m.Name, err)
+				}
+				return nil
+			}
+			trim("", tm)
+			tm.Walk(trim)
+		}
+	}
+}
+
+// manager finds the manager of a service by path, as @pressure/area2, and
+// keeps reloads from removing it under the service.
+func (s *Server) manager(path string) (*TagManager, error) {
+	tm, err := s.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	s.reloader.Keep = append(s.reloader.Keep, tm.Name)
+	return tm, nil
+}
+
+func (s *Server) lookup(path string) (*TagManager, error) {
+	parts := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+	for _, tm := range s.reloader.Managers() {
+		if tm.Name != parts[0] {
+			continue
+		}
+		if len(parts) == 1 {
+			return tm, nil
+		}
+		c, err := tm.Lookup(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := c.(*TagManager); ok {
+			return m, nil
+		}
+		return nil, fmt.Errorf("%s is not a tag manager.", path)
+	}
+	return nil, fmt.Errorf("Manager %s not found.", path)
+}
+
+// feed streams the changes of tm over connections of its own, as a feed
+// can't share its subscriptions with tags or other feeds. The connections
+// are added to conns, to be closed after the feed.
+func (s *Server) feed(tm *TagManager, conns *[]io.Closer) (*Feed, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	*conns = append(*conns, conn)
+	psconn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	*conns = append(*conns, psconn)
+	return tm.Feed(conn, NewPSClient(psconn)), nil
+}
+
+// connect dials a connection closed with the server.
+func (s *Server) connect() (*Client, error) {
+	conn, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	s.conns = append(s.conns, conn)
+	return conn, nil
+}
+
+func (w *watcher) close() {
+	for _, f := range w.feeds {
+		f.Close()
+	}
+	for _, c := range w.conns {
+		c.Close()
+	}
+}
+
+// NewServer serves the config file at path, dialing redis with dial.
+func NewServer(path string, dial func() (*Client, error)) *Server {
+	return &Server{Path: path, dial: dial, watchers: map[string]*watcher{}, done: make(chan struct{})}
+}
+
+const shutdownTimeout = 5 * time.Second
+
+// changeLogTrim is how often the server trims change logs.
+const changeLogTrim = time.Minute
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/joaodubas/tagging/tagpb"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const serverConfig = `{"managers": [
+  {"name": "@a", "tags": [{"name": "x", "value": 1}]},
+  {"name": "@b", "tags": [{"name": "x", "value": 2}]}
+]}`
+
+// testServer writes config to a file and returns a server of it on r, not
+// started, and a func writing the file again.
+func testServer(t *testing.T, r *testRedis, config string) (*Server, func(string)) {
+	path := filepath.Join(t.TempDir(), "tags.json")
+	write := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(config)
+	return NewServer(path, func() (*Client, error) { return Dial(r.Addr(), "", 0) }), write
+}
+
+// startServer starts a server of config, closed with the test.
+func startServer(t *testing.T, r *testRedis, config string) (*Server, func(string)) {
+	s, write := testServer(t, r, config)
+	t.Cleanup(func() { s.Close() })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s, write
+}
+
+// watched returns the names of the managers s serves.
+func watched(s *Server) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := []string{}
+	for name := range s.watchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// closeFunc is an io.Closer calling itself.
+type closeFunc func()
+
+func (f closeFunc) Close() error {
+	f()
+	return nil
+}
+
+func TestServerStartClose(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	s, _ := testServer(t, r, `{
+  "managers": [{"name": "@a", "tags": [{"name": "x", "value": 1}]}, {"name": "@b"}],
+  "server": {
+    "http": "127.0.0.1:0",
+    "modbus_servers": [{"manager": "@a", "listen": "127.0.0.1:0",
+      "maps": [{"table": "holding registers", "address": 0, "tag": "@a:x"}]}]
+  }
+}`)
+	if err := s.Start(); err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	if w := watched(s); w != "@a @b" {
+		t.Errorf("Expected @a and @b watched, got %s", w)
+	}
+	if len(s.services) != 1 {
+		t.Errorf("Expected the modbus server started, got %v", s.services)
+	}
+
+	// state tells what is still running when the probes are closed: the
+	// last service and the last connection.
+	managers := s.reloader.Managers()
+	state := func() string {
+		api := "api serving"
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.http.Serve(l) == http.ErrServerClosed {
+			api = "api stopped"
+		}
+		closed := 0
+		for _, tm := range managers {
+			if atomic.LoadInt32(&tm.closed) == 1 {
+				closed++
+			}
+		}
+		return fmt.Sprintf("%s, watched %q, %d managers closed", api, watched(s), closed)
+	}
+	var atServices, atConns string
+	s.services = append([]io.Closer{closeFunc(func() { atServices = state() })}, s.services...)
+	s.conns = append([]io.Closer{closeFunc(func() { atConns = state() })}, s.conns...)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := `api stopped, watched "@a @b", 0 managers closed`; atServices != want {
+		t.Errorf("Expected the services stopped with %s, got %s", want, atServices)
+	}
+	if want := `api stopped, watched "", 2 managers closed`; atConns != want {
+		t.Errorf("Expected the connections closed with %s, got %s", want, atConns)
+	}
+	waitFor(t, "feeds to unsubscribe", func() bool { return r.subscribers() == 0 })
+}
+
+func TestServerReloadOnSIGHUP(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	s, write := testServer(t, r, `{"managers": [{"name": "@a"}]}`)
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	// Run handles the signals once it starts the managers.
+	waitFor(t, "@a to be watched", func() bool { return watched(s) == "@a" })
+
+	write(`{"managers": [{"name": "@b", "tags": [{"name": "x", "value": 2}]}]}`)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitFor(t, "@b to replace @a", func() bool { return watched(s) == "@b" })
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/@b/tags/x", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the API of @b served, got %d %s", w.Code, w.Body.String())
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected Run to return on SIGTERM")
+	}
+}
+
+func TestServerReloadKeepsServices(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	s, write := startServer(t, r, `{
+  "managers": [{"name": "@a", "managers": [{"name": "area", "tags": [{"name": "x"}]}]}],
+  "server": {"modbus_servers": [{"manager": "@a/area", "listen": "127.0.0.1:0",
+    "maps": [{"table": "holding registers", "address": 0, "tag": "@a:area:x"}]}]}
+}`)
+
+	write(`{"managers": [{"name": "@a"}, {"name": "@b"}]}`)
+	if _, err := s.Reload(); err == nil {
+		t.Error("Expected the reload removing @a:area to be refused")
+	}
+	if w := watched(s); w != "@a" {
+		t.Errorf("Expected only @a watched, got %s", w)
+	}
+	if _, err := s.reloader.Managers()[0].Lookup("area/x"); err != nil {
+		t.Errorf("Expected @a:area:x kept, got %s", err)
+	}
+}
+
+func TestServerServeHTTP(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	s, _ := startServer(t, r, serverConfig)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	list := map[string][]string{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(list["managers"], " ") != "@a @b" {
+		t.Errorf("Expected managers @a and @b listed, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/@b/tags/x", nil))
+	state := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || state["Value"] != 2.0 {
+		t.Errorf("Expected x of @b with 2, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/@z/tags/x", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected @z not found, got %d", w.Code)
+	}
+}
+
+func TestServerServeGRPC(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+
+	for _, c := range []struct {
+		config  string
+		manager string
+		want    interface{}
+	}{
+		{serverConfig, "@a", int64(1)},
+		{serverConfig, "@b", int64(2)},
+		{serverConfig, "", nil},
+		{serverConfig, "@z", nil},
+		{`{"managers": [{"name": "@b", "tags": [{"name": "x", "value": 2}]}]}`, "", int64(2)},
+	} {
+		s, _ := startServer(t, r, c.config)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := newH2CServer(http.HandlerFunc(s.serveGRPC))
+		go h.Serve(l)
+
+		v, err := tagpb.NewRemoteTagger(l.Addr().String(), c.manager).Get("x", "Value")
+		if c.want == nil {
+			if e, ok := err.(*tagpb.RemoteError); !ok || e.Code != tagpb.NotFound {
+				t.Errorf("Expected no manager found for %q, got %v (%v)", c.manager, v, err)
+			}
+		} else if err != nil || v != c.want {
+			t.Errorf("Expected x of %q to be %v, got %v (%v)", c.manager, c.want, v, err)
+		}
+		h.Close()
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sparkplug data types.
+const (
+	spInt32   = 3
+	spInt64   = 4
+	spDouble  = 10
+	spBoolean = 11
+	spString  = 12
+)
+
+const spRebirth = "Node Control/Rebirth"
+
+// spMetric is a metric of a sparkplug payload. Props are sent as a property
+// set of strings.
+type spMetric struct {
+	Name      string
+	Type      uint32
+	Value     interface{}
+	Timestamp uint64
+	Props     map[string]string
+}
+
+func (m *spMetric) String() string {
+	return fmt.Sprintf("spMetric{Name: %s, Type: %d, Value: %v}", m.Name, m.Type, m.Value)
+}
+
+// EdgeNode is a sparkplug B edge node, with a device for each manager. Device
+// metrics are named after tag paths and props, as tank-0/Value, and the Meta
+// of a tag goes as properties of its Value metric. Editable props are written
+// with DCMD, and NCMD with Node Control/Rebirth true births everything again.
+// Every connection takes the next bdSeq, sent in its NDEATH will and NBIRTH.
+type EdgeNode struct {
+	client  *MQTTClient
+	Group   string
+	Node    string
+	devices []*TagManager
+	seq     uint64
+	bdSeq   uint64
+	mu      sync.Mutex
+}
+
+func (e *EdgeNode) String() string {
+	return fmt.Sprintf("EdgeNode{Group: %s, Node: %s, Devices#len: %d}", e.Group, e.Node, len(e.devices))
+}
+
+// Rebirth publishes NBIRTH and a DBIRTH for every device, restarting the
+// sequence.
+func (e *EdgeNode) Rebirth() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.seq = 0
+	e.publish(e.topic("NBIRTH", ""), []*spMetric{
+		{Name: "bdSeq", Type: spInt64, Value: int64(e.bdSeq)},
+		{Name: spRebirth, Type: spBoolean, Value: false},
+	})
+	for _, d := range e.devices {
+		var metrics []*spMetric
+		d.Walk(func(p string, tag Tagger) error {
+			metrics = append(metrics, tagMetrics(p, tag)...)
+			return nil
+		})
+		e.publish(e.topic("DBIRTH", deviceID(d)), metrics)
+	}
+}
+
+// Run publishes DDATA for the changes of feed, until it is closed. Changes to
+// Meta need a rebirth, as metric properties are only sent on births.
+func (e *EdgeNode) Run(feed *Feed) {
+	for {
+		select {
+		case <-feed.Done():
+			return
+		case c := <-feed.C:
+			e.change(c)
+		}
+	}
+}
+
+// Close publishes NDEATH and disconnects.
+func (e *EdgeNode) Close() error {
+	e.mu.Lock()
+	e.client.Publish(e.death())
+	e.mu.Unlock()
+	return e.client.Close()
+}
+
+func (e *EdgeNode) change(c *Change) {
+	p, err := tagSchema.ByKey(c.Prop)
+	if err != nil || p.Name == "Name" {
+		return
+	}
+	if p.Name == "Meta" {
+		e.Rebirth()
+		return
+	}
+	d := e.device(c.Tag)
+	if d == nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	m := &spMetric{
+		Name:      keyPath(strings.TrimPrefix(c.Tag, d.Name+":")) + "/" + p.Name,
+		Type:      metricType(p.Type),
+		Value:     changeValue(d, c),
+		Timestamp: uint64(c.Timestamp) * 1000,
+	}
+	e.publish(e.topic("DDATA", deviceID(d)), []*spMetric{m})
+}
+
+// command handles NCMD and DCMD messages.
+func (e *EdgeNode) command(msg *MQTTMessage) {
+	metrics, err := decodeSparkplug(msg.Payload)
+	if err != nil {
+		log.Printf("Couldn't decode %s: %s\n", msg, err)
+		return
+	}
+
+	parts := strings.Split(msg.Topic, "/")
+	if parts[2] == "NCMD" {
+		for _, m := range metrics {
+			if m.Name == spRebirth && m.Value == true {
+				e.Rebirth()
+			}
+		}
+		return
+	}
+
+	var d *TagManager
+	for _, c := range e.devices {
+		if len(parts) == 5 && deviceID(c) == parts[4] {
+			d = c
+		}
+	}
+	if d == nil {
+		log.Printf("Unknown device in %s\n", msg.Topic)
+		return
+	}
+	for _, m := range metrics {
+		i := strings.LastIndex(m.Name, "/")
+		if i < 0 {
+			log.Printf("Invalid metric %s for %s\n", m.Name, msg.Topic)
+			continue
+		}
+		tag := d.Name + ":" + strings.Replace(m.Name[:i], "/", ":", -1)
+		if err := d.Set(tag, m.Name[i+1:], m.Value); err != nil {
+			log.Printf("Couldn't write %s of %s: %s\n", m.Name, deviceID(d), err)
+		}
+	}
+}
+
+// publish sends metrics with the next sequence number, with e.mu held.
+func (e *EdgeNode) publish(topic string, metrics []*spMetric) {
+	payload := encodeSparkplug(uint64(time.Now().UnixNano()/1e6), e.seq, metrics)
+	e.seq = (e.seq + 1) % 256
+	m := &MQTTMessage{Topic: topic, Payload: payload}
+	if err := e.client.Publish(m); err != nil {
+		log.Printf("Couldn't publish %s: %s\n", m, err)
+	}
+}
+
+// reconnect moves to the next bdSeq and sets the NDEATH will of the
+// connection about to be made.
+func (e *EdgeNode) reconnect() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.bdSeq = (e.bdSeq + 1) % 256
+	e.client.Options.Will = e.death()
+}
+
+func (e *EdgeNode) death() *MQTTMessage {
+	// NDEATH goes without sequence number
+	payload := pbUint(nil, 1, uint64(time.Now().UnixNano()/1e6))
+	payload = pbBytes(payload, 2, encodeMetric(&spMetric{Name: "bdSeq", Type: spInt64, Value: int64(e.bdSeq)}))
+	return &MQTTMessage{Topic: e.topic("NDEATH", ""), Payload: payload, QoS: 1}
+}
+
+func (e *EdgeNode) device(tag string) *TagManager {
+	var found *TagManager
+	for _, d := range e.devices {
+		if strings.HasPrefix(tag, d.Name+":") && (found == nil || len(d.Name) > len(found.Name)) {
+			found = d
+		}
+	}
+	return found
+}
+
+func (e *EdgeNode) topic(kind string, device string) string {
+	t := fmt.Sprintf("spBv1.0/%s/%s/%s", e.Group, kind, e.Node)
+	if device != "" {
+		t += "/" + device
+	}
+	return t
+}
+
+// NewEdgeNode connects to the broker in options, with NDEATH as last will,
+// and births the node and its devices.
+func NewEdgeNode(group string, node string, options MQTTOptions, devices ...*TagManager) (*EdgeNode, error) {
+	e := &EdgeNode{
+		Group:   group,
+		Node:    node,
+		devices: devices,
+		bdSeq:   uint64(time.Now().Unix()) % 256,
+	}
+	e.client = NewMQTTClient(options)
+	e.client.BeforeConnect = e.reconnect
+	e.client.OnConnect = e.Rebirth
+	e.client.Subscribe(e.topic("NCMD", ""), 1, e.command)
+	e.client.Subscribe(e.topic("DCMD", "+"), 1, e.command)
+	if err := e.client.Connect(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func deviceID(m *TagManager) string {
+	return strings.Replace(m.Name, ":", ".", -1)
+}
+
+// tagMetrics returns the birth metrics of tag, at path in its device.
+func tagMetrics(path string, tag Tagger) []*spMetric {
+	if _, ok := tag.(*TagManager); ok {
+		return nil
+	}
+	s, err := schemaOf(tag)
+	if err != nil {
+		return nil
+	}
+
+	var timestamp uint64
+	if t, err := getProp(tag, "Timestamp"); err == nil {
+		timestamp = uint64(t.(int64)) * 1000
+	}
+	var metrics []*spMetric
+	for _, p := range s.Props {
+		if p.Name == "Name" || p.Name == "Meta" {
+			continue
+		}
+		m := &spMetric{
+			Name:      path + "/" + p.Name,
+			Type:      metricType(p.Type),
+			Value:     p.Get(tag),
+			Timestamp: timestamp,
+		}
+		if p.Name == "Value" {
+			if meta, err := getProp(tag, "Meta"); err == nil {
+				m.Props = meta.(map[string]string)
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+func metricType(t PropType) uint32 {
+	switch t {
+	case IntProp, Int64Prop:
+		return spInt64
+	case FloatProp:
+		return spDouble
+	case BoolProp:
+		return spBoolean
+	}
+	return spString
+}
+
+// protobuf --------------------------------------------------------------------
+
+// encodeSparkplug encodes a sparkplug B Payload message.
+func encodeSparkplug(timestamp uint64, seq uint64, metrics []*spMetric) []byte {
+	b := pbUint(nil, 1, timestamp)
+	for _, m := range metrics {
+		b = pbBytes(b, 2, encodeMetric(m))
+	}
+	return pbUint(b, 3, seq)
+}
+
+func encodeMetric(m *spMetric) []byte {
+	b := pbBytes(nil, 1, []byte(m.Name))
+	if m.Timestamp != 0 {
+		b = pbUint(b, 3, m.Timestamp)
+	}
+	b = pbUint(b, 4, uint64(m.Type))
+
+	if len(m.Props) > 0 {
+		keys := make([]string, 0, len(m.Props))
+		for k := range m.Props {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var set []byte
+		for _, k := range keys {
+			set = pbBytes(set, 1, []byte(k))
+		}
+		for _, k := range keys {
+			value := pbUint(nil, 1, spString)
+			set = pbBytes(set, 2, pbBytes(value, 8, []byte(m.Props[k])))
+		}
+		b = pbBytes(b, 9, set)
+	}
+
+	switch v := m.Value.(type) {
+	case int:
+		b = pbUint(b, 11, uint64(v))
+	case int64:
+		b = pbUint(b, 11, uint64(v))
+	case float64:
+		b = pbVarint(b, 13<<3|1)
+		b = append(b, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(b[len(b)-8:], math.Float64bits(v))
+	case bool:
+		b = pbUint(b, 14, uint64(boolNumber(v)))
+	case string:
+		b = pbBytes(b, 15, []byte(v))
+	default:
+		b = pbBytes(b, 15, []byte(fmt.Sprint(v)))
+	}
+	return b
+}
+
+// decodeSparkplug decodes the metrics of a sparkplug B Payload message.
+func decodeSparkplug(b []byte) ([]*spMetric, error) {
+	var metrics []*spMetric
+	err := pbFields(b, func(field int, v uint64, data []byte) error {
+		if field != 2 {
+			return nil
+		}
+		m, err := decodeMetric(data)
+		if err != nil {
+			return err
+		}
+		metrics = append(metrics, m)
+		return nil
+	})
+	return metrics, err
+}
+
+func decodeMetric(b []byte) (*spMetric, error) {
+	m := &spMetric{}
+	err := pbFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.Name = string(data)
+		case 3:
+			m.Timestamp = v
+		case 4:
+			m.Type = uint32(v)
+		case 10:
+			m.Value = int64(int32(uint32(v)))
+		case 11:
+			m.Value = int64(v)
+		case 12:
+			m.Value = float64(math.Float32frombits(uint32(v)))
+		case 13:
+			m.Value = math.Float64frombits(v)
+		case 14:
+			m.Value = v != 0
+		case 15:
+			m.Value = string(data)
+		}
+		return nil
+	})
+	return m, err
+}
+
+// pbFields calls fn for every field of the protobuf message b, with the value
+// of varint and fixed fields in v and the data of length delimited ones.
+func pbFields(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf key")
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("invalid protobuf varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return fmt.Errorf("invalid protobuf fixed64")
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("invalid protobuf length")
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return fmt.Errorf("invalid protobuf fixed32")
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if err := fn(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pbVarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func pbUint(b []byte, field int, v uint64) []byte {
+	return pbVarint(pbVarint(b, uint64(field)<<3), v)
+}
+
+func pbBytes(b []byte, field int, data []byte) []byte {
+	b = pbVarint(pbVarint(b, uint64(field)<<3|2), uint64(len(data)))
+	return append(b, data...)
+}
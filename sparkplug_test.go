@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// bdSeqOf returns the bdSeq metric of a NBIRTH or NDEATH payload.
+func bdSeqOf(t *testing.T, payload []byte) int64 {
+	metrics, err := decodeSparkplug(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range metrics {
+		if m.Name == "bdSeq" {
+			return m.Value.(int64)
+		}
+	}
+	t.Fatal("no bdSeq metric")
+	return 0
+}
+
+func TestEdgeNodeReconnect(t *testing.T) {
+	broker := newTestBroker(t, "")
+	defer broker.Close()
+	watcher, received := watchTopics(t, broker, "spBv1.0/#")
+	defer watcher.Close()
+
+	e, err := NewEdgeNode("g", "n", MQTTOptions{
+		Addr:     broker.Addr(),
+		ClientID: "node",
+		Retry:    50 * time.Millisecond,
+	}, memManager("@sp", &memTag{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	var births []int64
+	for i := 0; i < 3; i++ {
+		timeout := time.After(time.Second)
+		for len(births) == i {
+			select {
+			case m := <-received:
+				if m.Topic == "spBv1.0/g/NBIRTH/n" {
+					births = append(births, bdSeqOf(t, m.Payload))
+				}
+			case <-timeout:
+				t.Fatal("no NBIRTH after connecting")
+			}
+		}
+		if i < 2 {
+			broker.kick("node")
+		}
+	}
+
+	var wills []*MQTTMessage
+	for _, w := range broker.connects() {
+		if w != nil && w.Topic == "spBv1.0/g/NDEATH/n" {
+			wills = append(wills, w)
+		}
+	}
+	if len(wills) != 3 {
+		t.Fatalf("%d connects with a NDEATH will, want 3", len(wills))
+	}
+	for i, w := range wills {
+		if seq := bdSeqOf(t, w.Payload); seq != births[i] {
+			t.Errorf("connect %d has bdSeq %d in NDEATH and %d in NBIRTH", i, seq, births[i])
+		}
+		if i > 0 && births[i] != (births[i-1]+1)%256 {
+			t.Errorf("connect %d has bdSeq %d after %d", i, births[i], births[i-1])
+		}
+	}
+}
+
+func TestEdgeNodeCommand(t *testing.T) {
+	broker := newTestBroker(t, "")
+	defer broker.Close()
+	watcher, received := watchTopics(t, broker, "spBv1.0/g/DBIRTH/#")
+	defer watcher.Close()
+
+	a := &memTag{Value: 3}
+	e, err := NewEdgeNode("g", "n", MQTTOptions{Addr: broker.Addr(), ClientID: "node"}, memManager("@sp", a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	select {
+	case m := <-received:
+		metrics, err := decodeSparkplug(m.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, metric := range metrics {
+			if metric.Name == "a/Value" {
+				found = metric.Value == int64(3)
+			}
+		}
+		if !found {
+			t.Errorf("DBIRTH has no a/Value of 3: %v", metrics)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no DBIRTH")
+	}
+
+	broker.subscribed(t, "spBv1.0/g/DCMD/n/+")
+	payload := encodeSparkplug(0, 0, []*spMetric{{Name: "a/Value", Type: spInt64, Value: int64(8)}})
+	watcher.Publish(&MQTTMessage{Topic: "spBv1.0/g/DCMD/n/@sp", Payload: payload})
+	deadline := time.Now().Add(time.Second)
+	for v, _ := getProp(a, "Value"); v != 8; v, _ = getProp(a, "Value") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Value is %v after DCMD, want 8", v)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hub fans the changes of a feed out to every stream subscriber.
+type hub struct {
+	subs map[*subscriber]bool
+	done chan struct{}
+	once sync.Once
+	mu   sync.Mutex
+}
+
+// subscriber holds the changes not yet sent to a stream client. Changes to
+// the same tag property are merged, keeping the latest, so a client which
+// doesn't keep up gets fewer events but never a stale value.
+type subscriber struct {
+	manager  string
+	tags     []string
+	patterns []string
+	pending  []*Change
+	index    map[string]int
+	ready    chan struct{}
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+func (h *hub) run(feed *Feed) {
+	defer h.stop()
+	done := feed.Done()
+	for {
+		select {
+		case c := <-feed.C:
+			h.mu.Lock()
+			for s := range h.subs {
+				s.push(c)
+			}
+			h.mu.Unlock()
+		case <-done:
+			return
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// stop stops fanning changes out and ends every stream, so their clients
+// connect again to the current hub.
+func (h *hub) stop() {
+	h.once.Do(func() {
+		close(h.done)
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		delete(h.subs, s)
+		close(s.done)
+	}
+}
+
+// add registers s, failing once the hub is stopped.
+func (h *hub) add(s *subscriber) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if stopped(h.done) {
+		return false
+	}
+	h.subs[s] = true
+	return true
+}
+
+func (h *hub) remove(s *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, s)
+}
+
+// push queues c when it selects one of the tags of s.
+func (s *subscriber) push(c *Change) {
+	p := keyPath(strings.TrimPrefix(c.Tag, s.manager+":"))
+	if !s.match(p) {
+		return
+	}
+	c = &Change{Tag: p, Prop: c.Prop, Value: c.Value, Timestamp: c.Timestamp}
+
+	key := c.Tag + "\x00" + c.Prop
+	s.mu.Lock()
+	if i, ok := s.index[key]; ok {
+		s.pending[i] = c
+	} else {
+		s.index[key] = len(s.pending)
+		s.pending = append(s.pending, c)
+	}
+	s.mu.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the pending changes, in the order their tag properties first
+// changed.
+func (s *subscriber) take() []*Change {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending
+	s.pending = nil
+	s.index = map[string]int{}
+	return pending
+}
+
+func (s *subscriber) match(p string) bool {
+	if containsString(s.tags, p) {
+		return true
+	}
+	for _, pattern := range s.patterns {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return len(s.tags) == 0 && len(s.patterns) == 0
+}
+
+// newSubscriber selects the tags of manager by path in tags or by glob in
+// patterns, every tag when both are empty.
+func newSubscriber(manager string, tags []string, patterns []string) *subscriber {
+	return &subscriber{
+		manager:  manager,
+		tags:     tags,
+		patterns: patterns,
+		index:    map[string]int{},
+		ready:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// follow sends the changes of s until send fails, the hub ends s or done is
+// closed. With a throttle, changes are sent at most once per interval. ping is
+// called on every tick of beat.
+func (s *subscriber) follow(throttle time.Duration, beat <-chan time.Time, done <-chan struct{}, send func([]*Change) bool, ping func() bool) {
+	var flush <-chan time.Time
+	if throttle > 0 {
+		t := time.NewTicker(throttle)
+		defer t.Stop()
+		flush = t.C
+	}
+	ready := s.ready
+
+	for {
+		select {
+		case <-ready:
+			if flush != nil {
+				// changes wait in the subscriber until the next flush.
+				ready = nil
+				continue
+			}
+			if !send(s.take()) {
+				return
+			}
+		case <-flush:
+			ready = s.ready
+			pending := s.take()
+			if len(pending) > 0 && !send(pending) {
+				return
+			}
+		case <-beat:
+			if !ping() {
+				return
+			}
+		case <-s.done:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// api -------------------------------------------------------------------------
+
+// Stream enables the /stream endpoint, fed by the changes of feed. Streams fed
+// by a previous feed are ended.
+func (a *API) Stream(feed *Feed) {
+	h := &hub{subs: map[*subscriber]bool{}, done: make(chan struct{})}
+	go h.run(feed)
+
+	a.mu.Lock()
+	old := a.hub
+	a.hub = h
+	a.mu.Unlock()
+	if old != nil {
+		old.stop()
+	}
+}
+
+// streamHub returns the hub of the current feed, or nil when streaming is not
+// enabled.
+func (a *API) streamHub() *hub {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.hub
+}
+
+// handleStream sends server-sent events to the client. The query selects the
+// tags, by path in tags or by glob in patterns, both comma separated, and
+// tunes the stream:
+//
+//	throttle   minimum interval between events, as 500ms; changes to the same
+//	           tag property in between are merged, keeping the latest
+//	heartbeat  interval between keep alive comments, 15s by default
+//
+// A snapshot event with the state of every selected tag comes first, then a
+// change event for each change.
+func (a *API) handleStream(w http.ResponseWriter, r *http.Request) {
+	h := a.streamHub()
+	if h == nil {
+		writeError(w, &apiError{http.StatusNotFound, "streaming is not enabled"})
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, &apiError{http.StatusInternalServerError, "streaming is not supported"})
+		return
+	}
+
+	q := r.URL.Query()
+	throttle, err := durationParam(q.Get("throttle"), 0)
+	if err != nil {
+		writeError(w, &apiError{http.StatusBadRequest, err.Error()})
+		return
+	}
+	heartbeat, err := durationParam(q.Get("heartbeat"), 15*time.Second)
+	if err != nil || heartbeat <= 0 {
+		writeError(w, &apiError{http.StatusBadRequest, fmt.Sprintf("invalid heartbeat %q", q.Get("heartbeat"))})
+		return
+	}
+
+	s := newSubscriber(a.manager.Name, splitParam(q.Get("tags")), splitParam(q.Get("patterns")))
+	if !h.add(s) {
+		writeError(w, &apiError{http.StatusServiceUnavailable, "streaming is restarting"})
+		return
+	}
+	defer h.remove(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	snapshot := map[string]interface{}{}
+	a.manager.Walk(func(p string, tag Tagger) error {
+		if _, ok := tag.(*TagManager); !ok && s.match(p) {
+			snapshot[p] = a.state(tag)
+		}
+		return nil
+	})
+	if err := writeEvent(w, "snapshot", snapshot); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	beat := time.NewTicker(heartbeat)
+	defer beat.Stop()
+
+	send := func(changes []*Change) bool {
+		if !writeChanges(w, changes) {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	ping := func() bool {
+		if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	s.follow(throttle, beat.C, r.Context().Done(), send, ping)
+}
+
+// utility ---------------------------------------------------------------------
+
+func writeEvent(w http.ResponseWriter, event string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+func writeChanges(w http.ResponseWriter, changes []*Change) bool {
+	for _, c := range changes {
+		if err := writeEvent(w, "change", c); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func splitParam(s string) []string {
+	l := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+func durationParam(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
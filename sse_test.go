@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSubscriberMerges(t *testing.T) {
+	s := newSubscriber("@s", nil, nil)
+	for i := 0; i < 1000; i++ {
+		s.push(&Change{Tag: "@s:a", Prop: "value", Value: i})
+		s.push(&Change{Tag: "@s:b", Prop: "value", Value: -i})
+	}
+	s.push(&Change{Tag: "@s:a", Prop: "quality", Value: 0})
+
+	pending := s.take()
+	if len(pending) != 3 {
+		t.Fatalf("%d changes pending, want 3", len(pending))
+	}
+	if c := pending[0]; c.Tag != "a" || c.Value != 999 {
+		t.Errorf("first change is %s, want the latest value of a", c)
+	}
+	if c := pending[1]; c.Tag != "b" || c.Value != -999 {
+		t.Errorf("second change is %s, want the latest value of b", c)
+	}
+	if len(s.take()) != 0 {
+		t.Error("changes left after take")
+	}
+}
+
+func TestStreamAgainStopsHub(t *testing.T) {
+	api := NewAPI(memManager("@s", &memTag{}))
+	api.Stream(testFeed())
+	old := api.streamHub()
+	s := newSubscriber("@s", nil, nil)
+	if !old.add(s) {
+		t.Fatal("could not subscribe")
+	}
+
+	api.Stream(testFeed())
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("the stream of the previous feed was not ended")
+	}
+	if old.add(s) {
+		t.Error("subscribed to a stopped hub")
+	}
+}
+
+func TestStreamWhileServing(t *testing.T) {
+	api := NewAPI(memManager("@s", &memTag{}))
+	api.Stream(testFeed())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			api.Stream(testFeed())
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		r := httptest.NewRequest("GET", "/stream", nil).WithContext(ctx)
+		api.ServeHTTP(httptest.NewRecorder(), r)
+		cancel()
+	}
+	<-done
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fzzy/radix/redis"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamBlock is how long a stream read waits for new entries. It must stay
+// below the client read timeout set by NewClient.
+const streamBlock = 5 * time.Second
+
+type StreamEntry struct {
+	ID     string
+	Change *Change
+}
+
+func (e *StreamEntry) String() string {
+	return fmt.Sprintf("StreamEntry{ID: %s, Change: %s}", e.ID, e.Change)
+}
+
+// stream consumer --------------------------------------------------------------
+
+// maxDeliveries is how many times an entry is delivered to a consumer group
+// before it's acknowledged without being handled, so an entry its consumers
+// keep failing on doesn't block them.
+const maxDeliveries = 5
+
+// StreamConsumer reads a change log as a member of a consumer group. Entries
+// delivered but not acknowledged are read again once, before new ones, so a
+// consumer restarted with the same name resumes where it stopped. Entries
+// delivered more than MaxDeliveries times are dropped. The consumer blocks on
+// a connection of its own while it waits for entries, which Close closes.
+type StreamConsumer struct {
+	conn          *Client
+	Stream        string
+	Group         string
+	Name          string
+	MaxDeliveries int
+	pending       string
+}
+
+func (c *StreamConsumer) String() string {
+	return fmt.Sprintf(
+		"StreamConsumer{Stream: %s, Group: %s, Name: %s}",
+		c.Stream,
+		c.Group,
+		c.Name,
+	)
+}
+
+// Read returns the pending entries of the consumer, after the ones already
+// returned, and then new entries, waiting up to block for them.
+func (c *StreamConsumer) Read(count int, block time.Duration) ([]*StreamEntry, error) {
+	for c.pending != "" {
+		entries, err := c.read(c.pending, count, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			c.pending = ""
+			break
+		}
+		c.pending = entries[len(entries)-1].ID
+		if entries, err = c.drop(entries); err != nil || len(entries) > 0 {
+			return entries, err
+		}
+	}
+	return c.read(">", count, block)
+}
+
+// Close closes the connection of the consumer. The group keeps its pending
+// entries for a consumer with the same name.
+func (c *StreamConsumer) Close() error {
+	return c.conn.Close()
+}
+
+func (c *StreamConsumer) Ack(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	_, err := c.conn.Xack(c.Stream, c.Group, args...)
+	return err
+}
+
+func (c *StreamConsumer) read(id string, count int, block time.Duration) ([]*StreamEntry, error) {
+	args := []interface{}{"count", count}
+	if id == ">" {
+		args = append(args, "block", int64(block/time.Millisecond))
+	}
+	args = append(args, "streams", c.Stream, id)
+
+	r, err := c.conn.Xreadgroup(c.Group, c.Name, args...)
+	if err != nil {
+		return nil, err
+	}
+	return parseStreamReply(r)
+}
+
+// drop acknowledges the entries delivered more than MaxDeliveries times, and
+// returns the others.
+func (c *StreamConsumer) drop(entries []*StreamEntry) ([]*StreamEntry, error) {
+	first, last := entries[0].ID, entries[len(entries)-1].ID
+	r, err := c.conn.Xpending(c.Stream, c.Group, first, last, len(entries), c.Name)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := map[string]int64{}
+	for _, e := range r.Elems {
+		if len(e.Elems) != 4 {
+			return nil, fmt.Errorf("unexpected pending entry %s", e)
+		}
+		id, _ := e.Elems[0].Str()
+		deliveries[id], _ = e.Elems[3].Int64()
+	}
+
+	kept := []*StreamEntry{}
+	for _, e := range entries {
+		if n := deliveries[e.ID]; n <= int64(c.MaxDeliveries) {
+			kept = append(kept, e)
+			continue
+		}
+		log.Printf("Dropping %s from %s after %d deliveries.\n", e, c, deliveries[e.ID])
+		if err := c.Ack(e.ID); err != nil {
+			return nil, err
+		}
+	}
+	return kept, nil
+}
+
+// NewStreamConsumer joins the group in stream, creating both when missing. A
+// new group starts from the beginning of the change log. The consumer dials
+// its own connection from conn, as a blocking read would hold a shared one
+// and stall every other command on it.
+func NewStreamConsumer(conn *Client, stream string, group string, name string) (*StreamConsumer, error) {
+	own, err := conn.dial()
+	if err != nil {
+		return nil, err
+	}
+	_, err = own.Xgroup("create", stream, group, "0", "mkstream")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		own.Close()
+		return nil, err
+	}
+
+	return &StreamConsumer{
+		conn:          own,
+		Stream:        stream,
+		Group:         group,
+		Name:          name,
+		MaxDeliveries: maxDeliveries,
+		pending:       "0",
+	}, nil
+}
+
+// utility ---------------------------------------------------------------------
+
+// TrimChanges trims the change log stream to its maxLen newest entries. Older
+// entries that a consumer group hasn't read or acknowledged yet are kept, so
+// no change is lost to a lagging consumer. It returns the number of entries
+// removed.
+func TrimChanges(conn *Client, stream string, maxLen int) (int64, error) {
+	if maxLen <= 0 {
+		return 0, nil
+	}
+	r, err := conn.Xrevrange(stream, "+", "-", "count", maxLen)
+	if err != nil {
+		return 0, err
+	}
+	if len(r.Elems) < maxLen {
+		return 0, nil
+	}
+	newest, err := parseStreamEntries(r)
+	if err != nil {
+		return 0, err
+	}
+	min := newest[len(newest)-1].ID
+
+	r, err = conn.Xinfo("groups", stream)
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range r.Elems {
+		name, last := "", ""
+		for i := 0; i+1 < len(g.Elems); i += 2 {
+			switch k, _ := g.Elems[i].Str(); k {
+			case "name":
+				name, _ = g.Elems[i+1].Str()
+			case "last-delivered-id":
+				last, _ = g.Elems[i+1].Str()
+			}
+		}
+
+		// entries after the last delivered are unread, and the oldest
+		// pending is the first one not acknowledged.
+		p, err := conn.Xpending(stream, name)
+		if err != nil {
+			return 0, err
+		}
+		if len(p.Elems) == 4 && p.Elems[1].Type != redis.NilReply {
+			last, _ = p.Elems[1].Str()
+		}
+		if last != "" && compareStreamIDs(last, min) < 0 {
+			min = last
+		}
+	}
+
+	r, err = conn.Xtrim(stream, "minid", min)
+	if err != nil {
+		return 0, err
+	}
+	return r.Int64()
+}
+
+// compareStreamIDs returns -1, 0 or 1 as the stream id a is before, equal to
+// or after b.
+func compareStreamIDs(a string, b string) int {
+	pa, pb := strings.SplitN(a, "-", 2), strings.SplitN(b, "-", 2)
+	for i := 0; i < 2; i++ {
+		var x, y uint64
+		if i < len(pa) {
+			x, _ = strconv.ParseUint(pa[i], 10, 64)
+		}
+		if i < len(pb) {
+			y, _ = strconv.ParseUint(pb[i], 10, 64)
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// addChange queues the XADD of c into the transaction started on conn, so the
+// change log is written along with the keys. The log isn't capped, as a cap
+// would drop entries consumers haven't read; TrimChanges trims it safely.
+func addChange(conn *Client, stream string, c *Change) asyncReply {
+	return conn.Add(
+		"xadd",
+		stream,
+		"*",
+		"tag", c.Tag,
+		"prop", c.Prop,
+		"value", fmt.Sprint(c.Value),
+		"timestamp", c.Timestamp,
+	)
+}
+
+// readChanges reads the entries of stream after id, without a consumer group.
+func readChanges(conn *Client, stream string, id string, block time.Duration) ([]*StreamEntry, error) {
+	r, err := conn.Xread("block", int64(block/time.Millisecond), "streams", stream, id)
+	if err != nil {
+		return nil, err
+	}
+	return parseStreamReply(r)
+}
+
+// parseStreamReply reads the reply of XREAD and XREADGROUP for one stream.
+func parseStreamReply(r *redis.Reply) ([]*StreamEntry, error) {
+	if r.Type == redis.NilReply || len(r.Elems) == 0 {
+		return nil, nil
+	}
+
+	s := r.Elems[0]
+	if len(s.Elems) != 2 {
+		return nil, fmt.Errorf("unexpected stream reply %s", r)
+	}
+	return parseStreamEntries(s.Elems[1])
+}
+
+// parseStreamEntries reads a list of [id, [field, value, ...]] entries, as
+// replied by XRANGE and inside XREAD.
+func parseStreamEntries(r *redis.Reply) ([]*StreamEntry, error) {
+	entries := []*StreamEntry{}
+	for _, e := range r.Elems {
+		if len(e.Elems) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry %s", e)
+		}
+
+		id, err := e.Elems[0].Str()
+		if err != nil {
+			return nil, err
+		}
+
+		// entries already trimmed from the stream are still listed as
+		// pending, without fields.
+		if e.Elems[1].Type == redis.NilReply {
+			entries = append(entries, &StreamEntry{ID: id, Change: &Change{}})
+			continue
+		}
+
+		h, err := e.Elems[1].Hash()
+		if err != nil {
+			return nil, err
+		}
+
+		ts, _ := strconv.ParseInt(h["timestamp"], 10, 64)
+		entries = append(entries, &StreamEntry{
+			ID: id,
+			Change: &Change{
+				Tag:       h["tag"],
+				Prop:      h["prop"],
+				Value:     h["value"],
+				Timestamp: ts,
+			},
+		})
+	}
+	return entries, nil
+}
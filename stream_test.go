@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamConsumerPending(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	log := changeLog("@s")
+	for _, v := range []string{"1", "2"} {
+		conn.Multi()
+		addChange(conn, log, &Change{Tag: "@s:a", Prop: "value", Value: v})
+		if _, err := conn.Exec(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := func(c *StreamConsumer) []string {
+		entries, err := c.Read(10, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := []string{}
+		for _, e := range entries {
+			values = append(values, e.Change.Value.(string))
+		}
+		return values
+	}
+	c, err := NewStreamConsumer(conn, log, "g", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { c.Close() }()
+	entries, err := c.Read(10, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected both entries, got %v", entries)
+	}
+	c.Ack(entries[0].ID)
+	if v := read(c); len(v) != 0 {
+		t.Fatalf("Expected no new entries, got %v", v)
+	}
+
+	// a restarted consumer reads the pending entry once, then new ones.
+	for i := 0; i < maxDeliveries-1; i++ {
+		c.Close()
+		c, _ = NewStreamConsumer(conn, log, "g", "c1")
+		if v := read(c); len(v) != 1 || v[0] != "2" {
+			t.Fatalf("Expected the pending entry, got %v", v)
+		}
+		if v := read(c); len(v) != 0 {
+			t.Fatalf("Expected the pending entry once, got %v", v)
+		}
+	}
+
+	// past MaxDeliveries, it's acknowledged and skipped.
+	c.Close()
+	c, _ = NewStreamConsumer(conn, log, "g", "c1")
+	if v := read(c); len(v) != 0 {
+		t.Fatalf("Expected the entry to be dropped, got %v", v)
+	}
+	p, err := conn.Xpending(log, "g", "-", "+", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Elems) != 0 {
+		t.Errorf("Expected no pending entries, got %d", len(p.Elems))
+	}
+}
+
+func TestTrimChanges(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	log := changeLog("@s")
+	add := func(n int) {
+		for i := 0; i < n; i++ {
+			conn.Multi()
+			addChange(conn, log, &Change{Tag: "@s:a", Prop: "value", Value: i})
+			if _, err := conn.Exec(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	length := func() int64 {
+		n, err := conn.cmd("xlen", log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i, _ := n.Int64()
+		return i
+	}
+
+	// without groups, the log is trimmed to its newest entries.
+	add(10)
+	if n, err := TrimChanges(conn, log, 4); err != nil || n != 6 || length() != 4 {
+		t.Fatalf("Expected 6 entries trimmed and 4 left, got %d, %d, %v", n, length(), err)
+	}
+
+	// a group holding an entry pending keeps it and every later one.
+	c, err := NewStreamConsumer(conn, log, "g", "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	entries, err := c.Read(2, 10*time.Millisecond)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %v, %v", entries, err)
+	}
+	c.Ack(entries[1].ID)
+	add(4)
+	if n, err := TrimChanges(conn, log, 2); err != nil || n != 0 || length() != 8 {
+		t.Fatalf("Expected nothing trimmed past the pending entry, got %d, %d, %v", n, length(), err)
+	}
+
+	// once acknowledged, entries up to the first unread one are trimmed.
+	c.Ack(entries[0].ID)
+	if n, err := TrimChanges(conn, log, 2); err != nil || n != 1 || length() != 7 {
+		t.Fatalf("Expected 1 entry trimmed, up to the last delivered, got %d, %d, %v", n, length(), err)
+	}
+	if n, err := TrimChanges(conn, log, 0); err != nil || n != 0 {
+		t.Errorf("Expected no trimming with maxLen 0, got %d, %v", n, err)
+	}
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/fzzy/radix/redis"
+	"io"
 	"log"
-	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,15 +19,28 @@ type Tagger interface {
 	Set(Tag string, prop string, args ...interface{}) error
 }
 
+// propsSetter is implemented by taggers writing several properties at once,
+// all of them or none.
+type propsSetter interface {
+	SetProps(tag string, props map[string]interface{}) error
+}
+
 // tag manager -----------------------------------------------------------------
 
+// TagManager holds taggers under a common key prefix. Tags and index are
+// changed by reloads while the API and the services read them, so they're
+// only accessed under mu once the manager is in use.
 type TagManager struct {
-	Name string
-	Tags []Tagger
+	Name   string
+	Mode   ChangeMode
+	Tags   []Tagger
+	index  map[string]Tagger
+	closed int32
+	mu     sync.RWMutex
 }
 
 func (t *TagManager) String() string {
-	return fmt.Sprintf("TagManager{Name: %s, Tags#len: %d}", t.Name, len(t.Tags))
+	return fmt.Sprintf("TagManager{Name: %s, Tags#len: %d}", t.Name, t.Len())
 }
 
 func (t *TagManager) Init() error {
@@ -35,7 +52,7 @@ func (t *TagManager) Get(tag string, prop string) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
-	return concreteGetProp(c, prop)
+	return getProp(c, prop)
 }
 
 func (t *TagManager) Set(tag string, prop string, args ...interface{}) error {
@@ -43,44 +60,313 @@ func (t *TagManager) Set(tag string, prop string, args ...interface{}) error {
 	if err != nil {
 		return err
 	}
-	return concreteSetProp(c, prop, args)
+	return c.Set(nameOf(c), prop, args...)
+}
+
+// SetProps writes several properties of tag, in a single transaction when the
+// tagger supports it, and in name order otherwise.
+func (t *TagManager) SetProps(tag string, props map[string]interface{}) error {
+	c, err := t.getTag(tag)
+	if err != nil {
+		return err
+	}
+	return setProps(c, props)
 }
 
-func (t *TagManager) Append(tag Tagger) {
+// Append puts tag under the manager, prefixing its name with the one of the
+// manager, and initializes it. Managers are appended before their own tags, so
+// keys are prefixed at every level; a manager already holding tags is refused,
+// as is a tagger named as one already under the manager.
+func (t *TagManager) Append(tag Tagger) error {
+	if m, ok := tag.(*TagManager); ok && m.Len() > 0 {
+		return fmt.Errorf(
+			"could not append %s into %s: append managers before their tags, so keys are prefixed at every level",
+			m,
+			t,
+		)
+	}
+	if n := fmt.Sprintf("%s:%s", t.Name, nameOf(tag)); t.indexed(n) != nil {
+		return fmt.Errorf("Tag %s already exists.", n)
+	}
+
 	t.updateChildTagName(tag)
-	err := concreteCallMethod(tag, "Init")
+	if n, ok := tag.(changeNotifier); ok {
+		n.notifyOn(t.Mode, changeTarget(t.Mode, t.Name))
+	}
+	if err := tag.Init(); err != nil {
+		return fmt.Errorf("could not initialize tagger %s: %s", tag, err)
+	}
+	t.add(tag)
+	return nil
+}
+
+// Remove takes the named tagger out of the manager, stopping it when it
+// implements io.Closer.
+func (t *TagManager) Remove(name string) error {
+	c, err := t.getTag(name)
 	if err != nil {
-		log.Printf("could not initialize tagger %s: %s\n", t, err)
-	} else {
-		t.Tags = append(t.Tags, tag)
+		return err
+	}
+	m := t.owner(c)
+	if m == nil {
+		return fmt.Errorf("Tag %s not found.", name)
+	}
+
+	m.mu.Lock()
+	for i, e := range m.Tags {
+		if e == c {
+			m.Tags = append(m.Tags[:i], m.Tags[i+1:]...)
+			break
+		}
 	}
+	delete(m.index, nameOf(c))
+	m.mu.Unlock()
+
+	if cl, ok := c.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
 }
 
-func (t *TagManager) getTag(tag string) (Tagger, error) {
-	for _, c := range t.Tags {
-		if !concreteNameIs(c, tag) {
+// Rename gives the named tagger the name to inside its manager. Tags are
+// initialized again under the new name and their old keys are deleted.
+func (t *TagManager) Rename(name string, to string) error {
+	c, err := t.getTag(name)
+	if err != nil {
+		return err
+	}
+	m := t.owner(c)
+	if m == nil {
+		return fmt.Errorf("Tag %s not found.", name)
+	}
+
+	old := nameOf(c)
+	n := fmt.Sprintf("%s:%s", m.Name, to)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.index[n]; ok {
+		return fmt.Errorf("Tag %s already exists.", n)
+	}
+	if cm, ok := c.(*TagManager); ok && cm.Len() > 0 {
+		return fmt.Errorf("Manager %s is not empty.", old)
+	}
+
+	if tag, ok := c.(*Tag); ok {
+		if err := tag.rename(n); err != nil {
+			return err
+		}
+	} else if err := setProp(c, "Name", n); err != nil {
+		return err
+	}
+
+	delete(m.index, old)
+	m.indexTag(c)
+	return nil
+}
+
+// Len returns the number of taggers directly under the manager.
+func (t *TagManager) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.Tags)
+}
+
+// Each calls fn for the taggers directly under the manager, in the order they
+// were appended. Each stops at the first error returned by fn.
+func (t *TagManager) Each(fn func(tag Tagger) error) error {
+	for _, c := range t.tags() {
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the taggers of the manager. Closed managers are left out of
+// their template instances.
+func (t *TagManager) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	for _, c := range t.tags() {
+		if cl, ok := c.(io.Closer); ok {
+			cl.Close()
+		}
+	}
+	return nil
+}
+
+func (t *TagManager) isClosed() bool {
+	return atomic.LoadInt32(&t.closed) == 1
+}
+
+// Path returns the slash separated address of the manager, such as
+// plant1/area2/@pressure.
+func (t *TagManager) Path() string {
+	return keyPath(t.Name)
+}
+
+// Lookup finds a tagger by its path relative to the manager, such as
+// area2/@pressure/tank-3.
+func (t *TagManager) Lookup(path string) (Tagger, error) {
+	var c Tagger = t
+	for _, n := range strings.Split(strings.Trim(path, "/"), "/") {
+		if n == "" {
 			continue
 		}
+		m, ok := c.(*TagManager)
+		if !ok {
+			return nil, fmt.Errorf("Tag %s not found.", path)
+		}
+		c = m.child(n)
+		if c == nil {
+			return nil, fmt.Errorf("Tag %s not found.", path)
+		}
+	}
+	return c, nil
+}
+
+// Children lists the taggers directly under path, relative to the manager.
+func (t *TagManager) Children(path string) ([]Tagger, error) {
+	c, err := t.Lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := c.(*TagManager)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a tag manager.", path)
+	}
+	return m.tags(), nil
+}
+
+// Walk calls fn for every tagger under the manager, depth first, with its path
+// relative to the manager. Walk stops at the first error returned by fn.
+func (t *TagManager) Walk(fn func(path string, tag Tagger) error) error {
+	for _, c := range t.tags() {
+		p := t.localName(c)
+		if err := fn(p, c); err != nil {
+			return err
+		}
+		m, ok := c.(*TagManager)
+		if !ok {
+			continue
+		}
+		err := m.Walk(func(path string, tag Tagger) error {
+			return fn(p+"/"+path, tag)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TagManager) getTag(tag string) (Tagger, error) {
+	if strings.Contains(tag, "/") {
+		return t.Lookup(tag)
+	}
+	if c := t.indexed(tag); c != nil {
 		return c, nil
 	}
+	for i := len(t.Name) + 1; i < len(tag); i++ {
+		if tag[i] != ':' {
+			continue
+		}
+		if m, ok := t.indexed(tag[:i]).(*TagManager); ok {
+			return m.getTag(tag)
+		}
+	}
 	return nil, fmt.Errorf("Tag %s not found.", tag)
 }
 
+func (t *TagManager) child(name string) Tagger {
+	return t.indexed(fmt.Sprintf("%s:%s", t.Name, name))
+}
+
+func (t *TagManager) indexed(name string) Tagger {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.index[name]
+}
+
+// tags returns a copy of the taggers directly under the manager, safe to
+// range over while they're appended or removed.
+func (t *TagManager) tags() []Tagger {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return append([]Tagger(nil), t.Tags...)
+}
+
+// add puts tag, already initialized, under the manager.
+func (t *TagManager) add(tag Tagger) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Tags = append(t.Tags, tag)
+	t.indexTag(tag)
+}
+
+// owner returns the manager, at any level under t, holding tag.
+func (t *TagManager) owner(tag Tagger) *TagManager {
+	n := nameOf(tag)
+	i := strings.LastIndex(n, ":")
+	if i < 0 {
+		return nil
+	}
+	if n[:i] == t.Name {
+		return t
+	}
+	c, err := t.getTag(n[:i])
+	if err != nil {
+		return nil
+	}
+	m, _ := c.(*TagManager)
+	return m
+}
+
+func (t *TagManager) indexTag(tag Tagger) {
+	if t.index == nil {
+		t.index = map[string]Tagger{}
+	}
+	t.index[nameOf(tag)] = tag
+}
+
+func (t *TagManager) localName(tag Tagger) string {
+	return strings.TrimPrefix(nameOf(tag), t.Name+":")
+}
+
 func (t *TagManager) updateChildTagName(tag Tagger) {
-	n, _ := concreteGetProp(tag, "Name")
-	concreteSetProp(tag, "Name", fmt.Sprintf("%s:%s", t.Name, n))
+	setProp(tag, "Name", fmt.Sprintf("%s:%s", t.Name, nameOf(tag)))
 }
 
 func NewTagManager(name string) *TagManager {
-	return &TagManager{Name: name}
+	return &TagManager{Name: name, index: map[string]Tagger{}}
+}
+
+var managerSchema = mustRegisterSchema(
+	&TagManager{},
+	&Property{
+		Name: "Name",
+		Type: StringProp,
+		Key:  "name",
+		Get:  func(t Tagger) interface{} { return t.(*TagManager).Name },
+		Set:  func(t Tagger, v interface{}) { t.(*TagManager).Name = v.(string) },
+	},
+)
+
+// keyPath turns a redis key prefix into a tag path.
+func keyPath(key string) string {
+	return strings.Replace(key, ":", "/", -1)
 }
 
 // vector ----------------------------------------------------------------------
 
+// Vector groups tags of a manager, or tags by name when it has no manager.
+// Mode is then how its members propagate their changes.
 type Vector struct {
-	conn *Client
-	Name string
-	Tags []string
+	conn    *Client
+	Name    string
+	Mode    ChangeMode
+	Tags    []string
+	manager *TagManager
+	query   *Query
 }
 
 func (v *Vector) String() string {
@@ -95,22 +381,49 @@ func (v *Vector) Get(tag string, prop string) (interface{}, error) {
 	return v.conn.Get(v.key(tag, prop))
 }
 
+// Set writes prop, named or given by its key, of the member tag, through the
+// manager when the vector has one, and otherwise propagated as Mode tells.
 func (v *Vector) Set(tag string, prop string, args ...interface{}) error {
-	_, err := v.conn.Set(v.key(tag, prop), args)
-	return err
+	if len(args) != 1 {
+		return fmt.Errorf("%s property takes a single value, got %d.", prop, len(args))
+	}
+	if v.manager != nil {
+		return v.manager.Set(tag, prop, args[0])
+	}
+	p, c, err := coerceEditable(prop, args[0])
+	if err != nil {
+		return err
+	}
+	return writeUpdates(v.conn, newUpdate(v.Mode, changeTarget(v.Mode, managerName(tag)), tag, p, c))
 }
 
 func (v *Vector) Append(tag Tagger) {
-	n, err := concreteGetProp(tag, "Name")
-	if err != nil {
+	n := nameOf(tag)
+	if n == "" {
 		log.Printf("Could not append %s into vector %s\n", tag, v.Name)
 	} else {
-		if d, ok := n.(string); ok {
-			v.Tags = append(v.Tags, d)
-		} else {
-			log.Printf("Tag %s has improper name %s", tag, n)
+		v.Tags = append(v.Tags, n)
+	}
+}
+
+// Refresh replaces the vector tags with the ones matching its query, when it
+// was built by TagManager.FindVector.
+func (v *Vector) Refresh() error {
+	if v.manager == nil || v.query == nil {
+		return nil
+	}
+	found, err := v.manager.Find(v.query)
+	if err != nil {
+		return err
+	}
+	v.Tags = []string{}
+	for _, tag := range found {
+		if _, ok := tag.(*TagManager); ok {
+			continue
 		}
+		v.Append(tag)
 	}
+	return nil
 }
 
 func (v *Vector) key(tag string, prop string) string {
@@ -125,19 +438,51 @@ func NewVector(name string, conn *Client, args ...string) *Vector {
 	}
 }
 
+var vectorSchema = mustRegisterSchema(
+	&Vector{},
+	&Property{
+		Name: "Name",
+		Type: StringProp,
+		Key:  "name",
+		Get:  func(t Tagger) interface{} { return t.(*Vector).Name },
+		Set:  func(t Tagger, v interface{}) { t.(*Vector).Name = v.(string) },
+	},
+)
+
 // tag -------------------------------------------------------------------------
 
+// Quality bounds, a tag is good when its quality is QualityGood.
+const (
+	QualityBad  = 0
+	QualityGood = 100
+)
+
+// isBad tells whether the quality q is bad, which is anything short of
+// QualityGood, for queries and aggregates alike.
+func isBad(q int) bool {
+	return q < QualityGood
+}
+
+// Tag mirrors a tag stored in redis. Its properties are written by the
+// dispatcher of its manager while the API and the services read them, so
+// they're only accessed through the tag schema, under mu.
 type Tag struct {
 	conn        *Client
-	psconn      *PSClient
 	Name        string
 	Description string
 	Value       int
 	Quality     int
 	Timestamp   int64
+	Meta        map[string]string
+	mode        ChangeMode
+	channel     string
+	dispatch    *dispatcher
+	mu          sync.RWMutex
 }
 
 func (t *Tag) String() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return fmt.Sprintf(
 		"Tag{Name: %s, Description: %s, Value: %d, Quality: %d, Timestamp: %d}",
 		t.Name,
@@ -148,182 +493,381 @@ func (t *Tag) String() string {
 	)
 }
 
+// Init stores the tag and mirrors its later changes, received by the
+// dispatcher of its manager.
 func (t *Tag) Init() error {
-	t.conn.Multi()
-	t.conn.Add("set", t.key(t.Name, "name"), t.Name)
-	t.conn.Add("set", t.key(t.Name, "description"), t.Description)
-	t.conn.Add("set", t.key(t.Name, "value"), t.Value)
-	t.conn.Add("set", t.key(t.Name, "quality"), t.Quality)
-	t.conn.Add("set", t.key(t.Name, "timestamp"), t.Timestamp)
-	_, err := t.conn.Exec()
-	if err == nil {
-		t.auto()
+	if err := t.store(); err != nil {
+		return err
 	}
-	return err
+	d, err := subscribe(t)
+	if err != nil {
+		return err
+	}
+	t.dispatch = d
+	return nil
+}
+
+// Close stops mirroring the tag from redis.
+func (t *Tag) Close() error {
+	if t.dispatch != nil {
+		t.dispatch.unsubscribe(t)
+		t.dispatch = nil
+	}
+	return nil
 }
 
 func (t *Tag) Get(tag string, prop string) (interface{}, error) {
-	return t.conn.Get(fmt.Sprintf("%s:%s", tag, prop))
+	if p, err := tagSchema.Lookup(prop); err == nil {
+		prop = p.Key
+	}
+	return t.conn.Get(t.key(tag, prop))
 }
 
 func (t *Tag) Set(tag string, prop string, args ...interface{}) error {
-	if prop == "Timestamp" || prop == "Name" {
-		return fmt.Errorf("%s property is not user editable.", prop)
+	if len(args) != 1 {
+		return fmt.Errorf("%s property takes a single value, got %d.", prop, len(args))
 	}
-	return t.update(tag, prop, args)
+	return t.SetProps(tag, map[string]interface{}{prop: args[0]})
+}
+
+// SetProps writes several properties in a single transaction, after checking
+// every one of them, so either all are written or none is.
+func (t *Tag) SetProps(tag string, props map[string]interface{}) error {
+	defer updateLatency.Since("", time.Now())
+	names := make([]string, 0, len(props))
+	for prop := range props {
+		names = append(names, prop)
+	}
+	sort.Strings(names)
+
+	updates := make([]*update, len(names))
+	for i, prop := range names {
+		p, err := tagSchema.Lookup(prop)
+		if err != nil {
+			return err
+		}
+		if !p.Editable {
+			return fmt.Errorf("%s property is not user editable.", prop)
+		}
+		v, err := p.Coerce(props[prop])
+		if err != nil {
+			return err
+		}
+		updates[i] = newUpdate(t.mode, t.channel, tag, p, v)
+	}
+	return writeUpdates(t.conn, updates...)
 }
 
 func (t *Tag) key(tag string, prop string) string {
 	return fmt.Sprintf("%s:%s", tag, prop)
 }
 
-func (t *Tag) update(tag string, prop string, args ...interface{}) error {
-	now := ts()
+func (t *Tag) keys(tag string) []interface{} {
+	keys := make([]interface{}, len(tagSchema.Props))
+	for i, p := range tagSchema.Props {
+		keys[i] = t.key(tag, p.Key)
+	}
+	return keys
+}
 
+// store writes every property of the tag into redis.
+func (t *Tag) store() error {
+	name := nameOf(t)
 	t.conn.Multi()
-	t.conn.Add("set", t.key(tag, strings.ToLower(prop)), args)
-	t.conn.Add("set", t.key(tag, "timestamp"), now)
+	for _, p := range tagSchema.Props {
+		t.conn.Add("set", t.key(name, p.Key), p.Encode(p.Get(t)))
+	}
 	_, err := t.conn.Exec()
+	return err
+}
 
-	if err != nil {
-		return err
+// LoadTag reads the tag called name from redis, in a single round trip. The
+// tag is not initialized, so it doesn't mirror later changes.
+func LoadTag(conn *Client, name string) (*Tag, error) {
+	t := &Tag{conn: conn, Name: name, Meta: map[string]string{}}
+	if err := t.load(name); err != nil {
+		return nil, err
 	}
-
-	return nil
+	return t, nil
 }
 
-func (t *Tag) auto() {
-	go func() {
-		converter := func(prop string, v *redis.Reply) (interface{}, error) {
-			switch prop {
-			case "Value", "Quality":
-				return v.Int()
-			case "Timestamp":
-				return v.Int64()
-			case "Name", "Description":
-				return v.Str()
-			}
-			return nil, fmt.Errorf("Missing case for prop %s\n", prop)
-		}
+// load reads every property of the tag called name from redis.
+func (t *Tag) load(name string) error {
+	return t.loadSchema(t, tagSchema, name)
+}
 
-		wait := 500 * time.Millisecond
+// loadSchema reads every property of s of the tag called name into tagger,
+// which is t or embeds it.
+func (t *Tag) loadSchema(tagger Tagger, s *Schema, name string) error {
+	keys := make([]interface{}, len(s.Props))
+	for i, p := range s.Props {
+		keys[i] = t.key(name, p.Key)
+	}
+	r, err := t.conn.Mget(keys...)
+	if err != nil {
+		return err
+	}
+	if len(r.Elems) != len(s.Props) {
+		return fmt.Errorf("unexpected reply reading %s", name)
+	}
+	if r.Elems[0].Type == redis.NilReply {
+		return fmt.Errorf("Tag %s not found.", name)
+	}
 
-		errHandler := func(msg string, args ...interface{}) {
-			log.Printf(msg, args...)
-			time.Sleep(wait)
+	for i, p := range s.Props {
+		if r.Elems[i].Type == redis.NilReply {
+			continue
 		}
-
-		t.psconn.PSubscribe(fmt.Sprintf("__keyspace@0__:%s", t.key(t.Name, "*")))
-		for {
-			sub := t.psconn.Receive()
-			if sub.Timeout() {
-				errHandler("Timedout when receiving update for %s.\n", t.Name)
-				continue
-			}
-
-			s := strings.Split(strings.SplitN(sub.Channel, ":", 2)[1], ":")
-			k, p := strings.Join(s[:2], ":"), strings.Title(s[2])
-			v, err := t.conn.Get(strings.Join(s, ":"))
-			if err != nil {
-				errHandler("Couldn't get value for key:\n", strings.Join(s, ":"))
-				continue
-			}
-
-			cv, err := converter(p, v)
-			if err != nil {
-				errHandler("Error during convertion: %s\n", err)
-				continue
-			}
-
-			err = concreteSetProp(t, p, cv)
-			if err != nil {
-				errHandler("Couldn't set property %s to value %s in %s\n", p, v.String(), k)
-				continue
-			}
-
-			time.Sleep(wait)
+		raw, _ := r.Elems[i].Str()
+		v, err := p.Coerce(raw)
+		if err != nil {
+			return fmt.Errorf("Couldn't set property %s in %s: %s", p.Name, name, err)
 		}
-	}()
+		p.Set(tagger, v)
+	}
+	return nil
 }
 
-func NewTag(conn *Client, psconn *PSClient, name string, description string, value int, quality int) *Tag {
-	t := &Tag{
-		conn:        conn,
-		psconn:      psconn,
-		Name:        name,
-		Description: description,
-		Value:       value,
-		Quality:     quality,
-		Timestamp:   ts(),
+func (t *Tag) rename(name string) error {
+	old := nameOf(t)
+	t.Close()
+	setProp(t, "Name", name)
+	if err := t.Init(); err != nil {
+		return err
 	}
+	_, err := t.conn.cmd("del", t.keys(old)...)
+	return err
+}
 
-	return t
+func (t *Tag) notifyOn(mode ChangeMode, channel string) {
+	t.mode = mode
+	t.channel = channel
 }
 
-func ts() int64 {
-	return time.Now().UTC().Unix()
+func (t *Tag) update(tag string, p *Property, v interface{}) error {
+	defer updateLatency.Since("", time.Now())
+	return writeUpdates(t.conn, newUpdate(t.mode, t.channel, tag, p, v))
 }
 
-// reflection utilities --------------------------------------------------------
+// update is the write of a property of a tag, propagated on channel as mode
+// tells.
+type update struct {
+	mode    ChangeMode
+	channel string
+	change  *Change
+}
 
-func concrete(t Tagger) reflect.Value {
-	return reflect.ValueOf(t).Elem()
+func newUpdate(mode ChangeMode, channel string, tag string, p *Property, v interface{}) *update {
+	return &update{
+		mode:    mode,
+		channel: channel,
+		change:  &Change{Tag: tag, Prop: p.Key, Value: p.Encode(v), Timestamp: ts()},
+	}
 }
 
-func concreteNameIs(t Tagger, name string) bool {
-	v, err := concreteGetProp(t, "Name")
+// writeUpdates writes every update, with the timestamp of its tag, in a
+// single transaction. Changes are appended to their log inside it in
+// StreamChanges, and published once it succeeded in PublishChanges.
+func writeUpdates(conn *Client, updates ...*update) error {
+	conn.Multi()
+	for _, u := range updates {
+		c := u.change
+		conn.Add("set", fmt.Sprintf("%s:%s", c.Tag, c.Prop), c.Value)
+		conn.Add("set", fmt.Sprintf("%s:timestamp", c.Tag), c.Timestamp)
+		if u.mode == StreamChanges {
+			addChange(conn, u.channel, c)
+		}
+	}
+	r, err := conn.Exec()
 	if err != nil {
-		return false
+		return err
+	}
+	for _, e := range r.Elems {
+		if e.Err != nil {
+			return e.Err
+		}
+	}
+
+	for _, u := range updates {
+		if u.mode != PublishChanges {
+			continue
+		}
+		msg, err := encodeChange(u.change)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Publish(u.channel, msg); err != nil {
+			return err
+		}
 	}
-	return v == name
+	return nil
 }
 
-func concreteGetProp(t Tagger, prop string) (interface{}, error) {
-	r := concrete(t)
-	v := r.FieldByName(prop)
-	if v.Kind() == reflect.Invalid {
-		return nil, fmt.Errorf("prop %s do not exist in %s", v, r)
+func (t *Tag) applyChange(c *Change) error {
+	if c.Tag != nameOf(t) {
+		return nil
+	}
+	if err := t.apply(c.Tag, c.Prop, fmt.Sprint(c.Value)); err != nil {
+		return err
 	}
-	return v.Interface(), nil
+	return t.apply(c.Tag, "timestamp", fmt.Sprint(c.Timestamp))
 }
 
-func concreteSetProp(t Tagger, prop string, arg interface{}) error {
-	r := concrete(t)
-	v := r.FieldByName(prop)
+// apply mirrors the value raw, read from the redis key suffix key, into the
+// tag property stored under it.
+func (t *Tag) apply(tag string, key string, raw string) error {
+	p, err := tagSchema.ByKey(key)
+	if err != nil {
+		return err
+	}
 
-	if v.Kind() == reflect.Invalid {
-		return fmt.Errorf("prop %s do not exist in %s", v, r)
+	v, err := p.Coerce(raw)
+	if err != nil {
+		return fmt.Errorf("Couldn't set property %s in %s: %s", p.Name, tag, err)
 	}
 
-	nv := reflect.ValueOf(arg)
-	if nv.Kind() != v.Kind() {
-		return fmt.Errorf(
-			"prop %s if of type %s, can't receive value of type %s",
-			prop,
-			v.Kind(),
-			nv.Kind(),
-		)
+	p.Set(t, v)
+	return nil
+}
+
+const autoWait = 500 * time.Millisecond
+
+func encodeMeta(m map[string]string) string {
+	if m == nil {
+		m = map[string]string{}
+	}
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+func decodeMeta(raw string) (map[string]string, error) {
+	m := map[string]string{}
+	if raw == "" {
+		return m, nil
+	}
+	err := json.Unmarshal([]byte(raw), &m)
+	return m, err
+}
+
+var tagSchema = mustRegisterSchema(
+	&Tag{},
+	&Property{
+		Name: "Name",
+		Type: StringProp,
+		Key:  "name",
+		Get:  tagGetter(func(t *Tag) interface{} { return t.Name }),
+		Set:  tagSetter(func(t *Tag, v interface{}) { t.Name = v.(string) }),
+	},
+	&Property{
+		Name:     "Description",
+		Type:     StringProp,
+		Key:      "description",
+		Editable: true,
+		Get:      tagGetter(func(t *Tag) interface{} { return t.Description }),
+		Set:      tagSetter(func(t *Tag, v interface{}) { t.Description = v.(string) }),
+	},
+	&Property{
+		Name:     "Value",
+		Type:     IntProp,
+		Key:      "value",
+		Editable: true,
+		Get:      tagGetter(func(t *Tag) interface{} { return t.Value }),
+		Set:      tagSetter(func(t *Tag, v interface{}) { t.Value = v.(int) }),
+	},
+	&Property{
+		Name:     "Quality",
+		Type:     IntProp,
+		Key:      "quality",
+		Editable: true,
+		Validate: validateQuality,
+		Get:      tagGetter(func(t *Tag) interface{} { return t.Quality }),
+		Set:      tagSetter(func(t *Tag, v interface{}) { t.Quality = v.(int) }),
+	},
+	&Property{
+		Name: "Timestamp",
+		Type: Int64Prop,
+		Key:  "timestamp",
+		Get:  tagGetter(func(t *Tag) interface{} { return t.Timestamp }),
+		Set:  tagSetter(func(t *Tag, v interface{}) { t.Timestamp = v.(int64) }),
+	},
+	&Property{
+		Name:     "Meta",
+		Type:     MetaProp,
+		Key:      "meta",
+		Editable: true,
+		Get:      tagGetter(func(t *Tag) interface{} { return t.Meta }),
+		Set:      tagSetter(func(t *Tag, v interface{}) { t.Meta = v.(map[string]string) }),
+	},
+)
+
+// tagGetter reads a property of a tag under its lock.
+func tagGetter(get func(t *Tag) interface{}) func(t Tagger) interface{} {
+	return func(t Tagger) interface{} {
+		tag := t.(*Tag)
+		tag.mu.RLock()
+		defer tag.mu.RUnlock()
+		return get(tag)
 	}
+}
 
-	switch v.Kind() {
-	case reflect.Int:
-		v.SetInt(nv.Int())
-	case reflect.String:
-		v.SetString(nv.String())
+// tagSetter writes a property of a tag under its lock.
+func tagSetter(set func(t *Tag, v interface{})) func(t Tagger, v interface{}) {
+	return func(t Tagger, v interface{}) {
+		tag := t.(*Tag)
+		tag.mu.Lock()
+		defer tag.mu.Unlock()
+		set(tag, v)
 	}
+}
 
+func validateQuality(v interface{}) error {
+	if q := v.(int); q < QualityBad || q > QualityGood {
+		return fmt.Errorf("quality must be between %d and %d", QualityBad, QualityGood)
+	}
 	return nil
 }
 
-func concreteCallMethod(t Tagger, method string) error {
-	r := reflect.ValueOf(t)
-	f := r.MethodByName(method)
-	if f.Kind() == reflect.Invalid {
-		return fmt.Errorf("method %s do not exist in %s", f, r)
+func NewTag(conn *Client, name string, description string, value int, quality int) *Tag {
+	t := &Tag{
+		conn:        conn,
+		Name:        name,
+		Description: description,
+		Value:       value,
+		Quality:     quality,
+		Timestamp:   ts(),
+		Meta:        map[string]string{},
+	}
+
+	return t
+}
+
+// setProps writes props into tag, through SetProps when it has it.
+func setProps(tag Tagger, props map[string]interface{}) error {
+	if s, ok := tag.(propsSetter); ok {
+		return s.SetProps(nameOf(tag), props)
+	}
+	names := make([]string, 0, len(props))
+	for prop := range props {
+		names = append(names, prop)
 	}
-	v := f.Call([]reflect.Value{})
-	if len(v) >= 1 && !v[len(v)-1].IsNil() {
-		return fmt.Errorf(v[len(v)-1].String())
+	sort.Strings(names)
+	for _, prop := range names {
+		if err := tag.Set(nameOf(tag), prop, props[prop]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+func stopped(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+func ts() int64 {
+	return time.Now().UTC().Unix()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// benchManager builds a manager holding n taggers, spread over areas of 1000.
+// Vectors are used as tags, as they don't touch redis on Init.
+func benchManager(n int) *TagManager {
+	tm := NewTagManager("@bench")
+	var area *TagManager
+	for i := 0; i < n; i++ {
+		if i%1000 == 0 {
+			area = NewTagManager(fmt.Sprintf("area%d", i/1000))
+			tm.Append(area)
+		}
+		area.Append(NewVector(fmt.Sprintf("tag%d", i), nil))
+	}
+	return tm
+}
+
+func benchmarkAppend(b *testing.B, n int) {
+	for i := 0; i < b.N; i++ {
+		benchManager(n)
+	}
+}
+
+func BenchmarkAppend10k(b *testing.B)  { benchmarkAppend(b, 10000) }
+func BenchmarkAppend100k(b *testing.B) { benchmarkAppend(b, 100000) }
+
+func benchmarkGet(b *testing.B, n int) {
+	tm := benchManager(n)
+	names := make([]string, 1000)
+	for i := range names {
+		j := i * n / len(names)
+		names[i] = fmt.Sprintf("@bench:area%d:tag%d", j/1000, j)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tm.getTag(names[i%len(names)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGet10k(b *testing.B)  { benchmarkGet(b, 10000) }
+func BenchmarkGet100k(b *testing.B) { benchmarkGet(b, 100000) }
+
+func benchmarkLookup(b *testing.B, n int) {
+	tm := benchManager(n)
+	paths := make([]string, 1000)
+	for i := range paths {
+		j := i * n / len(paths)
+		paths[i] = fmt.Sprintf("area%d/tag%d", j/1000, j)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tm.Lookup(paths[i%len(paths)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLookup10k(b *testing.B)  { benchmarkLookup(b, 10000) }
+func BenchmarkLookup100k(b *testing.B) { benchmarkLookup(b, 100000) }
+
+func TestLookup(t *testing.T) {
+	tm := benchManager(2500)
+
+	c, err := tm.Lookup("area2/tag2499")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := nameOf(c); n != "@bench:area2:tag2499" {
+		t.Errorf("Lookup found %s", n)
+	}
+	if _, err := tm.getTag("@bench:area1:tag1000"); err != nil {
+		t.Error(err)
+	}
+	if _, err := tm.getTag("@bench:area1:tag0"); err == nil {
+		t.Error("getTag found a tag of another area")
+	}
+}
+
+// TestTagApplyRace reads a tag while changes are applied to it, as the
+// dispatcher does, to be run with -race.
+func TestTagApplyRace(t *testing.T) {
+	tag := NewTag(nil, "@m:a", "", 0, QualityGood)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 100; i++ {
+			c := &Change{Tag: "@m:a", Prop: "value", Value: fmt.Sprint(i), Timestamp: int64(i)}
+			if err := tag.applyChange(c); err != nil {
+				t.Error(err)
+				return
+			}
+			tag.apply("@m:a", "meta", fmt.Sprintf(`{"n": "%d"}`, i))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		tagState(tag)
+		exportTag(tag, "a", nil)
+		_ = tag.String()
+	}
+	wg.Wait()
+
+	if v, _ := getProp(tag, "Value"); v != 100 {
+		t.Errorf("Expected value 100, got %v", v)
+	}
+	if ts, _ := getProp(tag, "Timestamp"); ts != int64(100) {
+		t.Errorf("Expected timestamp 100, got %v", ts)
+	}
+}
+
+// plantManager builds plant1/area2/@pressure holding tank-0 to tank-2, and
+// plant1/area2/flow.
+func plantManager() *TagManager {
+	plant := NewTagManager("plant1")
+	area := NewTagManager("area2")
+	plant.Append(area)
+	pressure := NewTagManager("@pressure")
+	area.Append(pressure)
+	for i := 0; i < 3; i++ {
+		pressure.Append(NewVector(fmt.Sprintf("tank-%d", i), nil))
+	}
+	area.Append(NewVector("flow", nil))
+	return plant
+}
+
+func TestNestedPaths(t *testing.T) {
+	plant := plantManager()
+
+	for _, c := range []struct {
+		path string
+		name string
+	}{
+		{"area2", "plant1:area2"},
+		{"area2/@pressure", "plant1:area2:@pressure"},
+		{"/area2/@pressure/tank-2/", "plant1:area2:@pressure:tank-2"},
+		{"area2/flow", "plant1:area2:flow"},
+		{"", "plant1"},
+	} {
+		tag, err := plant.Lookup(c.path)
+		if err != nil {
+			t.Errorf("Lookup %s: %s", c.path, err)
+			continue
+		}
+		if n := nameOf(tag); n != c.name {
+			t.Errorf("Lookup %s found %s, want %s", c.path, n, c.name)
+		}
+		if tag, err := plant.getTag(c.name); c.path != "" && (err != nil || nameOf(tag) != c.name) {
+			t.Errorf("getTag %s found %v, %v", c.name, tag, err)
+		}
+	}
+	for _, path := range []string{"area1", "area2/@pressure/tank-3", "area2/flow/x"} {
+		if _, err := plant.Lookup(path); err == nil {
+			t.Errorf("Lookup %s found a tag", path)
+		}
+	}
+
+	pressure, _ := plant.Lookup("area2/@pressure")
+	if p := pressure.(*TagManager).Path(); p != "plant1/area2/@pressure" {
+		t.Errorf("Expected path plant1/area2/@pressure, got %s", p)
+	}
+	if v, err := plant.Get("area2/@pressure/tank-1", "Name"); err != nil || v != "plant1:area2:@pressure:tank-1" {
+		t.Errorf("Get by path read %v, %v", v, err)
+	}
+}
+
+func TestBrowse(t *testing.T) {
+	plant := plantManager()
+
+	children, err := plant.Children("area2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 || nameOf(children[0]) != "plant1:area2:@pressure" || nameOf(children[1]) != "plant1:area2:flow" {
+		t.Errorf("Unexpected children of area2 %v", children)
+	}
+	if _, err := plant.Children("area2/flow"); err == nil {
+		t.Error("Children of a tag didn't fail")
+	}
+
+	paths := []string{}
+	plant.Walk(func(path string, tag Tagger) error {
+		paths = append(paths, path)
+		return nil
+	})
+	expected := []string{
+		"area2",
+		"area2/@pressure",
+		"area2/@pressure/tank-0",
+		"area2/@pressure/tank-1",
+		"area2/@pressure/tank-2",
+		"area2/flow",
+	}
+	if fmt.Sprint(paths) != fmt.Sprint(expected) {
+		t.Errorf("Walk visited %v, want %v", paths, expected)
+	}
+
+	stop := fmt.Errorf("stop")
+	n := 0
+	err = plant.Walk(func(path string, tag Tagger) error {
+		if n++; path == "area2/@pressure/tank-0" {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Errorf("Walk returned %v after %d taggers, want stop after 3", err, n)
+	}
+}
+
+func TestAppendFilledManager(t *testing.T) {
+	plant := plantManager()
+	area := NewTagManager("area3")
+	area.Append(NewVector("flow", nil))
+	if err := plant.Append(area); err == nil {
+		t.Error("Expected an error appending a manager holding tags")
+	}
+	if _, err := plant.Lookup("area3"); err == nil {
+		t.Error("appended a manager holding tags")
+	}
+}
+
+func TestAppendDuplicate(t *testing.T) {
+	plant := plantManager()
+	area, _ := plant.Lookup("area2")
+	flow := NewVector("flow", nil)
+	if err := area.(*TagManager).Append(flow); err == nil {
+		t.Error("Expected an error appending a duplicate name")
+	}
+	if flow.Name != "flow" {
+		t.Errorf("Expected the refused tagger to keep its name, got %s", flow.Name)
+	}
+	if c, _ := plant.Lookup("area2/flow"); c == nil || c == flow {
+		t.Error("Expected the first tagger to stay indexed")
+	}
+}
+
+// TestSetByKey writes properties by their redis key, as value, as well as by
+// their name.
+func TestSetByKey(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	tm := NewTagManager("@k")
+	defer tm.Close()
+	tm.Append(NewTag(conn, "a", "", 0, QualityGood))
+
+	if err := tm.Set("@k:a", "value", 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.SetProps("@k:a", map[string]interface{}{"quality": 50, "Description": "tank"}); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"value": "7", "quality": "50", "description": "tank"} {
+		if v := r.get("@k:a:" + key); v != want {
+			t.Errorf("Expected %s %s, got %s", key, want, v)
+		}
+	}
+	if err := tm.Set("@k:a", "timestamp", 1); err == nil {
+		t.Error("Set wrote the timestamp by its key")
+	}
+
+	v := NewVector("v", conn, "@k:a")
+	if err := v.SetAll("value", 9); err != nil {
+		t.Fatal(err)
+	}
+	if v := r.get("@k:a:value"); v != "9" {
+		t.Errorf("Expected value 9 written by the vector, got %s", v)
+	}
+
+	c, err := NewCalcTag(conn, "c", "", "@k:a * 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("@k:c", "value", 1); err == nil {
+		t.Error("Set wrote the value of a calculated tag by its key")
+	}
+}
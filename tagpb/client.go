@@ -0,0 +1,216 @@
+package tagpb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// RemoteTagger is a Tagger backed by the Tagging service of a remote server,
+// so code written against a TagManager can run against another process. Tags
+// are addressed by path relative to the served manager, or by full name, and
+// Manager selects the root manager on servers serving several.
+type RemoteTagger struct {
+	Addr    string
+	Manager string
+	client  *http.Client
+}
+
+func (t *RemoteTagger) String() string {
+	return fmt.Sprintf("RemoteTagger{Addr: %s, Manager: %s}", t.Addr, t.Manager)
+}
+
+// Init checks the server answers.
+func (t *RemoteTagger) Init() error {
+	_, err := t.Browse("")
+	return err
+}
+
+func (t *RemoteTagger) Get(tag string, prop string) (interface{}, error) {
+	results, err := t.Read(tag)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) != 1 {
+		return nil, fmt.Errorf("unexpected reply reading %s", tag)
+	}
+	if results[0].Err != nil {
+		return nil, results[0].Err
+	}
+	v, ok := results[0].State.Props[prop]
+	if !ok {
+		return nil, fmt.Errorf("prop %s do not exist in %s", prop, tag)
+	}
+	return v, nil
+}
+
+func (t *RemoteTagger) Set(tag string, prop string, args ...interface{}) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%s property takes a single value, got %d.", prop, len(args))
+	}
+	results, err := t.Write(&PropWrite{tag, prop, args[0]})
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("unexpected reply writing %s", tag)
+	}
+	return results[0].Err
+}
+
+// Read returns the state of the tags at paths.
+func (t *RemoteTagger) Read(paths ...string) ([]*ReadResult, error) {
+	reply, err := t.call("Read", (&ReadRequest{paths}).Marshal())
+	if err != nil {
+		return nil, err
+	}
+	resp := &ReadResponse{}
+	err = resp.Unmarshal(reply)
+	return resp.Results, err
+}
+
+// Write writes every property, reporting the failure of each.
+func (t *RemoteTagger) Write(writes ...*PropWrite) ([]*WriteResult, error) {
+	reply, err := t.call("Write", (&WriteRequest{writes}).Marshal())
+	if err != nil {
+		return nil, err
+	}
+	resp := &WriteResponse{}
+	err = resp.Unmarshal(reply)
+	return resp.Results, err
+}
+
+// Browse returns the state of the children of the manager at path.
+func (t *RemoteTagger) Browse(path string) ([]*TagState, error) {
+	reply, err := t.call("Browse", (&BrowseRequest{path}).Marshal())
+	if err != nil {
+		return nil, err
+	}
+	resp := &BrowseResponse{}
+	err = resp.Unmarshal(reply)
+	return resp.Children, err
+}
+
+// Subscribe streams the changes of the tags selected by path in paths or by
+// glob in patterns, every tag when both are empty. With a throttle, changes
+// to a property in between events are merged.
+func (t *RemoteTagger) Subscribe(paths []string, patterns []string, throttle time.Duration) (*RemoteStream, error) {
+	req := &SubscribeRequest{Paths: paths, Patterns: patterns, Throttle: throttle}
+	resp, err := t.post("Subscribe", req.Marshal())
+	if err != nil {
+		return nil, err
+	}
+	msg, err := ReadMessage(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		if e := callStatus(resp); e != nil {
+			return nil, e
+		}
+		return nil, err
+	}
+
+	e := &Event{}
+	if err := e.Unmarshal(msg); err != nil || e.Change != nil {
+		resp.Body.Close()
+		if err == nil {
+			err = fmt.Errorf("expected a snapshot")
+		}
+		return nil, err
+	}
+	s := &RemoteStream{Snapshot: e.Snapshot, C: make(chan *Change), body: resp.Body}
+	go s.receive(resp)
+	return s, nil
+}
+
+// call makes a unary call of method, returning the reply message.
+func (t *RemoteTagger) call(method string, req []byte) ([]byte, error) {
+	resp, err := t.post(method, req)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := ReadMessage(resp.Body)
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if e := callStatus(resp); e != nil {
+		return nil, e
+	}
+	return reply, err
+}
+
+func (t *RemoteTagger) post(method string, req []byte) (*http.Response, error) {
+	body := &bytes.Buffer{}
+	WriteMessage(body, req)
+	r, err := http.NewRequest("POST", "http://"+t.Addr+Service+method, body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Te", "trailers")
+	if t.Manager != "" {
+		r.Header.Set(ManagerHeader, t.Manager)
+	}
+
+	resp, err := t.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("could not call %s: %s", method, resp.Status)
+	}
+	return resp, nil
+}
+
+// NewRemoteTagger calls the Tagging service served at addr, for the root
+// manager called manager when the server serves several.
+func NewRemoteTagger(addr string, manager string) *RemoteTagger {
+	return &RemoteTagger{
+		Addr:    addr,
+		Manager: manager,
+		client:  &http.Client{Transport: &http.Transport{Protocols: Protocols()}},
+	}
+}
+
+// RemoteStream receives the changes subscribed with RemoteTagger.Subscribe on
+// C, which is closed when the stream ends. Err tells why it did.
+type RemoteStream struct {
+	Snapshot []*TagState
+	C        chan *Change
+	body     io.Closer
+	err      error
+}
+
+func (s *RemoteStream) Close() error {
+	return s.body.Close()
+}
+
+// Err returns the error ending the stream, once C is closed.
+func (s *RemoteStream) Err() error {
+	return s.err
+}
+
+func (s *RemoteStream) receive(resp *http.Response) {
+	defer close(s.C)
+	defer resp.Body.Close()
+	for {
+		msg, err := ReadMessage(resp.Body)
+		if err != nil {
+			if err == io.EOF {
+				err = callStatus(resp)
+			}
+			s.err = err
+			return
+		}
+		e := &Event{}
+		if err := e.Unmarshal(msg); err != nil {
+			s.err = err
+			return
+		}
+		if e.Change != nil {
+			s.C <- e.Change
+		}
+	}
+}
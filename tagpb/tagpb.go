@@ -0,0 +1,442 @@
+// Package tagpb holds the messages of the Tagging service of tagging.proto,
+// encoded by hand since protobuf can't be vendored into the Godeps workspace,
+// along with its transport over HTTP/2 without TLS and RemoteTagger, a client
+// of the service.
+package tagpb
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// gRPC status codes.
+const (
+	OK                 = 0
+	InvalidArgument    = 3
+	NotFound           = 5
+	FailedPrecondition = 9
+	Unimplemented      = 12
+	Internal           = 13
+)
+
+// Service prefixes the paths of the methods of the Tagging service.
+const Service = "/tagging.Tagging/"
+
+// ManagerHeader selects the root manager on a server serving several.
+const ManagerHeader = "Tagging-Manager"
+
+// MaxMessage bounds the size of the messages read.
+const MaxMessage = 4 << 20
+
+// RemoteError is an error replied by the Tagging service. Code is a gRPC
+// status code for failed calls, and an HTTP status, as in the HTTP API, for
+// the failed reads and writes of single tags.
+type RemoteError struct {
+	Code    int
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// messages --------------------------------------------------------------------
+
+// TagState is the state of a tagger read through the Tagging service.
+type TagState struct {
+	Path     string
+	Props    map[string]interface{}
+	Children []string
+}
+
+func (s *TagState) String() string {
+	return fmt.Sprintf("TagState{Path: %s, Props#len: %d}", s.Path, len(s.Props))
+}
+
+func (s *TagState) Marshal() []byte {
+	b := pbBytes(nil, 1, []byte(s.Path))
+
+	names := make([]string, 0, len(s.Props))
+	for name := range s.Props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := pbBytes(nil, 1, []byte(name))
+		entry = pbBytes(entry, 2, pbValue(s.Props[name]))
+		b = pbBytes(b, 2, entry)
+	}
+
+	for _, c := range s.Children {
+		b = pbBytes(b, 3, []byte(c))
+	}
+	return b
+}
+
+func (s *TagState) Unmarshal(b []byte) error {
+	s.Props = map[string]interface{}{}
+	return pbFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			s.Path = string(data)
+		case 2:
+			var name string
+			var value interface{}
+			err := pbFields(data, func(field int, v uint64, data []byte) error {
+				var err error
+				switch field {
+				case 1:
+					name = string(data)
+				case 2:
+					value, err = decodeValue(data)
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			s.Props[name] = value
+		case 3:
+			s.Children = append(s.Children, string(data))
+		}
+		return nil
+	})
+}
+
+type ReadRequest struct {
+	Paths []string
+}
+
+func (m *ReadRequest) Marshal() []byte {
+	return marshalStrings(1, m.Paths)
+}
+
+func (m *ReadRequest) Unmarshal(b []byte) error {
+	var err error
+	m.Paths, err = pbStrings(b, 1)
+	return err
+}
+
+type ReadResponse struct {
+	Results []*ReadResult
+}
+
+func (m *ReadResponse) Marshal() []byte {
+	var b []byte
+	for _, r := range m.Results {
+		result := pbBytes(nil, 1, []byte(r.Path))
+		if r.State != nil {
+			result = pbBytes(result, 2, r.State.Marshal())
+		}
+		if r.Err != nil {
+			result = pbBytes(result, 3, marshalStatus(r.Err))
+		}
+		b = pbBytes(b, 1, result)
+	}
+	return b
+}
+
+func (m *ReadResponse) Unmarshal(b []byte) error {
+	m.Results = []*ReadResult{}
+	return pbFields(b, func(field int, v uint64, data []byte) error {
+		if field != 1 {
+			return nil
+		}
+		r := &ReadResult{}
+		m.Results = append(m.Results, r)
+		return pbFields(data, func(field int, v uint64, data []byte) error {
+			var err error
+			switch field {
+			case 1:
+				r.Path = string(data)
+			case 2:
+				r.State = &TagState{}
+				err = r.State.Unmarshal(data)
+			case 3:
+				r.Err, err = unmarshalStatus(data)
+			}
+			return err
+		})
+	})
+}
+
+type ReadResult struct {
+	Path  string
+	State *TagState
+	Err   error
+}
+
+type WriteRequest struct {
+	Writes []*PropWrite
+}
+
+func (m *WriteRequest) Marshal() []byte {
+	var b []byte
+	for _, w := range m.Writes {
+		write := pbBytes(nil, 1, []byte(w.Path))
+		write = pbBytes(write, 2, []byte(w.Prop))
+		write = pbBytes(write, 3, pbValue(w.Value))
+		b = pbBytes(b, 1, write)
+	}
+	return b
+}
+
+func (m *WriteRequest) Unmarshal(b []byte) error {
+	m.Writes = []*PropWrite{}
+	return pbFields(b, func(field int, v uint64, data []byte) error {
+		if field != 1 {
+			return nil
+		}
+		w := &PropWrite{}
+		m.Writes = append(m.Writes, w)
+		return pbFields(data, func(field int, v uint64, data []byte) error {
+			var err error
+			switch field {
+			case 1:
+				w.Path = string(data)
+			case 2:
+				w.Prop = string(data)
+			case 3:
+				w.Value, err = decodeValue(data)
+			}
+			return err
+		})
+	})
+}
+
+type PropWrite struct {
+	Path  string
+	Prop  string
+	Value interface{}
+}
+
+type WriteResponse struct {
+	Results []*WriteResult
+}
+
+func (m *WriteResponse) Marshal() []byte {
+	var b []byte
+	for _, r := range m.Results {
+		result := pbBytes(nil, 1, []byte(r.Path))
+		if r.Err != nil {
+			result = pbBytes(result, 2, marshalStatus(r.Err))
+		}
+		b = pbBytes(b, 1, result)
+	}
+	return b
+}
+
+func (m *WriteResponse) Unmarshal(b []byte) error {
+	m.Results = []*WriteResult{}
+	return pbFields(b, func(field int, v uint64, data []byte) error {
+		if field != 1 {
+			return nil
+		}
+		r := &WriteResult{}
+		m.Results = append(m.Results, r)
+		return pbFields(data, func(field int, v uint64, data []byte) error {
+			var err error
+			switch field {
+			case 1:
+				r.Path = string(data)
+			case 2:
+				r.Err, err = unmarshalStatus(data)
+			}
+			return err
+		})
+	})
+}
+
+type WriteResult struct {
+	Path string
+	Err  error
+}
+
+type BrowseRequest struct {
+	Path string
+}
+
+func (m *BrowseRequest) Marshal() []byte {
+	return pbBytes(nil, 1, []byte(m.Path))
+}
+
+func (m *BrowseRequest) Unmarshal(b []byte) error {
+	return pbFields(b, func(field int, v uint64, data []byte) error {
+		if field == 1 {
+			m.Path = string(data)
+		}
+		return nil
+	})
+}
+
+type BrowseResponse struct {
+	Children []*TagState
+}
+
+func (m *BrowseResponse) Marshal() []byte {
+	return marshalStates(m.Children)
+}
+
+func (m *BrowseResponse) Unmarshal(b []byte) error {
+	var err error
+	m.Children, err = unmarshalStates(b)
+	return err
+}
+
+// SubscribeRequest selects tags by path in Paths or by glob in Patterns,
+// every tag when both are empty. With a Throttle, changes to a property in
+// between events are merged.
+type SubscribeRequest struct {
+	Paths    []string
+	Patterns []string
+	Throttle time.Duration
+}
+
+func (m *SubscribeRequest) Marshal() []byte {
+	b := marshalStrings(1, m.Paths)
+	for _, p := range m.Patterns {
+		b = pbBytes(b, 2, []byte(p))
+	}
+	if m.Throttle > 0 {
+		b = pbUint(b, 3, uint64(m.Throttle/time.Millisecond))
+	}
+	return b
+}
+
+func (m *SubscribeRequest) Unmarshal(b []byte) error {
+	return pbFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			m.Paths = append(m.Paths, string(data))
+		case 2:
+			m.Patterns = append(m.Patterns, string(data))
+		case 3:
+			m.Throttle = time.Duration(v) * time.Millisecond
+		}
+		return nil
+	})
+}
+
+// Event is streamed by Subscribe: a Snapshot of the selected tags first, then
+// their changes.
+type Event struct {
+	Snapshot []*TagState
+	Change   *Change
+}
+
+func (m *Event) Marshal() []byte {
+	if m.Change != nil {
+		return pbBytes(nil, 2, m.Change.Marshal())
+	}
+	return pbBytes(nil, 1, marshalStates(m.Snapshot))
+}
+
+func (m *Event) Unmarshal(b []byte) error {
+	return pbFields(b, func(field int, v uint64, data []byte) error {
+		var err error
+		switch field {
+		case 1:
+			m.Snapshot, err = unmarshalStates(data)
+		case 2:
+			m.Change = &Change{}
+			err = m.Change.Unmarshal(data)
+		}
+		return err
+	})
+}
+
+// Change is a change to a property of the tag at Path, named and typed as in
+// the tag schema.
+type Change struct {
+	Path      string
+	Prop      string
+	Value     interface{}
+	Timestamp int64
+}
+
+func (c *Change) String() string {
+	return fmt.Sprintf("Change{Path: %s, Prop: %s, Value: %v, Timestamp: %d}", c.Path, c.Prop, c.Value, c.Timestamp)
+}
+
+func (c *Change) Marshal() []byte {
+	b := pbBytes(nil, 1, []byte(c.Path))
+	b = pbBytes(b, 2, []byte(c.Prop))
+	b = pbBytes(b, 3, pbValue(c.Value))
+	return pbUint(b, 4, uint64(c.Timestamp))
+}
+
+func (c *Change) Unmarshal(b []byte) error {
+	return pbFields(b, func(field int, v uint64, data []byte) error {
+		var err error
+		switch field {
+		case 1:
+			c.Path = string(data)
+		case 2:
+			c.Prop = string(data)
+		case 3:
+			c.Value, err = decodeValue(data)
+		case 4:
+			c.Timestamp = int64(v)
+		}
+		return err
+	})
+}
+
+func marshalStrings(field int, l []string) []byte {
+	var b []byte
+	for _, s := range l {
+		b = pbBytes(b, field, []byte(s))
+	}
+	return b
+}
+
+func marshalStates(states []*TagState) []byte {
+	var b []byte
+	for _, s := range states {
+		b = pbBytes(b, 1, s.Marshal())
+	}
+	return b
+}
+
+func unmarshalStates(b []byte) ([]*TagState, error) {
+	states := []*TagState{}
+	err := pbFields(b, func(field int, v uint64, data []byte) error {
+		if field != 1 {
+			return nil
+		}
+		s := &TagState{}
+		states = append(states, s)
+		return s.Unmarshal(data)
+	})
+	return states, err
+}
+
+// marshalStatus encodes err as a Status message, with the code of a
+// RemoteError and as an internal server error otherwise.
+func marshalStatus(err error) []byte {
+	code := http.StatusInternalServerError
+	if e, ok := err.(*RemoteError); ok {
+		code = e.Code
+	}
+	return pbBytes(pbUint(nil, 1, uint64(code)), 2, []byte(err.Error()))
+}
+
+// unmarshalStatus returns the error of a Status message.
+func unmarshalStatus(b []byte) (error, error) {
+	e := &RemoteError{}
+	err := pbFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			e.Code = int(int32(v))
+		case 2:
+			e.Message = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
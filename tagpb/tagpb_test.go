@@ -0,0 +1,70 @@
+package tagpb
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMessagesRoundTrip(t *testing.T) {
+	state := &TagState{
+		Path: "area2/tank-1",
+		Props: map[string]interface{}{
+			"Value":   int64(-3),
+			"Level":   1.5,
+			"Enabled": true,
+			"Name":    "@p:area2:tank-1",
+			"Meta":    map[string]string{"unit": "bar", "": "x"},
+		},
+		Children: []string{"a", "b"},
+	}
+	read := &ReadResponse{Results: []*ReadResult{
+		{Path: "area2/tank-1", State: state},
+		{Path: "z", Err: &RemoteError{404, "Tag z not found."}},
+	}}
+	got := &ReadResponse{}
+	if err := got.Unmarshal(read.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, read) {
+		t.Errorf("decoded %v, want %v", got.Results, read.Results)
+	}
+
+	sub := &SubscribeRequest{Paths: []string{"a"}, Patterns: []string{"t*"}, Throttle: 250 * time.Millisecond}
+	gotSub := &SubscribeRequest{}
+	if err := gotSub.Unmarshal(sub.Marshal()); err != nil || !reflect.DeepEqual(gotSub, sub) {
+		t.Errorf("decoded %v (%v), want %v", gotSub, err, sub)
+	}
+
+	event := &Event{Change: &Change{Path: "a", Prop: "Value", Value: 2.5, Timestamp: 10}}
+	gotEvent := &Event{}
+	if err := gotEvent.Unmarshal(event.Marshal()); err != nil || !reflect.DeepEqual(gotEvent, event) {
+		t.Errorf("decoded %v (%v), want %v", gotEvent.Change, err, event.Change)
+	}
+}
+
+func TestMessageFraming(t *testing.T) {
+	b := &bytes.Buffer{}
+	if err := WriteMessage(b, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := ReadMessage(b); err != nil || string(msg) != "abc" {
+		t.Errorf("read %q (%v), want abc", msg, err)
+	}
+
+	b.Write([]byte{0, 0xff, 0xff, 0xff, 0xff})
+	if _, err := ReadMessage(b); err == nil {
+		t.Error("read a message larger than MaxMessage")
+	}
+}
+
+func TestCallStatus(t *testing.T) {
+	w := httptest.NewRecorder()
+	FinishCall(w, &RemoteError{NotFound, "Manager @x not found."})
+	err := callStatus(w.Result())
+	if e, ok := err.(*RemoteError); !ok || e.Code != NotFound || e.Message != "Manager @x not found." {
+		t.Errorf("status is %v, want NotFound", err)
+	}
+}
@@ -0,0 +1,86 @@
+package tagpb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ReadMessage reads a length prefixed message of a call.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, fmt.Errorf("compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > MaxMessage {
+		return nil, fmt.Errorf("message of %d bytes is too large", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteMessage writes msg with the length prefix of a call.
+func WriteMessage(w io.Writer, msg []byte) error {
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	_, err := w.Write(append(header, msg...))
+	return err
+}
+
+// FinishCall sends the status of a call in the trailers, with the code of a
+// RemoteError and as an internal error otherwise.
+func FinishCall(w http.ResponseWriter, err error) {
+	code, msg := OK, ""
+	if err != nil {
+		code, msg = Internal, err.Error()
+		if e, ok := err.(*RemoteError); ok {
+			code = e.Code
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+// callStatus returns the error of a finished call, from its trailers, or its
+// headers when the server replied without a message.
+func callStatus(resp *http.Response) error {
+	h := resp.Trailer
+	if h.Get("Grpc-Status") == "" {
+		h = resp.Header
+	}
+	s := h.Get("Grpc-Status")
+	if s == "" {
+		return fmt.Errorf("call ended without a status")
+	}
+	code, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid status %q", s)
+	}
+	if code == OK {
+		return nil
+	}
+	msg, err := url.PathUnescape(h.Get("Grpc-Message"))
+	if err != nil {
+		msg = h.Get("Grpc-Message")
+	}
+	return &RemoteError{code, msg}
+}
+
+// Protocols enables HTTP/2 without TLS only, as gRPC requires HTTP/2.
+func Protocols() *http.Protocols {
+	p := &http.Protocols{}
+	p.SetUnencryptedHTTP2(true)
+	return p
+}
@@ -0,0 +1,157 @@
+package tagpb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// pbFields calls fn for every field of the protobuf message b, with the value
+// of varint and fixed fields in v and the data of length delimited ones.
+func pbFields(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf key")
+		}
+		b = b[n:]
+
+		var v uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("invalid protobuf varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return fmt.Errorf("invalid protobuf fixed64")
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("invalid protobuf length")
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return fmt.Errorf("invalid protobuf fixed32")
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if err := fn(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pbVarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+func pbUint(b []byte, field int, v uint64) []byte {
+	return pbVarint(pbVarint(b, uint64(field)<<3), v)
+}
+
+func pbBytes(b []byte, field int, data []byte) []byte {
+	b = pbVarint(pbVarint(b, uint64(field)<<3|2), uint64(len(data)))
+	return append(b, data...)
+}
+
+func pbFixed64(b []byte, field int, v uint64) []byte {
+	b = pbVarint(b, uint64(field)<<3|1)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return append(b, buf...)
+}
+
+// pbStrings returns the strings of the repeated field of b.
+func pbStrings(b []byte, field int) ([]string, error) {
+	l := []string{}
+	err := pbFields(b, func(f int, v uint64, data []byte) error {
+		if f == field {
+			l = append(l, string(data))
+		}
+		return nil
+	})
+	return l, err
+}
+
+// pbValue encodes v as a Value, by its Go type.
+func pbValue(v interface{}) []byte {
+	switch x := v.(type) {
+	case int:
+		return pbUint(nil, 1, uint64(x))
+	case int64:
+		return pbUint(nil, 1, uint64(x))
+	case float64:
+		return pbFixed64(nil, 2, math.Float64bits(x))
+	case bool:
+		if x {
+			return pbUint(nil, 3, 1)
+		}
+		return pbUint(nil, 3, 0)
+	case map[string]string:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var meta []byte
+		for _, k := range keys {
+			meta = pbBytes(meta, 1, pbBytes(pbBytes(nil, 1, []byte(k)), 2, []byte(x[k])))
+		}
+		return pbBytes(nil, 5, meta)
+	}
+	return pbBytes(nil, 4, []byte(fmt.Sprint(v)))
+}
+
+// decodeValue decodes a Value, with integers as int64.
+func decodeValue(b []byte) (interface{}, error) {
+	var value interface{}
+	err := pbFields(b, func(field int, v uint64, data []byte) error {
+		switch field {
+		case 1:
+			value = int64(v)
+		case 2:
+			value = math.Float64frombits(v)
+		case 3:
+			value = v != 0
+		case 4:
+			value = string(data)
+		case 5:
+			meta := map[string]string{}
+			err := pbFields(data, func(field int, v uint64, entry []byte) error {
+				if field != 1 {
+					return nil
+				}
+				var k, e string
+				err := pbFields(entry, func(field int, v uint64, data []byte) error {
+					switch field {
+					case 1:
+						k = string(data)
+					case 2:
+						e = string(data)
+					}
+					return nil
+				})
+				meta[k] = e
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			value = meta
+		}
+		return nil
+	})
+	return value, err
+}
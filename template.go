@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Member is one tag of a Template, with the defaults each instance gets.
+type Member struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Value       int               `json:"value"`
+	Quality     int               `json:"quality"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+func (m Member) tag(conn *Client, template string) *Tag {
+	t := NewTag(conn, m.Name, m.Description, m.Value, m.Quality)
+	for k, v := range m.Meta {
+		t.Meta[k] = v
+	}
+	t.Meta["template"] = template
+	return t
+}
+
+// template --------------------------------------------------------------------
+
+// Template is a user defined tag type, such as a pump, instantiated as a
+// TagManager holding one tag per member.
+type Template struct {
+	Name      string   `json:"name"`
+	Members   []Member `json:"members"`
+	instances []*instance
+	mu        sync.Mutex
+}
+
+type instance struct {
+	manager *TagManager
+	conn    *Client
+}
+
+func (t *Template) String() string {
+	return fmt.Sprintf("Template{Name: %s, Members#len: %d}", t.Name, len(t.Members))
+}
+
+// Instantiate appends a manager called name into parent, holding a tag for
+// every member of the template.
+func (t *Template) Instantiate(parent *TagManager, name string, conn *Client) (*TagManager, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if parent.child(name) != nil {
+		return nil, fmt.Errorf("Tag %s:%s already exists.", parent.Name, name)
+	}
+	tm := NewTagManager(name)
+	tm.Mode = parent.Mode
+	if err := parent.Append(tm); err != nil {
+		return nil, err
+	}
+
+	for _, m := range t.Members {
+		if err := tm.Append(m.tag(conn, t.Name)); err != nil {
+			name := tm.Name
+			parent.Remove(nameOf(tm))
+			return nil, fmt.Errorf("could not create member %s of %s: %s", m.Name, name, err)
+		}
+	}
+
+	t.prune()
+	t.instances = append(t.instances, &instance{tm, conn})
+	return tm, nil
+}
+
+// Update replaces the template members. Members new to the template are
+// created in every existing instance; members already there keep their
+// current values, and removed members are left in the instances. When a
+// member can't be created, the ones created before it are removed and the
+// template is left unchanged.
+func (t *Template) Update(members ...Member) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := validateMembers(t.Name, members); err != nil {
+		return err
+	}
+
+	t.prune()
+	created := map[*TagManager][]string{}
+	rollback := func() {
+		for tm, names := range created {
+			for _, n := range names {
+				tm.Remove(n)
+			}
+		}
+	}
+	for _, i := range t.instances {
+		for _, m := range members {
+			if i.manager.child(m.Name) != nil {
+				continue
+			}
+			c := m.tag(i.conn, t.Name)
+			if err := i.manager.Append(c); err != nil {
+				rollback()
+				return fmt.Errorf("could not create member %s of %s: %s", m.Name, i.manager.Name, err)
+			}
+			created[i.manager] = append(created[i.manager], nameOf(c))
+		}
+	}
+
+	t.Members = members
+	return nil
+}
+
+// Instances returns the managers created from the template, leaving out
+// the ones closed since.
+func (t *Template) Instances() []*TagManager {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune()
+	m := make([]*TagManager, len(t.instances))
+	for i, e := range t.instances {
+		m[i] = e.manager
+	}
+	return m
+}
+
+// prune drops the instances whose manager was closed, as it is when removed
+// from its parent or replaced by a reload.
+func (t *Template) prune() {
+	live := t.instances[:0]
+	for _, i := range t.instances {
+		if !i.manager.isClosed() {
+			live = append(live, i)
+		}
+	}
+	for i := len(live); i < len(t.instances); i++ {
+		t.instances[i] = nil
+	}
+	t.instances = live
+}
+
+func NewTemplate(name string, members ...Member) (*Template, error) {
+	if err := validateMembers(name, members); err != nil {
+		return nil, err
+	}
+	return &Template{Name: name, Members: members}, nil
+}
+
+// ParseTemplate reads a template written as JSON, such as
+//
+//	{"name": "pump", "members": [{"name": "running"}, {"name": "speed"}]}
+func ParseTemplate(r io.Reader) (*Template, error) {
+	t := &Template{}
+	if err := json.NewDecoder(r).Decode(t); err != nil {
+		return nil, err
+	}
+	return NewTemplate(t.Name, t.Members...)
+}
+
+func validateMembers(template string, members []Member) error {
+	if template == "" {
+		return fmt.Errorf("template needs a name")
+	}
+	seen := map[string]bool{}
+	for _, m := range members {
+		if m.Name == "" {
+			return fmt.Errorf("template %s has a member without name", template)
+		}
+		if seen[m.Name] {
+			return fmt.Errorf("template %s has duplicated member %s", template, m.Name)
+		}
+		if err := validateQuality(m.Quality); err != nil {
+			return fmt.Errorf("template %s member %s: %s", template, m.Name, err)
+		}
+		seen[m.Name] = true
+	}
+	return nil
+}
+
+// registry --------------------------------------------------------------------
+
+var (
+	templatesMu sync.RWMutex
+	templates   = map[string]*Template{}
+)
+
+func RegisterTemplate(t *Template) {
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	templates[t.Name] = t
+}
+
+func LookupTemplate(name string) (*Template, error) {
+	templatesMu.RLock()
+	defer templatesMu.RUnlock()
+	if t, ok := templates[name]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("Template %s not found.", name)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTemplateInstantiate(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	plant := NewTagManager("@plant")
+	defer plant.Close()
+
+	tpl, err := NewTemplate("pump", Member{Name: "running"}, Member{Name: "speed", Value: 1500, Quality: QualityGood, Meta: map[string]string{"unit": "rpm"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm, err := tpl.Instantiate(plant, "pump-1", conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := plant.Lookup("pump-1"); c != tm {
+		t.Fatal("instance not appended into its parent")
+	}
+	if v, err := plant.Get("@plant:pump-1:speed", "Value"); err != nil || v != 1500 {
+		t.Errorf("Expected speed 1500, got %v, %v", v, err)
+	}
+	meta, _ := plant.Get("@plant:pump-1:speed", "Meta")
+	if m := meta.(map[string]string); m["unit"] != "rpm" || m["template"] != "pump" {
+		t.Errorf("Unexpected meta %v", m)
+	}
+	if r.get("@plant:pump-1:running:value") != "0" {
+		t.Error("member not stored")
+	}
+	if _, err := tpl.Instantiate(plant, "pump-1", conn); err == nil {
+		t.Error("instantiated twice under the same name")
+	}
+	if n := len(tpl.Instances()); n != 1 {
+		t.Errorf("Expected 1 instance, got %d", n)
+	}
+}
+
+func TestTemplateUpdate(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	plant := NewTagManager("@plant")
+	defer plant.Close()
+
+	tpl, _ := NewTemplate("pump", Member{Name: "running"})
+	pump1, _ := tpl.Instantiate(plant, "pump-1", conn)
+	pump2, _ := tpl.Instantiate(plant, "pump-2", conn)
+	if err := pump1.Set("@plant:pump-1:running", "Value", 1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the running value", func() bool {
+		v, _ := pump1.Get("@plant:pump-1:running", "Value")
+		return v == 1
+	})
+
+	if err := plant.Remove("@plant:pump-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tpl.Update(Member{Name: "running"}, Member{Name: "speed"}); err != nil {
+		t.Fatal(err)
+	}
+	if pump1.child("speed") == nil {
+		t.Error("new member not created in the instance")
+	}
+	if v, _ := pump1.Get("@plant:pump-1:running", "Value"); v != 1 {
+		t.Errorf("Expected running to keep 1, got %v", v)
+	}
+	if pump2.child("speed") != nil {
+		t.Error("new member created in a removed instance")
+	}
+	if i := tpl.Instances(); len(i) != 1 || i[0] != pump1 {
+		t.Errorf("Expected pump-1 as the only instance, got %v", i)
+	}
+}
+
+func TestTemplateUpdateAtomic(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	plant := NewTagManager("@plant")
+	defer plant.Close()
+
+	tpl, _ := NewTemplate("pump", Member{Name: "running"})
+	pump1, _ := tpl.Instantiate(plant, "pump-1", r.dial(t))
+	lost := r.dial(t)
+	pump2, _ := tpl.Instantiate(plant, "pump-2", lost)
+	lost.Close()
+
+	if err := tpl.Update(Member{Name: "running"}, Member{Name: "speed"}); err == nil {
+		t.Fatal("Update didn't fail")
+	}
+	if pump1.child("speed") != nil || pump2.child("speed") != nil {
+		t.Error("member left in an instance after a failed update")
+	}
+	if len(tpl.Members) != 1 {
+		t.Errorf("Expected the members to be kept, got %v", tpl.Members)
+	}
+}
+
+func TestTemplateInstantiateFails(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	plant := NewTagManager("@plant")
+	defer plant.Close()
+
+	tpl, _ := NewTemplate("pump", Member{Name: "running"}, Member{Name: "speed"})
+	lost := r.dial(t)
+	lost.Close()
+	tm, err := tpl.Instantiate(plant, "pump-1", lost)
+	if err == nil {
+		t.Fatal("Instantiate didn't fail")
+	}
+	if tm != nil {
+		t.Errorf("Expected no instance, got %v", tm)
+	}
+	if plant.child("pump-1") != nil {
+		t.Error("failed instance left in its parent")
+	}
+	if n := len(tpl.Instances()); n != 0 {
+		t.Errorf("Expected no instances, got %d", n)
+	}
+
+	if _, err := tpl.Instantiate(plant, "pump-1", r.dial(t)); err != nil {
+		t.Errorf("Expected the name to be free again, got %s", err)
+	}
+}
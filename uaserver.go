@@ -0,0 +1,2317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// opc ua built-in types.
+const (
+	uaBoolean         = 1
+	uaSByte           = 2
+	uaByte            = 3
+	uaInt16           = 4
+	uaUInt16          = 5
+	uaInt32           = 6
+	uaUInt32          = 7
+	uaInt64           = 8
+	uaUInt64          = 9
+	uaFloat           = 10
+	uaDouble          = 11
+	uaString          = 12
+	uaDateTime        = 13
+	uaGuid            = 14
+	uaByteString      = 15
+	uaXmlElement      = 16
+	uaNodeIDType      = 17
+	uaExpandedNodeID  = 18
+	uaStatusCode      = 19
+	uaQualifiedName   = 20
+	uaLocalizedText   = 21
+	uaExtensionObject = 22
+	uaDataValue       = 23
+	uaVariant         = 24
+	uaDiagnosticInfo  = 25
+)
+
+// opc ua binary encoding ids of the services and structures served.
+const (
+	uaAnonymousIdentityToken      = 321
+	uaServiceFault                = 397
+	uaFindServersRequest          = 422
+	uaFindServersResponse         = 425
+	uaGetEndpointsRequest         = 428
+	uaGetEndpointsResponse        = 431
+	uaOpenSecureChannelRequest    = 446
+	uaOpenSecureChannelResponse   = 449
+	uaCloseSecureChannelRequest   = 452
+	uaCreateSessionRequest        = 461
+	uaCreateSessionResponse       = 464
+	uaActivateSessionRequest      = 467
+	uaActivateSessionResponse     = 470
+	uaCloseSessionRequest         = 473
+	uaCloseSessionResponse        = 476
+	uaBrowseRequest               = 527
+	uaBrowseResponse              = 530
+	uaBrowseNextRequest           = 533
+	uaBrowseNextResponse          = 536
+	uaReadRequest                 = 631
+	uaReadResponse                = 634
+	uaWriteRequest                = 673
+	uaWriteResponse               = 676
+	uaCreateMonitoredItemsRequest = 751
+	uaCreateMonitoredItemsReply   = 754
+	uaModifyMonitoredItemsRequest = 763
+	uaModifyMonitoredItemsReply   = 766
+	uaSetMonitoringModeRequest    = 769
+	uaSetMonitoringModeResponse   = 772
+	uaDeleteMonitoredItemsRequest = 781
+	uaDeleteMonitoredItemsReply   = 784
+	uaCreateSubscriptionRequest   = 787
+	uaCreateSubscriptionResponse  = 790
+	uaModifySubscriptionRequest   = 793
+	uaModifySubscriptionResponse  = 796
+	uaSetPublishingModeRequest    = 799
+	uaSetPublishingModeResponse   = 802
+	uaDataChangeNotification      = 811
+	uaPublishRequest              = 826
+	uaPublishResponse             = 829
+	uaRepublishRequest            = 832
+	uaRepublishResponse           = 835
+	uaDeleteSubscriptionsRequest  = 847
+	uaDeleteSubscriptionsResponse = 850
+)
+
+// opc ua reference types and type definitions of the nodes served.
+const (
+	uaReferences           = 31
+	uaNonHierarchical      = 32
+	uaHierarchical         = 33
+	uaHasChild             = 34
+	uaOrganizes            = 35
+	uaAggregates           = 44
+	uaHasProperty          = 46
+	uaHasComponent         = 47
+	uaBaseDataVariableType = 63
+	uaFolderType           = 61
+	uaPropertyType         = 68
+	uaServerType           = 2004
+)
+
+// opc ua attributes.
+const (
+	uaAttrNodeID                  = 1
+	uaAttrNodeClass               = 2
+	uaAttrBrowseName              = 3
+	uaAttrDisplayName             = 4
+	uaAttrDescription             = 5
+	uaAttrWriteMask               = 6
+	uaAttrUserWriteMask           = 7
+	uaAttrEventNotifier           = 12
+	uaAttrValue                   = 13
+	uaAttrDataType                = 14
+	uaAttrValueRank               = 15
+	uaAttrArrayDimensions         = 16
+	uaAttrAccessLevel             = 17
+	uaAttrUserAccessLevel         = 18
+	uaAttrMinimumSamplingInterval = 19
+	uaAttrHistorizing             = 20
+)
+
+const (
+	uaSecurityPolicyNone = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	uaTransportProfile   = "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary"
+	uaSecurityModeNone   = 1
+	uaBufferSize         = 65536
+	uaMaxMessage         = 4 << 20
+	uaMaxPublishes       = 16
+	uaMaxRetransmits     = 16
+	uaMinInterval        = 50 * time.Millisecond
+)
+
+// opc ua server ---------------------------------------------------------------
+
+// OPCUAServer serves an AddressSpace to opc ua clients over opc.tcp with the
+// binary encoding. Subscriptions sample their monitored items every
+// publishing interval and report the items whose value or status changed.
+// Sessions end with the secure channel that created them.
+//
+// Secure channels only take the None security policy and mode, and sessions
+// only take anonymous identity tokens: messages are neither signed nor
+// encrypted, and every client may write the editable properties of the tags.
+// Serve it on trusted networks only, or behind a tunnel doing both.
+type OPCUAServer struct {
+	space    *AddressSpace
+	URL      string
+	std      map[string]*UANode
+	listener net.Listener
+	conns    map[net.Conn]bool
+	sessions map[string]*uaSession
+	ids      uint32
+	mu       sync.Mutex
+}
+
+func (s *OPCUAServer) String() string {
+	return fmt.Sprintf("OPCUAServer{Manager: %s, URL: %s}", s.space.manager.Name, s.URL)
+}
+
+func (s *OPCUAServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts clients on l until the server is closed. Without an URL, the
+// server advertises the address of l.
+func (s *OPCUAServer) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	if s.URL == "" {
+		s.URL = "opc.tcp://" + l.Addr().String()
+	}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+func (s *OPCUAServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+func (s *OPCUAServer) serve(conn net.Conn) {
+	ch := &uaChannel{server: s, conn: conn, chunks: map[uint32][]byte{}}
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		var closed []*uaSession
+		for token, session := range s.sessions {
+			if session.ch == ch {
+				closed = append(closed, session)
+				delete(s.sessions, token)
+			}
+		}
+		s.mu.Unlock()
+		for _, session := range closed {
+			session.close()
+		}
+		conn.Close()
+	}()
+
+	if err := ch.run(); err != nil && err != io.EOF {
+		log.Printf("opcua: %s: %s\n", conn.RemoteAddr(), err)
+	}
+}
+
+// handle answers the request reqID of ch, held in msg.
+func (s *OPCUAServer) handle(ch *uaChannel, reqID uint32, msg []byte) {
+	d := &uaDecoder{b: msg}
+	typeID := d.nodeID()
+	r := &uaRequest{ch: ch, id: reqID, header: d.requestHeader(), body: d}
+	if d.err != nil {
+		r.fault(StatusBadDecodingError)
+		return
+	}
+
+	svc, ok := uaServices[typeID.Num]
+	if !ok || typeID.NS != 0 || typeID.Kind != uaNumericNodeID {
+		r.fault(StatusBadServiceUnsupported)
+		return
+	}
+	if svc.session {
+		var status uint32
+		if r.session, status = s.session(ch, r.header.Token, svc.response != uaActivateSessionResponse); status != StatusGood {
+			r.fault(status)
+			return
+		}
+	}
+
+	e, status := svc.fn(s, r)
+	switch {
+	case d.err != nil:
+		r.fault(StatusBadDecodingError)
+	case status != StatusGood:
+		r.fault(status)
+	case e != nil:
+		r.reply(svc.response, e.b)
+	}
+}
+
+// session finds the session of token, bound to ch. Only ActivateSession
+// takes sessions not activated yet.
+func (s *OPCUAServer) session(ch *uaChannel, token uaNodeID, activated bool) (*uaSession, uint32) {
+	s.mu.Lock()
+	session := s.sessions[token.String()]
+	s.mu.Unlock()
+	if session == nil {
+		return nil, StatusBadSessionIdInvalid
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if activated && !session.activated {
+		return nil, StatusBadSessionNotActivated
+	}
+	if activated && session.ch != ch {
+		return nil, StatusBadSecureChannelIdInvalid
+	}
+	return session, StatusGood
+}
+
+func (s *OPCUAServer) nextID() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids++
+	return s.ids
+}
+
+// node finds a standard node of namespace 0 or a node of the address space.
+func (s *OPCUAServer) node(id string) (*UANode, uint32) {
+	if n, ok := s.std[id]; ok {
+		return n, StatusGood
+	}
+	return s.space.Node(id)
+}
+
+// references returns the references of n, forward to its children and
+// inverse to its parent.
+func (s *OPCUAServer) references(n *UANode) []*uaReference {
+	ref := func(typ uint32, forward bool, id string) *uaReference {
+		target, _ := s.node(id)
+		return &uaReference{Type: typ, Forward: forward, Target: target}
+	}
+	root := s.space.NodeID("", "")
+	switch n.NodeID {
+	case "i=84":
+		return []*uaReference{ref(uaOrganizes, true, "i=85")}
+	case "i=85":
+		return []*uaReference{
+			ref(uaOrganizes, false, "i=84"),
+			ref(uaOrganizes, true, root),
+			ref(uaOrganizes, true, "i=2253"),
+		}
+	case "i=2253":
+		return []*uaReference{
+			ref(uaOrganizes, false, "i=85"),
+			ref(uaHasProperty, true, "i=2254"),
+			ref(uaHasProperty, true, "i=2255"),
+		}
+	case "i=2254", "i=2255":
+		return []*uaReference{ref(uaHasProperty, false, "i=2253")}
+	}
+
+	var refs []*uaReference
+	path, prop, _ := s.space.parseNodeID(n.NodeID)
+	switch {
+	case n.NodeID == root:
+		refs = append(refs, ref(uaOrganizes, false, "i=85"))
+	case prop != "":
+		refs = append(refs, ref(uaHasProperty, false, s.space.NodeID(path, "")))
+	default:
+		parent := ""
+		if i := strings.LastIndex(path, "/"); i >= 0 {
+			parent = path[:i]
+		}
+		refs = append(refs, ref(uaOrganizes, false, s.space.NodeID(parent, "")))
+	}
+
+	children, _ := s.space.Browse(n.NodeID)
+	for _, c := range children {
+		typ := uint32(uaOrganizes)
+		if n.Class == VariableNode {
+			typ = uaHasProperty
+		}
+		refs = append(refs, &uaReference{Type: typ, Forward: true, Target: c})
+	}
+	return refs
+}
+
+// typeDefinition returns the type definition of n.
+func (s *OPCUAServer) typeDefinition(n *UANode) uint32 {
+	switch {
+	case n.NodeID == "i=2253":
+		return uaServerType
+	case n.Class == ObjectNode:
+		return uaFolderType
+	case n.prop != nil && n.prop.Name == "Value":
+		return uaBaseDataVariableType
+	}
+	return uaPropertyType
+}
+
+// namespace returns the namespace index of the browse name of n.
+func (s *OPCUAServer) namespace(n *UANode) uint16 {
+	if _, ok := s.std[n.NodeID]; ok {
+		return 0
+	}
+	return uint16(s.space.Namespace)
+}
+
+// read returns the attribute attr of the node of id.
+func (s *OPCUAServer) read(id string, attr uint32) *DataValue {
+	n, status := s.node(id)
+	if status != StatusGood {
+		return &DataValue{Status: status}
+	}
+	value := func(v interface{}) *DataValue {
+		return &DataValue{Value: v, Status: StatusGood}
+	}
+
+	switch attr {
+	case uaAttrNodeID:
+		return value(parseUANodeID(n.NodeID))
+	case uaAttrNodeClass:
+		return value(int32(n.Class))
+	case uaAttrBrowseName:
+		return value(&uaQName{s.namespace(n), n.BrowseName})
+	case uaAttrDisplayName:
+		return value(uaText(n.BrowseName))
+	case uaAttrDescription:
+		d := ""
+		if n.tag != nil && (n.prop == nil || n.prop.Name == "Value") {
+			if v, err := getProp(n.tag, "Description"); err == nil {
+				d = fmt.Sprint(v)
+			}
+		}
+		return value(uaText(d))
+	case uaAttrWriteMask, uaAttrUserWriteMask:
+		return value(uint32(0))
+	}
+
+	if n.Class == ObjectNode {
+		if attr == uaAttrEventNotifier {
+			return value(byte(0))
+		}
+		return &DataValue{Status: StatusBadAttributeIdInvalid}
+	}
+
+	_, std := s.std[id]
+	switch attr {
+	case uaAttrValue:
+		switch {
+		case id == "i=2254":
+			return value([]string{s.applicationURI()})
+		case id == "i=2255":
+			return value(s.namespaces())
+		}
+		return s.space.Read(id)
+	case uaAttrDataType:
+		if std {
+			return value(uaNodeID{Kind: uaNumericNodeID, Num: uaString})
+		}
+		return value(uaNodeID{Kind: uaNumericNodeID, Num: uaDataTypeOf(n.prop.Type)})
+	case uaAttrValueRank:
+		if std {
+			return value(int32(1))
+		}
+		return value(int32(-1))
+	case uaAttrArrayDimensions:
+		if std {
+			return value([]uint32{0})
+		}
+		return value([]uint32{})
+	case uaAttrAccessLevel, uaAttrUserAccessLevel:
+		if !std && n.prop.Editable {
+			return value(byte(3))
+		}
+		return value(byte(1))
+	case uaAttrMinimumSamplingInterval:
+		return value(float64(0))
+	case uaAttrHistorizing:
+		return value(false)
+	}
+	return &DataValue{Status: StatusBadAttributeIdInvalid}
+}
+
+func (s *OPCUAServer) applicationURI() string {
+	return "urn:tagging:" + s.space.manager.Name
+}
+
+// namespaces returns the namespace array, with the address space namespace at
+// its index.
+func (s *OPCUAServer) namespaces() []string {
+	ns := make([]string, s.space.Namespace+1)
+	for i := range ns {
+		ns[i] = fmt.Sprintf("urn:tagging:ns%d", i)
+	}
+	ns[0] = "http://opcfoundation.org/UA/"
+	ns[s.space.Namespace] = s.applicationURI()
+	return ns
+}
+
+func (s *OPCUAServer) application(e *uaEncoder, url string) {
+	e.str(s.applicationURI())
+	e.str("urn:tagging")
+	e.text("tagging " + s.space.manager.Name)
+	e.u32(0)
+	e.null()
+	e.null()
+	e.strs([]string{url})
+}
+
+func (s *OPCUAServer) endpoint(e *uaEncoder, url string) {
+	e.str(url)
+	s.application(e, url)
+	e.null()
+	e.u32(uaSecurityModeNone)
+	e.str(uaSecurityPolicyNone)
+	e.i32(1)
+	e.str("anonymous")
+	e.u32(0)
+	e.null()
+	e.null()
+	e.null()
+	e.str(uaTransportProfile)
+	e.u8(0)
+}
+
+// endpointURL returns the url the client asked for, or the server url.
+func (s *OPCUAServer) endpointURL(url string) string {
+	if url != "" {
+		return url
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.URL
+}
+
+// NewOPCUAServer serves the tags of manager in namespace 1, under the Objects
+// folder.
+func NewOPCUAServer(manager *TagManager) *OPCUAServer {
+	s := &OPCUAServer{
+		space:    NewAddressSpace(manager, 1),
+		conns:    map[net.Conn]bool{},
+		sessions: map[string]*uaSession{},
+	}
+	s.std = map[string]*UANode{
+		"i=84":   {NodeID: "i=84", Class: ObjectNode, BrowseName: "Root"},
+		"i=85":   {NodeID: "i=85", Class: ObjectNode, BrowseName: "Objects"},
+		"i=2253": {NodeID: "i=2253", Class: ObjectNode, BrowseName: "Server"},
+		"i=2254": {NodeID: "i=2254", Class: VariableNode, BrowseName: "ServerArray"},
+		"i=2255": {NodeID: "i=2255", Class: VariableNode, BrowseName: "NamespaceArray"},
+	}
+	return s
+}
+
+// uaReference is a reference of a node to Target.
+type uaReference struct {
+	Type    uint32
+	Forward bool
+	Target  *UANode
+}
+
+// uaReferenceParents holds the supertype of each reference type served.
+var uaReferenceParents = map[uint32]uint32{
+	uaNonHierarchical: uaReferences,
+	uaHierarchical:    uaReferences,
+	uaHasChild:        uaHierarchical,
+	uaOrganizes:       uaHierarchical,
+	uaAggregates:      uaHasChild,
+	uaHasProperty:     uaAggregates,
+	uaHasComponent:    uaAggregates,
+}
+
+// matches tells if r is of the reference type filter, or of a subtype of it
+// when subtypes is set. A null filter takes every reference.
+func (r *uaReference) matches(filter uaNodeID, subtypes bool) bool {
+	if filter.null() {
+		return true
+	}
+	if filter.NS != 0 || filter.Kind != uaNumericNodeID {
+		return false
+	}
+	for t := r.Type; t != 0; t = uaReferenceParents[t] {
+		if t == filter.Num {
+			return true
+		}
+		if !subtypes {
+			return false
+		}
+	}
+	return false
+}
+
+func uaDataTypeOf(t PropType) uint32 {
+	switch t {
+	case IntProp, Int64Prop:
+		return uaInt64
+	case FloatProp:
+		return uaDouble
+	case BoolProp:
+		return uaBoolean
+	}
+	return uaString
+}
+
+// services --------------------------------------------------------------------
+
+// uaRequest is a service request received on a channel. Services not
+// answering at once reply later through it.
+type uaRequest struct {
+	ch      *uaChannel
+	id      uint32
+	header  *uaRequestHeader
+	body    *uaDecoder
+	session *uaSession
+	results []uint32
+}
+
+func (r *uaRequest) reply(typeID uint32, body []byte) {
+	e := &uaEncoder{}
+	e.nodeID(uaNodeID{Kind: uaNumericNodeID, Num: typeID})
+	e.responseHeader(r.header.Handle, StatusGood)
+	e.b = append(e.b, body...)
+	r.ch.send(r.id, e.b)
+}
+
+func (r *uaRequest) fault(status uint32) {
+	e := &uaEncoder{}
+	e.nodeID(uaNodeID{Kind: uaNumericNodeID, Num: uaServiceFault})
+	handle := uint32(0)
+	if r.header != nil {
+		handle = r.header.Handle
+	}
+	e.responseHeader(handle, status)
+	r.ch.send(r.id, e.b)
+}
+
+// uaService answers a request with the body of its response after the
+// response header, or a bad status to reply with a fault. A nil body and a
+// good status mean the service replies later.
+type uaService struct {
+	response uint32
+	session  bool
+	fn       func(s *OPCUAServer, r *uaRequest) (*uaEncoder, uint32)
+}
+
+var uaServices map[uint32]*uaService
+
+func init() {
+	uaServices = map[uint32]*uaService{
+		uaFindServersRequest:          {uaFindServersResponse, false, (*OPCUAServer).findServers},
+		uaGetEndpointsRequest:         {uaGetEndpointsResponse, false, (*OPCUAServer).getEndpoints},
+		uaCreateSessionRequest:        {uaCreateSessionResponse, false, (*OPCUAServer).createSession},
+		uaActivateSessionRequest:      {uaActivateSessionResponse, true, (*OPCUAServer).activateSession},
+		uaCloseSessionRequest:         {uaCloseSessionResponse, true, (*OPCUAServer).closeSession},
+		uaBrowseRequest:               {uaBrowseResponse, true, (*OPCUAServer).browse},
+		uaBrowseNextRequest:           {uaBrowseNextResponse, true, (*OPCUAServer).browseNext},
+		uaReadRequest:                 {uaReadResponse, true, (*OPCUAServer).readService},
+		uaWriteRequest:                {uaWriteResponse, true, (*OPCUAServer).write},
+		uaCreateSubscriptionRequest:   {uaCreateSubscriptionResponse, true, (*OPCUAServer).createSubscription},
+		uaModifySubscriptionRequest:   {uaModifySubscriptionResponse, true, (*OPCUAServer).modifySubscription},
+		uaSetPublishingModeRequest:    {uaSetPublishingModeResponse, true, (*OPCUAServer).setPublishingMode},
+		uaDeleteSubscriptionsRequest:  {uaDeleteSubscriptionsResponse, true, (*OPCUAServer).deleteSubscriptions},
+		uaCreateMonitoredItemsRequest: {uaCreateMonitoredItemsReply, true, (*OPCUAServer).createMonitoredItems},
+		uaModifyMonitoredItemsRequest: {uaModifyMonitoredItemsReply, true, (*OPCUAServer).modifyMonitoredItems},
+		uaSetMonitoringModeRequest:    {uaSetMonitoringModeResponse, true, (*OPCUAServer).setMonitoringMode},
+		uaDeleteMonitoredItemsRequest: {uaDeleteMonitoredItemsReply, true, (*OPCUAServer).deleteMonitoredItems},
+		uaPublishRequest:              {uaPublishResponse, true, (*OPCUAServer).publish},
+		uaRepublishRequest:            {uaRepublishResponse, true, (*OPCUAServer).republish},
+	}
+}
+
+func (s *OPCUAServer) findServers(r *uaRequest) (*uaEncoder, uint32) {
+	url := r.body.str()
+	e := &uaEncoder{}
+	e.i32(1)
+	s.application(e, s.endpointURL(url))
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) getEndpoints(r *uaRequest) (*uaEncoder, uint32) {
+	url := r.body.str()
+	e := &uaEncoder{}
+	e.i32(1)
+	s.endpoint(e, s.endpointURL(url))
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) createSession(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	d.application()
+	d.str()
+	url := d.str()
+	d.str()
+	d.bytes()
+	d.bytes()
+	timeout := d.f64()
+	if d.err != nil {
+		return nil, StatusBadDecodingError
+	}
+	timeout = math.Max(10000, math.Min(timeout, 3600000))
+
+	token := make([]byte, 16)
+	rand.Read(token)
+	session := &uaSession{
+		id:    uaNodeID{NS: uint16(s.space.Namespace), Kind: uaNumericNodeID, Num: s.nextID()},
+		token: uaNodeID{NS: uint16(s.space.Namespace), Kind: uaOpaqueNodeID, Str: string(token)},
+		ch:    r.ch,
+		subs:  map[uint32]*uaSubscription{},
+	}
+	s.mu.Lock()
+	s.sessions[session.token.String()] = session
+	s.mu.Unlock()
+
+	e := &uaEncoder{}
+	e.nodeID(session.id)
+	e.nodeID(session.token)
+	e.f64(timeout)
+	e.bytes(uaNonce())
+	e.null()
+	e.i32(1)
+	s.endpoint(e, s.endpointURL(url))
+	e.i32(0)
+	e.null()
+	e.null()
+	e.u32(uaMaxMessage)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) activateSession(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	d.str()
+	d.bytes()
+	for i, n := 0, d.count(); i < n; i++ {
+		d.bytes()
+		d.bytes()
+	}
+	d.strs()
+	typeID, _ := d.extension()
+	if d.err != nil {
+		return nil, StatusBadDecodingError
+	}
+	if !typeID.null() && (typeID.NS != 0 || typeID.Num != uaAnonymousIdentityToken) {
+		return nil, StatusBadIdentityTokenInvalid
+	}
+
+	r.session.mu.Lock()
+	r.session.activated = true
+	r.session.ch = r.ch
+	r.session.mu.Unlock()
+
+	e := &uaEncoder{}
+	e.bytes(uaNonce())
+	e.i32(0)
+	e.i32(0)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) closeSession(r *uaRequest) (*uaEncoder, uint32) {
+	s.mu.Lock()
+	delete(s.sessions, r.session.token.String())
+	s.mu.Unlock()
+	r.session.close()
+	return &uaEncoder{}, StatusGood
+}
+
+func (s *OPCUAServer) browse(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	d.nodeID()
+	d.time()
+	d.u32()
+	d.u32()
+	n := d.count()
+	if d.err == nil && n == 0 {
+		return nil, StatusBadNothingToDo
+	}
+
+	e := &uaEncoder{}
+	e.i32(int32(n))
+	for i := 0; i < n; i++ {
+		id := d.nodeID()
+		direction := d.u32()
+		refType := d.nodeID()
+		subtypes := d.boolean()
+		classes := d.u32()
+		mask := d.u32()
+
+		node, status := s.node(id.String())
+		if status != StatusGood {
+			e.u32(status)
+			e.null()
+			e.i32(0)
+			continue
+		}
+		var refs []*uaReference
+		for _, ref := range s.references(node) {
+			if ref.Target == nil || !ref.matches(refType, subtypes) {
+				continue
+			}
+			if direction == 0 && !ref.Forward || direction == 1 && ref.Forward {
+				continue
+			}
+			if classes != 0 && classes&uint32(ref.Target.Class) == 0 {
+				continue
+			}
+			refs = append(refs, ref)
+		}
+
+		e.u32(StatusGood)
+		e.null()
+		e.i32(int32(len(refs)))
+		for _, ref := range refs {
+			s.referenceDescription(e, ref, mask)
+		}
+	}
+	e.i32(0)
+	return e, StatusGood
+}
+
+// referenceDescription encodes ref, with the fields not in mask left null.
+func (s *OPCUAServer) referenceDescription(e *uaEncoder, ref *uaReference, mask uint32) {
+	t := ref.Target
+	if mask&0x01 != 0 {
+		e.nodeID(uaNodeID{Kind: uaNumericNodeID, Num: ref.Type})
+	} else {
+		e.nodeID(uaNodeID{})
+	}
+	e.boolean(ref.Forward)
+	e.nodeID(parseUANodeID(t.NodeID))
+	if mask&0x08 != 0 {
+		e.qname(&uaQName{s.namespace(t), t.BrowseName})
+	} else {
+		e.qname(&uaQName{})
+	}
+	if mask&0x10 != 0 {
+		e.text(t.BrowseName)
+	} else {
+		e.u8(0)
+	}
+	if mask&0x04 != 0 {
+		e.u32(uint32(t.Class))
+	} else {
+		e.u32(0)
+	}
+	if mask&0x20 != 0 {
+		e.nodeID(uaNodeID{Kind: uaNumericNodeID, Num: s.typeDefinition(t)})
+	} else {
+		e.nodeID(uaNodeID{})
+	}
+}
+
+// browseNext has no continuation points to follow, as browse returns every
+// reference at once.
+func (s *OPCUAServer) browseNext(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	d.boolean()
+	n := d.count()
+	e := &uaEncoder{}
+	e.i32(int32(n))
+	for i := 0; i < n; i++ {
+		d.bytes()
+		e.u32(StatusBadContinuationPointInvalid)
+		e.null()
+		e.i32(0)
+	}
+	e.i32(0)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) readService(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	d.f64()
+	timestamps := d.u32()
+	n := d.count()
+	if d.err == nil && timestamps > 3 {
+		return nil, StatusBadTimestampsToReturnInvalid
+	}
+	if d.err == nil && n == 0 {
+		return nil, StatusBadNothingToDo
+	}
+
+	e := &uaEncoder{}
+	e.i32(int32(n))
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		id := d.nodeID()
+		attr := d.u32()
+		d.str()
+		d.qname()
+		e.dataValue(s.read(id.String(), attr), timestamps, now)
+	}
+	e.i32(0)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) write(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	n := d.count()
+	if d.err == nil && n == 0 {
+		return nil, StatusBadNothingToDo
+	}
+
+	e := &uaEncoder{}
+	e.i32(int32(n))
+	for i := 0; i < n; i++ {
+		id := d.nodeID().String()
+		attr := d.u32()
+		d.str()
+		v := d.dataValue()
+		switch {
+		case d.err != nil:
+			return nil, StatusBadDecodingError
+		case attr != uaAttrValue:
+			e.u32(StatusBadWriteNotSupported)
+		case s.std[id] != nil:
+			e.u32(StatusBadNotWritable)
+		default:
+			e.u32(s.space.Write(id, v.Value))
+		}
+	}
+	e.i32(0)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) createSubscription(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	sub := &uaSubscription{
+		id:      s.nextID(),
+		server:  s,
+		session: r.session,
+		items:   map[uint32]*uaItem{},
+		sent:    map[uint32][]byte{},
+		done:    make(chan struct{}),
+	}
+	sub.revise(d.f64(), d.u32(), d.u32(), d.u32())
+	sub.enabled = d.boolean()
+	d.u8()
+	if d.err != nil {
+		return nil, StatusBadDecodingError
+	}
+	sub.idle = sub.keepAlive
+
+	r.session.mu.Lock()
+	r.session.subs[sub.id] = sub
+	r.session.mu.Unlock()
+	go sub.run()
+
+	e := &uaEncoder{}
+	e.u32(sub.id)
+	sub.revised(e)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) modifySubscription(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	sub := r.session.subscription(d.u32())
+	interval, lifetime, keepAlive, max := d.f64(), d.u32(), d.u32(), d.u32()
+	d.u8()
+	if d.err != nil {
+		return nil, StatusBadDecodingError
+	}
+	if sub == nil {
+		return nil, StatusBadSubscriptionIdInvalid
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.revise(interval, lifetime, keepAlive, max)
+	e := &uaEncoder{}
+	sub.revised(e)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) setPublishingMode(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	enabled := d.boolean()
+	ids := d.u32s()
+	e := &uaEncoder{}
+	e.i32(int32(len(ids)))
+	for _, id := range ids {
+		sub := r.session.subscription(id)
+		if sub == nil {
+			e.u32(StatusBadSubscriptionIdInvalid)
+			continue
+		}
+		sub.mu.Lock()
+		sub.enabled = enabled
+		sub.mu.Unlock()
+		e.u32(StatusGood)
+	}
+	e.i32(0)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) deleteSubscriptions(r *uaRequest) (*uaEncoder, uint32) {
+	ids := r.body.u32s()
+	e := &uaEncoder{}
+	e.i32(int32(len(ids)))
+	for _, id := range ids {
+		if r.session.deleteSubscription(id) {
+			e.u32(StatusGood)
+		} else {
+			e.u32(StatusBadSubscriptionIdInvalid)
+		}
+	}
+	e.i32(0)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) createMonitoredItems(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	sub := r.session.subscription(d.u32())
+	timestamps := d.u32()
+	n := d.count()
+	switch {
+	case d.err != nil:
+		return nil, StatusBadDecodingError
+	case sub == nil:
+		return nil, StatusBadSubscriptionIdInvalid
+	case timestamps > 3:
+		return nil, StatusBadTimestampsToReturnInvalid
+	case n == 0:
+		return nil, StatusBadNothingToDo
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	e := &uaEncoder{}
+	e.i32(int32(n))
+	for i := 0; i < n; i++ {
+		item := &uaItem{node: d.nodeID().String(), attr: d.u32(), timestamps: timestamps}
+		d.str()
+		d.qname()
+		item.mode = d.u32()
+		item.handle = d.u32()
+		d.f64()
+		d.extension()
+		d.u32()
+		d.boolean()
+		if d.err != nil {
+			return nil, StatusBadDecodingError
+		}
+
+		status := s.read(item.node, item.attr).Status
+		switch {
+		case status == StatusBadNodeIdUnknown || status == StatusBadAttributeIdInvalid:
+		case item.mode > 2:
+			status = StatusBadMonitoringModeInvalid
+		default:
+			status = StatusGood
+			item.id = s.nextID()
+			sub.items[item.id] = item
+		}
+		e.u32(status)
+		e.u32(item.id)
+		e.f64(sub.interval.Seconds() * 1000)
+		e.u32(1)
+		e.nodeID(uaNodeID{})
+		e.u8(0)
+	}
+	e.i32(0)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) modifyMonitoredItems(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	sub := r.session.subscription(d.u32())
+	timestamps := d.u32()
+	n := d.count()
+	switch {
+	case d.err != nil:
+		return nil, StatusBadDecodingError
+	case sub == nil:
+		return nil, StatusBadSubscriptionIdInvalid
+	case timestamps > 3:
+		return nil, StatusBadTimestampsToReturnInvalid
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	e := &uaEncoder{}
+	e.i32(int32(n))
+	for i := 0; i < n; i++ {
+		item := sub.items[d.u32()]
+		handle := d.u32()
+		d.f64()
+		d.extension()
+		d.u32()
+		d.boolean()
+		if item == nil {
+			e.u32(StatusBadMonitoredItemIdInvalid)
+		} else {
+			item.handle, item.timestamps = handle, timestamps
+			e.u32(StatusGood)
+		}
+		e.f64(sub.interval.Seconds() * 1000)
+		e.u32(1)
+		e.nodeID(uaNodeID{})
+		e.u8(0)
+	}
+	e.i32(0)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) setMonitoringMode(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	sub := r.session.subscription(d.u32())
+	mode := d.u32()
+	ids := d.u32s()
+	switch {
+	case d.err != nil:
+		return nil, StatusBadDecodingError
+	case sub == nil:
+		return nil, StatusBadSubscriptionIdInvalid
+	case mode > 2:
+		return nil, StatusBadMonitoringModeInvalid
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	e := &uaEncoder{}
+	e.i32(int32(len(ids)))
+	for _, id := range ids {
+		item := sub.items[id]
+		if item == nil {
+			e.u32(StatusBadMonitoredItemIdInvalid)
+			continue
+		}
+		item.mode = mode
+		e.u32(StatusGood)
+	}
+	e.i32(0)
+	return e, StatusGood
+}
+
+func (s *OPCUAServer) deleteMonitoredItems(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	sub := r.session.subscription(d.u32())
+	ids := d.u32s()
+	switch {
+	case d.err != nil:
+		return nil, StatusBadDecodingError
+	case sub == nil:
+		return nil, StatusBadSubscriptionIdInvalid
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	e := &uaEncoder{}
+	e.i32(int32(len(ids)))
+	for _, id := range ids {
+		if sub.items[id] == nil {
+			e.u32(StatusBadMonitoredItemIdInvalid)
+			continue
+		}
+		delete(sub.items, id)
+		e.u32(StatusGood)
+	}
+	e.i32(0)
+	return e, StatusGood
+}
+
+// publish acknowledges the notifications of the request and queues it, to be
+// answered by the next subscription with notifications or a keep alive.
+func (s *OPCUAServer) publish(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	n := d.count()
+	for i := 0; i < n; i++ {
+		sub := r.session.subscription(d.u32())
+		seq := d.u32()
+		switch {
+		case sub == nil:
+			r.results = append(r.results, StatusBadSubscriptionIdInvalid)
+		case !sub.ack(seq):
+			r.results = append(r.results, StatusBadSequenceNumberUnknown)
+		default:
+			r.results = append(r.results, StatusGood)
+		}
+	}
+	if d.err != nil {
+		return nil, StatusBadDecodingError
+	}
+
+	session := r.session
+	session.mu.Lock()
+	if len(session.subs) == 0 {
+		session.mu.Unlock()
+		return nil, StatusBadNoSubscription
+	}
+	session.publishes = append(session.publishes, r)
+	var dropped *uaRequest
+	if len(session.publishes) > uaMaxPublishes {
+		dropped, session.publishes = session.publishes[0], session.publishes[1:]
+	}
+	session.mu.Unlock()
+	if dropped != nil {
+		dropped.fault(StatusBadTooManyPublishRequests)
+	}
+	return nil, StatusGood
+}
+
+func (s *OPCUAServer) republish(r *uaRequest) (*uaEncoder, uint32) {
+	d := r.body
+	sub := r.session.subscription(d.u32())
+	seq := d.u32()
+	switch {
+	case d.err != nil:
+		return nil, StatusBadDecodingError
+	case sub == nil:
+		return nil, StatusBadSubscriptionIdInvalid
+	}
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	msg, ok := sub.sent[seq]
+	if !ok {
+		return nil, StatusBadMessageNotAvailable
+	}
+	return &uaEncoder{b: msg}, StatusGood
+}
+
+func uaNonce() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}
+
+// secure channel --------------------------------------------------------------
+
+// uaChannel is an opc.tcp connection holding a secure channel without
+// security. Chunks are sent under mu, as subscriptions reply to publish
+// requests from their own goroutines.
+type uaChannel struct {
+	server   *OPCUAServer
+	conn     net.Conn
+	id       uint32
+	token    uint32
+	seq      uint32
+	sendSize int
+	recvSize int
+	chunks   map[uint32][]byte
+	mu       sync.Mutex
+}
+
+func (ch *uaChannel) run() error {
+	ch.recvSize = uaBufferSize
+	kind, _, body, err := ch.read()
+	if err != nil {
+		return err
+	}
+	if kind != "HEL" {
+		ch.fail(StatusBadTcpMessageTypeInvalid, "expected hello")
+		return fmt.Errorf("expected hello, got %s", kind)
+	}
+	d := &uaDecoder{b: body}
+	d.u32()
+	recv, send := int(d.u32()), int(d.u32())
+	if d.err != nil || recv < 8192 || send < 8192 {
+		ch.fail(StatusBadDecodingError, "invalid hello")
+		return fmt.Errorf("invalid hello")
+	}
+	ch.recvSize = minInt(send, uaBufferSize)
+	ch.sendSize = minInt(recv, uaBufferSize)
+
+	ack := &uaEncoder{}
+	ack.u32(0)
+	ack.u32(uint32(ch.recvSize))
+	ack.u32(uint32(ch.sendSize))
+	ack.u32(uaMaxMessage)
+	ack.u32(0)
+	ch.mu.Lock()
+	err = ch.write("ACK", 'F', ack.b)
+	ch.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for {
+		kind, chunk, body, err := ch.read()
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case "OPN":
+			if err := ch.open(body); err != nil {
+				return err
+			}
+		case "CLO":
+			return io.EOF
+		case "MSG":
+			if err := ch.receive(chunk, body); err != nil {
+				return err
+			}
+		default:
+			ch.fail(StatusBadTcpMessageTypeInvalid, "unexpected "+kind)
+			return fmt.Errorf("unexpected message %s", kind)
+		}
+	}
+}
+
+// read returns the type, chunk type and body of the next chunk.
+func (ch *uaChannel) read() (string, byte, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(ch.conn, header); err != nil {
+		return "", 0, nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(header[4:]))
+	if size < 8 || size > ch.recvSize {
+		ch.fail(StatusBadTcpMessageTooLarge, "chunk too large")
+		return "", 0, nil, fmt.Errorf("invalid chunk size %d", size)
+	}
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(ch.conn, body); err != nil {
+		return "", 0, nil, err
+	}
+	return string(header[:3]), header[3], body, nil
+}
+
+// open issues or renews the secure channel.
+func (ch *uaChannel) open(body []byte) error {
+	d := &uaDecoder{b: body}
+	id := d.u32()
+	policy := d.str()
+	d.bytes()
+	d.bytes()
+	d.u32()
+	reqID := d.u32()
+	typeID := d.nodeID()
+	header := d.requestHeader()
+	d.u32()
+	renew := d.u32() == 1
+	mode := d.u32()
+	d.bytes()
+	lifetime := d.u32()
+
+	switch {
+	case d.err != nil || typeID.Num != uaOpenSecureChannelRequest:
+		ch.fail(StatusBadDecodingError, "invalid open secure channel request")
+		return fmt.Errorf("invalid open secure channel request")
+	case policy != uaSecurityPolicyNone:
+		ch.fail(StatusBadSecurityPolicyRejected, policy)
+		return fmt.Errorf("security policy %s rejected", policy)
+	case mode != uaSecurityModeNone:
+		ch.fail(StatusBadSecurityModeRejected, "only the None security mode is supported")
+		return fmt.Errorf("security mode %d rejected", mode)
+	case renew && id != ch.id:
+		ch.fail(StatusBadSecureChannelIdInvalid, "unknown secure channel")
+		return fmt.Errorf("renew of unknown secure channel %d", id)
+	case !renew && ch.id != 0:
+		ch.fail(StatusBadSecureChannelIdInvalid, "secure channel already open")
+		return fmt.Errorf("secure channel %d opened again", ch.id)
+	}
+	if !renew {
+		ch.id = ch.server.nextID()
+	}
+	if lifetime < 10000 {
+		lifetime = 10000
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.token++
+	e := &uaEncoder{}
+	e.u32(ch.id)
+	e.str(uaSecurityPolicyNone)
+	e.null()
+	e.null()
+	ch.seq++
+	e.u32(ch.seq)
+	e.u32(reqID)
+	e.nodeID(uaNodeID{Kind: uaNumericNodeID, Num: uaOpenSecureChannelResponse})
+	e.responseHeader(header.Handle, StatusGood)
+	e.u32(0)
+	e.u32(ch.id)
+	e.u32(ch.token)
+	e.time(time.Now())
+	e.u32(lifetime)
+	e.bytes([]byte{})
+	return ch.write("OPN", 'F', e.b)
+}
+
+// receive joins the chunks of a message, handling it once complete.
+func (ch *uaChannel) receive(chunk byte, body []byte) error {
+	d := &uaDecoder{b: body}
+	id := d.u32()
+	d.u32()
+	d.u32()
+	reqID := d.u32()
+	if d.err != nil || ch.id == 0 || id != ch.id {
+		ch.fail(StatusBadSecureChannelIdInvalid, "unknown secure channel")
+		return fmt.Errorf("message for unknown secure channel %d", id)
+	}
+
+	msg := append(ch.chunks[reqID], d.b...)
+	switch chunk {
+	case 'C':
+		if len(msg) > uaMaxMessage {
+			ch.fail(StatusBadTcpMessageTooLarge, "message too large")
+			return fmt.Errorf("message of more than %d bytes", uaMaxMessage)
+		}
+		ch.chunks[reqID] = msg
+	case 'A':
+		delete(ch.chunks, reqID)
+	default:
+		delete(ch.chunks, reqID)
+		if len(msg) >= 4 && binary.LittleEndian.Uint16(msg[2:]) == uaCloseSecureChannelRequest && msg[0] == 1 {
+			return io.EOF
+		}
+		ch.server.handle(ch, reqID, msg)
+	}
+	return nil
+}
+
+// send sends msg as the reply to reqID, in chunks of the size the client
+// takes.
+func (ch *uaChannel) send(reqID uint32, msg []byte) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	max := ch.sendSize - 24
+	for {
+		n, chunk := len(msg), byte('F')
+		if n > max {
+			n, chunk = max, 'C'
+		}
+		e := &uaEncoder{}
+		e.u32(ch.id)
+		e.u32(ch.token)
+		ch.seq++
+		e.u32(ch.seq)
+		e.u32(reqID)
+		if err := ch.write("MSG", chunk, append(e.b, msg[:n]...)); err != nil {
+			return
+		}
+		if msg = msg[n:]; chunk == 'F' {
+			return
+		}
+	}
+}
+
+// write sends a chunk, with ch.mu held.
+func (ch *uaChannel) write(kind string, chunk byte, body []byte) error {
+	header := make([]byte, 8)
+	copy(header, kind)
+	header[3] = chunk
+	binary.LittleEndian.PutUint32(header[4:], uint32(8+len(body)))
+	ch.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := ch.conn.Write(append(header, body...))
+	return err
+}
+
+// fail sends an error message, before the connection is closed.
+func (ch *uaChannel) fail(status uint32, reason string) {
+	e := &uaEncoder{}
+	e.u32(status)
+	e.str(reason)
+	ch.mu.Lock()
+	ch.write("ERR", 'F', e.b)
+	ch.mu.Unlock()
+}
+
+// sessions --------------------------------------------------------------------
+
+// uaSession holds the subscriptions of a client and its publish requests, to
+// be answered by the subscriptions.
+type uaSession struct {
+	id        uaNodeID
+	token     uaNodeID
+	ch        *uaChannel
+	activated bool
+	publishes []*uaRequest
+	subs      map[uint32]*uaSubscription
+	mu        sync.Mutex
+}
+
+func (s *uaSession) subscription(id uint32) *uaSubscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subs[id]
+}
+
+// takePublish returns the oldest publish request queued, nil when none is.
+func (s *uaSession) takePublish() *uaRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.publishes) == 0 {
+		return nil
+	}
+	r := s.publishes[0]
+	s.publishes = s.publishes[1:]
+	return r
+}
+
+func (s *uaSession) waiting() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.publishes) > 0
+}
+
+// deleteSubscription stops the subscription id. Publish requests left without
+// subscriptions are answered with BadNoSubscription.
+func (s *uaSession) deleteSubscription(id uint32) bool {
+	s.mu.Lock()
+	sub := s.subs[id]
+	delete(s.subs, id)
+	var orphans []*uaRequest
+	if len(s.subs) == 0 {
+		orphans, s.publishes = s.publishes, nil
+	}
+	s.mu.Unlock()
+
+	if sub == nil {
+		return false
+	}
+	sub.stop()
+	for _, r := range orphans {
+		r.fault(StatusBadNoSubscription)
+	}
+	return true
+}
+
+// close stops the subscriptions and answers the publish requests queued.
+func (s *uaSession) close() {
+	s.mu.Lock()
+	subs, publishes := s.subs, s.publishes
+	s.subs, s.publishes = map[uint32]*uaSubscription{}, nil
+	s.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.stop()
+	}
+	for _, r := range publishes {
+		r.fault(StatusBadSessionClosed)
+	}
+}
+
+// subscriptions ---------------------------------------------------------------
+
+// uaSubscription samples its monitored items every publishing interval, and
+// answers a publish request of its session with the items changed, or with a
+// keep alive after keepAlive intervals without changes. It ends after
+// lifetime intervals without publish requests.
+type uaSubscription struct {
+	id        uint32
+	server    *OPCUAServer
+	session   *uaSession
+	interval  time.Duration
+	lifetime  uint32
+	keepAlive uint32
+	max       uint32
+	enabled   bool
+	items     map[uint32]*uaItem
+	seq       uint32
+	idle      uint32
+	starved   uint32
+	sent      map[uint32][]byte
+	done      chan struct{}
+	once      sync.Once
+	mu        sync.Mutex
+}
+
+// uaItem is a monitored item, holding the last sample reported or waiting to
+// be.
+type uaItem struct {
+	id         uint32
+	node       string
+	attr       uint32
+	handle     uint32
+	mode       uint32
+	timestamps uint32
+	last       []byte
+	pending    *DataValue
+}
+
+func (s *uaSubscription) run() {
+	for {
+		s.mu.Lock()
+		interval := s.interval
+		s.mu.Unlock()
+		select {
+		case <-s.done:
+			return
+		case <-time.After(interval):
+		}
+		if !s.cycle() {
+			s.session.deleteSubscription(s.id)
+			return
+		}
+	}
+}
+
+// cycle samples the items and publishes what changed, telling if the
+// subscription is still alive.
+func (s *uaSubscription) cycle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.session.waiting() {
+		s.starved = 0
+	} else if s.starved++; s.starved >= s.lifetime {
+		return false
+	}
+
+	ids := make([]int, 0, len(s.items))
+	for id, item := range s.items {
+		ids = append(ids, int(id))
+		if item.mode == 0 {
+			continue
+		}
+		v := s.server.read(item.node, item.attr)
+		sample := &uaEncoder{}
+		sample.variant(v.Value)
+		sample.u32(v.Status)
+		if !bytes.Equal(sample.b, item.last) {
+			item.last = sample.b
+			item.pending = v
+		}
+	}
+	sort.Ints(ids)
+
+	var changed []*uaItem
+	for _, id := range ids {
+		item := s.items[uint32(id)]
+		if item.mode == 2 && item.pending != nil && (s.max == 0 || len(changed) < int(s.max)) {
+			changed = append(changed, item)
+		}
+	}
+
+	if s.enabled && len(changed) > 0 {
+		r := s.session.takePublish()
+		if r == nil {
+			return true
+		}
+		s.seq++
+		msg := s.message(s.seq, changed)
+		s.sent[s.seq] = msg
+		if len(s.sent) > uaMaxRetransmits {
+			delete(s.sent, s.seq-uaMaxRetransmits)
+		}
+		for _, item := range changed {
+			item.pending = nil
+		}
+		more := false
+		for _, item := range s.items {
+			more = more || item.mode == 2 && item.pending != nil
+		}
+		s.publish(r, msg, more)
+		s.idle = 0
+		return true
+	}
+
+	if s.idle++; s.idle >= s.keepAlive {
+		if r := s.session.takePublish(); r != nil {
+			s.publish(r, s.message(s.seq+1, nil), false)
+			s.idle = 0
+		}
+	}
+	return true
+}
+
+// message encodes a notification message with the pending values of items,
+// a keep alive when there are none.
+func (s *uaSubscription) message(seq uint32, items []*uaItem) []byte {
+	now := time.Now()
+	e := &uaEncoder{}
+	e.u32(seq)
+	e.time(now)
+	if len(items) == 0 {
+		e.i32(0)
+		return e.b
+	}
+
+	n := &uaEncoder{}
+	n.i32(int32(len(items)))
+	for _, item := range items {
+		n.u32(item.handle)
+		n.dataValue(item.pending, item.timestamps, now)
+	}
+	n.i32(0)
+
+	e.i32(1)
+	e.nodeID(uaNodeID{Kind: uaNumericNodeID, Num: uaDataChangeNotification})
+	e.u8(1)
+	e.bytes(n.b)
+	return e.b
+}
+
+// publish answers r with the notification message msg, with s.mu held.
+func (s *uaSubscription) publish(r *uaRequest, msg []byte, more bool) {
+	seqs := make([]int, 0, len(s.sent))
+	for seq := range s.sent {
+		seqs = append(seqs, int(seq))
+	}
+	sort.Ints(seqs)
+
+	e := &uaEncoder{}
+	e.u32(s.id)
+	e.i32(int32(len(seqs)))
+	for _, seq := range seqs {
+		e.u32(uint32(seq))
+	}
+	e.boolean(more)
+	e.b = append(e.b, msg...)
+	e.i32(int32(len(r.results)))
+	for _, status := range r.results {
+		e.u32(status)
+	}
+	e.i32(0)
+	r.reply(uaPublishResponse, e.b)
+}
+
+// ack drops the notification message seq kept for republishing.
+func (s *uaSubscription) ack(seq uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.sent[seq]
+	delete(s.sent, seq)
+	return ok
+}
+
+// revise sets the publishing parameters, within the limits of the server.
+func (s *uaSubscription) revise(interval float64, lifetime uint32, keepAlive uint32, max uint32) {
+	s.interval = time.Duration(interval * float64(time.Millisecond))
+	if s.interval < uaMinInterval {
+		s.interval = uaMinInterval
+	}
+	if s.interval > time.Hour {
+		s.interval = time.Hour
+	}
+	if keepAlive == 0 {
+		keepAlive = 10
+	}
+	if lifetime < 3*keepAlive {
+		lifetime = 3 * keepAlive
+	}
+	s.lifetime, s.keepAlive, s.max = lifetime, keepAlive, max
+}
+
+func (s *uaSubscription) revised(e *uaEncoder) {
+	e.f64(s.interval.Seconds() * 1000)
+	e.u32(s.lifetime)
+	e.u32(s.keepAlive)
+}
+
+func (s *uaSubscription) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// ua binary -------------------------------------------------------------------
+
+// uaNodeID kinds.
+const (
+	uaNumericNodeID = 2
+	uaStringNodeID  = 3
+	uaGuidNodeID    = 4
+	uaOpaqueNodeID  = 5
+)
+
+// uaNodeID is a node id as encoded. Str holds the identifier of string ids,
+// and the bytes of guid and opaque ones.
+type uaNodeID struct {
+	NS   uint16
+	Kind byte
+	Num  uint32
+	Str  string
+}
+
+// String formats id as in the address space, as i=85 or ns=1;s=tank-0.
+func (id uaNodeID) String() string {
+	ns := ""
+	if id.NS != 0 {
+		ns = fmt.Sprintf("ns=%d;", id.NS)
+	}
+	switch id.Kind {
+	case uaStringNodeID:
+		return ns + "s=" + id.Str
+	case uaGuidNodeID:
+		return ns + "g=" + fmt.Sprintf("%x", id.Str)
+	case uaOpaqueNodeID:
+		return ns + "b=" + base64.StdEncoding.EncodeToString([]byte(id.Str))
+	}
+	return ns + "i=" + strconv.FormatUint(uint64(id.Num), 10)
+}
+
+func (id uaNodeID) null() bool {
+	return id.NS == 0 && (id.Kind == uaNumericNodeID || id.Kind == 0) && id.Num == 0
+}
+
+// parseUANodeID parses the numeric and string node ids of the address space.
+func parseUANodeID(s string) uaNodeID {
+	var id uaNodeID
+	if strings.HasPrefix(s, "ns=") {
+		i := strings.Index(s, ";")
+		if i < 0 {
+			return id
+		}
+		ns, _ := strconv.Atoi(s[3:i])
+		id.NS, s = uint16(ns), s[i+1:]
+	}
+	if strings.HasPrefix(s, "s=") {
+		id.Kind, id.Str = uaStringNodeID, s[2:]
+		return id
+	}
+	n, _ := strconv.ParseUint(strings.TrimPrefix(s, "i="), 10, 32)
+	id.Kind, id.Num = uaNumericNodeID, uint32(n)
+	return id
+}
+
+// uaQName is a qualified name.
+type uaQName struct {
+	NS   uint16
+	Name string
+}
+
+// uaText is a localized text without locale.
+type uaText string
+
+type uaRequestHeader struct {
+	Token  uaNodeID
+	Handle uint32
+}
+
+// uaDecoder reads the binary encoding. The first error is kept in err, and
+// reads after it return zero values.
+type uaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *uaDecoder) read(n int) []byte {
+	if d.err == nil && (n < 0 || n > len(d.b)) {
+		d.err = fmt.Errorf("truncated opc ua message")
+	}
+	if d.err != nil {
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *uaDecoder) u8() byte {
+	if b := d.read(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *uaDecoder) u16() uint16 {
+	if b := d.read(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) u32() uint32 {
+	if b := d.read(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) u64() uint64 {
+	if b := d.read(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) boolean() bool {
+	return d.u8() != 0
+}
+
+func (d *uaDecoder) f64() float64 {
+	return math.Float64frombits(d.u64())
+}
+
+func (d *uaDecoder) bytes() []byte {
+	n := int32(d.u32())
+	if n < 0 {
+		return nil
+	}
+	return d.read(int(n))
+}
+
+func (d *uaDecoder) str() string {
+	return string(d.bytes())
+}
+
+// count reads the length of an array, null arrays being empty.
+func (d *uaDecoder) count() int {
+	n := int32(d.u32())
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(d.b) && d.err == nil {
+		d.err = fmt.Errorf("invalid opc ua array length %d", n)
+	}
+	if d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *uaDecoder) strs() []string {
+	l := []string{}
+	for i, n := 0, d.count(); i < n; i++ {
+		l = append(l, d.str())
+	}
+	return l
+}
+
+func (d *uaDecoder) u32s() []uint32 {
+	l := []uint32{}
+	for i, n := 0, d.count(); i < n; i++ {
+		l = append(l, d.u32())
+	}
+	return l
+}
+
+func (d *uaDecoder) time() time.Time {
+	ticks := int64(d.u64())
+	if ticks == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, (ticks-uaEpoch)*100).UTC()
+}
+
+func (d *uaDecoder) nodeID() uaNodeID {
+	var id uaNodeID
+	switch d.u8() & 0x3f {
+	case 0:
+		id.Kind, id.Num = uaNumericNodeID, uint32(d.u8())
+	case 1:
+		id.Kind, id.NS, id.Num = uaNumericNodeID, uint16(d.u8()), uint32(d.u16())
+	case 2:
+		id.Kind, id.NS, id.Num = uaNumericNodeID, d.u16(), d.u32()
+	case 3:
+		id.Kind, id.NS, id.Str = uaStringNodeID, d.u16(), d.str()
+	case 4:
+		id.Kind, id.NS, id.Str = uaGuidNodeID, d.u16(), string(d.read(16))
+	case 5:
+		id.Kind, id.NS, id.Str = uaOpaqueNodeID, d.u16(), d.str()
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("invalid opc ua node id")
+		}
+	}
+	return id
+}
+
+func (d *uaDecoder) expandedNodeID() uaNodeID {
+	flags := len(d.b) > 0 && d.err == nil
+	var mask byte
+	if flags {
+		mask = d.b[0]
+	}
+	id := d.nodeID()
+	if mask&0x80 != 0 {
+		d.str()
+	}
+	if mask&0x40 != 0 {
+		d.u32()
+	}
+	return id
+}
+
+func (d *uaDecoder) qname() *uaQName {
+	return &uaQName{d.u16(), d.str()}
+}
+
+func (d *uaDecoder) text() uaText {
+	mask := d.u8()
+	if mask&0x01 != 0 {
+		d.str()
+	}
+	if mask&0x02 != 0 {
+		return uaText(d.str())
+	}
+	return ""
+}
+
+// extension reads an extension object, returning its type and body.
+func (d *uaDecoder) extension() (uaNodeID, []byte) {
+	id := d.nodeID()
+	if d.u8() == 0 {
+		return id, nil
+	}
+	return id, d.bytes()
+}
+
+func (d *uaDecoder) application() {
+	d.str()
+	d.str()
+	d.text()
+	d.u32()
+	d.str()
+	d.str()
+	d.strs()
+}
+
+func (d *uaDecoder) requestHeader() *uaRequestHeader {
+	h := &uaRequestHeader{Token: d.nodeID()}
+	d.time()
+	h.Handle = d.u32()
+	d.u32()
+	d.str()
+	d.u32()
+	d.extension()
+	return h
+}
+
+func (d *uaDecoder) dataValue() *DataValue {
+	v := &DataValue{}
+	mask := d.u8()
+	if mask&0x01 != 0 {
+		v.Value = d.variant()
+	}
+	if mask&0x02 != 0 {
+		v.Status = d.u32()
+	}
+	if mask&0x04 != 0 {
+		v.SourceTimestamp = d.time()
+	}
+	if mask&0x10 != 0 {
+		d.u16()
+	}
+	if mask&0x08 != 0 {
+		d.time()
+	}
+	if mask&0x20 != 0 {
+		d.u16()
+	}
+	return v
+}
+
+func (d *uaDecoder) diagnosticInfo() {
+	mask := d.u8()
+	for _, bit := range []byte{0x01, 0x02, 0x08, 0x04} {
+		if mask&bit != 0 {
+			d.u32()
+		}
+	}
+	if mask&0x10 != 0 {
+		d.str()
+	}
+	if mask&0x20 != 0 {
+		d.u32()
+	}
+	if mask&0x40 != 0 {
+		d.diagnosticInfo()
+	}
+}
+
+// variant reads a variant, with integers as int64 and arrays as
+// []interface{}.
+func (d *uaDecoder) variant() interface{} {
+	mask := d.u8()
+	if mask&0x80 == 0 {
+		return d.scalar(mask & 0x3f)
+	}
+	n := d.count()
+	l := make([]interface{}, n)
+	for i := range l {
+		l[i] = d.scalar(mask & 0x3f)
+	}
+	if mask&0x40 != 0 {
+		d.u32s()
+	}
+	return l
+}
+
+func (d *uaDecoder) scalar(t byte) interface{} {
+	switch t {
+	case 0:
+		return nil
+	case uaBoolean:
+		return d.boolean()
+	case uaSByte:
+		return int64(int8(d.u8()))
+	case uaByte:
+		return int64(d.u8())
+	case uaInt16:
+		return int64(int16(d.u16()))
+	case uaUInt16:
+		return int64(d.u16())
+	case uaInt32:
+		return int64(int32(d.u32()))
+	case uaUInt32:
+		return int64(d.u32())
+	case uaInt64, uaUInt64:
+		return int64(d.u64())
+	case uaFloat:
+		return float64(math.Float32frombits(d.u32()))
+	case uaDouble:
+		return d.f64()
+	case uaString:
+		return d.str()
+	case uaDateTime:
+		return d.time()
+	case uaGuid:
+		return string(d.read(16))
+	case uaByteString, uaXmlElement:
+		return d.bytes()
+	case uaNodeIDType:
+		return d.nodeID()
+	case uaExpandedNodeID:
+		return d.expandedNodeID()
+	case uaStatusCode:
+		return int64(d.u32())
+	case uaQualifiedName:
+		return d.qname()
+	case uaLocalizedText:
+		return d.text()
+	case uaExtensionObject:
+		_, b := d.extension()
+		return b
+	case uaDataValue:
+		return d.dataValue()
+	case uaVariant:
+		return d.variant()
+	case uaDiagnosticInfo:
+		d.diagnosticInfo()
+		return nil
+	}
+	if d.err == nil {
+		d.err = fmt.Errorf("invalid opc ua variant type %d", t)
+	}
+	return nil
+}
+
+// uaEncoder writes the binary encoding.
+type uaEncoder struct {
+	b []byte
+}
+
+func (e *uaEncoder) u8(v byte) {
+	e.b = append(e.b, v)
+}
+
+func (e *uaEncoder) u16(v uint16) {
+	e.b = append(e.b, byte(v), byte(v>>8))
+}
+
+func (e *uaEncoder) u32(v uint32) {
+	e.b = append(e.b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *uaEncoder) i32(v int32) {
+	e.u32(uint32(v))
+}
+
+func (e *uaEncoder) u64(v uint64) {
+	e.u32(uint32(v))
+	e.u32(uint32(v >> 32))
+}
+
+func (e *uaEncoder) f64(v float64) {
+	e.u64(math.Float64bits(v))
+}
+
+func (e *uaEncoder) boolean(v bool) {
+	if v {
+		e.u8(1)
+	} else {
+		e.u8(0)
+	}
+}
+
+func (e *uaEncoder) bytes(b []byte) {
+	if b == nil {
+		e.null()
+		return
+	}
+	e.i32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *uaEncoder) str(s string) {
+	e.i32(int32(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// null writes a null string, byte string or array.
+func (e *uaEncoder) null() {
+	e.i32(-1)
+}
+
+func (e *uaEncoder) strs(l []string) {
+	e.i32(int32(len(l)))
+	for _, s := range l {
+		e.str(s)
+	}
+}
+
+func (e *uaEncoder) time(t time.Time) {
+	if t.IsZero() {
+		e.u64(0)
+		return
+	}
+	e.u64(uint64(t.UnixNano()/100 + uaEpoch))
+}
+
+func (e *uaEncoder) nodeID(id uaNodeID) {
+	switch id.Kind {
+	case uaStringNodeID, uaOpaqueNodeID:
+		e.u8(id.Kind)
+		e.u16(id.NS)
+		e.str(id.Str)
+	case uaGuidNodeID:
+		e.u8(id.Kind)
+		e.u16(id.NS)
+		e.b = append(e.b, id.Str...)
+	default:
+		switch {
+		case id.NS == 0 && id.Num <= 0xff:
+			e.b = append(e.b, 0, byte(id.Num))
+		case id.NS <= 0xff && id.Num <= 0xffff:
+			e.b = append(e.b, 1, byte(id.NS))
+			e.u16(uint16(id.Num))
+		default:
+			e.u8(2)
+			e.u16(id.NS)
+			e.u32(id.Num)
+		}
+	}
+}
+
+func (e *uaEncoder) qname(q *uaQName) {
+	e.u16(q.NS)
+	e.str(q.Name)
+}
+
+func (e *uaEncoder) text(s string) {
+	e.u8(0x02)
+	e.str(s)
+}
+
+func (e *uaEncoder) responseHeader(handle uint32, status uint32) {
+	e.time(time.Now())
+	e.u32(handle)
+	e.u32(status)
+	e.u8(0)
+	e.null()
+	e.nodeID(uaNodeID{})
+	e.u8(0)
+}
+
+// dataValue writes v with the timestamps asked: 0 source, 1 server, 2 both
+// and 3 neither.
+func (e *uaEncoder) dataValue(v *DataValue, timestamps uint32, now time.Time) {
+	var mask byte
+	if v.Value != nil {
+		mask |= 0x01
+	}
+	if v.Status != StatusGood {
+		mask |= 0x02
+	}
+	source := !v.SourceTimestamp.IsZero() && (timestamps == 0 || timestamps == 2)
+	if source {
+		mask |= 0x04
+	}
+	server := timestamps == 1 || timestamps == 2
+	if server {
+		mask |= 0x08
+	}
+
+	e.u8(mask)
+	if v.Value != nil {
+		e.variant(v.Value)
+	}
+	if v.Status != StatusGood {
+		e.u32(v.Status)
+	}
+	if source {
+		e.time(v.SourceTimestamp)
+	}
+	if server {
+		e.time(now)
+	}
+}
+
+// variant writes v, typed by its Go type. Other types are sent as strings.
+func (e *uaEncoder) variant(v interface{}) {
+	switch x := v.(type) {
+	case nil:
+		e.u8(0)
+	case bool:
+		e.u8(uaBoolean)
+		e.boolean(x)
+	case byte:
+		e.u8(uaByte)
+		e.u8(x)
+	case int32:
+		e.u8(uaInt32)
+		e.i32(x)
+	case uint32:
+		e.u8(uaUInt32)
+		e.u32(x)
+	case int:
+		e.u8(uaInt64)
+		e.u64(uint64(x))
+	case int64:
+		e.u8(uaInt64)
+		e.u64(uint64(x))
+	case float64:
+		e.u8(uaDouble)
+		e.f64(x)
+	case string:
+		e.u8(uaString)
+		e.str(x)
+	case time.Time:
+		e.u8(uaDateTime)
+		e.time(x)
+	case uaNodeID:
+		e.u8(uaNodeIDType)
+		e.nodeID(x)
+	case *uaQName:
+		e.u8(uaQualifiedName)
+		e.qname(x)
+	case uaText:
+		e.u8(uaLocalizedText)
+		e.text(string(x))
+	case []string:
+		e.u8(uaString | 0x80)
+		e.strs(x)
+	case []uint32:
+		e.u8(uaUInt32 | 0x80)
+		e.i32(int32(len(x)))
+		for _, n := range x {
+			e.u32(n)
+		}
+	default:
+		e.u8(uaString)
+		e.str(fmt.Sprint(v))
+	}
+}
+
+// uaEpoch is the unix epoch in the 100ns intervals since 1601 of opc ua
+// timestamps.
+const uaEpoch = 116444736000000000
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
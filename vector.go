@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fzzy/radix/redis"
+)
+
+// Sample is the state of one vector member read from redis.
+type Sample struct {
+	Tag       string
+	Value     int
+	Quality   int
+	Timestamp int64
+}
+
+func (s *Sample) String() string {
+	return fmt.Sprintf(
+		"Sample{Tag: %s, Value: %d, Quality: %d, Timestamp: %d}",
+		s.Tag,
+		s.Value,
+		s.Quality,
+		s.Timestamp,
+	)
+}
+
+// Aggregate summarizes the samples of a vector. Min, Max, Sum and Mean only
+// account for good quality samples, AnyBad tells whether some were left out.
+type Aggregate struct {
+	Count  int
+	Good   int
+	Min    int
+	Max    int
+	Sum    int
+	Mean   float64
+	AnyBad bool
+}
+
+func (a *Aggregate) String() string {
+	return fmt.Sprintf(
+		"Aggregate{Count: %d, Good: %d, Min: %d, Max: %d, Sum: %d, Mean: %g, AnyBad: %t}",
+		a.Count,
+		a.Good,
+		a.Min,
+		a.Max,
+		a.Sum,
+		a.Mean,
+		a.AnyBad,
+	)
+}
+
+// VectorEvent is emitted by Vector.Watch when a member changes.
+type VectorEvent struct {
+	Change    *Change
+	Aggregate *Aggregate
+}
+
+func (e *VectorEvent) String() string {
+	return fmt.Sprintf("VectorEvent{Change: %s, Aggregate: %s}", e.Change, e.Aggregate)
+}
+
+// vector ----------------------------------------------------------------------
+
+// Read returns a sample of every member, in a single round trip.
+func (v *Vector) Read() ([]*Sample, error) {
+	props := []string{"value", "quality", "timestamp"}
+	keys := make([]interface{}, 0, len(v.Tags)*len(props))
+	for _, tag := range v.Tags {
+		for _, p := range props {
+			keys = append(keys, v.key(tag, p))
+		}
+	}
+	if len(keys) == 0 {
+		return []*Sample{}, nil
+	}
+
+	r, err := v.conn.Mget(keys...)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Elems) != len(keys) {
+		return nil, fmt.Errorf("unexpected reply reading %s", v)
+	}
+
+	samples := make([]*Sample, len(v.Tags))
+	for i, tag := range v.Tags {
+		s := &Sample{Tag: tag, Quality: QualityBad}
+		e := r.Elems[i*len(props):]
+		if e[0].Type != redis.NilReply {
+			s.Value, _ = e[0].Int()
+			s.Quality, _ = e[1].Int()
+			s.Timestamp, _ = e[2].Int64()
+		}
+		samples[i] = s
+	}
+	return samples, nil
+}
+
+// Aggregate reads every member and summarizes them.
+func (v *Vector) Aggregate() (*Aggregate, error) {
+	samples, err := v.Read()
+	if err != nil {
+		return nil, err
+	}
+	return aggregate(samples), nil
+}
+
+// SetAll writes prop with the same value into every member. Members are
+// written through their manager when the vector has one, and otherwise in a
+// single transaction propagated as Mode tells.
+func (v *Vector) SetAll(prop string, value interface{}) error {
+	if v.manager != nil {
+		for _, tag := range v.Tags {
+			if err := v.manager.Set(tag, prop, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	p, c, err := coerceEditable(prop, value)
+	if err != nil {
+		return err
+	}
+	updates := make([]*update, len(v.Tags))
+	for i, tag := range v.Tags {
+		updates[i] = newUpdate(v.Mode, changeTarget(v.Mode, managerName(tag)), tag, p, c)
+	}
+	return writeUpdates(v.conn, updates...)
+}
+
+// VectorWatch delivers the events of Vector.Watch on C, which is closed once
+// the watch is.
+type VectorWatch struct {
+	C      <-chan *VectorEvent
+	feed   *Feed
+	psconn *Client
+}
+
+func (w *VectorWatch) String() string {
+	return fmt.Sprintf("VectorWatch{Feed: %s}", w.feed)
+}
+
+// Close stops the watch and its feed.
+func (w *VectorWatch) Close() error {
+	w.feed.Close()
+	return w.psconn.Close()
+}
+
+// Watch emits an event, with the recomputed aggregate, whenever a member
+// changes its value or quality. The changes are read from a feed of their
+// own, dialed from the vector connection, following the mode of its manager,
+// or Mode when it has none.
+func (v *Vector) Watch() (*VectorWatch, error) {
+	mode, targets := v.Mode, v.changeTargets()
+	if v.manager != nil {
+		mode, targets = v.manager.Mode, v.manager.changeTargets()
+	}
+	psconn, err := v.conn.dial()
+	if err != nil {
+		return nil, err
+	}
+	feed := NewFeed(v.conn, NewPSClient(psconn), mode, targets...)
+	ch, err := v.watch(feed)
+	if err != nil {
+		feed.Close()
+		psconn.Close()
+		return nil, err
+	}
+	return &VectorWatch{C: ch, feed: feed, psconn: psconn}, nil
+}
+
+// changeTargets returns the feed targets of the members, as propagated in
+// Mode.
+func (v *Vector) changeTargets() []string {
+	targets := []string{}
+	seen := map[string]bool{}
+	for _, tag := range v.Tags {
+		t := tag + ":*"
+		if v.Mode != KeyspaceChanges {
+			t = changeTarget(v.Mode, managerName(tag))
+		}
+		if !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// watch emits the events of Watch for the changes reported by feed. The
+// channel is closed when the feed is.
+func (v *Vector) watch(feed *Feed) (<-chan *VectorEvent, error) {
+	samples, err := v.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	members := map[string]*Sample{}
+	for _, s := range samples {
+		members[s.Tag] = s
+	}
+
+	ch := make(chan *VectorEvent)
+	done := feed.Done()
+	go func() {
+		defer close(ch)
+		for {
+			var c *Change
+			select {
+			case c = <-feed.C:
+			case <-done:
+				return
+			}
+
+			s, ok := members[c.Tag]
+			if !ok {
+				continue
+			}
+			p, err := tagSchema.ByKey(c.Prop)
+			if err != nil || (p.Name != "Value" && p.Name != "Quality") {
+				continue
+			}
+			n, err := p.Coerce(fmt.Sprint(c.Value))
+			if err != nil {
+				continue
+			}
+
+			if p.Name == "Value" {
+				s.Value = n.(int)
+			} else {
+				s.Quality = n.(int)
+			}
+			s.Timestamp = c.Timestamp
+
+			select {
+			case ch <- &VectorEvent{c, aggregate(samples)}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// utility ---------------------------------------------------------------------
+
+// coerceEditable returns the tag property prop, named or given by its key,
+// and value converted to it, when users may write it.
+func coerceEditable(prop string, value interface{}) (*Property, interface{}, error) {
+	p, err := tagSchema.Lookup(prop)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !p.Editable {
+		return nil, nil, fmt.Errorf("%s property is not user editable.", prop)
+	}
+	c, err := p.Coerce(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, c, nil
+}
+
+func aggregate(samples []*Sample) *Aggregate {
+	a := &Aggregate{Count: len(samples)}
+	for _, s := range samples {
+		if isBad(s.Quality) {
+			a.AnyBad = true
+			continue
+		}
+		a.Good++
+		a.Sum += s.Value
+		if a.Good == 1 || s.Value < a.Min {
+			a.Min = s.Value
+		}
+		if a.Good == 1 || s.Value > a.Max {
+			a.Max = s.Value
+		}
+	}
+	if a.Good == 0 {
+		return a
+	}
+	a.Mean = float64(a.Sum) / float64(a.Good)
+	return a
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// testFeed returns a feed which isn't watching redis, for tests to send their
+// own changes on.
+func testFeed() *Feed {
+	return &Feed{C: make(chan *Change), done: make(chan struct{})}
+}
+
+func TestAggregate(t *testing.T) {
+	for _, c := range []struct {
+		samples  []*Sample
+		expected Aggregate
+	}{
+		{nil, Aggregate{}},
+		{
+			[]*Sample{{Value: 5, Quality: QualityBad}},
+			Aggregate{Count: 1, AnyBad: true},
+		},
+		{
+			[]*Sample{{Value: -3e9, Quality: QualityGood}, {Value: -4e9, Quality: QualityGood}},
+			Aggregate{Count: 2, Good: 2, Min: -4e9, Max: -3e9, Sum: -7e9, Mean: -3.5e9},
+		},
+		{
+			[]*Sample{{Value: 3e9, Quality: QualityGood}, {Value: 100, Quality: 50}, {Value: 1e9, Quality: QualityGood}},
+			Aggregate{Count: 3, Good: 2, Min: 1e9, Max: 3e9, Sum: 4e9, Mean: 2e9, AnyBad: true},
+		},
+	} {
+		if a := aggregate(c.samples); *a != c.expected {
+			t.Errorf("Expected %s, got %s", &c.expected, a)
+		}
+	}
+}
+
+func TestVectorSetPublishes(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	v := NewVector("v", conn, "@v:a", "@v:b")
+	v.Mode = PublishChanges
+
+	feed := NewFeed(conn, NewPSClient(r.dial(t)), PublishChanges, changeChannel("@v"))
+	defer feed.Close()
+	r.subscribed(t, 1)
+
+	if err := v.Set("@v:b", "value", 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Set("@v:b", "Timestamp", 7); err == nil {
+		t.Error("wrote a property which is not editable")
+	}
+	if err := v.Set("@v:b", "Value", 1, 2); err == nil {
+		t.Error("wrote several values")
+	}
+	select {
+	case c := <-feed.C:
+		if c.Tag != "@v:b" || c.Prop != "value" {
+			t.Errorf("Unexpected change %s", c)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("change not published")
+	}
+	if s := r.get("@v:b:value"); s != "7" {
+		t.Errorf("Expected value 7 stored, got %q", s)
+	}
+	if r.get("@v:b:timestamp") == "" {
+		t.Error("timestamp not stored")
+	}
+}
+
+func TestVectorWatch(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	v := NewVector("v", conn, "@v:a", "@v:b")
+	if err := v.SetAll("Quality", QualityGood); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetAll("Value", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	feed := testFeed()
+	events, err := v.watch(feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(c *Change) *VectorEvent {
+		feed.C <- c
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(2 * time.Second):
+			t.Fatalf("no event for %s", c)
+		}
+		return nil
+	}
+
+	e := next(&Change{Tag: "@v:a", Prop: "value", Value: "4", Timestamp: 1})
+	if a := e.Aggregate; a.Min != 4 || a.Max != 10 || a.Sum != 14 {
+		t.Errorf("Unexpected aggregate %s", a)
+	}
+	e = next(&Change{Tag: "@v:b", Prop: "quality", Value: "0", Timestamp: 2})
+	if a := e.Aggregate; a.Good != 1 || !a.AnyBad || a.Min != 4 || a.Max != 4 {
+		t.Errorf("Unexpected aggregate %s", a)
+	}
+
+	// changes of other tags and props are skipped.
+	feed.C <- &Change{Tag: "@v:c", Prop: "value", Value: "1"}
+	feed.C <- &Change{Tag: "@v:a", Prop: "description", Value: "x"}
+	e = next(&Change{Tag: "@v:a", Prop: "value", Value: "5", Timestamp: 3})
+	if e.Change.Timestamp != 3 || e.Aggregate.Sum != 5 {
+		t.Errorf("Unexpected event %s", e)
+	}
+
+	feed.Close()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Error("event after the feed was closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("events not closed with the feed")
+	}
+}
+
+func TestVectorWatchDials(t *testing.T) {
+	r := newTestRedis(t)
+	defer r.Close()
+	conn := r.dial(t)
+	v := NewVector("v", conn, "@v:a", "@v:b")
+	v.Mode = PublishChanges
+	if err := v.SetAll("Quality", QualityGood); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.SetAll("Value", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := v.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.subscribed(t, 1)
+
+	if err := v.Set("@v:b", "Value", 6); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-w.C:
+		if e.Change.Tag != "@v:b" || e.Aggregate.Sum != 16 {
+			t.Errorf("Unexpected event %s", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event for the change")
+	}
+
+	w.Close()
+	select {
+	case _, ok := <-w.C:
+		if ok {
+			t.Error("event after the watch was closed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("events not closed with the watch")
+	}
+}